@@ -3,13 +3,17 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
+	"strconv"
 	"time"
 
 	"github.com/fatcat22/ssctrl/config"
+	"github.com/fatcat22/ssctrl/core"
 )
 
 type Handler interface {
@@ -22,6 +26,19 @@ type Handler interface {
 	ChangeCurrentServer(newSrvName string) error
 	UpdateServers(map[string]config.ServerConfig) error
 	RemoveServers(names []string) error
+	GetTunnels(server string) (config.TunnelConfig, error)
+	ChangeTunnels(server string, tunnels *config.TunnelConfig) error
+	GetUserRules() config.UserRules
+	AddUserRules(config.UserRules) error
+	RemoveUserRules(config.UserRules) error
+	GetBypass() []string
+	ChangeBypass([]string) error
+	ChangePACProfile(name string) error
+	UpdateGFWList() error
+	TestURL(rawURL string) (core.RouteResult, error)
+	GetSSStatus() core.SSStatus
+	GetFailOpenStatus() core.FailOpenEvent
+	GetSSLog() *core.SSLog
 	Autorun(bool) error
 
 	Exit()
@@ -36,11 +53,15 @@ type apiServer struct {
 
 	ctrlHandler Handler
 
-	getRoute  map[string]handleFunc
-	postRoute map[string]handleFunc
+	getRoute    map[string]handleFunc
+	postRoute   map[string]handleFunc
+	deleteRoute map[string]handleFunc
 
 	isStartup  bool
 	shutdownCh chan struct{}
+	// closingCh is closed before shutting down server,
+	// which stops the requests following logs.
+	closingCh chan struct{}
 }
 
 func NewAPIServer(port string, h Handler) (*apiServer, error) {
@@ -63,6 +84,7 @@ func (as *apiServer) Startup() error {
 
 	as.renewServer()
 	as.shutdownCh = make(chan struct{})
+	as.closingCh = make(chan struct{})
 
 	var resultErr error
 	go func() {
@@ -92,6 +114,7 @@ func (as *apiServer) Shutdown() error {
 		return nil
 	}
 
+	close(as.closingCh)
 	as.server.Shutdown(context.Background())
 
 	<-as.shutdownCh
@@ -108,6 +131,8 @@ func (as *apiServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		routeTable = as.getRoute
 	case "POST":
 		routeTable = as.postRoute
+	case "DELETE":
+		routeTable = as.deleteRoute
 	default:
 		w.Write([]byte(fmt.Sprintf("unsupport request '%s'", req.Method)))
 		w.WriteHeader(http.StatusBadRequest)
@@ -136,7 +161,14 @@ func (as *apiServer) renewServer() {
 
 func (as *apiServer) setRoute() {
 	as.getRoute = map[string]handleFunc{
-		"/config": as.handleGetConfig,
+		"/config":    as.handleGetConfig,
+		"/rules":     as.handleGetUserRules,
+		"/bypass":    as.handleGetBypass,
+		"/pac/test":  as.handleTestURL,
+		"/ss/status": as.handleGetSSStatus,
+		"/failOpen":  as.handleGetFailOpenStatus,
+		"/logs":      as.handleGetLogs,
+		"/tunnels":   as.handleGetTunnels,
 	}
 
 	as.postRoute = map[string]handleFunc{
@@ -151,6 +183,16 @@ func (as *apiServer) setRoute() {
 		"/updateServers": as.handleUpdateServers,
 		"/removeServers": as.handleRemoveServers,
 		"/autorun":       as.handleAutorun,
+		"/rules":         as.handleAddUserRules,
+		"/updateGFWList": as.handleUpdateGFWList,
+		"/pacProfile":    as.handleChangePACProfile,
+		"/bypass":        as.handleChangeBypass,
+		"/tunnels":       as.handleChangeTunnels,
+	}
+
+	as.deleteRoute = map[string]handleFunc{
+		"/rules":   as.handleRemoveUserRules,
+		"/tunnels": as.handleRemoveTunnels,
 	}
 }
 
@@ -283,6 +325,249 @@ func (as *apiServer) handleRemoveServers(w http.ResponseWriter, req *http.Reques
 	)
 }
 
+func (as *apiServer) handleGetUserRules(w http.ResponseWriter, _ *http.Request) {
+	data, err := json.Marshal(as.ctrlHandler.GetUserRules())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("marshal rules error"))
+		return
+	}
+
+	w.Write(data)
+}
+
+func (as *apiServer) handleAddUserRules(w http.ResponseWriter, req *http.Request) {
+	as.handleReq(
+		w,
+		req,
+		true,
+		nil,
+		func(data string) error {
+			var rules config.UserRules
+			if err := json.Unmarshal([]byte(data), &rules); err != nil {
+				return err
+			}
+			return as.ctrlHandler.AddUserRules(rules)
+		},
+	)
+}
+
+func (as *apiServer) handleRemoveUserRules(w http.ResponseWriter, req *http.Request) {
+	as.handleReq(
+		w,
+		req,
+		true,
+		nil,
+		func(data string) error {
+			var rules config.UserRules
+			if err := json.Unmarshal([]byte(data), &rules); err != nil {
+				return err
+			}
+			return as.ctrlHandler.RemoveUserRules(rules)
+		},
+	)
+}
+
+// handleGetTunnels returns the default tunnels, or the tunnels used
+// by the server of argument 'server'.
+func (as *apiServer) handleGetTunnels(w http.ResponseWriter, req *http.Request) {
+	tunnels, err := as.ctrlHandler.GetTunnels(req.URL.Query().Get("server"))
+	if err != nil {
+		w.WriteHeader(http.StatusNotAcceptable)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	data, err := json.Marshal(tunnels)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("marshal tunnels error"))
+		return
+	}
+
+	w.Write(data)
+}
+
+func (as *apiServer) handleChangeTunnels(w http.ResponseWriter, req *http.Request) {
+	as.handleReq(
+		w,
+		req,
+		true,
+		nil,
+		func(data string) error {
+			var tunnels config.TunnelConfig
+			if err := json.Unmarshal([]byte(data), &tunnels); err != nil {
+				return err
+			}
+			return as.ctrlHandler.ChangeTunnels(req.URL.Query().Get("server"), &tunnels)
+		},
+	)
+}
+
+// handleRemoveTunnels makes the server of argument 'server' use the default tunnels.
+func (as *apiServer) handleRemoveTunnels(w http.ResponseWriter, req *http.Request) {
+	as.handleReq(
+		w,
+		req,
+		false,
+		nil,
+		func(string) error {
+			server := req.URL.Query().Get("server")
+			if len(server) == 0 {
+				return errors.New("argument 'server' is empty")
+			}
+			return as.ctrlHandler.ChangeTunnels(server, nil)
+		},
+	)
+}
+
+func (as *apiServer) handleGetBypass(w http.ResponseWriter, _ *http.Request) {
+	data, err := json.Marshal(as.ctrlHandler.GetBypass())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("marshal bypass error"))
+		return
+	}
+
+	w.Write(data)
+}
+
+func (as *apiServer) handleChangeBypass(w http.ResponseWriter, req *http.Request) {
+	as.handleReq(
+		w,
+		req,
+		true,
+		nil,
+		func(data string) error {
+			var bypass []string
+			if err := json.Unmarshal([]byte(data), &bypass); err != nil {
+				return err
+			}
+			return as.ctrlHandler.ChangeBypass(bypass)
+		},
+	)
+}
+
+func (as *apiServer) handleChangePACProfile(w http.ResponseWriter, req *http.Request) {
+	as.handleReq(
+		w,
+		req,
+		true,
+		nil,
+		as.ctrlHandler.ChangePACProfile,
+	)
+}
+
+func (as *apiServer) handleGetSSStatus(w http.ResponseWriter, _ *http.Request) {
+	data, err := json.Marshal(as.ctrlHandler.GetSSStatus())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("marshal ss status error"))
+		return
+	}
+
+	w.Write(data)
+}
+
+func (as *apiServer) handleGetFailOpenStatus(w http.ResponseWriter, _ *http.Request) {
+	data, err := json.Marshal(as.ctrlHandler.GetFailOpenStatus())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("marshal fail-open status error"))
+		return
+	}
+
+	w.Write(data)
+}
+
+// handleGetLogs writes the latest lines of shadowsocks log, the number of
+// lines is limited by argument 'lines'. With 'follow=1', new lines are
+// written until the client closes the connection.
+func (as *apiServer) handleGetLogs(w http.ResponseWriter, req *http.Request) {
+	n := 0
+	if s := req.URL.Query().Get("lines"); len(s) != 0 {
+		var err error
+		if n, err = strconv.Atoi(s); err != nil || n < 0 {
+			w.WriteHeader(http.StatusNotAcceptable)
+			w.Write([]byte(fmt.Sprintf("invalid argument 'lines': '%s'", s)))
+			return
+		}
+	}
+
+	ssLog := as.ctrlHandler.GetSSLog()
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if req.URL.Query().Get("follow") != "1" {
+		for _, line := range ssLog.Lines(n) {
+			fmt.Fprintln(w, line)
+		}
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("streaming is not supported"))
+		return
+	}
+	lines, ch, cancel := ssLog.Follow(n)
+	defer cancel()
+	for _, line := range lines {
+		fmt.Fprintln(w, line)
+	}
+	flusher.Flush()
+
+	for {
+		select {
+		case line := <-ch:
+			fmt.Fprintln(w, line)
+			flusher.Flush()
+		case <-req.Context().Done():
+			return
+		case <-as.closingCh:
+			return
+		}
+	}
+}
+
+func (as *apiServer) handleTestURL(w http.ResponseWriter, req *http.Request) {
+	rawURL := req.URL.Query().Get("url")
+	if len(rawURL) == 0 {
+		w.WriteHeader(http.StatusNotAcceptable)
+		w.Write([]byte("argument 'url' is empty"))
+		return
+	}
+	if u, err := url.Parse(rawURL); err != nil || len(u.Scheme) == 0 || len(u.Hostname()) == 0 {
+		w.WriteHeader(http.StatusNotAcceptable)
+		w.Write([]byte(fmt.Sprintf("invalid url '%s'", rawURL)))
+		return
+	}
+
+	result, err := as.ctrlHandler.TestURL(rawURL)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("marshal result error"))
+		return
+	}
+	w.Write(data)
+}
+
+func (as *apiServer) handleUpdateGFWList(w http.ResponseWriter, _ *http.Request) {
+	as.handleReq(
+		w,
+		nil,
+		false,
+		nil,
+		func(string) error { return as.ctrlHandler.UpdateGFWList() },
+	)
+}
+
 func (as *apiServer) handleAutorun(w http.ResponseWriter, req *http.Request) {
 	const enableArg = "enable"
 	const disableArg = "disable"
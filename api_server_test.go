@@ -1,15 +1,19 @@
 package main
 
 import (
+	"bufio"
 	"encoding/json"
 	"errors"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/fatcat22/ssctrl/config"
+	"github.com/fatcat22/ssctrl/core"
 )
 
 type handlerMock struct {
@@ -22,7 +26,15 @@ type handlerMock struct {
 	apiPort        string
 	currentSrvName string
 	servers        map[string]config.ServerConfig
+	userRules      config.UserRules
+	bypass         []string
+	tunnels        map[string]config.TunnelConfig
 	autorun        string
+	gfwListUpdated bool
+	pacProfile     string
+	ssStatus       core.SSStatus
+	failOpen       core.FailOpenEvent
+	ssLog          *core.SSLog
 
 	enableProxy         func() error
 	disableProxy        func() error
@@ -33,6 +45,13 @@ type handlerMock struct {
 	changeCurrentServer func(string) error
 	updateServers       func(map[string]config.ServerConfig) error
 	removeServers       func([]string) error
+	addUserRules        func(config.UserRules) error
+	removeUserRules     func(config.UserRules) error
+	changeBypass        func([]string) error
+	changeTunnels       func(string, *config.TunnelConfig) error
+	changePACProfile    func(string) error
+	updateGFWList       func() error
+	testURL             func(string) (core.RouteResult, error)
 	autorunFunc         func(bool) error
 	exitFunc            func()
 	marshalConfig       func(func(v interface{}) ([]byte, error)) ([]byte, error)
@@ -127,6 +146,105 @@ func (h *handlerMock) RemoveServers(names []string) error {
 	return nil
 }
 
+func (h *handlerMock) GetUserRules() config.UserRules {
+	return h.userRules
+}
+
+func (h *handlerMock) AddUserRules(rules config.UserRules) error {
+	if h.addUserRules != nil {
+		return h.addUserRules(rules)
+	}
+
+	h.userRules = h.userRules.Merge(rules)
+	return nil
+}
+
+func (h *handlerMock) RemoveUserRules(rules config.UserRules) error {
+	if h.removeUserRules != nil {
+		return h.removeUserRules(rules)
+	}
+
+	h.userRules = h.userRules.Remove(rules)
+	return nil
+}
+
+func (h *handlerMock) GetBypass() []string {
+	return h.bypass
+}
+
+func (h *handlerMock) ChangeBypass(bypass []string) error {
+	if h.changeBypass != nil {
+		return h.changeBypass(bypass)
+	}
+
+	h.bypass = bypass
+	return nil
+}
+
+func (h *handlerMock) GetTunnels(server string) (config.TunnelConfig, error) {
+	if tunnels, ok := h.tunnels[server]; ok {
+		return tunnels, nil
+	}
+	if _, ok := h.servers[server]; !ok && len(server) != 0 {
+		return config.TunnelConfig{}, errors.New("server not found")
+	}
+	return h.tunnels[""], nil
+}
+
+func (h *handlerMock) ChangeTunnels(server string, tunnels *config.TunnelConfig) error {
+	if h.changeTunnels != nil {
+		return h.changeTunnels(server, tunnels)
+	}
+
+	if h.tunnels == nil {
+		h.tunnels = make(map[string]config.TunnelConfig)
+	}
+	if tunnels == nil {
+		delete(h.tunnels, server)
+	} else {
+		h.tunnels[server] = *tunnels
+	}
+	return nil
+}
+
+func (h *handlerMock) ChangePACProfile(name string) error {
+	if h.changePACProfile != nil {
+		return h.changePACProfile(name)
+	}
+
+	h.pacProfile = name
+	return nil
+}
+
+func (h *handlerMock) UpdateGFWList() error {
+	if h.updateGFWList != nil {
+		return h.updateGFWList()
+	}
+
+	h.gfwListUpdated = true
+	return nil
+}
+
+func (h *handlerMock) TestURL(rawURL string) (core.RouteResult, error) {
+	if h.testURL != nil {
+		return h.testURL(rawURL)
+	}
+
+	return core.RouteResult{URL: rawURL}, nil
+}
+
+func (h *handlerMock) GetSSStatus() core.SSStatus {
+	return h.ssStatus
+}
+
+func (h *handlerMock) GetFailOpenStatus() core.FailOpenEvent {
+	return h.failOpen
+}
+
+func (h *handlerMock) GetSSLog() *core.SSLog {
+	return h.ssLog
+}
+
 func (h *handlerMock) Autorun(enable bool) error {
 	if h.autorunFunc != nil {
 		return h.autorunFunc(enable)
@@ -309,6 +427,28 @@ func TestChangeModeSuccess(t *testing.T) {
 		},
 		t,
 	)
+
+	testPostSuccess(
+		"mode",
+		"direct",
+		func(h *handlerMock) {
+			if h.mode != "direct" {
+				t.Errorf("expect mode %s but got %s", "direct", h.mode)
+			}
+		},
+		t,
+	)
+
+	testPostSuccess(
+		"mode",
+		"rule",
+		func(h *handlerMock) {
+			if h.mode != "rule" {
+				t.Errorf("expect mode %s but got %s", "rule", h.mode)
+			}
+		},
+		t,
+	)
 }
 
 func TestChangeModeFailed(t *testing.T) {
@@ -502,9 +642,11 @@ func TestUpdateServersSuccess(t *testing.T) {
 			Password: "srv1pwdxm!",
 		},
 		"srvName2": config.ServerConfig{
-			Address:  "81.82.83.84",
-			Port:     "8484",
-			Password: "srv2pwdxm@",
+			Address:    "81.82.83.84",
+			Port:       "8484",
+			Password:   "srv2pwdxm@",
+			Plugin:     "v2ray-plugin",
+			PluginOpts: "tls;host=www.example.com",
 		},
 	}
 
@@ -666,6 +808,594 @@ func TestRemoveServersFailed(t *testing.T) {
 	)
 }
 
+func TestGetUserRules(t *testing.T) {
+	expectRules := config.UserRules{
+		Proxy:  []string{"google.com", "8.8.8.0/24"},
+		Direct: []string{"baidu.com"},
+	}
+	h := &handlerMock{
+		userRules: expectRules,
+	}
+	const port = "2022"
+
+	srv, err := NewAPIServer(port, h)
+	if err != nil {
+		t.Fatalf("NewAPIServer error: %v", err)
+	}
+	srv.Startup()
+	defer srv.Shutdown()
+
+	resp, err := http.Get(getCtrlURL(port, "rules"))
+	if err != nil {
+		t.Fatalf("http get rules error: %v", err)
+	}
+	msg, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("get rules failed. status code: %d. error message: %s", resp.StatusCode, string(msg))
+	}
+
+	var rules config.UserRules
+	if err := json.Unmarshal(msg, &rules); err != nil {
+		t.Fatalf("unmarshal rules error: %v", err)
+	}
+	if !reflect.DeepEqual(rules, expectRules) {
+		t.Errorf("expect rules '%v' but got '%v'", expectRules, rules)
+	}
+}
+
+func TestAddUserRulesSuccess(t *testing.T) {
+	expectRules := config.UserRules{
+		Proxy:  []string{"google.com", "8.8.8.0/24"},
+		Direct: []string{"baidu.com"},
+	}
+
+	testPostSuccessWithSetFunc(
+		"rules",
+		`{"proxy":["8.8.8.0/24"],"direct":["baidu.com"]}`,
+		func(h *handlerMock) {
+			h.userRules = config.UserRules{Proxy: []string{"google.com"}}
+		},
+		func(h *handlerMock) {
+			if !reflect.DeepEqual(h.userRules, expectRules) {
+				t.Errorf("expect rules '%v' but got '%v'", expectRules, h.userRules)
+			}
+		},
+		t,
+	)
+}
+
+func TestAddUserRulesFailed(t *testing.T) {
+	errVal := errors.New("failed test for 'rules'")
+	testPostFailed(
+		"rules",
+		`{"proxy":["google.com"]}`,
+		func(h *handlerMock) error {
+			h.addUserRules = func(config.UserRules) error {
+				return errVal
+			}
+			return errVal
+		},
+		func(h *handlerMock) {
+			if len(h.userRules.Proxy) != 0 {
+				t.Errorf("expect proxy rules is empty but got '%v'", h.userRules.Proxy)
+			}
+		},
+		t,
+	)
+}
+
+func TestRemoveUserRules(t *testing.T) {
+	expectRules := config.UserRules{
+		Proxy: []string{"google.com"},
+	}
+	h := &handlerMock{
+		userRules: config.UserRules{
+			Proxy:  []string{"google.com", "8.8.8.0/24"},
+			Direct: []string{"baidu.com"},
+		},
+	}
+	const port = "2022"
+
+	srv, err := NewAPIServer(port, h)
+	if err != nil {
+		t.Fatalf("NewAPIServer error: %v", err)
+	}
+	srv.Startup()
+	defer srv.Shutdown()
+
+	req, err := http.NewRequest("DELETE", getCtrlURL(port, "rules"), strings.NewReader(`{"proxy":["8.8.8.0/24"],"direct":["baidu.com"]}`))
+	if err != nil {
+		t.Fatalf("create request error: %v", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("http delete rules error: %v", err)
+	}
+	msg, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("delete rules failed. status code: %d. error message: %s", resp.StatusCode, string(msg))
+	}
+
+	if !reflect.DeepEqual(h.userRules, expectRules) {
+		t.Errorf("expect rules '%v' but got '%v'", expectRules, h.userRules)
+	}
+}
+
+func TestGetBypass(t *testing.T) {
+	expectBypass := []string{"127.0.0.1", "10.0.0.0/8", "*.local"}
+	h := &handlerMock{
+		bypass: expectBypass,
+	}
+	const port = "2022"
+
+	srv, err := NewAPIServer(port, h)
+	if err != nil {
+		t.Fatalf("NewAPIServer error: %v", err)
+	}
+	srv.Startup()
+	defer srv.Shutdown()
+
+	resp, err := http.Get(getCtrlURL(port, "bypass"))
+	if err != nil {
+		t.Fatalf("http get bypass error: %v", err)
+	}
+	msg, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("get bypass failed. status code: %d. error message: %s", resp.StatusCode, string(msg))
+	}
+
+	var bypass []string
+	if err := json.Unmarshal(msg, &bypass); err != nil {
+		t.Fatalf("unmarshal bypass error: %v", err)
+	}
+	if !reflect.DeepEqual(bypass, expectBypass) {
+		t.Errorf("expect bypass '%v' but got '%v'", expectBypass, bypass)
+	}
+}
+
+func TestChangeBypassSuccess(t *testing.T) {
+	expectBypass := []string{"localhost", "172.16.0.0/12"}
+	testPostSuccess(
+		"bypass",
+		`["localhost","172.16.0.0/12"]`,
+		func(h *handlerMock) {
+			if !reflect.DeepEqual(h.bypass, expectBypass) {
+				t.Errorf("expect bypass '%v' but got '%v'", expectBypass, h.bypass)
+			}
+		},
+		t,
+	)
+}
+
+func TestChangeBypassFailed(t *testing.T) {
+	errVal := errors.New("failed test for 'bypass'")
+	testPostFailed(
+		"bypass",
+		`["localhost"]`,
+		func(h *handlerMock) error {
+			h.changeBypass = func([]string) error {
+				return errVal
+			}
+			return errVal
+		},
+		func(h *handlerMock) {
+			if len(h.bypass) != 0 {
+				t.Errorf("expect bypass is empty but got '%v'", h.bypass)
+			}
+		},
+		t,
+	)
+}
+
+func TestGetTunnels(t *testing.T) {
+	defaultTunnels := config.TunnelConfig{
+		UDPRelay:   true,
+		UDPTunnels: []string{":8053=8.8.8.8:53"},
+	}
+	srvTunnels := config.TunnelConfig{
+		TCPTunnels: []string{":84=8.8.8.8:80"},
+	}
+	h := &handlerMock{
+		servers: map[string]config.ServerConfig{
+			"srv1": config.ServerConfig{},
+			"srv2": config.ServerConfig{},
+		},
+		tunnels: map[string]config.TunnelConfig{
+			"":     defaultTunnels,
+			"srv2": srvTunnels,
+		},
+	}
+	const port = "2022"
+
+	srv, err := NewAPIServer(port, h)
+	if err != nil {
+		t.Fatalf("NewAPIServer error: %v", err)
+	}
+	srv.Startup()
+	defer srv.Shutdown()
+
+	getTunnels := func(server string) (int, config.TunnelConfig) {
+		resp, err := http.Get(getCtrlURL(port, "tunnels?server="+url.QueryEscape(server)))
+		if err != nil {
+			t.Fatalf("http get tunnels error: %v", err)
+		}
+		msg, _ := ioutil.ReadAll(resp.Body)
+		var tunnels config.TunnelConfig
+		if resp.StatusCode == http.StatusOK {
+			if err := json.Unmarshal(msg, &tunnels); err != nil {
+				t.Fatalf("unmarshal tunnels error: %v", err)
+			}
+		}
+		return resp.StatusCode, tunnels
+	}
+
+	if code, tunnels := getTunnels(""); code != http.StatusOK || !reflect.DeepEqual(tunnels, defaultTunnels) {
+		t.Errorf("expect default tunnels '%v' but got '%v'(status code %d)", defaultTunnels, tunnels, code)
+	}
+	if code, tunnels := getTunnels("srv1"); code != http.StatusOK || !reflect.DeepEqual(tunnels, defaultTunnels) {
+		t.Errorf("expect tunnels '%v' of srv1 but got '%v'(status code %d)", defaultTunnels, tunnels, code)
+	}
+	if code, tunnels := getTunnels("srv2"); code != http.StatusOK || !reflect.DeepEqual(tunnels, srvTunnels) {
+		t.Errorf("expect tunnels '%v' of srv2 but got '%v'(status code %d)", srvTunnels, tunnels, code)
+	}
+	if code, _ := getTunnels("notexist"); code != http.StatusNotAcceptable {
+		t.Errorf("expect status code %d for unknown server but got %d", http.StatusNotAcceptable, code)
+	}
+}
+
+func TestChangeTunnels(t *testing.T) {
+	expectTunnels := config.TunnelConfig{
+		UDPRelay:   true,
+		TCPTunnels: []string{":84=8.8.8.8:80"},
+	}
+	testPostSuccess(
+		"tunnels?server=srv1",
+		`{"udpRelay":true,"tcpTunnels":[":84=8.8.8.8:80"]}`,
+		func(h *handlerMock) {
+			if !reflect.DeepEqual(h.tunnels["srv1"], expectTunnels) {
+				t.Errorf("expect tunnels '%v' of srv1 but got '%v'", expectTunnels, h.tunnels["srv1"])
+			}
+		},
+		t,
+	)
+
+	errVal := errors.New("failed test for 'tunnels'")
+	testPostFailed(
+		"tunnels",
+		`{"udpRelay":false}`,
+		func(h *handlerMock) error {
+			h.changeTunnels = func(string, *config.TunnelConfig) error {
+				return errVal
+			}
+			return errVal
+		},
+		func(h *handlerMock) {
+			if len(h.tunnels) != 0 {
+				t.Errorf("expect tunnels is empty but got '%v'", h.tunnels)
+			}
+		},
+		t,
+	)
+}
+
+func TestRemoveTunnels(t *testing.T) {
+	h := &handlerMock{
+		tunnels: map[string]config.TunnelConfig{
+			"":     config.TunnelConfig{UDPRelay: true},
+			"srv1": config.TunnelConfig{},
+		},
+	}
+	const port = "2022"
+
+	srv, err := NewAPIServer(port, h)
+	if err != nil {
+		t.Fatalf("NewAPIServer error: %v", err)
+	}
+	srv.Startup()
+	defer srv.Shutdown()
+
+	removeTunnels := func(server string) int {
+		req, err := http.NewRequest("DELETE", getCtrlURL(port, "tunnels?server="+url.QueryEscape(server)), nil)
+		if err != nil {
+			t.Fatalf("create request error: %v", err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("http delete tunnels error: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := removeTunnels(""); code == http.StatusOK {
+		t.Errorf("expect removing default tunnels failed")
+	}
+	if code := removeTunnels("srv1"); code != http.StatusOK {
+		t.Errorf("remove tunnels of srv1 failed. status code: %d", code)
+	}
+	if _, ok := h.tunnels["srv1"]; ok {
+		t.Errorf("expect tunnels of srv1 removed but got '%v'", h.tunnels["srv1"])
+	}
+	if _, ok := h.tunnels[""]; !ok {
+		t.Errorf("expect default tunnels kept")
+	}
+}
+
+func TestChangePACProfileSuccess(t *testing.T) {
+	const expectName = "office"
+	testPostSuccess(
+		"pacProfile",
+		expectName,
+		func(h *handlerMock) {
+			if h.pacProfile != expectName {
+				t.Errorf("change pac profile failed: expect '%s' but got '%s'", expectName, h.pacProfile)
+			}
+		},
+		t,
+	)
+}
+
+func TestChangePACProfileFailed(t *testing.T) {
+	const expectName = "home"
+	errVal := errors.New("failed test for 'pacProfile'")
+	testPostFailed(
+		"pacProfile",
+		"office",
+		func(h *handlerMock) error {
+			h.pacProfile = expectName
+			h.changePACProfile = func(string) error {
+				return errVal
+			}
+			return errVal
+		},
+		func(h *handlerMock) {
+			if h.pacProfile != expectName {
+				t.Errorf("expect pac profile '%s' but got '%s'", expectName, h.pacProfile)
+			}
+		},
+		t,
+	)
+}
+
+func TestUpdateGFWListSuccess(t *testing.T) {
+	testPostSuccess(
+		"updateGFWList",
+		"",
+		func(h *handlerMock) {
+			if !h.gfwListUpdated {
+				t.Errorf("post updateGFWList success but gfwlist is not updated")
+			}
+		},
+		t,
+	)
+}
+
+func TestUpdateGFWListFailed(t *testing.T) {
+	errVal := errors.New("failed test for 'updateGFWList'")
+	testPostFailed(
+		"updateGFWList",
+		"",
+		func(h *handlerMock) error {
+			h.updateGFWList = func() error {
+				return errVal
+			}
+			return errVal
+		},
+		func(h *handlerMock) {
+			if h.gfwListUpdated {
+				t.Errorf("post updateGFWList failed but gfwlist is updated")
+			}
+		},
+		t,
+	)
+}
+
+func TestPACTestURL(t *testing.T) {
+	const testURL = "https://www.google.com/search?q=a"
+	expectResult := core.RouteResult{
+		URL:   testURL,
+		Host:  "www.google.com",
+		Route: core.RouteProxy,
+		Rule:  "||google.com",
+	}
+	h := &handlerMock{
+		testURL: func(rawURL string) (core.RouteResult, error) {
+			if rawURL != testURL {
+				return core.RouteResult{}, errors.New("unexpect url " + rawURL)
+			}
+			return expectResult, nil
+		},
+	}
+	const port = "2022"
+
+	srv, err := NewAPIServer(port, h)
+	if err != nil {
+		t.Fatalf("NewAPIServer error: %v", err)
+	}
+	srv.Startup()
+	defer srv.Shutdown()
+
+	resp, err := http.Get(getCtrlURL(port, "pac/test?url="+url.QueryEscape(testURL)))
+	if err != nil {
+		t.Fatalf("http get pac/test error: %v", err)
+	}
+	msg, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("get pac/test failed. status code: %d. error message: %s", resp.StatusCode, string(msg))
+	}
+
+	var result core.RouteResult
+	if err := json.Unmarshal(msg, &result); err != nil {
+		t.Fatalf("unmarshal result error: %v", err)
+	}
+	if result != expectResult {
+		t.Errorf("expect result '%v' but got '%v'", expectResult, result)
+	}
+
+	resp, err = http.Get(getCtrlURL(port, "pac/test"))
+	if err != nil {
+		t.Fatalf("http get pac/test error: %v", err)
+	}
+	if resp.StatusCode == http.StatusOK {
+		t.Errorf("get pac/test without url success, but we expect failed")
+	}
+
+	for _, invalidURL := range []string{"www.example.com", "http://", "http://%zz"} {
+		resp, err = http.Get(getCtrlURL(port, "pac/test?url="+url.QueryEscape(invalidURL)))
+		if err != nil {
+			t.Fatalf("http get pac/test error: %v", err)
+		}
+		if resp.StatusCode != http.StatusNotAcceptable {
+			t.Errorf("get pac/test with invalid url '%s': expect status code %d but got %d", invalidURL, http.StatusNotAcceptable, resp.StatusCode)
+		}
+	}
+}
+
+func TestGetSSStatus(t *testing.T) {
+	expectStatus := core.SSStatus{
+		State:        core.SSStateRestarting,
+		Restarts:     3,
+		LastExit:     "exit status 1",
+		LastExitTime: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+	h := &handlerMock{
+		ssStatus: expectStatus,
+	}
+	const port = "2022"
+
+	srv, err := NewAPIServer(port, h)
+	if err != nil {
+		t.Fatalf("NewAPIServer error: %v", err)
+	}
+	srv.Startup()
+	defer srv.Shutdown()
+
+	resp, err := http.Get(getCtrlURL(port, "ss/status"))
+	if err != nil {
+		t.Fatalf("http get ss status error: %v", err)
+	}
+	msg, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("get ss status failed. status code: %d. error message: %s", resp.StatusCode, string(msg))
+	}
+
+	var status core.SSStatus
+	if err := json.Unmarshal(msg, &status); err != nil {
+		t.Fatalf("unmarshal ss status error: %v", err)
+	}
+	if status.State != expectStatus.State || status.Restarts != expectStatus.Restarts ||
+		status.LastExit != expectStatus.LastExit || !status.LastExitTime.Equal(expectStatus.LastExitTime) {
+		t.Errorf("expect ss status '%+v' but got '%+v'", expectStatus, status)
+	}
+}
+
+func TestGetFailOpenStatus(t *testing.T) {
+	expectStatus := core.FailOpenEvent{
+		Active: true,
+		Reason: "server is unreachable",
+		Time:   time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+	h := &handlerMock{
+		failOpen: expectStatus,
+	}
+	const port = "2022"
+
+	srv, err := NewAPIServer(port, h)
+	if err != nil {
+		t.Fatalf("NewAPIServer error: %v", err)
+	}
+	srv.Startup()
+	defer srv.Shutdown()
+
+	resp, err := http.Get(getCtrlURL(port, "failOpen"))
+	if err != nil {
+		t.Fatalf("http get fail-open status error: %v", err)
+	}
+	msg, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("get fail-open status failed. status code: %d. error message: %s", resp.StatusCode, string(msg))
+	}
+
+	var status core.FailOpenEvent
+	if err := json.Unmarshal(msg, &status); err != nil {
+		t.Fatalf("unmarshal fail-open status error: %v", err)
+	}
+	if status.Active != expectStatus.Active || status.Reason != expectStatus.Reason || !status.Time.Equal(expectStatus.Time) {
+		t.Errorf("expect fail-open status '%+v' but got '%+v'", expectStatus, status)
+	}
+}
+
+func TestGetLogs(t *testing.T) {
+	h := &handlerMock{
+		ssLog: core.NewSSLog(""),
+	}
+	for _, line := range []string{"line1", "line2", "line3"} {
+		h.ssLog.WriteLine(line)
+	}
+	const port = "2022"
+
+	srv, err := NewAPIServer(port, h)
+	if err != nil {
+		t.Fatalf("NewAPIServer error: %v", err)
+	}
+	srv.Startup()
+	defer srv.Shutdown()
+
+	resp, err := http.Get(getCtrlURL(port, "logs?lines=2"))
+	if err != nil {
+		t.Fatalf("http get logs error: %v", err)
+	}
+	msg, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("get logs failed. status code: %d. error message: %s", resp.StatusCode, string(msg))
+	}
+	if string(msg) != "line2\nline3\n" {
+		t.Errorf("expect the latest 2 lines but got '%s'", msg)
+	}
+
+	resp, err = http.Get(getCtrlURL(port, "logs?lines=abc"))
+	if err != nil {
+		t.Fatalf("http get logs error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		t.Errorf("get logs with invalid lines success")
+	}
+
+	// follow
+	resp, err = http.Get(getCtrlURL(port, "logs?follow=1&lines=1"))
+	if err != nil {
+		t.Fatalf("http follow logs error: %v", err)
+	}
+	defer resp.Body.Close()
+	r := bufio.NewReader(resp.Body)
+	for _, expect := range []string{"line3", "line4", "line5"} {
+		if expect != "line3" {
+			h.ssLog.WriteLine(expect)
+		}
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("read followed logs error: %v", err)
+		}
+		if line != expect+"\n" {
+			t.Errorf("expect followed line '%s' but got '%s'", expect, line)
+		}
+	}
+
+	// shutting down server stops following
+	done := make(chan struct{})
+	go func() {
+		srv.Shutdown()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatalf("shutdown api server with following logs timeout")
+	}
+}
+
 func TestAutorunSuccess(t *testing.T) {
 	testPostSuccess(
 		"autorun",
@@ -0,0 +1,44 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// DefaultBypass are the hosts and networks which never use proxy by default.
+var DefaultBypass = []string{"127.0.0.1", "192.168.0.0/16", "10.0.0.0/8", "localhost"}
+
+// CheckBypassEntry checks an entry of the bypass list, which is an ip
+// address, an ip v4 CIDR, a domain name or a domain name starting with
+// "*." such as "*.local".
+func CheckBypassEntry(entry string) error {
+	if len(entry) == 0 {
+		return errors.New("bypass entry is empty")
+	}
+
+	if net.ParseIP(entry) != nil {
+		return nil
+	}
+	if strings.Contains(entry, "/") {
+		if err := CheckUserRule(entry); err != nil {
+			return fmt.Errorf("invalid bypass entry: %v", err)
+		}
+		return nil
+	}
+
+	if err := CheckUserRule(strings.TrimPrefix(entry, "*.")); err != nil {
+		return fmt.Errorf("invalid bypass entry: %v", err)
+	}
+	return nil
+}
+
+func CheckBypass(bypass []string) error {
+	for _, entry := range bypass {
+		if err := CheckBypassEntry(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -4,9 +4,11 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
 	"reflect"
 	"strings"
+	"time"
 
 	"github.com/fatcat22/ssctrl/common"
 	toml "github.com/pelletier/go-toml"
@@ -17,39 +19,126 @@ type ServerConfig struct {
 	Port     string `toml:"port" json:"port"`
 	Crypt    string `toml:"crypto,omitempty" json:"crypto"`
 	Password string `toml:"password" json:"password"`
+
+	// Plugin is the name of the SIP003 plugin such as "v2ray-plugin" or
+	// "obfs-local", which is looked up in PATH unless PluginPath is set.
+	Plugin     string `toml:"plugin,omitempty" json:"plugin,omitempty"`
+	PluginPath string `toml:"pluginPath,omitempty" json:"pluginPath,omitempty"`
+	PluginOpts string `toml:"pluginOpts,omitempty" json:"pluginOpts,omitempty"`
+
+	// Tunnels overrides the default tunnels for this server if it's not nil.
+	Tunnels *TunnelConfig `toml:"tunnels,omitempty" json:"tunnels,omitempty"`
 }
 
 type appConfig struct {
-	Enabled     bool   `toml:"enabled,omitempty" json:"enabled"`
-	Autorun     bool   `toml:"autorun,omitempty" json:"autorun"`
-	Mode        string `toml:"mode,omitempty" json:"mode"`
-	LocalPort   string `toml:"localPort,omitempty" json:"localPort"`
-	PACPort     string `toml:"pacPort,omitempty" json:"pacPort"`
-	APIPort     string `toml:"apiPort,omitempty" json:"apiPort"`
-	UsingServer string `toml:"usingServer,omitempty" json:"usingServer"`
+	Enabled      bool   `toml:"enabled" json:"enabled"`
+	Autorun      bool   `toml:"autorun,omitempty" json:"autorun"`
+	Mode         string `toml:"mode,omitempty" json:"mode"`
+	LocalPort    string `toml:"localPort,omitempty" json:"localPort"`
+	LocalAddress string `toml:"localAddress,omitempty" json:"localAddress"`
+	PACPort      string `toml:"pacPort,omitempty" json:"pacPort"`
+	APIPort      string `toml:"apiPort,omitempty" json:"apiPort"`
+	UsingServer  string `toml:"usingServer,omitempty" json:"usingServer"`
+
+	// HTTPPort is the port of http proxy, which is disabled if it's empty.
+	HTTPPort string `toml:"httpPort,omitempty" json:"httpPort"`
+	// RulePort is the port of the proxy OS proxy points to in ModeRule.
+	RulePort string `toml:"rulePort,omitempty" json:"rulePort"`
+
+	// AllowedClients are the networks of other devices which
+	// are allowed to get pac file. Loopback is always allowed.
+	AllowedClients []string `toml:"allowedClients,omitempty" json:"allowedClients"`
+
+	// Bypass are the hosts and networks which never use proxy,
+	// both in OS proxy settings and pac file.
+	Bypass []string `toml:"bypass" json:"bypass"`
 
 	Servers map[string]*ServerConfig `toml:"servers" json:"servers"`
+	Rules   UserRules                `toml:"rules" json:"rules"`
+	GFWList GFWListConfig            `toml:"gfwlist" json:"gfwlist"`
+	IPRules IPRulesConfig            `toml:"ipRules" json:"ipRules"`
+
+	FailOpen FailOpenConfig `toml:"failOpen" json:"failOpen"`
+
+	// Tunnels are the tunnels of the ss process, which are used
+	// by the servers without their own ones.
+	Tunnels TunnelConfig `toml:"tunnels" json:"tunnels"`
+
+	// PACProfile is the name of the active pac profile,
+	// DefaultPACProfile is used if it's empty.
+	PACProfile  string                 `toml:"pacProfile,omitempty" json:"pacProfile"`
+	PACProfiles map[string]*PACProfile `toml:"pacProfiles,omitempty" json:"pacProfiles"`
+
+	// PACStrategy is PACStrategyBlacklist or PACStrategyWhitelist.
+	PACStrategy string `toml:"pacStrategy,omitempty" json:"pacStrategy"`
+	// WhitelistFile is the list of domains which go direct with
+	// PACStrategyWhitelist. The default one is used if it's empty.
+	WhitelistFile string `toml:"whitelistFile,omitempty" json:"whitelistFile"`
+
+	// PACTemplate is a text/template file rendered as the pac
+	// file instead of the default one.
+	PACTemplate string `toml:"pacTemplate,omitempty" json:"pacTemplate"`
+
+	// SSBackend is SSBackendExternal or SSBackendBuiltin.
+	SSBackend string `toml:"ssBackend,omitempty" json:"ssBackend"`
+
+	// DrainTimeout is a duration string such as "30s", which is how long
+	// the connections through the old server are kept after switching
+	// servers. DefaultDrainTimeout is used if it's empty.
+	DrainTimeout string `toml:"drainTimeout,omitempty" json:"drainTimeout"`
 }
 
 const (
-	ModePAC                      = "pac"
-	ModeGlobal                   = "global"
+	ModePAC    = "pac"
+	ModeGlobal = "global"
+	// ModeDirect clears OS proxy settings but keeps the local proxy running.
+	ModeDirect = "direct"
+	// ModeRule points OS proxy to a local proxy which routes every
+	// connection by the rules of pac file.
+	ModeRule                     = "rule"
 	Crypt_AEAD_AES_128_GCM       = "AEAD_AES_128_GCM"
 	Crypt_AEAD_AES_256_GCM       = "AEAD_AES_256_GCM"
 	Crypt_AEAD_CHACHA20_POLY1305 = "AEAD_CHACHA20_POLY1305"
 
-	DefaultCrypt     = Crypt_AEAD_CHACHA20_POLY1305
-	defaultEnabled   = true
-	defaultMode      = ModePAC
-	defaultLocalPort = "1080"
-	defaultPACPort   = "1082"
-	defaultAPIPort   = "1083"
+	// PACStrategyBlacklist proxies the hosts in gfwlist, and
+	// PACStrategyWhitelist proxies the hosts not in whitelist.
+	PACStrategyBlacklist = "blacklist"
+	PACStrategyWhitelist = "whitelist"
+
+	// SSBackendExternal runs the shadowsocks client by the go-shadowsocks2
+	// executable, and SSBackendBuiltin runs it in ssctrl process.
+	SSBackendExternal = "external"
+	SSBackendBuiltin  = "builtin"
+
+	DefaultCrypt       = Crypt_AEAD_CHACHA20_POLY1305
+	defaultEnabled     = true
+	defaultMode        = ModePAC
+	defaultLocalPort   = "1080"
+	defaultLocalAddr   = "127.0.0.1"
+	defaultPACPort     = "1082"
+	defaultAPIPort     = "1083"
+	defaultRulePort    = "1085"
+	defaultUDPRelay    = true
+	defaultPACStrategy = PACStrategyBlacklist
+	defaultSSBackend   = SSBackendExternal
+
+	DefaultDrainTimeout = 30 * time.Second
 )
 
 var (
 	modeValues map[string]struct{} = map[string]struct{}{
 		ModePAC:    struct{}{},
 		ModeGlobal: struct{}{},
+		ModeDirect: struct{}{},
+		ModeRule:   struct{}{},
+	}
+	pacStrategyValues map[string]struct{} = map[string]struct{}{
+		PACStrategyBlacklist: struct{}{},
+		PACStrategyWhitelist: struct{}{},
+	}
+	ssBackendValues map[string]struct{} = map[string]struct{}{
+		SSBackendExternal: struct{}{},
+		SSBackendBuiltin:  struct{}{},
 	}
 	cryptoValues map[string]struct{} = map[string]struct{}{
 		Crypt_AEAD_AES_128_GCM:       struct{}{},
@@ -59,11 +148,21 @@ var (
 )
 
 var defaultCfg = appConfig{
-	Enabled:   false,
-	Mode:      defaultMode,
-	LocalPort: defaultLocalPort,
-	PACPort:   defaultPACPort,
-	APIPort:   defaultAPIPort,
+	Enabled:      defaultEnabled,
+	Mode:         defaultMode,
+	LocalPort:    defaultLocalPort,
+	LocalAddress: defaultLocalAddr,
+	PACPort:      defaultPACPort,
+	APIPort:      defaultAPIPort,
+	RulePort:     defaultRulePort,
+	Bypass:       DefaultBypass,
+	PACStrategy:  defaultPACStrategy,
+	SSBackend:    defaultSSBackend,
+	Tunnels: TunnelConfig{
+		UDPRelay:   defaultUDPRelay,
+		UDPTunnels: []string{":8053=8.8.8.8:53", ":8054=8.8.4.4:53"},
+		TCPTunnels: []string{":8053=8.8.8.8:53", ":84=8.8.4.4:53"},
+	},
 
 	Servers: make(map[string]*ServerConfig),
 }
@@ -82,6 +181,16 @@ func IsValidMode(m string) bool {
 	return ok
 }
 
+func IsValidPACStrategy(s string) bool {
+	_, ok := pacStrategyValues[s]
+	return ok
+}
+
+func IsValidSSBackend(b string) bool {
+	_, ok := ssBackendValues[b]
+	return ok
+}
+
 func IsValidCryptoMethod(cm string) bool {
 	_, ok := cryptoValues[cm]
 	return ok
@@ -171,6 +280,17 @@ func (ac *AppConfig) CheckServerConfig(srv ServerConfig) error {
 			return fmt.Errorf("invalid crypto method '%s'", srv.Crypt)
 		}
 	}
+	if err := CheckServerPlugin(srv); err != nil {
+		return err
+	}
+	if len(srv.Plugin) != 0 && ac.GetSSBackend() == SSBackendBuiltin {
+		return fmt.Errorf("plugin '%s' is not supported by the builtin ss backend", srv.Plugin)
+	}
+	if srv.Tunnels != nil {
+		if err := ac.checkTunnels("server", *srv.Tunnels); err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
@@ -187,6 +307,10 @@ func (ac *AppConfig) UpdateServer(name string, srv ServerConfig) error {
 	if srv.Crypt == "" {
 		srv.Crypt = DefaultCrypt
 	}
+	if srv.Tunnels != nil {
+		tunnels := srv.Tunnels.Copy()
+		srv.Tunnels = &tunnels
+	}
 	ac.c.Servers[name] = &srv
 
 	if ac.c.UsingServer == name {
@@ -300,6 +424,41 @@ func (ac *AppConfig) SetLocalPortMust(newPort string) {
 	}
 }
 
+func (ac *AppConfig) GetHTTPPort() string {
+	return ac.c.HTTPPort
+}
+
+func (ac *AppConfig) GetRulePort() string {
+	return ac.c.RulePort
+}
+
+func (ac *AppConfig) GetLocalAddress() string {
+	return ac.c.LocalAddress
+}
+
+func (ac *AppConfig) GetAllowedClients() []string {
+	return append([]string(nil), ac.c.AllowedClients...)
+}
+
+func (ac *AppConfig) GetBypass() []string {
+	return append([]string(nil), ac.c.Bypass...)
+}
+
+func (ac *AppConfig) SetBypass(bypass []string) error {
+	if err := CheckBypass(bypass); err != nil {
+		return err
+	}
+
+	ac.c.Bypass = append([]string(nil), bypass...)
+	return nil
+}
+
+func (ac *AppConfig) SetBypassMust(bypass []string) {
+	if err := ac.SetBypass(bypass); err != nil {
+		panic(fmt.Sprintf("SetBypass error: %v", err))
+	}
+}
+
 func (ac *AppConfig) GetPACPort() string {
 	return ac.c.PACPort
 }
@@ -323,6 +482,159 @@ func (ac *AppConfig) SetPACPortMust(newPort string) {
 	}
 }
 
+// GetUserRules returns the user rules of the active pac profile.
+func (ac *AppConfig) GetUserRules() UserRules {
+	return ac.currentUserRules().Copy()
+}
+
+// SetUserRules changes the user rules of the active pac profile.
+func (ac *AppConfig) SetUserRules(rules UserRules) error {
+	if err := CheckUserRules(rules); err != nil {
+		return err
+	}
+
+	*ac.currentUserRules() = rules.Copy()
+	return nil
+}
+
+func (ac *AppConfig) SetUserRulesMust(rules UserRules) {
+	if err := ac.SetUserRules(rules); err != nil {
+		panic(fmt.Sprintf("SetUserRules error: %v", err))
+	}
+}
+
+func (ac *AppConfig) GetGFWListConfig() GFWListConfig {
+	return ac.c.GFWList
+}
+
+// GetTunnels returns the default tunnels of servers.
+func (ac *AppConfig) GetTunnels() TunnelConfig {
+	return ac.c.Tunnels.Copy()
+}
+
+// GetServerTunnels returns the tunnels used by the server srvName.
+func (ac *AppConfig) GetServerTunnels(srvName string) (TunnelConfig, error) {
+	srv, ok := ac.c.Servers[srvName]
+	if !ok {
+		return TunnelConfig{}, fmt.Errorf("unknown server name '%s'", srvName)
+	}
+
+	if srv.Tunnels != nil {
+		return srv.Tunnels.Copy(), nil
+	}
+	return ac.GetTunnels(), nil
+}
+
+// CheckTunnels checks the tunnels, and their ports are not used by ssctrl.
+func (ac *AppConfig) CheckTunnels(tunnels TunnelConfig) error {
+	return ac.checkTunnels("default", tunnels)
+}
+
+func (ac *AppConfig) SetTunnels(tunnels TunnelConfig) error {
+	if err := ac.CheckTunnels(tunnels); err != nil {
+		return err
+	}
+
+	ac.c.Tunnels = tunnels.Copy()
+	return nil
+}
+
+func (ac *AppConfig) SetTunnelsMust(tunnels TunnelConfig) {
+	if err := ac.SetTunnels(tunnels); err != nil {
+		panic(fmt.Sprintf("SetTunnels error: %v", err))
+	}
+}
+
+func (ac *AppConfig) GetFailOpenConfig() FailOpenConfig {
+	return ac.c.FailOpen
+}
+
+func (ac *AppConfig) GetPACProfile(name string) (PACProfile, error) {
+	if name == DefaultPACProfile {
+		return PACProfile{Rules: ac.c.Rules.Copy()}, nil
+	}
+
+	profile, ok := ac.c.PACProfiles[name]
+	if !ok {
+		return PACProfile{}, fmt.Errorf("unknown pac profile '%s'", name)
+	}
+	return profile.Copy(), nil
+}
+
+func (ac *AppConfig) GetCurrentPACProfile() (string, PACProfile) {
+	name := ac.currentPACProfileName()
+	profile, err := ac.GetPACProfile(name)
+	if err != nil {
+		panic(fmt.Sprintf("GetPACProfile error: %v", err))
+	}
+	return name, profile
+}
+
+func (ac *AppConfig) SetCurrentPACProfile(name string) error {
+	if _, err := ac.GetPACProfile(name); err != nil {
+		return err
+	}
+
+	if name == DefaultPACProfile {
+		name = ""
+	}
+	ac.c.PACProfile = name
+	return nil
+}
+
+func (ac *AppConfig) SetCurrentPACProfileMust(name string) {
+	if err := ac.SetCurrentPACProfile(name); err != nil {
+		panic(fmt.Sprintf("SetCurrentPACProfile error: %v", err))
+	}
+}
+
+func (ac *AppConfig) GetIPRulesConfig() IPRulesConfig {
+	return ac.c.IPRules
+}
+
+func (ac *AppConfig) GetPACStrategy() string {
+	return ac.c.PACStrategy
+}
+
+// GetSSBackend returns the way to run the shadowsocks client,
+// SSBackendExternal if it's not set.
+func (ac *AppConfig) GetSSBackend() string {
+	if len(ac.c.SSBackend) == 0 {
+		return defaultSSBackend
+	}
+	return ac.c.SSBackend
+}
+
+// GetDrainTimeout returns how long the connections through the old
+// server are kept after switching servers.
+func (ac *AppConfig) GetDrainTimeout() time.Duration {
+	d, err := parseDrainTimeout(ac.c.DrainTimeout)
+	if err != nil {
+		return DefaultDrainTimeout
+	}
+	return d
+}
+
+func parseDrainTimeout(timeout string) (time.Duration, error) {
+	if len(timeout) == 0 {
+		return DefaultDrainTimeout, nil
+	}
+
+	d, err := time.ParseDuration(timeout)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid drain timeout '%s'", timeout)
+	}
+	return d, nil
+}
+
+func (ac *AppConfig) GetWhitelistFile() string {
+	return ac.c.WhitelistFile
+}
+
+func (ac *AppConfig) GetPACTemplate() string {
+	return ac.c.PACTemplate
+}
+
 func (ac *AppConfig) Marshal(marshal func(v interface{}) ([]byte, error)) ([]byte, error) {
 	return marshal(ac.c)
 }
@@ -335,19 +647,79 @@ func (ac *AppConfig) check() error {
 	if !IsValidMode(ac.c.Mode) {
 		return fmt.Errorf("invalid mode name '%s'", ac.c.Mode)
 	}
+	if !IsValidPACStrategy(ac.c.PACStrategy) {
+		return fmt.Errorf("invalid pac strategy '%s'", ac.c.PACStrategy)
+	}
+	if !IsValidSSBackend(ac.c.SSBackend) {
+		return fmt.Errorf("invalid ss backend '%s'", ac.c.SSBackend)
+	}
 	if !common.IsValidPort(ac.c.LocalPort) {
 		return fmt.Errorf("invalid local port '%s'", ac.c.LocalPort)
 	}
+	if err := common.CheckIPV4Format(ac.c.LocalAddress); err != nil {
+		return fmt.Errorf("invalid local address: %v", err)
+	}
+	if err := CheckAllowedClients(ac.c.AllowedClients); err != nil {
+		return err
+	}
+	if err := CheckBypass(ac.c.Bypass); err != nil {
+		return err
+	}
 	if !common.IsValidPort(ac.c.APIPort) {
 		return fmt.Errorf("invalid control port '%s'", ac.c.APIPort)
 	}
 	if !common.IsValidPort(ac.c.PACPort) {
 		return fmt.Errorf("invalid pac port '%s'", ac.c.PACPort)
 	}
+	if len(ac.c.HTTPPort) != 0 && !common.IsValidPort(ac.c.HTTPPort) {
+		return fmt.Errorf("invalid http proxy port '%s'", ac.c.HTTPPort)
+	}
+	if !common.IsValidPort(ac.c.RulePort) {
+		return fmt.Errorf("invalid rule proxy port '%s'", ac.c.RulePort)
+	}
 
 	if err := ac.checkRepeatPorts("", nil); err != nil {
 		return err
 	}
+	if err := CheckUserRules(ac.c.Rules); err != nil {
+		return err
+	}
+	if err := CheckGFWListConfig(ac.c.GFWList); err != nil {
+		return err
+	}
+	if err := CheckIPRulesConfig(ac.c.IPRules); err != nil {
+		return err
+	}
+	if err := CheckFailOpenConfig(ac.c.FailOpen); err != nil {
+		return err
+	}
+	if _, err := parseDrainTimeout(ac.c.DrainTimeout); err != nil {
+		return err
+	}
+	if err := ac.CheckTunnels(ac.c.Tunnels); err != nil {
+		return err
+	}
+	if err := ac.checkPACProfiles(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// CheckAllowedClients checks every client is an ip v4 address or CIDR.
+func CheckAllowedClients(clients []string) error {
+	for _, c := range clients {
+		if strings.Contains(c, "/") {
+			ip, _, err := net.ParseCIDR(c)
+			if err != nil || ip.To4() == nil {
+				return fmt.Errorf("invalid allowed client network '%s'", c)
+			}
+			continue
+		}
+		if err := common.CheckIPV4Format(c); err != nil {
+			return fmt.Errorf("invalid allowed client: %v", err)
+		}
+	}
 
 	return nil
 }
@@ -378,6 +750,33 @@ func (ac *AppConfig) checkServers() error {
 	return nil
 }
 
+func (ac *AppConfig) checkPACProfiles() error {
+	for name, profile := range ac.c.PACProfiles {
+		if err := CheckPACProfile(name, *profile); err != nil {
+			return err
+		}
+	}
+
+	if _, err := ac.GetPACProfile(ac.currentPACProfileName()); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (ac *AppConfig) currentPACProfileName() string {
+	if len(ac.c.PACProfile) == 0 {
+		return DefaultPACProfile
+	}
+	return ac.c.PACProfile
+}
+
+func (ac *AppConfig) currentUserRules() *UserRules {
+	if profile, ok := ac.c.PACProfiles[ac.c.PACProfile]; ok {
+		return &profile.Rules
+	}
+	return &ac.c.Rules
+}
+
 func (ac *AppConfig) checkPort(port string, except *string) error {
 	if !common.IsValidPort(port) {
 		return fmt.Errorf("invalid port value '%s'", port)
@@ -387,7 +786,65 @@ func (ac *AppConfig) checkPort(port string, except *string) error {
 }
 
 func (ac *AppConfig) checkRepeatPorts(port string, except *string) error {
-	portMap := make(map[string]string, 3)
+	portMap, err := ac.usedPorts(except)
+	if err != nil {
+		return err
+	}
+
+	if repName, ok := portMap[port]; ok {
+		return fmt.Errorf("port '%s' repeat with %s", port, repName)
+	}
+
+	// tunnels of different servers are not checked with each other,
+	// because only the ones of the current server are running.
+	if err := checkTunnelPorts("default", ac.c.Tunnels, portMap, port); err != nil {
+		return err
+	}
+	for name, srv := range ac.c.Servers {
+		if srv.Tunnels == nil {
+			continue
+		}
+		if err := checkTunnelPorts(fmt.Sprintf("server '%s'", name), *srv.Tunnels, portMap, port); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkTunnels checks the tunnels of owner, and their ports are not used by ssctrl.
+func (ac *AppConfig) checkTunnels(owner string, tunnels TunnelConfig) error {
+	if err := CheckTunnelConfig(tunnels); err != nil {
+		return err
+	}
+
+	portMap, err := ac.usedPorts(nil)
+	if err != nil {
+		return err
+	}
+	return checkTunnelPorts(owner, tunnels, portMap, "")
+}
+
+// checkTunnelPorts checks tcp tunnels do not listen on the ports of
+// portMap or port. Udp tunnels are not checked, because ssctrl listens
+// on tcp only, and the udp relay listens on a random port for every udp
+// association instead of the local port.
+func checkTunnelPorts(owner string, tunnels TunnelConfig, portMap map[string]string, port string) error {
+	for _, t := range tunnels.TCPTunnels {
+		p := tunnelPort(t)
+		if repName, ok := portMap[p]; ok {
+			return fmt.Errorf("tcp tunnel port '%s' of %s is same as %s", p, owner, repName)
+		}
+		if p == port {
+			return fmt.Errorf("port '%s' repeat with tcp tunnel of %s", port, owner)
+		}
+	}
+	return nil
+}
+
+// usedPorts returns the ports listened by ssctrl except the one
+// pointed by except, and fails if some of them are repeated.
+func (ac *AppConfig) usedPorts(except *string) (map[string]string, error) {
+	portMap := make(map[string]string, 4)
 
 	addPortMap := func(p *string, name string) error {
 		if reflect.DeepEqual(p, except) {
@@ -401,19 +858,26 @@ func (ac *AppConfig) checkRepeatPorts(port string, except *string) error {
 	}
 
 	if err := addPortMap(&ac.c.APIPort, "control port"); err != nil {
-		return err
+		return nil, err
 	}
 	if err := addPortMap(&ac.c.LocalPort, "local port"); err != nil {
-		return err
+		return nil, err
 	}
 	if err := addPortMap(&ac.c.PACPort, "pac port"); err != nil {
-		return err
+		return nil, err
 	}
-
-	if repName, ok := portMap[port]; ok {
-		return fmt.Errorf("port '%s' repeat with %s", port, repName)
+	if len(ac.c.HTTPPort) != 0 {
+		if err := addPortMap(&ac.c.HTTPPort, "http proxy port"); err != nil {
+			return nil, err
+		}
 	}
-	return nil
+	if len(ac.c.RulePort) != 0 {
+		if err := addPortMap(&ac.c.RulePort, "rule proxy port"); err != nil {
+			return nil, err
+		}
+	}
+
+	return portMap, nil
 }
 
 func (ac *AppConfig) setServerDefault() {
@@ -1,10 +1,15 @@
 package config
 
 import (
+	"encoding/json"
 	"html/template"
 	"io/ioutil"
 	"os"
+	"reflect"
 	"testing"
+	"time"
+
+	toml "github.com/pelletier/go-toml"
 )
 
 type configData struct {
@@ -37,7 +42,7 @@ var cfgData = configData{
 	Mode:    "pac",
 
 	LocalPort:    "1081",
-	LocalAddress: "127.0.0.1",
+	LocalAddress: "0.0.0.0",
 
 	PACPort: "1082",
 	APIPort: "1083",
@@ -117,6 +122,9 @@ func TestLoadConfig(t *testing.T) {
 	if appCfg.GetLocalPort() != cfgData.LocalPort {
 		t.Errorf("unexpect local port: expect %s but got %s", cfgData.LocalPort, appCfg.GetLocalPort())
 	}
+	if appCfg.GetLocalAddress() != cfgData.LocalAddress {
+		t.Errorf("unexpect local address: expect %s but got %s", cfgData.LocalAddress, appCfg.GetLocalAddress())
+	}
 	if appCfg.GetPACPort() != cfgData.PACPort {
 		t.Errorf("unexpect pac port: expect %s but got %s", cfgData.PACPort, appCfg.GetPACPort())
 	}
@@ -201,12 +209,18 @@ func TestDefaultConfig(t *testing.T) {
 	if appCfg.GetLocalPort() != defaultLocalPort {
 		t.Errorf("unexpect default local port: expect %s but got %s", defaultLocalPort, appCfg.GetLocalPort())
 	}
+	if appCfg.GetLocalAddress() != defaultLocalAddr {
+		t.Errorf("unexpect default local address: expect %s but got %s", defaultLocalAddr, appCfg.GetLocalAddress())
+	}
 	if appCfg.GetPACPort() != defaultPACPort {
 		t.Errorf("unexpect default pac port: expect %s but got %s", defaultPACPort, appCfg.GetAPIPort())
 	}
 	if appCfg.GetAPIPort() != defaultAPIPort {
 		t.Errorf("unexpect default control port: expect %s but got %s", defaultAPIPort, appCfg.GetAPIPort())
 	}
+	if appCfg.GetRulePort() != defaultRulePort {
+		t.Errorf("unexpect default rule proxy port: expect %s but got %s", defaultRulePort, appCfg.GetRulePort())
+	}
 	srvName, srv := appCfg.GetCurrentServerConfig()
 	if srvName != cfgData.Server2Name {
 		t.Errorf("unexpect default current server name: expect %s but got %s", srvName, srvName)
@@ -224,3 +238,574 @@ func TestDefaultConfig(t *testing.T) {
 		t.Errorf("crtypt password of server '%s' error: expect %s but got %s", srvName, cfgData.Server2Password, srv.Password)
 	}
 }
+
+func TestCheckAllowedClients(t *testing.T) {
+	if err := CheckAllowedClients([]string{"192.168.1.0/24", "10.0.0.8"}); err != nil {
+		t.Errorf("check valid allowed clients error: %v", err)
+	}
+
+	invalidClients := [][]string{{"192.168.1.0/33"}, {"2001:db8::/32"}, {"example.com"}, {"10.0.0.256"}}
+	for _, c := range invalidClients {
+		if err := CheckAllowedClients(c); err == nil {
+			t.Errorf("check invalid allowed clients %v success", c)
+		}
+	}
+}
+
+func TestCheckIPRulesConfig(t *testing.T) {
+	validCfgs := []IPRulesConfig{
+		{},
+		{File: "chnroutes.txt", Route: IPRouteProxy, Order: IPRulesAfter},
+		{File: "chnroutes.txt", Route: IPRouteDirect, Order: IPRulesBefore},
+	}
+	for _, cfg := range validCfgs {
+		if err := CheckIPRulesConfig(cfg); err != nil {
+			t.Errorf("check valid ip rules config %v error: %v", cfg, err)
+		}
+	}
+
+	invalidCfgs := []IPRulesConfig{
+		{File: "chnroutes.txt", Route: "reject"},
+		{File: "chnroutes.txt", Order: "first"},
+	}
+	for _, cfg := range invalidCfgs {
+		if err := CheckIPRulesConfig(cfg); err == nil {
+			t.Errorf("check invalid ip rules config %v success", cfg)
+		}
+	}
+
+	var cfg IPRulesConfig
+	if cfg.IsEnabled() || cfg.GetRoute() != IPRouteDirect || !cfg.IsBeforeDomainRules() {
+		t.Errorf("unexpect default ip rules config")
+	}
+}
+
+func TestCheckFailOpenConfig(t *testing.T) {
+	validCfgs := []FailOpenConfig{
+		{},
+		{Enable: true, MaxFailures: 5, CheckInterval: "1m"},
+	}
+	for _, cfg := range validCfgs {
+		if err := CheckFailOpenConfig(cfg); err != nil {
+			t.Errorf("check valid fail-open config %v error: %v", cfg, err)
+		}
+	}
+
+	invalidCfgs := []FailOpenConfig{
+		{Enable: true, MaxFailures: -1},
+		{Enable: true, CheckInterval: "0"},
+		{Enable: true, CheckInterval: "often"},
+	}
+	for _, cfg := range invalidCfgs {
+		if err := CheckFailOpenConfig(cfg); err == nil {
+			t.Errorf("check invalid fail-open config %v success", cfg)
+		}
+	}
+
+	var cfg FailOpenConfig
+	if interval, _ := cfg.GetCheckInterval(); cfg.Enable || cfg.GetMaxFailures() != DefaultFailOpenMaxFailures || interval != DefaultFailOpenCheckInterval {
+		t.Errorf("unexpect default fail-open config")
+	}
+}
+
+func TestPACProfiles(t *testing.T) {
+	const cfgHead = `
+    [servers]
+        [servers.myserver]
+            address = "11.22.33.44"
+            port = "8088"
+            password = "1234abcd"
+
+    [rules]
+        proxy = ["google.com"]
+
+    [pacProfiles]
+        [pacProfiles.office]
+            file = "/path/to/office.txt"
+            [pacProfiles.office.rules]
+                direct = ["example.com"]
+    `
+	appCfg, err := loadConfigData(t, `pacProfile = "office"`+cfgHead)
+	if err != nil {
+		t.Fatalf("load config error: %v", err)
+	}
+	name, profile := appCfg.GetCurrentPACProfile()
+	if name != "office" || profile.File != "/path/to/office.txt" {
+		t.Errorf("unexpect current pac profile '%s': %v", name, profile)
+	}
+	if rules := appCfg.GetUserRules(); len(rules.Direct) != 1 || rules.Direct[0] != "example.com" {
+		t.Errorf("expect user rules of profile 'office' but got %v", rules)
+	}
+
+	if err := appCfg.SetCurrentPACProfile("home"); err == nil {
+		t.Errorf("set unknown pac profile success")
+	}
+	appCfg.SetCurrentPACProfileMust(DefaultPACProfile)
+	if name, profile := appCfg.GetCurrentPACProfile(); name != DefaultPACProfile || len(profile.File) != 0 {
+		t.Errorf("unexpect current pac profile '%s': %v", name, profile)
+	}
+	if rules := appCfg.GetUserRules(); len(rules.Proxy) != 1 || rules.Proxy[0] != "google.com" {
+		t.Errorf("expect top level user rules but got %v", rules)
+	}
+
+	if _, err := loadConfigData(t, `pacProfile = "home"`+cfgHead); err == nil {
+		t.Errorf("load config with unknown pac profile success")
+	}
+	if _, err := loadConfigData(t, cfgHead+`
+        [pacProfiles.default]
+            file = "/path/to/default.txt"
+    `); err == nil {
+		t.Errorf("load config with reserved pac profile name success")
+	}
+}
+
+func TestPACStrategy(t *testing.T) {
+	const servers = `
+    [servers]
+        [servers.myserver]
+            address = "11.22.33.44"
+            port = "8088"
+            password = "1234abcd"
+    `
+
+	appCfg, err := loadConfigData(t, servers)
+	if err != nil {
+		t.Fatalf("load config error: %v", err)
+	}
+	if appCfg.GetPACStrategy() != PACStrategyBlacklist {
+		t.Errorf("expect default pac strategy '%s' but got '%s'", PACStrategyBlacklist, appCfg.GetPACStrategy())
+	}
+
+	appCfg, err = loadConfigData(t, `
+    pacStrategy = "whitelist"
+    whitelistFile = "/path/to/whitelist.txt"
+    `+servers)
+	if err != nil {
+		t.Fatalf("load config error: %v", err)
+	}
+	if appCfg.GetPACStrategy() != PACStrategyWhitelist || appCfg.GetWhitelistFile() != "/path/to/whitelist.txt" {
+		t.Errorf("unexpect pac strategy '%s' with file '%s'", appCfg.GetPACStrategy(), appCfg.GetWhitelistFile())
+	}
+
+	if _, err := loadConfigData(t, `pacStrategy = "greylist"`+servers); err == nil {
+		t.Errorf("load config with invalid pac strategy success")
+	}
+}
+
+func TestHTTPPort(t *testing.T) {
+	const servers = `
+    [servers]
+        [servers.myserver]
+            address = "11.22.33.44"
+            port = "8088"
+            password = "1234abcd"
+    `
+
+	appCfg, err := loadConfigData(t, servers)
+	if err != nil {
+		t.Fatalf("load config error: %v", err)
+	}
+	if appCfg.GetHTTPPort() != "" {
+		t.Errorf("expect http proxy disabled by default but got port '%s'", appCfg.GetHTTPPort())
+	}
+
+	appCfg, err = loadConfigData(t, `httpPort = "1084"`+servers)
+	if err != nil {
+		t.Fatalf("load config error: %v", err)
+	}
+	if appCfg.GetHTTPPort() != "1084" {
+		t.Errorf("expect http port '1084' but got '%s'", appCfg.GetHTTPPort())
+	}
+
+	if _, err := loadConfigData(t, `httpPort = "70000"`+servers); err == nil {
+		t.Errorf("load config with invalid http port success")
+	}
+	if _, err := loadConfigData(t, `
+    pacPort = "1084"
+    httpPort = "1084"
+    `+servers); err == nil {
+		t.Errorf("load config with repeated http port success")
+	}
+}
+
+func TestRuleMode(t *testing.T) {
+	const servers = `
+    [servers]
+        [servers.myserver]
+            address = "11.22.33.44"
+            port = "8088"
+            password = "1234abcd"
+    `
+
+	appCfg, err := loadConfigData(t, `
+    mode = "rule"
+    rulePort = "1090"
+    `+servers)
+	if err != nil {
+		t.Fatalf("load config error: %v", err)
+	}
+	if appCfg.GetMode() != ModeRule || appCfg.GetRulePort() != "1090" {
+		t.Errorf("expect rule mode at port 1090 but got mode '%s' at port '%s'", appCfg.GetMode(), appCfg.GetRulePort())
+	}
+
+	if _, err := loadConfigData(t, `
+    localPort = "1090"
+    rulePort = "1090"
+    `+servers); err == nil {
+		t.Errorf("load config with repeated rule port success")
+	}
+}
+
+func TestBypass(t *testing.T) {
+	const servers = `
+    [servers]
+        [servers.myserver]
+            address = "11.22.33.44"
+            port = "8088"
+            password = "1234abcd"
+    `
+
+	appCfg, err := loadConfigData(t, servers)
+	if err != nil {
+		t.Fatalf("load config error: %v", err)
+	}
+	if !reflect.DeepEqual(appCfg.GetBypass(), DefaultBypass) {
+		t.Errorf("expect default bypass %v but got %v", DefaultBypass, appCfg.GetBypass())
+	}
+
+	appCfg, err = loadConfigData(t, `bypass = []`+servers)
+	if err != nil {
+		t.Fatalf("load config error: %v", err)
+	}
+	if len(appCfg.GetBypass()) != 0 {
+		t.Errorf("expect empty bypass but got %v", appCfg.GetBypass())
+	}
+
+	expect := []string{"*.local", "172.16.0.0/12", "::1"}
+	if err := appCfg.SetBypass(expect); err != nil {
+		t.Fatalf("set bypass error: %v", err)
+	}
+	if !reflect.DeepEqual(appCfg.GetBypass(), expect) {
+		t.Errorf("expect bypass %v but got %v", expect, appCfg.GetBypass())
+	}
+
+	for _, invalid := range []string{"", "http://intranet", "10.0.0.0/33", "*"} {
+		if err := appCfg.SetBypass([]string{invalid}); err == nil {
+			t.Errorf("set invalid bypass '%s' success", invalid)
+		}
+	}
+	if _, err := loadConfigData(t, `bypass = ["a b"]`+servers); err == nil {
+		t.Errorf("load config with invalid bypass success")
+	}
+}
+
+func loadConfigData(t *testing.T, data string) (*AppConfig, error) {
+	cfgFile, err := ioutil.TempFile("", "ssctrl")
+	if err != nil {
+		t.Fatalf("create config file failed: %v", err)
+	}
+	defer os.Remove(cfgFile.Name())
+	cfgFile.WriteString(data)
+	cfgFile.Close()
+	return LoadConfig(cfgFile.Name())
+}
+
+func TestTunnels(t *testing.T) {
+	validCfgs := []TunnelConfig{
+		{},
+		{UDPRelay: true, UDPTunnels: []string{":8053=8.8.8.8:53"}, TCPTunnels: []string{"127.0.0.1:8053=8.8.8.8:53"}},
+	}
+	for _, cfg := range validCfgs {
+		if err := CheckTunnelConfig(cfg); err != nil {
+			t.Errorf("check valid tunnel config %v error: %v", cfg, err)
+		}
+	}
+
+	invalidCfgs := []TunnelConfig{
+		{UDPTunnels: []string{"8053=8.8.8.8:53"}},
+		{UDPTunnels: []string{":8053"}},
+		{TCPTunnels: []string{":70000=8.8.8.8:53"}},
+		{TCPTunnels: []string{"localhost:84=8.8.8.8:80"}},
+		{TCPTunnels: []string{":84=:80"}},
+		{TCPTunnels: []string{":84=8.8.8.8:80", "127.0.0.1:84=8.8.4.4:80"}},
+	}
+	for _, cfg := range invalidCfgs {
+		if err := CheckTunnelConfig(cfg); err == nil {
+			t.Errorf("check invalid tunnel config %v success", cfg)
+		}
+	}
+
+	const servers = `
+    [servers]
+        [servers.myserver]
+            address = "11.22.33.44"
+            port = "8088"
+            password = "1234abcd"
+    `
+
+	appCfg, err := loadConfigData(t, servers)
+	if err != nil {
+		t.Fatalf("load config error: %v", err)
+	}
+	dnsTunnels := TunnelConfig{
+		UDPRelay:   true,
+		UDPTunnels: []string{":8053=8.8.8.8:53", ":8054=8.8.4.4:53"},
+		TCPTunnels: []string{":8053=8.8.8.8:53", ":84=8.8.4.4:53"},
+	}
+	if tunnels := appCfg.GetTunnels(); !reflect.DeepEqual(tunnels, dnsTunnels) {
+		t.Errorf("expect the DNS tunnels by default but got %v", tunnels)
+	}
+
+	appCfg, err = loadConfigData(t, `usingServer = "myserver"`+servers+`
+            [servers.myserver.tunnels]
+                tcpTunnels = [":84=8.8.8.8:80"]
+        [servers.other]
+            address = "55.66.77.88"
+            port = "8088"
+            password = "1234abcd"
+    [tunnels]
+        udpRelay = false
+        udpTunnels = [":8053=8.8.8.8:53"]
+        tcpTunnels = []
+    `)
+	if err != nil {
+		t.Fatalf("load config error: %v", err)
+	}
+	expectDefault := TunnelConfig{UDPTunnels: []string{":8053=8.8.8.8:53"}}
+	if tunnels, err := appCfg.GetServerTunnels("other"); err != nil || !reflect.DeepEqual(tunnels, expectDefault) {
+		t.Errorf("expect default tunnels %v but got %v(error: %v)", expectDefault, tunnels, err)
+	}
+	expectOverride := TunnelConfig{TCPTunnels: []string{":84=8.8.8.8:80"}}
+	if tunnels, err := appCfg.GetServerTunnels("myserver"); err != nil || !reflect.DeepEqual(tunnels, expectOverride) {
+		t.Errorf("expect server tunnels %v but got %v(error: %v)", expectOverride, tunnels, err)
+	}
+
+	conflicts := []string{
+		// tcp tunnel at pac port
+		`
+    [tunnels]
+        tcpTunnels = [":1082=8.8.8.8:80"]
+    `,
+		// tcp tunnel of a server at api port
+		`
+            [servers.myserver.tunnels]
+                tcpTunnels = [":1083=8.8.8.8:80"]
+    `,
+	}
+	for _, c := range conflicts {
+		if _, err := loadConfigData(t, servers+c); err == nil {
+			t.Errorf("load config with conflicting tunnel port success: %s", c)
+		}
+	}
+
+	// the udp relay doesn't listen on local port
+	if _, err := loadConfigData(t, servers+`
+    [tunnels]
+        udpRelay = true
+        udpTunnels = [":1080=8.8.8.8:53"]
+    `); err != nil {
+		t.Errorf("load config with udp tunnel at local port with udp relay error: %v", err)
+	}
+
+	if err := appCfg.SetLocalPort("84"); err == nil {
+		t.Errorf("set local port to the port of a tcp tunnel success")
+	}
+}
+
+func TestServerPlugin(t *testing.T) {
+	validCfgs := []ServerConfig{
+		{},
+		{Plugin: "v2ray-plugin"},
+		{Plugin: "obfs-local", PluginPath: "/usr/local/bin/obfs-local", PluginOpts: "obfs=http;obfs-host=www.example.com"},
+	}
+	for _, cfg := range validCfgs {
+		if err := CheckServerPlugin(cfg); err != nil {
+			t.Errorf("check valid plugin of server %v error: %v", cfg, err)
+		}
+	}
+
+	invalidCfgs := []ServerConfig{
+		{PluginOpts: "tls"},
+		{PluginPath: "/usr/local/bin/v2ray-plugin"},
+		{Plugin: "bin/v2ray-plugin"},
+		{Plugin: "v2ray plugin"},
+		{Plugin: "v2ray-plugin", PluginPath: "v2ray-plugin"},
+		{Plugin: "v2ray-plugin", PluginOpts: "tls\nhost=example.com"},
+	}
+	for _, cfg := range invalidCfgs {
+		if err := CheckServerPlugin(cfg); err == nil {
+			t.Errorf("check invalid plugin of server %v success", cfg)
+		}
+	}
+
+	appCfg, err := loadConfigData(t, `
+    [servers]
+        [servers.myserver]
+            address = "11.22.33.44"
+            port = "443"
+            password = "1234abcd"
+            plugin = "v2ray-plugin"
+            pluginPath = "/usr/local/bin/v2ray-plugin"
+            pluginOpts = "tls;host=www.example.com"
+    `)
+	if err != nil {
+		t.Fatalf("load config error: %v", err)
+	}
+	_, srv := appCfg.GetCurrentServerConfig()
+	if srv.Plugin != "v2ray-plugin" || srv.PluginPath != "/usr/local/bin/v2ray-plugin" || srv.PluginOpts != "tls;host=www.example.com" {
+		t.Errorf("unexpect plugin of server: %v", srv)
+	}
+
+	// round trip through toml
+	data, err := appCfg.Marshal(toml.Marshal)
+	if err != nil {
+		t.Fatalf("marshal config error: %v", err)
+	}
+	reloaded, err := loadConfigData(t, string(data))
+	if err != nil {
+		t.Fatalf("load marshaled config error: %v", err)
+	}
+	if _, reloadedSrv := reloaded.GetCurrentServerConfig(); reloadedSrv != srv {
+		t.Errorf("expect server %v after reloading but got %v", srv, reloadedSrv)
+	}
+
+	// round trip through json
+	data, err = json.Marshal(srv)
+	if err != nil {
+		t.Fatalf("marshal server error: %v", err)
+	}
+	var jsonSrv ServerConfig
+	if err := json.Unmarshal(data, &jsonSrv); err != nil {
+		t.Fatalf("unmarshal server error: %v", err)
+	}
+	if jsonSrv != srv {
+		t.Errorf("expect server %v after json round trip but got %v", srv, jsonSrv)
+	}
+
+	if _, err := loadConfigData(t, `
+    [servers]
+        [servers.myserver]
+            address = "11.22.33.44"
+            port = "443"
+            password = "1234abcd"
+            pluginOpts = "tls"
+    `); err == nil {
+		t.Errorf("load config with plugin options but no plugin success")
+	}
+}
+
+func TestSSBackend(t *testing.T) {
+	const servers = `
+    [servers]
+        [servers.myserver]
+            address = "11.22.33.44"
+            port = "8088"
+            password = "1234abcd"
+    `
+
+	appCfg, err := loadConfigData(t, servers)
+	if err != nil {
+		t.Fatalf("load config error: %v", err)
+	}
+	if appCfg.GetSSBackend() != SSBackendExternal {
+		t.Errorf("expect ss backend '%s' by default but got '%s'", SSBackendExternal, appCfg.GetSSBackend())
+	}
+	if NewConfig().GetSSBackend() != SSBackendExternal {
+		t.Errorf("expect ss backend '%s' of new config but got '%s'", SSBackendExternal, NewConfig().GetSSBackend())
+	}
+
+	appCfg, err = loadConfigData(t, `ssBackend = "builtin"`+servers)
+	if err != nil {
+		t.Fatalf("load config error: %v", err)
+	}
+	if appCfg.GetSSBackend() != SSBackendBuiltin {
+		t.Errorf("expect ss backend '%s' but got '%s'", SSBackendBuiltin, appCfg.GetSSBackend())
+	}
+	if err := appCfg.UpdateServer("other", ServerConfig{Address: "55.66.77.88", Port: "443", Plugin: "v2ray-plugin"}); err == nil {
+		t.Errorf("update server with plugin success with builtin ss backend")
+	}
+
+	if _, err := loadConfigData(t, `ssBackend = "internal"`+servers); err == nil {
+		t.Errorf("load config with invalid ss backend success")
+	}
+	if _, err := loadConfigData(t, `ssBackend = "builtin"`+servers+`
+            plugin = "v2ray-plugin"
+    `); err == nil {
+		t.Errorf("load config with plugin and builtin ss backend success")
+	}
+}
+
+func TestDrainTimeout(t *testing.T) {
+	const servers = `
+    [servers]
+        [servers.myserver]
+            address = "11.22.33.44"
+            port = "8088"
+            password = "1234abcd"
+    `
+
+	appCfg, err := loadConfigData(t, servers)
+	if err != nil {
+		t.Fatalf("load config error: %v", err)
+	}
+	if appCfg.GetDrainTimeout() != DefaultDrainTimeout {
+		t.Errorf("expect drain timeout %v by default but got %v", DefaultDrainTimeout, appCfg.GetDrainTimeout())
+	}
+
+	appCfg, err = loadConfigData(t, `drainTimeout = "5m"`+servers)
+	if err != nil {
+		t.Fatalf("load config error: %v", err)
+	}
+	if appCfg.GetDrainTimeout() != 5*time.Minute {
+		t.Errorf("expect drain timeout %v but got %v", 5*time.Minute, appCfg.GetDrainTimeout())
+	}
+
+	appCfg, err = loadConfigData(t, `drainTimeout = "0s"`+servers)
+	if err != nil {
+		t.Fatalf("load config error: %v", err)
+	}
+	if appCfg.GetDrainTimeout() != 0 {
+		t.Errorf("expect drain timeout 0 but got %v", appCfg.GetDrainTimeout())
+	}
+
+	for _, timeout := range []string{"-1s", "30"} {
+		if _, err := loadConfigData(t, `drainTimeout = "`+timeout+`"`+servers); err == nil {
+			t.Errorf("load config with invalid drain timeout '%s' success", timeout)
+		}
+	}
+}
+
+func TestRestoreDisabledConfig(t *testing.T) {
+	cfgFile, err := ioutil.TempFile("", "ssctrl")
+	if err != nil {
+		t.Fatalf("create config file failed: %v", err)
+	}
+	cfgPath := cfgFile.Name()
+	defer os.Remove(cfgPath)
+	cfgFile.WriteString(`
+    [servers]
+    [servers.myserver]
+        address = "11.22.33.44"
+        port = "8088"
+        password = "1234abcd"
+`)
+	cfgFile.Close()
+
+	appCfg, err := LoadConfig(cfgPath)
+	if err != nil {
+		t.Fatalf("load config error: %v", err)
+	}
+	appCfg.SetEnabled(false)
+	if err := RestoreConfig(appCfg, cfgPath); err != nil {
+		t.Fatalf("restore config error: %v", err)
+	}
+
+	// false is saved, or it's enabled by default after reloading
+	appCfg, err = LoadConfig(cfgPath)
+	if err != nil {
+		t.Fatalf("load restored config error: %v", err)
+	}
+	if appCfg.IsEnabled() {
+		t.Errorf("expect disabled after restoring config but got enabled")
+	}
+}
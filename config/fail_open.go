@@ -0,0 +1,55 @@
+package config
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	DefaultFailOpenMaxFailures   = 3
+	DefaultFailOpenCheckInterval = 10 * time.Second
+)
+
+// FailOpenConfig describes the fail-open policy, which clears OS proxy
+// settings when the proxy backend is down, so connections go direct
+// instead of failing, and re-applies them when the backend recovers.
+// The policy is disabled if Enable is false.
+type FailOpenConfig struct {
+	Enable bool `toml:"enable,omitempty" json:"enable"`
+	// MaxFailures is the number of continuous failed health checks
+	// before falling back to direct. DefaultFailOpenMaxFailures is
+	// used if it's 0.
+	MaxFailures int `toml:"maxFailures,omitempty" json:"maxFailures"`
+	// CheckInterval is a duration string such as "30s".
+	// DefaultFailOpenCheckInterval is used if it's empty.
+	CheckInterval string `toml:"checkInterval,omitempty" json:"checkInterval"`
+}
+
+func CheckFailOpenConfig(cfg FailOpenConfig) error {
+	if cfg.MaxFailures < 0 {
+		return fmt.Errorf("invalid fail-open max failures %d", cfg.MaxFailures)
+	}
+	if _, err := cfg.GetCheckInterval(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (cfg FailOpenConfig) GetMaxFailures() int {
+	if cfg.MaxFailures == 0 {
+		return DefaultFailOpenMaxFailures
+	}
+	return cfg.MaxFailures
+}
+
+func (cfg FailOpenConfig) GetCheckInterval() (time.Duration, error) {
+	if len(cfg.CheckInterval) == 0 {
+		return DefaultFailOpenCheckInterval, nil
+	}
+
+	d, err := time.ParseDuration(cfg.CheckInterval)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid fail-open check interval '%s'", cfg.CheckInterval)
+	}
+	return d, nil
+}
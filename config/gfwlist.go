@@ -0,0 +1,53 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultGFWListURL             = "https://raw.githubusercontent.com/gfwlist/gfwlist/master/gfwlist.txt"
+	DefaultGFWListRefreshInterval = 24 * time.Hour
+)
+
+// GFWListConfig describes where to get the gfwlist(the base64 encoded
+// AdBlock style rule list) and how often to refresh it.
+// The subscription is disabled if Source is empty.
+type GFWListConfig struct {
+	// Source is a http(s) URL or a local file path.
+	Source string `toml:"source,omitempty" json:"source"`
+	// RefreshInterval is a duration string such as "12h".
+	// DefaultGFWListRefreshInterval is used if it's empty,
+	// and "0" disables refreshing periodically.
+	RefreshInterval string `toml:"refreshInterval,omitempty" json:"refreshInterval"`
+	// ViaProxy makes downloading go through the local socks port.
+	ViaProxy bool `toml:"viaProxy,omitempty" json:"viaProxy"`
+}
+
+func CheckGFWListConfig(cfg GFWListConfig) error {
+	if _, err := cfg.GetRefreshInterval(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (cfg GFWListConfig) IsEnabled() bool {
+	return len(strings.TrimSpace(cfg.Source)) != 0
+}
+
+func (cfg GFWListConfig) IsRemote() bool {
+	return strings.HasPrefix(cfg.Source, "http://") || strings.HasPrefix(cfg.Source, "https://")
+}
+
+func (cfg GFWListConfig) GetRefreshInterval() (time.Duration, error) {
+	if len(cfg.RefreshInterval) == 0 {
+		return DefaultGFWListRefreshInterval, nil
+	}
+
+	d, err := time.ParseDuration(cfg.RefreshInterval)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid gfwlist refresh interval '%s'", cfg.RefreshInterval)
+	}
+	return d, nil
+}
@@ -0,0 +1,65 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	IPRouteProxy  = "proxy"
+	IPRouteDirect = "direct"
+
+	IPRulesBefore = "before"
+	IPRulesAfter  = "after"
+
+	defaultIPRoute = IPRouteDirect
+	defaultIPOrder = IPRulesBefore
+)
+
+// IPRulesConfig describes a list of ip v4 CIDRs(such as chnroutes) and
+// the route of the hosts resolved to them. IP rules are disabled if File is empty.
+type IPRulesConfig struct {
+	// File is a local file with one CIDR(or ip address) per line.
+	File string `toml:"file,omitempty" json:"file"`
+	// Route is IPRouteProxy or IPRouteDirect(the default).
+	Route string `toml:"route,omitempty" json:"route"`
+	// Order tells whether ip rules are checked before(the default) or
+	// after the domain rules of pac file. Checking before domain rules
+	// makes the browser resolve every host.
+	Order string `toml:"order,omitempty" json:"order"`
+}
+
+func CheckIPRulesConfig(cfg IPRulesConfig) error {
+	switch cfg.Route {
+	case "", IPRouteProxy, IPRouteDirect:
+	default:
+		return fmt.Errorf("invalid ip rules route '%s'", cfg.Route)
+	}
+
+	switch cfg.Order {
+	case "", IPRulesBefore, IPRulesAfter:
+	default:
+		return fmt.Errorf("invalid ip rules order '%s'", cfg.Order)
+	}
+
+	return nil
+}
+
+func (cfg IPRulesConfig) IsEnabled() bool {
+	return len(strings.TrimSpace(cfg.File)) != 0
+}
+
+func (cfg IPRulesConfig) GetRoute() string {
+	if len(cfg.Route) == 0 {
+		return defaultIPRoute
+	}
+	return cfg.Route
+}
+
+// IsBeforeDomainRules reports whether ip rules are checked before domain rules.
+func (cfg IPRulesConfig) IsBeforeDomainRules() bool {
+	if len(cfg.Order) == 0 {
+		return defaultIPOrder == IPRulesBefore
+	}
+	return cfg.Order == IPRulesBefore
+}
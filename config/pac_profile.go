@@ -0,0 +1,41 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+)
+
+// DefaultPACProfile is the name of the profile made up of the top level
+// rules and the default rule file(gfwlist). It can't be used in PACProfiles.
+const DefaultPACProfile = "default"
+
+// PACProfile is a named set of pac rules, such as the rules used at home
+// or at the office.
+type PACProfile struct {
+	// File is the rule file(pac file or AdBlock style rule list) of the
+	// profile. The default one(gfwlist) is used if it's empty.
+	File  string    `toml:"file,omitempty" json:"file"`
+	Rules UserRules `toml:"rules" json:"rules"`
+}
+
+func CheckPACProfile(name string, profile PACProfile) error {
+	if len(name) == 0 {
+		return errors.New("pac profile name is empty")
+	}
+	if name == DefaultPACProfile {
+		return fmt.Errorf("pac profile name '%s' is reserved", name)
+	}
+	if err := CheckUserRules(profile.Rules); err != nil {
+		return fmt.Errorf("invalid rules of pac profile '%s': %v", name, err)
+	}
+
+	return nil
+}
+
+// Copy returns a deep copy of p.
+func (p PACProfile) Copy() PACProfile {
+	return PACProfile{
+		File:  p.File,
+		Rules: p.Rules.Copy(),
+	}
+}
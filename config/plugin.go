@@ -0,0 +1,38 @@
+package config
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// CheckServerPlugin checks the SIP003 plugin fields of srv. PluginPath
+// and PluginOpts make no sense without Plugin.
+func CheckServerPlugin(srv ServerConfig) error {
+	if len(srv.Plugin) == 0 {
+		if len(srv.PluginPath) != 0 || len(srv.PluginOpts) != 0 {
+			return fmt.Errorf("plugin path or options are set without plugin name")
+		}
+		return nil
+	}
+
+	if strings.ContainsAny(srv.Plugin, " \t\r\n/\\") {
+		return fmt.Errorf("invalid plugin name '%s'", srv.Plugin)
+	}
+	if len(srv.PluginPath) != 0 && !filepath.IsAbs(srv.PluginPath) {
+		return fmt.Errorf("plugin path '%s' is not absolute", srv.PluginPath)
+	}
+	if strings.ContainsAny(srv.PluginOpts, "\r\n") {
+		return fmt.Errorf("invalid plugin options '%s'", srv.PluginOpts)
+	}
+	return nil
+}
+
+// PluginCommand returns the plugin executable of srv, which is PluginPath
+// if it's set, or Plugin looked up in PATH. It's empty if srv has no plugin.
+func (srv ServerConfig) PluginCommand() string {
+	if len(srv.PluginPath) != 0 {
+		return srv.PluginPath
+	}
+	return srv.Plugin
+}
@@ -0,0 +1,82 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/fatcat22/ssctrl/common"
+)
+
+// TunnelConfig describes the tunnels of the ss process and whether
+// the socks proxy relays udp.
+type TunnelConfig struct {
+	// UDPRelay enables udp relay of the socks proxy. It listens on a
+	// random port for every udp association instead of the local port.
+	UDPRelay bool `toml:"udpRelay" json:"udpRelay"`
+	// UDPTunnels and TCPTunnels forward a local port to a remote address
+	// through the server, such as ":8053=8.8.8.8:53" for a DNS tunnel.
+	UDPTunnels []string `toml:"udpTunnels" json:"udpTunnels"`
+	TCPTunnels []string `toml:"tcpTunnels" json:"tcpTunnels"`
+}
+
+// Copy returns a TunnelConfig not sharing tunnel lists with cfg.
+func (cfg TunnelConfig) Copy() TunnelConfig {
+	cfg.UDPTunnels = append([]string(nil), cfg.UDPTunnels...)
+	cfg.TCPTunnels = append([]string(nil), cfg.TCPTunnels...)
+	return cfg
+}
+
+// ParseTunnel parses a tunnel like "[laddr]:lport=raddr:rport",
+// and returns its local address and remote address.
+func ParseTunnel(tunnel string) (local, remote string, err error) {
+	parts := strings.Split(tunnel, "=")
+	if len(parts) != 2 {
+		return "", "", fmt.Errorf("invalid tunnel '%s'", tunnel)
+	}
+
+	laddr, lport, err := net.SplitHostPort(parts[0])
+	if err != nil || !common.IsValidPort(lport) {
+		return "", "", fmt.Errorf("invalid local address of tunnel '%s'", tunnel)
+	}
+	if len(laddr) != 0 && net.ParseIP(laddr) == nil {
+		return "", "", fmt.Errorf("invalid local address of tunnel '%s'", tunnel)
+	}
+	raddr, rport, err := net.SplitHostPort(parts[1])
+	if err != nil || len(raddr) == 0 || !common.IsValidPort(rport) {
+		return "", "", fmt.Errorf("invalid remote address of tunnel '%s'", tunnel)
+	}
+
+	return parts[0], parts[1], nil
+}
+
+// CheckTunnelConfig checks the format of every tunnel, and that no two
+// tunnels of the same protocol listen on the same port.
+func CheckTunnelConfig(cfg TunnelConfig) error {
+	check := func(tunnels []string, proto string) error {
+		ports := make(map[string]struct{}, len(tunnels))
+		for _, t := range tunnels {
+			if _, _, err := ParseTunnel(t); err != nil {
+				return err
+			}
+			port := tunnelPort(t)
+			if _, ok := ports[port]; ok {
+				return fmt.Errorf("%s tunnel port '%s' is repeated", proto, port)
+			}
+			ports[port] = struct{}{}
+		}
+		return nil
+	}
+
+	if err := check(cfg.UDPTunnels, "udp"); err != nil {
+		return err
+	}
+	return check(cfg.TCPTunnels, "tcp")
+}
+
+// tunnelPort returns the local port of a valid tunnel.
+func tunnelPort(tunnel string) string {
+	local, _, _ := ParseTunnel(tunnel)
+	_, port, _ := net.SplitHostPort(local)
+	return port
+}
@@ -0,0 +1,126 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// UserRules contains user-defined rules which are checked before
+// the rules of pac file. Every rule is a domain name(matches the domain
+// and all its sub domains) or an ip v4 CIDR such as "10.0.0.0/8".
+type UserRules struct {
+	Proxy  []string `toml:"proxy,omitempty" json:"proxy"`
+	Direct []string `toml:"direct,omitempty" json:"direct"`
+}
+
+func CheckUserRule(rule string) error {
+	if len(rule) == 0 {
+		return errors.New("rule is empty")
+	}
+
+	if strings.Contains(rule, "/") {
+		ip, _, err := net.ParseCIDR(rule)
+		if err != nil {
+			return fmt.Errorf("invalid CIDR rule '%s'", rule)
+		}
+		if ip.To4() == nil {
+			return fmt.Errorf("only ip v4 CIDR is supported: '%s'", rule)
+		}
+		return nil
+	}
+
+	for _, c := range rule {
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '.' || c == '_' {
+			continue
+		}
+		return fmt.Errorf("invalid character '%c' in domain rule '%s'", c, rule)
+	}
+	if strings.HasPrefix(rule, ".") || strings.HasSuffix(rule, ".") {
+		return fmt.Errorf("invalid domain rule '%s'", rule)
+	}
+
+	return nil
+}
+
+func CheckUserRules(rules UserRules) error {
+	for _, r := range rules.Proxy {
+		if err := CheckUserRule(r); err != nil {
+			return err
+		}
+	}
+	for _, r := range rules.Direct {
+		if err := CheckUserRule(r); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Copy returns a deep copy of r.
+func (r UserRules) Copy() UserRules {
+	return UserRules{
+		Proxy:  append([]string(nil), r.Proxy...),
+		Direct: append([]string(nil), r.Direct...),
+	}
+}
+
+// Merge returns the union of r and other. A rule added to one list
+// is removed from the other, so the same rule never exist in both lists.
+func (r UserRules) Merge(other UserRules) UserRules {
+	result := UserRules{
+		Proxy:  subtractRules(r.Proxy, other.Direct),
+		Direct: subtractRules(r.Direct, other.Proxy),
+	}
+
+	result.Proxy = unionRules(result.Proxy, other.Proxy)
+	result.Direct = unionRules(result.Direct, other.Direct)
+	return result
+}
+
+// Remove returns the rules of r which are not in other.
+func (r UserRules) Remove(other UserRules) UserRules {
+	return UserRules{
+		Proxy:  subtractRules(r.Proxy, other.Proxy),
+		Direct: subtractRules(r.Direct, other.Direct),
+	}
+}
+
+func unionRules(a, b []string) []string {
+	result := append([]string(nil), a...)
+	exist := make(map[string]struct{}, len(a))
+	for _, r := range a {
+		exist[normalizeRule(r)] = struct{}{}
+	}
+
+	for _, r := range b {
+		if _, ok := exist[normalizeRule(r)]; ok {
+			continue
+		}
+		exist[normalizeRule(r)] = struct{}{}
+		result = append(result, r)
+	}
+	return result
+}
+
+func subtractRules(a, b []string) []string {
+	remove := make(map[string]struct{}, len(b))
+	for _, r := range b {
+		remove[normalizeRule(r)] = struct{}{}
+	}
+
+	var result []string
+	for _, r := range a {
+		if _, ok := remove[normalizeRule(r)]; !ok {
+			result = append(result, r)
+		}
+	}
+	return result
+}
+
+func normalizeRule(r string) string {
+	return strings.ToLower(strings.TrimSpace(r))
+}
@@ -0,0 +1,59 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCheckUserRule(t *testing.T) {
+	validRules := []string{"google.com", "www.google.com", "localhost", "10.0.0.0/8", "192.168.1.1"}
+	for _, r := range validRules {
+		if err := CheckUserRule(r); err != nil {
+			t.Errorf("check valid rule '%s' error: %v", r, err)
+		}
+	}
+
+	invalidRules := []string{"", "http://google.com", "google.com/abc", "2001:db8::/32", ".google.com", "goo gle.com"}
+	for _, r := range invalidRules {
+		if err := CheckUserRule(r); err == nil {
+			t.Errorf("check invalid rule '%s' success", r)
+		}
+	}
+}
+
+func TestUserRulesMerge(t *testing.T) {
+	rules := UserRules{
+		Proxy:  []string{"google.com", "twitter.com"},
+		Direct: []string{"baidu.com"},
+	}
+	expect := UserRules{
+		Proxy:  []string{"google.com", "youtube.com"},
+		Direct: []string{"baidu.com", "twitter.com"},
+	}
+
+	result := rules.Merge(UserRules{
+		Proxy:  []string{"Google.com", "youtube.com"},
+		Direct: []string{"twitter.com"},
+	})
+	if !reflect.DeepEqual(result, expect) {
+		t.Errorf("expect merged rules %v but got %v", expect, result)
+	}
+}
+
+func TestUserRulesRemove(t *testing.T) {
+	rules := UserRules{
+		Proxy:  []string{"google.com", "twitter.com"},
+		Direct: []string{"baidu.com"},
+	}
+	expect := UserRules{
+		Proxy: []string{"google.com"},
+	}
+
+	result := rules.Remove(UserRules{
+		Proxy:  []string{"twitter.com"},
+		Direct: []string{"baidu.com", "qq.com"},
+	})
+	if !reflect.DeepEqual(result, expect) {
+		t.Errorf("expect rules %v but got %v", expect, result)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"sync"
 
 	"github.com/fatcat22/ssctrl/config"
+	"github.com/fatcat22/ssctrl/core"
 )
 
 type CoreInterface interface {
@@ -16,6 +17,15 @@ type CoreInterface interface {
 	ChangeLocalPort(newPort string) error
 	ChangePACPort(newPort string) error
 	ChangeServerConfig(newSrvCfg config.ServerConfig) error
+	ChangeDefaultTunnels(tunnels config.TunnelConfig) error
+	ChangeUserRules(rules config.UserRules) error
+	ChangeBypass(bypass []string) error
+	ChangePACProfile(profile config.PACProfile) error
+	UpdateGFWList() error
+	TestURL(rawURL string) (core.RouteResult, error)
+	SSStatus() core.SSStatus
+	FailOpenStatus() core.FailOpenEvent
+	SSLog() *core.SSLog
 }
 
 type Controler struct {
@@ -234,6 +244,158 @@ func (ctrl *Controler) RemoveServers(names []string) error {
 	return nil
 }
 
+// GetTunnels returns the default tunnels if server is empty,
+// or the tunnels used by server.
+func (ctrl *Controler) GetTunnels(server string) (config.TunnelConfig, error) {
+	ctrl.lock.Lock()
+	defer ctrl.lock.Unlock()
+
+	if len(server) == 0 {
+		return ctrl.cfg.GetTunnels(), nil
+	}
+	return ctrl.cfg.GetServerTunnels(server)
+}
+
+// ChangeTunnels changes the default tunnels if server is empty, or the
+// tunnels of server. server uses the default tunnels if tunnels is nil.
+func (ctrl *Controler) ChangeTunnels(server string, tunnels *config.TunnelConfig) error {
+	ctrl.lock.Lock()
+	defer ctrl.lock.Unlock()
+
+	if len(server) == 0 {
+		if tunnels == nil {
+			return errors.New("default tunnels can not be removed")
+		}
+		if err := ctrl.cfg.CheckTunnels(*tunnels); err != nil {
+			return err
+		}
+		if err := ctrl.core.ChangeDefaultTunnels(*tunnels); err != nil {
+			return err
+		}
+
+		ctrl.cfg.SetTunnelsMust(*tunnels)
+		return nil
+	}
+
+	srvCfg, err := ctrl.cfg.GetServerConfig(server)
+	if err != nil {
+		return err
+	}
+	srvCfg.Tunnels = tunnels
+	if err := ctrl.cfg.CheckServerConfig(srvCfg); err != nil {
+		return err
+	}
+	if current, _ := ctrl.cfg.GetCurrentServerConfig(); current == server {
+		if err := ctrl.core.ChangeServerConfig(srvCfg); err != nil {
+			return err
+		}
+	}
+
+	ctrl.cfg.UpdateServerMust(server, srvCfg)
+	return nil
+}
+
+func (ctrl *Controler) GetUserRules() config.UserRules {
+	ctrl.lock.Lock()
+	defer ctrl.lock.Unlock()
+
+	return ctrl.cfg.GetUserRules()
+}
+
+func (ctrl *Controler) AddUserRules(rules config.UserRules) error {
+	ctrl.lock.Lock()
+	defer ctrl.lock.Unlock()
+
+	if err := config.CheckUserRules(rules); err != nil {
+		return err
+	}
+
+	return ctrl.changeUserRules(ctrl.cfg.GetUserRules().Merge(rules))
+}
+
+func (ctrl *Controler) RemoveUserRules(rules config.UserRules) error {
+	ctrl.lock.Lock()
+	defer ctrl.lock.Unlock()
+
+	return ctrl.changeUserRules(ctrl.cfg.GetUserRules().Remove(rules))
+}
+
+func (ctrl *Controler) GetBypass() []string {
+	ctrl.lock.Lock()
+	defer ctrl.lock.Unlock()
+
+	return ctrl.cfg.GetBypass()
+}
+
+func (ctrl *Controler) ChangeBypass(bypass []string) error {
+	ctrl.lock.Lock()
+	defer ctrl.lock.Unlock()
+
+	if err := config.CheckBypass(bypass); err != nil {
+		return err
+	}
+
+	if err := ctrl.core.ChangeBypass(bypass); err != nil {
+		return err
+	}
+
+	ctrl.cfg.SetBypassMust(bypass)
+	return nil
+}
+
+func (ctrl *Controler) ChangePACProfile(name string) error {
+	ctrl.lock.Lock()
+	defer ctrl.lock.Unlock()
+
+	if current, _ := ctrl.cfg.GetCurrentPACProfile(); name == current {
+		return nil
+	}
+	profile, err := ctrl.cfg.GetPACProfile(name)
+	if err != nil {
+		return err
+	}
+
+	if err := ctrl.core.ChangePACProfile(profile); err != nil {
+		return err
+	}
+
+	ctrl.cfg.SetCurrentPACProfileMust(name)
+	return nil
+}
+
+// UpdateGFWList does not hold ctrl.lock, because downloading may take a
+// long time and the core is safe to be updated in background.
+func (ctrl *Controler) UpdateGFWList() error {
+	return ctrl.core.UpdateGFWList()
+}
+
+func (ctrl *Controler) TestURL(rawURL string) (core.RouteResult, error) {
+	ctrl.lock.Lock()
+	defer ctrl.lock.Unlock()
+
+	return ctrl.core.TestURL(rawURL)
+}
+
+func (ctrl *Controler) GetSSStatus() core.SSStatus {
+	ctrl.lock.Lock()
+	defer ctrl.lock.Unlock()
+
+	return ctrl.core.SSStatus()
+}
+
+func (ctrl *Controler) GetFailOpenStatus() core.FailOpenEvent {
+	ctrl.lock.Lock()
+	defer ctrl.lock.Unlock()
+
+	return ctrl.core.FailOpenStatus()
+}
+
+// GetSSLog does not hold ctrl.lock, because the log is safe to be read
+// at any time and following it may take a long time.
+func (ctrl *Controler) GetSSLog() *core.SSLog {
+	return ctrl.core.SSLog()
+}
+
 func (ctrl *Controler) Autorun(enable bool) error {
 	if enable {
 		if err := ctrl.svc.Install(); err != nil {
@@ -303,6 +465,15 @@ func (ctrl *Controler) shutdown() {
 	ctrl.isRunning = false
 }
 
+func (ctrl *Controler) changeUserRules(newRules config.UserRules) error {
+	if err := ctrl.core.ChangeUserRules(newRules); err != nil {
+		return err
+	}
+
+	ctrl.cfg.SetUserRulesMust(newRules)
+	return nil
+}
+
 func (ctrl *Controler) checkServersConfig(servers map[string]config.ServerConfig) error {
 	for name, srv := range servers {
 		if len(name) == 0 {
@@ -1,19 +1,28 @@
 package main
 
 import (
+	"io/ioutil"
+	"os"
+	"reflect"
 	"strings"
 	"testing"
 
+	"github.com/fatcat22/ssctrl/common"
 	"github.com/fatcat22/ssctrl/config"
+	"github.com/fatcat22/ssctrl/core"
 )
 
 type proxyCoreMock struct {
 	isStartup bool
 
-	mode      string
-	localPort string
-	pacPort   string
-	srvCfg    config.ServerConfig
+	mode       string
+	localPort  string
+	pacPort    string
+	srvCfg     config.ServerConfig
+	tunnels    config.TunnelConfig
+	userRules  config.UserRules
+	bypass     []string
+	pacProfile config.PACProfile
 }
 
 func (cm *proxyCoreMock) Startup() error {
@@ -45,6 +54,50 @@ func (cm *proxyCoreMock) ChangeServerConfig(newSrvCfg config.ServerConfig) error
 	return nil
 }
 
+func (cm *proxyCoreMock) ChangeDefaultTunnels(tunnels config.TunnelConfig) error {
+	cm.tunnels = tunnels
+	return nil
+}
+
+func (cm *proxyCoreMock) ChangeUserRules(rules config.UserRules) error {
+	cm.userRules = rules
+	return nil
+}
+
+func (cm *proxyCoreMock) ChangeBypass(bypass []string) error {
+	cm.bypass = bypass
+	return nil
+}
+
+func (cm *proxyCoreMock) ChangePACProfile(profile config.PACProfile) error {
+	cm.pacProfile = profile
+	cm.userRules = profile.Rules
+	return nil
+}
+
+func (cm *proxyCoreMock) UpdateGFWList() error {
+	return nil
+}
+
+func (cm *proxyCoreMock) TestURL(rawURL string) (core.RouteResult, error) {
+	return core.RouteResult{URL: rawURL}, nil
+}
+
+func (cm *proxyCoreMock) SSLog() *core.SSLog {
+	return core.NewSSLog("")
+}
+
+func (cm *proxyCoreMock) FailOpenStatus() core.FailOpenEvent {
+	return core.FailOpenEvent{}
+}
+
+func (cm *proxyCoreMock) SSStatus() core.SSStatus {
+	if cm.isStartup {
+		return core.SSStatus{State: core.SSStateRunning}
+	}
+	return core.SSStatus{State: core.SSStateStopped}
+}
+
 func TestControlerStartupWithEnable(t *testing.T) {
 	const expectMode = config.ModePAC
 	const expectPACPort = "1234"
@@ -472,10 +525,13 @@ func TestControlerUpdateServers(t *testing.T) {
 			Password: "server2pwd",
 		},
 		"server3": config.ServerConfig{
-			Address:  "69.78.77.86",
-			Port:     "4455",
-			Crypt:    config.Crypt_AEAD_CHACHA20_POLY1305,
-			Password: "server2pwd",
+			Address:    "69.78.77.86",
+			Port:       "4455",
+			Crypt:      config.Crypt_AEAD_CHACHA20_POLY1305,
+			Password:   "server2pwd",
+			Plugin:     "obfs-local",
+			PluginPath: "/usr/local/bin/obfs-local",
+			PluginOpts: "obfs=http",
 		},
 	}
 
@@ -629,3 +685,254 @@ func TestControlerRemoveServers(t *testing.T) {
 		t.Errorf("expect current server config '%v' but got '%v'", servers[currentSrvName], srv)
 	}
 }
+
+func TestControlerChangeUserRules(t *testing.T) {
+	cm := &proxyCoreMock{}
+
+	cfg := config.NewConfig()
+	if err := cfg.SetAPIPort("4321"); err != nil {
+		t.Fatalf("AppConfig.SetAPIPort error: %v", err)
+	}
+
+	ctrl, err := NewControler(cfg, cm, nil)
+	if err != nil {
+		t.Fatalf("NewControler error: %v", err)
+	}
+
+	// check add invalid rules
+	if err := ctrl.AddUserRules(config.UserRules{Proxy: []string{"http://google.com"}}); err == nil {
+		t.Errorf("AddUserRules success but the rule is invalid")
+	}
+
+	// check add rules
+	addRules := config.UserRules{
+		Proxy:  []string{"google.com", "8.8.8.0/24"},
+		Direct: []string{"baidu.com"},
+	}
+	if err := ctrl.AddUserRules(addRules); err != nil {
+		t.Fatalf("AddUserRules error: %v", err)
+	}
+	if !reflect.DeepEqual(cm.userRules, addRules) {
+		t.Errorf("expect core rules '%v' but got '%v'", addRules, cm.userRules)
+	}
+	if !reflect.DeepEqual(cfg.GetUserRules(), addRules) {
+		t.Errorf("expect config rules '%v' but got '%v'", addRules, cfg.GetUserRules())
+	}
+
+	// check remove rules
+	expectRules := config.UserRules{
+		Proxy: []string{"google.com"},
+	}
+	if err := ctrl.RemoveUserRules(config.UserRules{Proxy: []string{"8.8.8.0/24"}, Direct: []string{"baidu.com"}}); err != nil {
+		t.Fatalf("RemoveUserRules error: %v", err)
+	}
+	if !reflect.DeepEqual(cm.userRules, expectRules) {
+		t.Errorf("expect core rules '%v' but got '%v'", expectRules, cm.userRules)
+	}
+	if !reflect.DeepEqual(ctrl.GetUserRules(), expectRules) {
+		t.Errorf("expect config rules '%v' but got '%v'", expectRules, ctrl.GetUserRules())
+	}
+}
+
+func TestControlerChangeBypass(t *testing.T) {
+	cm := &proxyCoreMock{}
+
+	cfg := config.NewConfig()
+	if err := cfg.SetAPIPort("4321"); err != nil {
+		t.Fatalf("AppConfig.SetAPIPort error: %v", err)
+	}
+
+	ctrl, err := NewControler(cfg, cm, nil)
+	if err != nil {
+		t.Fatalf("NewControler error: %v", err)
+	}
+
+	if err := ctrl.ChangeBypass([]string{"http://intranet"}); err == nil {
+		t.Errorf("ChangeBypass success but the bypass is invalid")
+	}
+	if cm.bypass != nil {
+		t.Errorf("invalid bypass is set to core: %v", cm.bypass)
+	}
+
+	expectBypass := []string{"127.0.0.1", "10.0.0.0/8", "*.local", "intranet.example.com"}
+	if err := ctrl.ChangeBypass(expectBypass); err != nil {
+		t.Fatalf("ChangeBypass error: %v", err)
+	}
+	if !reflect.DeepEqual(cm.bypass, expectBypass) {
+		t.Errorf("expect core bypass '%v' but got '%v'", expectBypass, cm.bypass)
+	}
+	if !reflect.DeepEqual(ctrl.GetBypass(), expectBypass) {
+		t.Errorf("expect config bypass '%v' but got '%v'", expectBypass, ctrl.GetBypass())
+	}
+}
+
+func TestControlerChangeTunnels(t *testing.T) {
+	const cfgData = `
+apiPort = "4321"
+usingServer = "srv1"
+
+[servers]
+    [servers.srv1]
+        address = "11.22.33.44"
+        port = "8899"
+        password = "yourpwd"
+    [servers.srv2]
+        address = "55.66.77.88"
+        port = "8899"
+        password = "yourpwd"
+
+[tunnels]
+    udpRelay = true
+    udpTunnels = [":8053=8.8.8.8:53"]
+    tcpTunnels = []
+`
+	cfgFile, err := common.TempFile()
+	if err != nil {
+		t.Fatalf("create config file error: %v", err)
+	}
+	defer os.Remove(cfgFile)
+	if err := ioutil.WriteFile(cfgFile, []byte(cfgData), os.ModePerm); err != nil {
+		t.Fatalf("write config file error: %v", err)
+	}
+	cfg, err := config.LoadConfig(cfgFile)
+	if err != nil {
+		t.Fatalf("LoadConfig error: %v", err)
+	}
+
+	cm := &proxyCoreMock{}
+	ctrl, err := NewControler(cfg, cm, nil)
+	if err != nil {
+		t.Fatalf("NewControler error: %v", err)
+	}
+
+	defaultTunnels := config.TunnelConfig{
+		UDPRelay:   true,
+		UDPTunnels: []string{":8053=8.8.8.8:53"},
+	}
+	if tunnels, err := ctrl.GetTunnels("srv2"); err != nil || !reflect.DeepEqual(tunnels, defaultTunnels) {
+		t.Errorf("expect default tunnels '%v' for srv2 but got '%v'(error: %v)", defaultTunnels, tunnels, err)
+	}
+
+	// invalid or conflicting tunnels
+	if err := ctrl.ChangeTunnels("", &config.TunnelConfig{TCPTunnels: []string{"8053=8.8.8.8:53"}}); err == nil {
+		t.Errorf("ChangeTunnels success but the tunnel is invalid")
+	}
+	if err := ctrl.ChangeTunnels("srv2", &config.TunnelConfig{TCPTunnels: []string{":4321=8.8.8.8:53"}}); err == nil {
+		t.Errorf("ChangeTunnels success but the tunnel port is used by api server")
+	}
+	if err := ctrl.ChangeTunnels("", nil); err == nil {
+		t.Errorf("ChangeTunnels success but the default tunnels are removed")
+	}
+	if err := ctrl.ChangeTunnels("unknown", &config.TunnelConfig{}); err == nil {
+		t.Errorf("ChangeTunnels success but the server does not exist")
+	}
+
+	// tunnels of the current server are set to core
+	srvTunnels := config.TunnelConfig{TCPTunnels: []string{":84=8.8.8.8:80"}}
+	if err := ctrl.ChangeTunnels("srv1", &srvTunnels); err != nil {
+		t.Fatalf("ChangeTunnels error: %v", err)
+	}
+	if cm.srvCfg.Tunnels == nil || !reflect.DeepEqual(*cm.srvCfg.Tunnels, srvTunnels) {
+		t.Errorf("expect tunnels '%v' of current server in core but got '%v'", srvTunnels, cm.srvCfg.Tunnels)
+	}
+	if tunnels, _ := ctrl.GetTunnels("srv1"); !reflect.DeepEqual(tunnels, srvTunnels) {
+		t.Errorf("expect tunnels '%v' of srv1 but got '%v'", srvTunnels, tunnels)
+	}
+
+	// default tunnels
+	newDefault := config.TunnelConfig{UDPRelay: false}
+	if err := ctrl.ChangeTunnels("", &newDefault); err != nil {
+		t.Fatalf("ChangeTunnels error: %v", err)
+	}
+	if !reflect.DeepEqual(cm.tunnels, newDefault) {
+		t.Errorf("expect default tunnels '%v' in core but got '%v'", newDefault, cm.tunnels)
+	}
+	if tunnels, _ := ctrl.GetTunnels(""); !reflect.DeepEqual(tunnels, newDefault) {
+		t.Errorf("expect default tunnels '%v' but got '%v'", newDefault, tunnels)
+	}
+
+	// srv1 uses the default tunnels after removing its own
+	if err := ctrl.ChangeTunnels("srv1", nil); err != nil {
+		t.Fatalf("ChangeTunnels error: %v", err)
+	}
+	if cm.srvCfg.Tunnels != nil {
+		t.Errorf("expect no tunnels of current server in core but got '%v'", cm.srvCfg.Tunnels)
+	}
+	if tunnels, _ := ctrl.GetTunnels("srv1"); !reflect.DeepEqual(tunnels, newDefault) {
+		t.Errorf("expect default tunnels '%v' of srv1 but got '%v'", newDefault, tunnels)
+	}
+}
+
+func TestControlerChangePACProfile(t *testing.T) {
+	const cfgData = `
+apiPort = "4321"
+
+[servers]
+    [servers.mysrv]
+        address = "11.22.33.44"
+        port = "8899"
+        password = "yourpwd"
+
+[rules]
+    proxy = ["google.com"]
+
+[pacProfiles]
+    [pacProfiles.office]
+        file = "/path/to/office.txt"
+        [pacProfiles.office.rules]
+            direct = ["example.com"]
+`
+	cfgFile, err := common.TempFile()
+	if err != nil {
+		t.Fatalf("create config file error: %v", err)
+	}
+	defer os.Remove(cfgFile)
+	if err := ioutil.WriteFile(cfgFile, []byte(cfgData), os.ModePerm); err != nil {
+		t.Fatalf("write config file error: %v", err)
+	}
+	cfg, err := config.LoadConfig(cfgFile)
+	if err != nil {
+		t.Fatalf("LoadConfig error: %v", err)
+	}
+
+	cm := &proxyCoreMock{}
+	ctrl, err := NewControler(cfg, cm, nil)
+	if err != nil {
+		t.Fatalf("NewControler error: %v", err)
+	}
+
+	if err := ctrl.ChangePACProfile("unknown"); err == nil {
+		t.Errorf("ChangePACProfile success but the profile does not exist")
+	}
+
+	expectProfile := config.PACProfile{
+		File:  "/path/to/office.txt",
+		Rules: config.UserRules{Direct: []string{"example.com"}},
+	}
+	if err := ctrl.ChangePACProfile("office"); err != nil {
+		t.Fatalf("ChangePACProfile error: %v", err)
+	}
+	if !reflect.DeepEqual(cm.pacProfile, expectProfile) {
+		t.Errorf("expect core profile '%v' but got '%v'", expectProfile, cm.pacProfile)
+	}
+	if name, _ := cfg.GetCurrentPACProfile(); name != "office" {
+		t.Errorf("expect current pac profile 'office' but got '%s'", name)
+	}
+
+	// user rules are changed in the active profile
+	if err := ctrl.AddUserRules(config.UserRules{Direct: []string{"example.org"}}); err != nil {
+		t.Fatalf("AddUserRules error: %v", err)
+	}
+	expectRules := config.UserRules{Direct: []string{"example.com", "example.org"}}
+	if _, profile := cfg.GetCurrentPACProfile(); !reflect.DeepEqual(profile.Rules, expectRules) {
+		t.Errorf("expect profile rules '%v' but got '%v'", expectRules, profile.Rules)
+	}
+
+	if err := ctrl.ChangePACProfile(config.DefaultPACProfile); err != nil {
+		t.Fatalf("ChangePACProfile to default error: %v", err)
+	}
+	expectRules = config.UserRules{Proxy: []string{"google.com"}}
+	if cm.pacProfile.File != "" || !reflect.DeepEqual(cm.userRules, expectRules) {
+		t.Errorf("expect default profile with rules '%v' but got '%v'", expectRules, cm.pacProfile)
+	}
+}
@@ -0,0 +1,118 @@
+package core
+
+import (
+	"time"
+
+	"github.com/fatcat22/ssctrl/config"
+)
+
+// FailOpenEvent is emitted when OS proxy settings are cleared because
+// the proxy backend is down, or re-applied because it recovers.
+type FailOpenEvent struct {
+	// Active is true if OS proxy settings are cleared by fail-open.
+	Active bool `json:"active"`
+	// Reason is the error of the last failed health check when
+	// falling back to direct.
+	Reason string    `json:"reason,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+/*
+BackendMonitor runs check every interval. onDown is called with the
+error of the last check after maxFailures continuous failed checks, and
+onRecover is called when a check succeeds again after that. They are
+called again on the next check if they return error.
+*/
+type BackendMonitor struct {
+	interval    time.Duration
+	maxFailures int
+
+	check     func() error
+	onDown    func(reason error) error
+	onRecover func() error
+
+	failures int
+	isDown   bool
+
+	isStartup bool
+	stopCh    chan struct{}
+	doneCh    chan struct{}
+}
+
+func NewBackendMonitor(cfg config.FailOpenConfig, check func() error, onDown func(error) error, onRecover func() error) (*BackendMonitor, error) {
+	interval, err := cfg.GetCheckInterval()
+	if err != nil {
+		return nil, err
+	}
+
+	return &BackendMonitor{
+		interval:    interval,
+		maxFailures: cfg.GetMaxFailures(),
+
+		check:     check,
+		onDown:    onDown,
+		onRecover: onRecover,
+
+		isStartup: false,
+	}, nil
+}
+
+func (bm *BackendMonitor) Startup() error {
+	if bm.isStartup {
+		return nil
+	}
+
+	bm.failures = 0
+	bm.isDown = false
+	bm.stopCh = make(chan struct{})
+	bm.doneCh = make(chan struct{})
+	go bm.loop()
+
+	bm.isStartup = true
+	return nil
+}
+
+// Shutdown stops checking. onRecover is not called even if the backend
+// is down, the caller should restore the state by itself.
+func (bm *BackendMonitor) Shutdown() error {
+	if !bm.isStartup {
+		return nil
+	}
+
+	close(bm.stopCh)
+	<-bm.doneCh
+
+	bm.isStartup = false
+	return nil
+}
+
+func (bm *BackendMonitor) loop() {
+	defer close(bm.doneCh)
+
+	t := time.NewTicker(bm.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			bm.checkOnce()
+		case <-bm.stopCh:
+			return
+		}
+	}
+}
+
+func (bm *BackendMonitor) checkOnce() {
+	err := bm.check()
+	if err == nil {
+		bm.failures = 0
+		if bm.isDown && bm.onRecover() == nil {
+			bm.isDown = false
+		}
+		return
+	}
+
+	bm.failures++
+	if !bm.isDown && bm.failures >= bm.maxFailures && bm.onDown(err) == nil {
+		bm.isDown = true
+	}
+}
@@ -0,0 +1,285 @@
+package core
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fatcat22/ssctrl/common"
+	"github.com/fatcat22/ssctrl/config"
+)
+
+const gfwListFetchTimeout = 60 * time.Second
+
+var (
+	DefaultGFWListCachePath = filepath.Join(common.HomeDir(), ".ssctrl", "gfwlist.txt")
+)
+
+/*
+GFWListUpdater downloads gfwlist from the configured source, converts it
+to a rule list and saves it to cacheFile. onUpdate is called with cacheFile
+after every successful update.
+*/
+type GFWListUpdater struct {
+	cfg       config.GFWListConfig
+	interval  time.Duration
+	cacheFile string
+	onUpdate  func(cacheFile string) error
+
+	localAddr string
+	localPort string
+	lock      sync.Mutex
+
+	// updateLock makes updates run one by one.
+	updateLock sync.Mutex
+
+	isStartup bool
+	stopCh    chan struct{}
+	doneCh    chan struct{}
+	// cancel cancels fetchCtx, which stops the running fetch on Shutdown.
+	fetchCtx context.Context
+	cancel   context.CancelFunc
+}
+
+func NewGFWListUpdater(cfg config.GFWListConfig, cacheFile, localAddr, localPort string, onUpdate func(string) error) (*GFWListUpdater, error) {
+	interval, err := cfg.GetRefreshInterval()
+	if err != nil {
+		return nil, err
+	}
+
+	return &GFWListUpdater{
+		cfg:       cfg,
+		interval:  interval,
+		cacheFile: cacheFile,
+		onUpdate:  onUpdate,
+
+		localAddr: localAddr,
+		localPort: localPort,
+
+		isStartup: false,
+	}, nil
+}
+
+func (gu *GFWListUpdater) Startup() error {
+	if gu.isStartup || !gu.cfg.IsEnabled() {
+		return nil
+	}
+
+	gu.lock.Lock()
+	gu.fetchCtx, gu.cancel = context.WithCancel(context.Background())
+	gu.lock.Unlock()
+
+	gu.stopCh = make(chan struct{})
+	gu.doneCh = make(chan struct{})
+	go gu.loop()
+
+	gu.isStartup = true
+	return nil
+}
+
+func (gu *GFWListUpdater) Shutdown() error {
+	if !gu.isStartup {
+		return nil
+	}
+
+	gu.lock.Lock()
+	gu.cancel()
+	gu.fetchCtx, gu.cancel = nil, nil
+	gu.lock.Unlock()
+
+	close(gu.stopCh)
+	<-gu.doneCh
+
+	gu.isStartup = false
+	return nil
+}
+
+// Update downloads and applies gfwlist immediately.
+func (gu *GFWListUpdater) Update() error {
+	if !gu.cfg.IsEnabled() {
+		return errors.New("gfwlist source is not configured")
+	}
+
+	gu.updateLock.Lock()
+	defer gu.updateLock.Unlock()
+
+	data, err := fetchGFWList(gu.context(), gu.cfg, gu.proxyAddr())
+	if err != nil {
+		return err
+	}
+	rules, err := decodeGFWList(data)
+	if err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(gu.cacheFile, []byte(strings.Join(rules, "\n")+"\n")); err != nil {
+		return err
+	}
+
+	return gu.onUpdate(gu.cacheFile)
+}
+
+func (gu *GFWListUpdater) ChangeLocalPort(newPort string) error {
+	gu.lock.Lock()
+	defer gu.lock.Unlock()
+
+	gu.localPort = newPort
+	return nil
+}
+
+// IsCacheValid reports whether the cache file exists and is not expired.
+func (gu *GFWListUpdater) IsCacheValid() bool {
+	fi, err := os.Stat(gu.cacheFile)
+	if err != nil {
+		return false
+	}
+
+	return gu.interval == 0 || time.Since(fi.ModTime()) < gu.interval
+}
+
+func (gu *GFWListUpdater) loop() {
+	defer close(gu.doneCh)
+
+	if !gu.IsCacheValid() {
+		gu.updateAndLog()
+	}
+
+	if gu.interval == 0 {
+		<-gu.stopCh
+		return
+	}
+
+	t := time.NewTicker(gu.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			gu.updateAndLog()
+		case <-gu.stopCh:
+			return
+		}
+	}
+}
+
+func (gu *GFWListUpdater) updateAndLog() {
+	if err := gu.Update(); err != nil {
+		log.Printf("update gfwlist from '%s' error: %v\n", gu.cfg.Source, err)
+	}
+}
+
+// context returns the context of fetching, which is cancelled by Shutdown.
+func (gu *GFWListUpdater) context() context.Context {
+	gu.lock.Lock()
+	defer gu.lock.Unlock()
+
+	if gu.fetchCtx == nil {
+		return context.Background()
+	}
+	return gu.fetchCtx
+}
+
+func (gu *GFWListUpdater) proxyAddr() string {
+	if !gu.cfg.ViaProxy {
+		return ""
+	}
+
+	gu.lock.Lock()
+	defer gu.lock.Unlock()
+	return gu.localAddr + ":" + gu.localPort
+}
+
+// fetchGFWList reads gfwlist from a local file or downloads it until ctx
+// is cancelled. If socksAddr is not empty, downloading goes through this
+// socks5 proxy.
+func fetchGFWList(ctx context.Context, cfg config.GFWListConfig, socksAddr string) ([]byte, error) {
+	if !cfg.IsRemote() {
+		return ioutil.ReadFile(cfg.Source)
+	}
+
+	transport := &http.Transport{}
+	if len(socksAddr) != 0 {
+		transport.Proxy = http.ProxyURL(&url.URL{
+			Scheme: "socks5",
+			Host:   socksAddr,
+		})
+	}
+	client := &http.Client{
+		Transport: transport,
+		Timeout:   gfwListFetchTimeout,
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, cfg.Source, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("download gfwlist failed: %s", resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// decodeGFWList converts the base64 encoded gfwlist to rule list.
+// Plain text(not encoded) list is accepted too.
+func decodeGFWList(data []byte) ([]string, error) {
+	encoded := strings.Map(func(r rune) rune {
+		if r == '\r' || r == '\n' || r == ' ' || r == '\t' {
+			return -1
+		}
+		return r
+	}, string(data))
+
+	if decoded, err := base64.StdEncoding.DecodeString(encoded); err == nil {
+		data = decoded
+	}
+
+	rules, err := parsePACRules(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(rules) == 0 {
+		return nil, errors.New("no rule found in gfwlist")
+	}
+	return rules, nil
+}
+
+// writeFileAtomic writes data to a temporary file and renames it to
+// file, so readers never see a half-written file.
+func writeFileAtomic(file string, data []byte) error {
+	tmpFile, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file))
+	if err != nil {
+		return err
+	}
+	tmpName := tmpFile.Name()
+
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		os.Remove(tmpName)
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+
+	if err := os.Rename(tmpName, file); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	return nil
+}
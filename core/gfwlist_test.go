@@ -0,0 +1,170 @@
+package core
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/fatcat22/ssctrl/common"
+	"github.com/fatcat22/ssctrl/config"
+)
+
+const mockGFWList = `[AutoProxy 0.2.9]
+! Checksum: abcd
+||google.com
+|http://85.17.73.31/
+@@||qq.com
+`
+
+var mockGFWListRules = []string{"||google.com", "|http://85.17.73.31/", "@@||qq.com"}
+
+func TestDecodeGFWList(t *testing.T) {
+	encoded := base64.StdEncoding.EncodeToString([]byte(mockGFWList))
+	// gfwlist.txt is wrapped every 64 characters
+	wrapped := encoded[:64] + "\n" + encoded[64:] + "\n"
+
+	rules, err := decodeGFWList([]byte(wrapped))
+	if err != nil {
+		t.Fatalf("decode gfwlist error: %v", err)
+	}
+	if !reflect.DeepEqual(rules, mockGFWListRules) {
+		t.Errorf("expect rules %v but got %v", mockGFWListRules, rules)
+	}
+
+	rules, err = decodeGFWList([]byte(mockGFWList))
+	if err != nil {
+		t.Fatalf("decode plain gfwlist error: %v", err)
+	}
+	if !reflect.DeepEqual(rules, mockGFWListRules) {
+		t.Errorf("expect rules %v but got %v", mockGFWListRules, rules)
+	}
+
+	if _, err := decodeGFWList([]byte("! only comment\n")); err == nil {
+		t.Errorf("decode gfwlist without rules should be failed")
+	}
+}
+
+func TestGFWListUpdate(t *testing.T) {
+	httpSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(base64.StdEncoding.EncodeToString([]byte(mockGFWList))))
+	}))
+	defer httpSrv.Close()
+
+	cacheFile, err := common.TempFile()
+	if err != nil {
+		t.Fatalf("create cache file error: %v", err)
+	}
+	defer os.Remove(cacheFile)
+
+	pacSrv, _ := createPACServer(t, "1037")
+	pacSrv.Startup()
+	defer pacSrv.Shutdown()
+
+	cfg := config.GFWListConfig{
+		Source: httpSrv.URL,
+	}
+	gu, err := NewGFWListUpdater(cfg, cacheFile, "127.0.0.1", "1080", pacSrv.ReloadPAC)
+	if err != nil {
+		t.Fatalf("create gfwlist updater error: %v", err)
+	}
+	if err := gu.Update(); err != nil {
+		t.Fatalf("update gfwlist error: %v", err)
+	}
+
+	cacheRules, err := loadPACRules(cacheFile)
+	if err != nil {
+		t.Fatalf("load cached rules error: %v", err)
+	}
+	if !reflect.DeepEqual(cacheRules, mockGFWListRules) {
+		t.Errorf("expect cached rules %v but got %v", mockGFWListRules, cacheRules)
+	}
+	checkGetPAC(t, `"qq."`, "1037")
+}
+
+func TestGFWListUpdateFailed(t *testing.T) {
+	httpSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer httpSrv.Close()
+
+	cacheFile, err := common.TempFile()
+	if err != nil {
+		t.Fatalf("create cache file error: %v", err)
+	}
+	defer os.Remove(cacheFile)
+
+	updated := false
+	cfg := config.GFWListConfig{
+		Source: httpSrv.URL,
+	}
+	gu, err := NewGFWListUpdater(cfg, cacheFile, "127.0.0.1", "1080", func(string) error {
+		updated = true
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("create gfwlist updater error: %v", err)
+	}
+	if err := gu.Update(); err == nil {
+		t.Errorf("update gfwlist success but the server return 404")
+	}
+	if updated {
+		t.Errorf("update gfwlist failed but onUpdate is called")
+	}
+	if data, _ := ioutil.ReadFile(cacheFile); len(data) != 0 {
+		t.Errorf("update gfwlist failed but cache file is changed")
+	}
+}
+
+func TestGFWListShutdownCancelsFetch(t *testing.T) {
+	requested := make(chan struct{})
+	release := make(chan struct{})
+	httpSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		close(requested)
+		select {
+		case <-req.Context().Done():
+		case <-release:
+		}
+	}))
+	defer httpSrv.Close()
+	defer close(release)
+
+	cacheFile, err := common.TempFile()
+	if err != nil {
+		t.Fatalf("create cache file error: %v", err)
+	}
+	// no cache, so the updater fetches gfwlist once it starts
+	os.Remove(cacheFile)
+	defer os.Remove(cacheFile)
+
+	cfg := config.GFWListConfig{
+		Source: httpSrv.URL,
+	}
+	gu, err := NewGFWListUpdater(cfg, cacheFile, "127.0.0.1", "1080", func(string) error { return nil })
+	if err != nil {
+		t.Fatalf("create gfwlist updater error: %v", err)
+	}
+	if err := gu.Startup(); err != nil {
+		t.Fatalf("start gfwlist updater error: %v", err)
+	}
+	select {
+	case <-requested:
+	case <-time.After(3 * time.Second):
+		t.Fatalf("gfwlist is not fetched after startup")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		gu.Shutdown()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatalf("shutdown gfwlist updater is blocked by the running fetch")
+	}
+}
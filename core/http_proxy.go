@@ -0,0 +1,310 @@
+package core
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"sync"
+	"time"
+)
+
+/*
+HTTPProxy is a http proxy server for the apps which only understand
+http proxies. Both plain http requests and CONNECT are forwarded
+through the local socks5 proxy.
+*/
+type HTTPProxy struct {
+	server *http.Server
+
+	listenAddr string
+	port       string
+
+	socksAddr string
+	socksPort string
+	lock      sync.RWMutex
+
+	// allowedNets are the networks of other devices which are allowed
+	// to use the proxy, see isClientAllowed.
+	allowedNets []*net.IPNet
+
+	// route tells whether the connections to target(host:port) go
+	// RouteDirect or RouteProxy. All go proxy if it's nil.
+	route func(target string) string
+
+	transport *http.Transport
+	forwarder *httputil.ReverseProxy
+
+	// tunnels are the connections hijacked by CONNECT and the remote
+	// connections of them, they are not closed by server.Shutdown.
+	tunnels    map[net.Conn]net.Conn
+	tunnelLock sync.Mutex
+
+	isStartup  bool
+	shutdownCh chan struct{}
+}
+
+// NewHTTPProxy creates a http proxy listening on listenAddr:port, which
+// dials through the socks5 proxy at socksAddr:socksPort. Only the clients
+// on the same host or in allowedClients(ip addresses or CIDRs) are served.
+func NewHTTPProxy(listenAddr, port, socksAddr, socksPort string, allowedClients []string) (*HTTPProxy, error) {
+	allowedNets, err := parseAllowedClients(allowedClients)
+	if err != nil {
+		return nil, err
+	}
+
+	hp := &HTTPProxy{
+		listenAddr: listenAddr,
+		port:       port,
+
+		socksAddr: socksAddr,
+		socksPort: socksPort,
+
+		allowedNets: allowedNets,
+
+		tunnels: make(map[net.Conn]net.Conn),
+
+		isStartup: false,
+	}
+
+	hp.transport = &http.Transport{
+		Proxy: nil,
+		DialContext: func(ctx context.Context, _, addr string) (net.Conn, error) {
+			return hp.dial(ctx, addr)
+		},
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}
+	hp.forwarder = &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			// don't tell the server the address of client
+			req.Header["X-Forwarded-For"] = nil
+		},
+		Transport: hp.transport,
+		ErrorLog:  log.New(ioutil.Discard, "", 0),
+	}
+	return hp, nil
+}
+
+func (hp *HTTPProxy) Startup() error {
+	if hp.isStartup {
+		return nil
+	}
+
+	hp.renewServer()
+	hp.shutdownCh = make(chan struct{})
+
+	var resultErr error
+	go func() {
+		defer func() {
+			hp.isStartup = false
+			close(hp.shutdownCh)
+		}()
+
+		l, err := net.Listen("tcp", hp.server.Addr)
+		if err != nil {
+			resultErr = err
+			log.Printf("http proxy start error: %v\n", resultErr)
+			return
+		}
+		resultErr = hp.server.Serve(&allowedListener{Listener: l, allowedNets: hp.allowedNets})
+		if resultErr != http.ErrServerClosed {
+			log.Printf("http proxy start error: %v\n", resultErr)
+		}
+	}()
+
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		hp.isStartup = true
+		return nil
+	case <-hp.shutdownCh:
+		return resultErr
+	}
+}
+
+func (hp *HTTPProxy) Shutdown() error {
+	if !hp.isStartup {
+		return nil
+	}
+
+	if err := hp.server.Shutdown(context.Background()); err != nil {
+		return err
+	}
+	hp.closeTunnels()
+	hp.transport.CloseIdleConnections()
+
+	<-hp.shutdownCh
+	hp.server = nil
+	hp.isStartup = false
+	return nil
+}
+
+// ChangeSocksPort makes new connections dial through the new socks port.
+func (hp *HTTPProxy) ChangeSocksPort(newPort string) {
+	hp.lock.Lock()
+	hp.socksPort = newPort
+	hp.lock.Unlock()
+
+	// idle connections are dialed by the old port
+	hp.transport.CloseIdleConnections()
+}
+
+func (hp *HTTPProxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method == http.MethodConnect {
+		hp.handleConnect(w, req)
+		return
+	}
+
+	if !req.URL.IsAbs() || len(req.URL.Host) == 0 {
+		http.Error(w, "not a proxy request", http.StatusBadRequest)
+		return
+	}
+	hp.forwarder.ServeHTTP(w, req)
+}
+
+func (hp *HTTPProxy) handleConnect(w http.ResponseWriter, req *http.Request) {
+	target := req.URL.Host
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		http.Error(w, "invalid CONNECT target", http.StatusBadRequest)
+		return
+	}
+
+	remote, err := hp.dial(req.Context(), target)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		remote.Close()
+		http.Error(w, "CONNECT is not supported", http.StatusInternalServerError)
+		return
+	}
+	client, buf, err := hijacker.Hijack()
+	if err != nil {
+		remote.Close()
+		return
+	}
+	if _, err := client.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+		client.Close()
+		remote.Close()
+		return
+	}
+
+	hp.addTunnel(client, remote)
+	defer hp.removeTunnel(client)
+
+	// data may be sent by client before it got the response
+	if n := buf.Reader.Buffered(); n > 0 {
+		data, _ := buf.Reader.Peek(n)
+		if _, err := remote.Write(data); err != nil {
+			client.Close()
+			remote.Close()
+			return
+		}
+	}
+	relay(client, remote)
+}
+
+func (hp *HTTPProxy) dial(ctx context.Context, addr string) (net.Conn, error) {
+	if hp.route != nil && hp.route(addr) == RouteDirect {
+		var d net.Dialer
+		return d.DialContext(ctx, "tcp", addr)
+	}
+
+	hp.lock.RLock()
+	socksAddr := net.JoinHostPort(dialAddr(hp.socksAddr), hp.socksPort)
+	hp.lock.RUnlock()
+
+	return dialSOCKS5(ctx, socksAddr, addr)
+}
+
+func (hp *HTTPProxy) addTunnel(client, remote net.Conn) {
+	hp.tunnelLock.Lock()
+	hp.tunnels[client] = remote
+	hp.tunnelLock.Unlock()
+}
+
+func (hp *HTTPProxy) removeTunnel(conn net.Conn) {
+	hp.tunnelLock.Lock()
+	delete(hp.tunnels, conn)
+	hp.tunnelLock.Unlock()
+}
+
+func (hp *HTTPProxy) closeTunnels() {
+	hp.tunnelLock.Lock()
+	defer hp.tunnelLock.Unlock()
+
+	for client, remote := range hp.tunnels {
+		client.Close()
+		remote.Close()
+	}
+}
+
+func (hp *HTTPProxy) renewServer() {
+	if hp.server != nil {
+		panic("http proxy server is not nil")
+	}
+
+	hp.server = &http.Server{
+		Addr:    hp.listenAddr + ":" + hp.port,
+		Handler: hp,
+	}
+}
+
+// allowedListener closes the connections from the clients not in
+// allowedNets, see isClientAllowed.
+type allowedListener struct {
+	net.Listener
+	allowedNets []*net.IPNet
+}
+
+func (l *allowedListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		serverIP, _, err := net.SplitHostPort(conn.LocalAddr().String())
+		if err == nil && isClientAllowed(conn.RemoteAddr().String(), serverIP, l.allowedNets) {
+			return conn, nil
+		}
+		conn.Close()
+	}
+}
+
+// relay copies data between a and b until both directions are
+// finished, and closes them.
+func relay(a, b net.Conn) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		io.Copy(a, b)
+		closeWrite(a)
+	}()
+
+	io.Copy(b, a)
+	closeWrite(b)
+	<-done
+
+	a.Close()
+	b.Close()
+}
+
+// closeWrite shuts down the writing side of conn if it's supported,
+// otherwise conn is closed.
+func closeWrite(conn net.Conn) {
+	if c, ok := conn.(interface{ CloseWrite() error }); ok {
+		c.CloseWrite()
+		return
+	}
+	conn.Close()
+}
@@ -0,0 +1,240 @@
+package core
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+// startMockSOCKS5 starts a socks5 server without authentication which
+// supports CONNECT only, and returns its port and the targets requested.
+func startMockSOCKS5(t *testing.T) (string, <-chan string, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen mock socks5 error: %v", err)
+	}
+
+	targets := make(chan string, 16)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveMockSOCKS5(conn, targets)
+		}
+	}()
+
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	return port, targets, func() { l.Close() }
+}
+
+func serveMockSOCKS5(conn net.Conn, targets chan<- string) {
+	defer conn.Close()
+
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return
+	}
+	if _, err := io.ReadFull(conn, make([]byte, header[1])); err != nil {
+		return
+	}
+	conn.Write([]byte{socks5Version, socks5NoAuth})
+
+	req := make([]byte, 3)
+	if _, err := io.ReadFull(conn, req); err != nil {
+		return
+	}
+	addr, err := socks.ReadAddr(conn)
+	if err != nil {
+		return
+	}
+	target := addr.String()
+	targets <- target
+
+	// every domain is resolved to 127.0.0.1
+	_, port, _ := net.SplitHostPort(target)
+	remote, err := net.Dial("tcp", "127.0.0.1:"+port)
+	if err != nil {
+		conn.Write([]byte{socks5Version, byte(socks.ErrConnectionRefused), 0, socks.AtypIPv4, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	conn.Write([]byte{socks5Version, socks5RepSucceeded, 0, socks.AtypIPv4, 127, 0, 0, 1, 0, 0})
+	relay(conn, remote)
+}
+
+func TestHTTPProxy(t *testing.T) {
+	const port = "1046"
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(w, "hello %s", req.URL.Path)
+	}))
+	defer backend.Close()
+	_, backendPort, _ := net.SplitHostPort(backend.Listener.Addr().String())
+
+	socksPort, targets, stop := startMockSOCKS5(t)
+	defer stop()
+
+	hp, err := NewHTTPProxy("127.0.0.1", port, "127.0.0.1", socksPort, nil)
+	if err != nil {
+		t.Fatalf("create http proxy error: %v", err)
+	}
+	if err := hp.Startup(); err != nil {
+		t.Fatalf("start http proxy error: %v", err)
+	}
+	defer hp.Shutdown()
+
+	proxyURL, _ := url.Parse("http://127.0.0.1:" + port)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	// plain http request
+	resp, err := client.Get("http://example.test:" + backendPort + "/plain")
+	if err != nil {
+		t.Fatalf("get through http proxy error: %v", err)
+	}
+	data, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(data) != "hello /plain" {
+		t.Errorf("expect 'hello /plain' but got '%s'", data)
+	}
+	if target := <-targets; target != "example.test:"+backendPort {
+		t.Errorf("expect socks target 'example.test:%s' but got '%s'", backendPort, target)
+	}
+
+	// CONNECT
+	conn, err := net.Dial("tcp", "127.0.0.1:"+port)
+	if err != nil {
+		t.Fatalf("connect http proxy error: %v", err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "CONNECT tunnel.test:%s HTTP/1.1\r\nHost: tunnel.test:%s\r\n\r\n", backendPort, backendPort)
+	br := bufio.NewReader(conn)
+	connectResp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("read CONNECT response error: %v", err)
+	}
+	if connectResp.StatusCode != http.StatusOK {
+		t.Fatalf("expect CONNECT status 200 but got %d", connectResp.StatusCode)
+	}
+	fmt.Fprintf(conn, "GET /tunnel HTTP/1.1\r\nHost: tunnel.test\r\nConnection: close\r\n\r\n")
+	resp, err = http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("read response in tunnel error: %v", err)
+	}
+	data, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(data) != "hello /tunnel" {
+		t.Errorf("expect 'hello /tunnel' but got '%s'", data)
+	}
+	if target := <-targets; target != "tunnel.test:"+backendPort {
+		t.Errorf("expect socks target 'tunnel.test:%s' but got '%s'", backendPort, target)
+	}
+
+	// not a proxy request
+	resp, err = http.Get("http://127.0.0.1:" + port + "/")
+	if err != nil {
+		t.Fatalf("get http proxy error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expect status 400 for non-proxy request but got %d", resp.StatusCode)
+	}
+}
+
+func TestPACWithHTTPProxy(t *testing.T) {
+	pacFile := createMockPACFile("||hello.example.com", t)
+	defer os.Remove(pacFile)
+
+	srv, err := NewPACServer("1047", "127.0.0.1", "4321", PACOptions{PACFile: pacFile, HTTPPort: "4322"})
+	if err != nil {
+		t.Fatalf("create pac server error: %v", err)
+	}
+
+	const expectProxy = "SOCKS5 127.0.0.1:4321; SOCKS 127.0.0.1:4321; PROXY 127.0.0.1:4322; DIRECT;"
+	result, err := srv.TestURL("https://hello.example.com/")
+	if err != nil {
+		t.Fatalf("test url error: %v", err)
+	}
+	if result.PAC != expectProxy {
+		t.Errorf("expect pac result '%s' but got '%s'", expectProxy, result.PAC)
+	}
+}
+
+// addrConn is a net.Conn with the given addresses.
+type addrConn struct {
+	net.Conn
+	local, remote net.Addr
+}
+
+func (c *addrConn) LocalAddr() net.Addr  { return c.local }
+func (c *addrConn) RemoteAddr() net.Addr { return c.remote }
+
+// connsListener accepts the connections in conns until it's empty.
+type connsListener struct {
+	net.Listener
+	conns []net.Conn
+}
+
+func (l *connsListener) Accept() (net.Conn, error) {
+	if len(l.conns) == 0 {
+		return nil, io.EOF
+	}
+	conn := l.conns[0]
+	l.conns = l.conns[1:]
+	return conn, nil
+}
+
+func TestAllowedListener(t *testing.T) {
+	allowedNets, err := parseAllowedClients([]string{"192.168.1.0/24"})
+	if err != nil {
+		t.Fatalf("parse allowed clients error: %v", err)
+	}
+
+	server := &net.TCPAddr{IP: net.ParseIP("192.168.2.1"), Port: 1084}
+	clients := []struct {
+		ip      string
+		allowed bool
+	}{
+		{"10.0.0.2", false},
+		{"127.0.0.1", true},
+		{"192.168.2.1", true},
+		{"192.168.1.3", true},
+		{"192.168.2.3", false},
+	}
+	var conns []net.Conn
+	for _, c := range clients {
+		a, _ := net.Pipe()
+		conns = append(conns, &addrConn{Conn: a, local: server, remote: &net.TCPAddr{IP: net.ParseIP(c.ip), Port: 50000}})
+	}
+
+	l := &allowedListener{Listener: &connsListener{conns: conns}, allowedNets: allowedNets}
+	var accepted []string
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			break
+		}
+		host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+		accepted = append(accepted, host)
+	}
+
+	var expect []string
+	for _, c := range clients {
+		if c.allowed {
+			expect = append(expect, c.ip)
+		}
+	}
+	if strings.Join(accepted, ",") != strings.Join(expect, ",") {
+		t.Errorf("expect clients %v accepted but got %v", expect, accepted)
+	}
+}
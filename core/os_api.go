@@ -8,9 +8,14 @@ type osAPI interface {
 	listAllNetwork() ([]string, error)
 	setAutoProxyFor(network, url string) error
 	setGlobalProxyFor(network, addr, port string) error
-	setProxyBypassDomains(network, bypass string) error
+	setWebProxyFor(network, addr, port string) error
+	setSecureWebProxyFor(network, addr, port string) error
+	getProxyBypassDomains(network string) ([]string, error)
+	setProxyBypassDomains(network string, bypass []string) error
 	clearAutoProxyFor(network string) error
 	clearGlobalProxyFor(network string) error
+	clearWebProxyFor(network string) error
+	clearSecureWebProxyFor(network string) error
 }
 
 var api osAPI
@@ -42,9 +42,34 @@ func (api *drawinAPI) setGlobalProxyFor(network, addr, port string) error {
 	return cmd.Run()
 }
 
-func (api *drawinAPI) setProxyBypassDomains(network, bypass string) error {
-	cmd := exec.Command("networksetup",
-		"-setproxybypassdomains", network, bypass)
+func (api *drawinAPI) getProxyBypassDomains(network string) ([]string, error) {
+	output, err := exec.Command("networksetup",
+		"-getproxybypassdomains", network).Output()
+	if err != nil {
+		return nil, err
+	}
+
+	// networksetup prints "There aren't any bypass domains set on xxx."
+	// if the list is empty.
+	if strings.HasPrefix(string(output), "There aren't any") {
+		return nil, nil
+	}
+
+	var results []string
+	for _, s := range strings.Split(string(output), "\n") {
+		if s = strings.TrimSpace(s); len(s) != 0 {
+			results = append(results, s)
+		}
+	}
+	return results, nil
+}
+
+func (api *drawinAPI) setProxyBypassDomains(network string, bypass []string) error {
+	args := append([]string{"-setproxybypassdomains", network}, bypass...)
+	if len(bypass) == 0 {
+		args = append(args, "Empty")
+	}
+	cmd := exec.Command("networksetup", args...)
 
 	return cmd.Run()
 }
@@ -84,3 +109,53 @@ func (api *drawinAPI) clearGlobalProxyFor(network string) error {
 		return nil
 	}
 }
+
+func (api *drawinAPI) setWebProxyFor(network, addr, port string) error {
+	cmd := exec.Command("networksetup",
+		"-setwebproxy", network, addr, port)
+
+	return cmd.Run()
+}
+
+func (api *drawinAPI) setSecureWebProxyFor(network, addr, port string) error {
+	cmd := exec.Command("networksetup",
+		"-setsecurewebproxy", network, addr, port)
+
+	return cmd.Run()
+}
+
+func (api *drawinAPI) clearWebProxyFor(network string) error {
+	cmd1 := exec.Command("networksetup",
+		"-setwebproxy", network, "Empty")
+	err1 := cmd1.Run()
+
+	cmd2 := exec.Command("networksetup",
+		"-setwebproxystate", network, "off")
+	err2 := cmd2.Run()
+
+	if err1 != nil {
+		return err1
+	} else if err2 != nil {
+		return err2
+	} else {
+		return nil
+	}
+}
+
+func (api *drawinAPI) clearSecureWebProxyFor(network string) error {
+	cmd1 := exec.Command("networksetup",
+		"-setsecurewebproxy", network, "Empty")
+	err1 := cmd1.Run()
+
+	cmd2 := exec.Command("networksetup",
+		"-setsecurewebproxystate", network, "off")
+	err2 := cmd2.Run()
+
+	if err1 != nil {
+		return err1
+	} else if err2 != nil {
+		return err2
+	} else {
+		return nil
+	}
+}
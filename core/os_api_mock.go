@@ -3,16 +3,22 @@ package core
 import "fmt"
 
 const (
-	modePAC    = 0x01
-	modeGlobal = 0x02
+	modePAC       = 0x01
+	modeGlobal    = 0x02
+	modeWeb       = 0x04
+	modeSecureWeb = 0x08
 )
 
 type mockSettings struct {
-	mode       int
-	pacURL     string
-	globalAddr string
-	globalPort string
-	bypassDom  string
+	mode          int
+	pacURL        string
+	globalAddr    string
+	globalPort    string
+	webAddr       string
+	webPort       string
+	secureWebAddr string
+	secureWebPort string
+	bypass        []string
 }
 
 type mockAPI struct {
@@ -68,13 +74,48 @@ func (m *mockAPI) setGlobalProxyFor(network, addr, port string) error {
 	return nil
 }
 
-func (m *mockAPI) setProxyBypassDomains(network, bypass string) error {
+func (m *mockAPI) setWebProxyFor(network, addr, port string) error {
 	settings, ok := m.settings[network]
 	if !ok {
 		return fmt.Errorf("unknown network '%s'", network)
 	}
 
-	settings.bypassDom = bypass
+	settings.mode |= modeWeb
+	settings.webAddr = addr
+	settings.webPort = port
+
+	return nil
+}
+
+func (m *mockAPI) setSecureWebProxyFor(network, addr, port string) error {
+	settings, ok := m.settings[network]
+	if !ok {
+		return fmt.Errorf("unknown network '%s'", network)
+	}
+
+	settings.mode |= modeSecureWeb
+	settings.secureWebAddr = addr
+	settings.secureWebPort = port
+
+	return nil
+}
+
+func (m *mockAPI) getProxyBypassDomains(network string) ([]string, error) {
+	settings, ok := m.settings[network]
+	if !ok {
+		return nil, fmt.Errorf("unknown network '%s'", network)
+	}
+
+	return append([]string(nil), settings.bypass...), nil
+}
+
+func (m *mockAPI) setProxyBypassDomains(network string, bypass []string) error {
+	settings, ok := m.settings[network]
+	if !ok {
+		return fmt.Errorf("unknown network '%s'", network)
+	}
+
+	settings.bypass = append([]string(nil), bypass...)
 
 	return nil
 }
@@ -104,6 +145,32 @@ func (m *mockAPI) clearGlobalProxyFor(network string) error {
 	return nil
 }
 
+func (m *mockAPI) clearWebProxyFor(network string) error {
+	settings, ok := m.settings[network]
+	if !ok {
+		return fmt.Errorf("unknown network '%s'", network)
+	}
+
+	settings.mode &= ^modeWeb
+	settings.webAddr = ""
+	settings.webPort = ""
+
+	return nil
+}
+
+func (m *mockAPI) clearSecureWebProxyFor(network string) error {
+	settings, ok := m.settings[network]
+	if !ok {
+		return fmt.Errorf("unknown network '%s'", network)
+	}
+
+	settings.mode &= ^modeSecureWeb
+	settings.secureWebAddr = ""
+	settings.secureWebPort = ""
+
+	return nil
+}
+
 func resetMockAPI() *mockAPI {
 	api = newMockAPI()
 	return api.(*mockAPI)
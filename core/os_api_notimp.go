@@ -19,7 +19,11 @@ func (api *notImpAPI) setGlobalProxyFor(network, addr, port string) error {
 	return fmt.Errorf("osAPI is not implemented on %s", runtime.GOOS)
 }
 
-func (api *notImpAPI) setProxyBypassDomains(network, bypass string) error {
+func (api *notImpAPI) getProxyBypassDomains(network string) ([]string, error) {
+	return nil, fmt.Errorf("osAPI is not implemented on %s", runtime.GOOS)
+}
+
+func (api *notImpAPI) setProxyBypassDomains(network string, bypass []string) error {
 	return fmt.Errorf("osAPI is not implemented on %s", runtime.GOOS)
 }
 
@@ -30,3 +34,19 @@ func (api *notImpAPI) clearAutoProxyFor(network string) error {
 func (api *notImpAPI) clearGlobalProxyFor(network string) error {
 	return fmt.Errorf("osAPI is not implemented on %s", runtime.GOOS)
 }
+
+func (api *notImpAPI) setWebProxyFor(network, addr, port string) error {
+	return fmt.Errorf("osAPI is not implemented on %s", runtime.GOOS)
+}
+
+func (api *notImpAPI) setSecureWebProxyFor(network, addr, port string) error {
+	return fmt.Errorf("osAPI is not implemented on %s", runtime.GOOS)
+}
+
+func (api *notImpAPI) clearWebProxyFor(network string) error {
+	return fmt.Errorf("osAPI is not implemented on %s", runtime.GOOS)
+}
+
+func (api *notImpAPI) clearSecureWebProxyFor(network string) error {
+	return fmt.Errorf("osAPI is not implemented on %s", runtime.GOOS)
+}
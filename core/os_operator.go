@@ -7,23 +7,34 @@ import (
 	"github.com/fatcat22/ssctrl/config"
 )
 
-const bypass = "127.0.0.1、192.168.0.0/16、10.0.0.0/8、localhost"
-
 type opConfig struct {
 	mode      string
 	pacURL    string
 	localAddr string
 	localPort string
+	// httpPort is the port of HTTPProxy listening on localAddr,
+	// it's empty if http proxy is disabled.
+	httpPort string
+	// rulePort is the port of RuleProxy listening on localAddr.
+	rulePort string
 }
 
 type OSOperator struct {
 	cfg opConfig
+	// bypass is set to every network whatever the mode is.
+	bypass []string
+	// osBypass is the bypass list of every network before Startup,
+	// which is set back on Shutdown.
+	osBypass map[string][]string
+	// webProxySet is true if the web and secure web proxies are set by
+	// op, only then they're cleared.
+	webProxySet bool
 
 	isStartup bool
 }
 
-func NewOSOperator(mode, pacURL, addr, port string) (*OSOperator, error) {
-	if mode != config.ModePAC && mode != config.ModeGlobal {
+func NewOSOperator(mode, pacURL, addr, port, httpPort, rulePort string, bypass []string) (*OSOperator, error) {
+	if !config.IsValidMode(mode) {
 		return nil, fmt.Errorf("unknown mode '%s'", mode)
 	}
 
@@ -33,7 +44,10 @@ func NewOSOperator(mode, pacURL, addr, port string) (*OSOperator, error) {
 			pacURL:    pacURL,
 			localAddr: addr,
 			localPort: port,
+			httpPort:  httpPort,
+			rulePort:  rulePort,
 		},
+		bypass: append([]string(nil), bypass...),
 
 		isStartup: false,
 	}, nil
@@ -44,10 +58,20 @@ func (op *OSOperator) Startup() error {
 		return nil
 	}
 
-	if err := resetProxy(op.cfg); err != nil {
+	osBypass, err := getBypass()
+	if err != nil {
+		return err
+	}
+	if err := op.resetProxy(op.cfg); err != nil {
+		return err
+	}
+	if err := setBypass(op.bypass); err != nil {
+		restoreBypass(osBypass)
+		op.clearProxyByMode(op.cfg.mode)
 		return err
 	}
 
+	op.osBypass = osBypass
 	op.isStartup = true
 	return nil
 }
@@ -57,10 +81,14 @@ func (op *OSOperator) Shutdown() error {
 		return nil
 	}
 
-	if err := clearProxyByMode(op.cfg.mode); err != nil {
+	if err := op.clearProxyByMode(op.cfg.mode); err != nil {
+		return err
+	}
+	if err := restoreBypass(op.osBypass); err != nil {
 		return err
 	}
 
+	op.osBypass = nil
 	op.isStartup = false
 	return nil
 }
@@ -90,7 +118,7 @@ func (op *OSOperator) ChangeLocalPort(newPort string) error {
 		return nil
 	}
 
-	if !op.isStartup || op.cfg.mode == config.ModePAC {
+	if !op.isStartup || op.cfg.mode != config.ModeGlobal {
 		op.cfg.localPort = newPort
 		return nil
 	}
@@ -110,7 +138,7 @@ func (op *OSOperator) ChangePACURL(newURL string) error {
 		return nil
 	}
 
-	if !op.isStartup || op.cfg.mode == config.ModeGlobal {
+	if !op.isStartup || op.cfg.mode != config.ModePAC {
 		op.cfg.pacURL = newURL
 		return nil
 	}
@@ -125,11 +153,24 @@ func (op *OSOperator) ChangePACURL(newURL string) error {
 	return nil
 }
 
+// ChangeBypass sets the new bypass list to every network.
+func (op *OSOperator) ChangeBypass(bypass []string) error {
+	if op.isStartup {
+		if err := setBypass(bypass); err != nil {
+			setBypass(op.bypass)
+			return err
+		}
+	}
+
+	op.bypass = append([]string(nil), bypass...)
+	return nil
+}
+
 func (op *OSOperator) reStartup(newCfg opConfig) (result error) {
 	oldMode := op.cfg.mode
 
 	if newCfg.mode == oldMode {
-		return resetProxy(newCfg)
+		return op.resetProxy(newCfg)
 	}
 
 	// Clear old mode first. Because if we reset newCfg first and
@@ -137,56 +178,152 @@ func (op *OSOperator) reStartup(newCfg opConfig) (result error) {
 	// Clear old mode first will cause the two modes all be cleared when
 	// clearProxyByMode success but resetProxy failed, but I think it's better
 	// all be cleared than exist at the same time.
-	if err := clearProxyByMode(op.cfg.mode); err != nil {
+	if err := op.clearProxyByMode(op.cfg.mode); err != nil {
 		return err
 	}
 	defer func() {
 		if result != nil {
-			resetProxy(op.cfg)
+			op.resetProxy(op.cfg)
 		}
 	}()
 
-	return resetProxy(newCfg)
+	return op.resetProxy(newCfg)
+}
+
+// resetProxy sets the proxies of cfg, and records whether the web
+// proxies are set.
+func (op *OSOperator) resetProxy(cfg opConfig) error {
+	err := resetProxy(cfg, op.webProxySet)
+	if err != nil {
+		// they may be set partly
+		op.webProxySet = op.webProxySet || webProxyOf(cfg)
+	} else {
+		op.webProxySet = webProxyOf(cfg)
+	}
+	return err
 }
 
-func resetProxy(cfg opConfig) error {
+func (op *OSOperator) clearProxyByMode(mode string) error {
+	if err := clearProxyByMode(mode, op.webProxySet); err != nil {
+		return err
+	}
+	op.webProxySet = false
+	return nil
+}
+
+// webProxyOf returns whether the web and secure web proxies are set in cfg.
+func webProxyOf(cfg opConfig) bool {
+	return cfg.mode == config.ModeRule ||
+		(cfg.mode == config.ModeGlobal && len(cfg.httpPort) != 0)
+}
+
+// resetProxy sets the proxies of cfg, the web and secure web proxies
+// are cleared first only if webSet is true.
+func resetProxy(cfg opConfig, webSet bool) error {
 	switch cfg.mode {
 	case config.ModePAC:
-		return setAutoProxy(cfg.pacURL)
+		return setAutoProxy(cfg.pacURL, webSet)
 	case config.ModeGlobal:
-		return setGlobalProxy(cfg.localAddr, cfg.localPort)
+		return setGlobalProxy(cfg.localAddr, cfg.localPort, cfg.httpPort, webSet)
+	case config.ModeRule:
+		// the rule proxy serves http too
+		return setGlobalProxy(cfg.localAddr, cfg.rulePort, cfg.rulePort, webSet)
+	case config.ModeDirect:
+		return clearAllProxy(webSet)
 	default:
 		return fmt.Errorf("unknown mode name '%s'", cfg.mode)
 	}
 }
 
-func clearProxyByMode(mode string) error {
+// clearProxyByMode clears the proxies of mode, the web and secure web
+// proxies are cleared only if webSet is true.
+func clearProxyByMode(mode string, webSet bool) error {
 	switch mode {
 	case config.ModePAC:
 		return clearAutoProxy()
-	case config.ModeGlobal:
-		return clearGlobalProxy()
+	case config.ModeGlobal, config.ModeRule:
+		return clearGlobalProxy(webSet)
+	case config.ModeDirect:
+		// nothing is set in direct mode
+		return nil
 	default:
 		return fmt.Errorf("unknown mode name '%s'", mode)
 	}
 }
 
-func setAutoProxy(url string) error {
-	return setProxy(func(nw string) error {
+func setAutoProxy(url string, webSet bool) error {
+	return setProxy(webSet, func(nw string) error {
 		return api.setAutoProxyFor(nw, url)
 	})
 }
 
-func setGlobalProxy(addr, port string) error {
-	return setProxy(func(nw string) error {
-		return api.setGlobalProxyFor(nw, addr, port)
+// setGlobalProxy sets the socks proxy, and the web and secure web
+// proxies if httpPort is not empty.
+func setGlobalProxy(addr, socksPort, httpPort string, webSet bool) error {
+	return setProxy(webSet || len(httpPort) != 0, func(nw string) error {
+		if err := api.setGlobalProxyFor(nw, addr, socksPort); err != nil {
+			return err
+		}
+		if len(httpPort) == 0 {
+			return nil
+		}
+		if err := api.setWebProxyFor(nw, addr, httpPort); err != nil {
+			return err
+		}
+		return api.setSecureWebProxyFor(nw, addr, httpPort)
 	})
 }
 
-func clearAllProxy() error {
+func setBypass(bypass []string) error {
+	networks, err := api.listAllNetwork()
+	if err != nil {
+		return err
+	}
+
+	for _, nw := range networks {
+		if err := api.setProxyBypassDomains(nw, bypass); err != nil {
+			return fmt.Errorf("set bypass of %s error: %v", nw, err)
+		}
+	}
+
+	return nil
+}
+
+// getBypass returns the bypass list of every network.
+func getBypass() (map[string][]string, error) {
+	networks, err := api.listAllNetwork()
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string][]string)
+	for _, nw := range networks {
+		bypass, err := api.getProxyBypassDomains(nw)
+		if err != nil {
+			return nil, fmt.Errorf("get bypass of %s error: %v", nw, err)
+		}
+		result[nw] = bypass
+	}
+
+	return result, nil
+}
+
+// restoreBypass sets the bypass lists returned by getBypass back.
+func restoreBypass(saved map[string][]string) error {
+	var resultErr error
+	for nw, bypass := range saved {
+		if err := api.setProxyBypassDomains(nw, bypass); err != nil {
+			resultErr = fmt.Errorf("restore bypass of %s error: %v", nw, err)
+		}
+	}
+
+	return resultErr
+}
+
+func clearAllProxy(clearWeb bool) error {
 	return clearProxy(func(network string) error {
 		err1 := api.clearAutoProxyFor(network)
-		err2 := api.clearGlobalProxyFor(network)
+		err2 := clearGlobalProxiesFor(network, clearWeb)
 
 		if err1 != nil {
 			return err1
@@ -204,14 +341,36 @@ func clearAutoProxy() error {
 	})
 }
 
-func clearGlobalProxy() error {
+func clearGlobalProxy(clearWeb bool) error {
 	return clearProxy(func(network string) error {
-		return api.clearGlobalProxyFor(network)
+		return clearGlobalProxiesFor(network, clearWeb)
 	})
 }
 
-func setProxy(setFunc func(string) error) error {
-	clearAllProxy()
+// clearGlobalProxiesFor clears the socks proxy of network, and the web
+// and secure web proxies if clearWeb is true. They may be set by the
+// user, so they're not touched unless ssctrl set them.
+func clearGlobalProxiesFor(network string, clearWeb bool) error {
+	err1 := api.clearGlobalProxyFor(network)
+	if !clearWeb {
+		return err1
+	}
+	err2 := api.clearWebProxyFor(network)
+	err3 := api.clearSecureWebProxyFor(network)
+
+	if err1 != nil {
+		return err1
+	} else if err2 != nil {
+		return err2
+	} else {
+		return err3
+	}
+}
+
+// setProxy clears the proxies and sets them by setFunc, the web and
+// secure web proxies are cleared only if clearWeb is true.
+func setProxy(clearWeb bool, setFunc func(string) error) error {
+	clearAllProxy(clearWeb)
 
 	networks, err := api.listAllNetwork()
 	if err != nil {
@@ -220,7 +379,7 @@ func setProxy(setFunc func(string) error) error {
 
 	for _, nw := range networks {
 		if err := setFunc(nw); err != nil {
-			clearAllProxy()
+			clearAllProxy(clearWeb)
 			return err
 		}
 	}
@@ -1,6 +1,7 @@
 package core
 
 import (
+	"reflect"
 	"testing"
 
 	"github.com/fatcat22/ssctrl/config"
@@ -17,7 +18,7 @@ func TestStartupPAC(t *testing.T) {
 	mapi := resetMockAPI()
 	expectNet, _ := mapi.listAllNetwork()
 
-	op, err := NewOSOperator(expectMode, expectURL, "", "")
+	op, err := NewOSOperator(expectMode, expectURL, "", "", "", "", nil)
 	if err != nil {
 		t.Fatalf("new OSOperator error: %v", err)
 	}
@@ -60,7 +61,7 @@ func TestStartupGlobal(t *testing.T) {
 	mapi := resetMockAPI()
 	expectNet, _ := mapi.listAllNetwork()
 
-	op, err := NewOSOperator(expectMode, "abcd", expectAddr, expectPort)
+	op, err := NewOSOperator(expectMode, "abcd", expectAddr, expectPort, "", "", nil)
 	if err != nil {
 		t.Fatalf("new OSOperator error: %v", err)
 	}
@@ -99,10 +100,175 @@ func TestStartupGlobal(t *testing.T) {
 	}
 }
 
+func TestStartupGlobalWithHTTP(t *testing.T) {
+	const expectAddr = "11.22.99.88"
+	const expectPort = "1234"
+	const expectHTTPPort = "1084"
+	mapi := resetMockAPI()
+
+	op, err := NewOSOperator(config.ModeGlobal, "abcd", expectAddr, expectPort, expectHTTPPort, "", nil)
+	if err != nil {
+		t.Fatalf("new OSOperator error: %v", err)
+	}
+	if err := op.Startup(); err != nil {
+		t.Fatalf("start OSOperator error: %v", err)
+	}
+
+	for name, s := range mapi.settings {
+		if s.mode != modeGlobal|modeWeb|modeSecureWeb {
+			t.Errorf("network %s: expect socks, web and secure web proxies but got mode %d", name, s.mode)
+		}
+		if s.globalPort != expectPort {
+			t.Errorf("network %s: expect socks port '%s' but got '%s'", name, expectPort, s.globalPort)
+		}
+		if s.webAddr != expectAddr || s.webPort != expectHTTPPort {
+			t.Errorf("network %s: expect web proxy %s:%s but got %s:%s", name, expectAddr, expectHTTPPort, s.webAddr, s.webPort)
+		}
+		if s.secureWebAddr != expectAddr || s.secureWebPort != expectHTTPPort {
+			t.Errorf("network %s: expect secure web proxy %s:%s but got %s:%s", name, expectAddr, expectHTTPPort, s.secureWebAddr, s.secureWebPort)
+		}
+	}
+
+	// web proxies are not used by pac mode
+	if err := op.ChangeMode(config.ModePAC); err != nil {
+		t.Fatalf("OSOperator.ChangeMode error: %v", err)
+	}
+	for name, s := range mapi.settings {
+		if s.mode != modePAC || s.webPort != "" || s.secureWebPort != "" {
+			t.Errorf("network %s: expect pac mode only but got mode %d", name, s.mode)
+		}
+	}
+
+	if err := op.ChangeMode(config.ModeGlobal); err != nil {
+		t.Fatalf("OSOperator.ChangeMode error: %v", err)
+	}
+	if err := op.Shutdown(); err != nil {
+		t.Fatalf("shutdown OSOperator error: %v", err)
+	}
+	for name, s := range mapi.settings {
+		if s.mode != 0 || s.webPort != "" || s.secureWebPort != "" {
+			t.Errorf("network %s: expect all proxies cleared but got mode %d", name, s.mode)
+		}
+	}
+}
+
+func TestKeepWebProxyOfUser(t *testing.T) {
+	mapi := resetMockAPI()
+	for name := range mapi.settings {
+		mapi.setWebProxyFor(name, "10.1.1.1", "8080")
+		mapi.setSecureWebProxyFor(name, "10.1.1.1", "8443")
+	}
+
+	op, err := NewOSOperator(config.ModePAC, "abcd", "11.22.33.44", "1234", "", "1085", nil)
+	if err != nil {
+		t.Fatalf("new OSOperator error: %v", err)
+	}
+	if err := op.Startup(); err != nil {
+		t.Fatalf("start OSOperator error: %v", err)
+	}
+	for _, mode := range []string{config.ModeGlobal, config.ModeDirect, config.ModePAC} {
+		if err := op.ChangeMode(mode); err != nil {
+			t.Fatalf("OSOperator.ChangeMode to %s error: %v", mode, err)
+		}
+		for name, s := range mapi.settings {
+			if s.webPort != "8080" || s.secureWebPort != "8443" {
+				t.Errorf("mode %s, network %s: expect web proxies of user kept but got '%s' and '%s'", mode, name, s.webPort, s.secureWebPort)
+			}
+		}
+	}
+
+	// the rule mode sets them, and then they're cleared
+	if err := op.ChangeMode(config.ModeRule); err != nil {
+		t.Fatalf("OSOperator.ChangeMode error: %v", err)
+	}
+	if err := op.Shutdown(); err != nil {
+		t.Fatalf("shutdown OSOperator error: %v", err)
+	}
+	for name, s := range mapi.settings {
+		if s.mode != 0 {
+			t.Errorf("network %s: expect all proxies cleared but got mode %d", name, s.mode)
+		}
+	}
+}
+
+func TestStartupDirect(t *testing.T) {
+	mapi := resetMockAPI()
+	for _, s := range mapi.settings {
+		s.mode = modePAC | modeGlobal
+		s.pacURL = "http://127.0.0.1:2222/proxy.pac"
+		s.globalPort = "1234"
+	}
+
+	op, err := NewOSOperator(config.ModeDirect, "abcd", "11.22.33.44", "1234", "", "", nil)
+	if err != nil {
+		t.Fatalf("new OSOperator error: %v", err)
+	}
+	if err := op.Startup(); err != nil {
+		t.Fatalf("start OSOperator error: %v", err)
+	}
+
+	for name, s := range mapi.settings {
+		if s.mode != 0 || s.pacURL != "" || s.globalPort != "" {
+			t.Errorf("network %s: expect proxy cleared in direct mode but got mode %d", name, s.mode)
+		}
+	}
+
+	if err := op.ChangeMode(config.ModePAC); err != nil {
+		t.Fatalf("OSOperator.ChangeMode error: %v", err)
+	}
+	for name, s := range mapi.settings {
+		if s.mode != modePAC || s.pacURL != "abcd" {
+			t.Errorf("network %s: expect mode pac with url 'abcd' but got mode %d with url '%s'", name, s.mode, s.pacURL)
+		}
+	}
+}
+
+func TestStartupRule(t *testing.T) {
+	const expectAddr = "11.22.33.44"
+	const expectRulePort = "1085"
+	mapi := resetMockAPI()
+
+	op, err := NewOSOperator(config.ModeRule, "abcd", expectAddr, "1234", "", expectRulePort, nil)
+	if err != nil {
+		t.Fatalf("new OSOperator error: %v", err)
+	}
+	if err := op.Startup(); err != nil {
+		t.Fatalf("start OSOperator error: %v", err)
+	}
+
+	for name, s := range mapi.settings {
+		if s.mode != modeGlobal|modeWeb|modeSecureWeb || s.globalAddr != expectAddr || s.globalPort != expectRulePort {
+			t.Errorf("network %s: expect global proxy %s:%s but got mode %d with %s:%s", name, expectAddr, expectRulePort, s.mode, s.globalAddr, s.globalPort)
+		}
+		if s.webPort != expectRulePort || s.secureWebPort != expectRulePort {
+			t.Errorf("network %s: expect web proxies at port %s but got %s and %s", name, expectRulePort, s.webPort, s.secureWebPort)
+		}
+	}
+
+	// local port is not used by rule mode
+	if err := op.ChangeLocalPort("2345"); err != nil {
+		t.Fatalf("OSOperator.ChangeLocalPort error: %v", err)
+	}
+	for name, s := range mapi.settings {
+		if s.globalPort != expectRulePort {
+			t.Errorf("network %s: expect global port %s but got %s", name, expectRulePort, s.globalPort)
+		}
+	}
+
+	if err := op.Shutdown(); err != nil {
+		t.Fatalf("OSOperator.Shutdown error: %v", err)
+	}
+	for name, s := range mapi.settings {
+		if s.mode != 0 {
+			t.Errorf("network %s: expect proxy cleared after shutdown but got mode %d", name, s.mode)
+		}
+	}
+}
+
 func TestShutdownPAC(t *testing.T) {
 	mapi := resetMockAPI()
 
-	op, err := NewOSOperator(config.ModePAC, "abcd", "11.22.33.44", "1234")
+	op, err := NewOSOperator(config.ModePAC, "abcd", "11.22.33.44", "1234", "", "", nil)
 	if err != nil {
 		t.Fatalf("new OSOperator error: %v", err)
 	}
@@ -130,7 +296,7 @@ func TestShutdownPAC(t *testing.T) {
 func TestShutdownGlobal(t *testing.T) {
 	mapi := resetMockAPI()
 
-	op, err := NewOSOperator(config.ModeGlobal, "abcd", "11.22.33.44", "1234")
+	op, err := NewOSOperator(config.ModeGlobal, "abcd", "11.22.33.44", "1234", "", "", nil)
 	if err != nil {
 		t.Fatalf("new OSOperator error: %v", err)
 	}
@@ -164,7 +330,7 @@ func TestChangeMode(t *testing.T) {
 	const expectPort = "1234"
 	mapi := resetMockAPI()
 
-	op, err := NewOSOperator(config.ModePAC, "abcd", expectAddr, expectPort)
+	op, err := NewOSOperator(config.ModePAC, "abcd", expectAddr, expectPort, "", "", nil)
 	if err != nil {
 		t.Fatalf("new OSOperator error: %v", err)
 	}
@@ -179,7 +345,7 @@ func TestChangeMode(t *testing.T) {
 		}
 	}
 
-	op, err = NewOSOperator(config.ModePAC, "abcd", expectAddr, expectPort)
+	op, err = NewOSOperator(config.ModePAC, "abcd", expectAddr, expectPort, "", "", nil)
 	if err != nil {
 		t.Fatalf("new OSOperator error: %v", err)
 	}
@@ -217,7 +383,7 @@ func TestChangeLocalPort(t *testing.T) {
 
 	// test ChangeLocalPort befer Startup
 	mapi := resetMockAPI()
-	op, err := NewOSOperator(config.ModeGlobal, "abcd", expectAddr, oldPort)
+	op, err := NewOSOperator(config.ModeGlobal, "abcd", expectAddr, oldPort, "", "", nil)
 	if err != nil {
 		t.Fatalf("new OSOperator error: %v", err)
 	}
@@ -233,7 +399,7 @@ func TestChangeLocalPort(t *testing.T) {
 
 	// test ChangeLocalPort after startup but with pac mode
 	mapi = resetMockAPI()
-	op, err = NewOSOperator(config.ModePAC, "abcd", expectAddr, oldPort)
+	op, err = NewOSOperator(config.ModePAC, "abcd", expectAddr, oldPort, "", "", nil)
 	if err != nil {
 		t.Fatalf("new OSOperator error: %v", err)
 	}
@@ -252,7 +418,7 @@ func TestChangeLocalPort(t *testing.T) {
 
 	// test ChangeLocalPort after startup and with global mode
 	mapi = resetMockAPI()
-	op, err = NewOSOperator(config.ModeGlobal, "abcd", expectAddr, oldPort)
+	op, err = NewOSOperator(config.ModeGlobal, "abcd", expectAddr, oldPort, "", "", nil)
 	if err != nil {
 		t.Fatalf("new OSOperator error: %v", err)
 	}
@@ -275,7 +441,7 @@ func TestChangePACURL(t *testing.T) {
 
 	// test ChangePACURL befer Startup
 	mapi := resetMockAPI()
-	op, err := NewOSOperator(config.ModePAC, "abcd", "11.22.33.44", "1234")
+	op, err := NewOSOperator(config.ModePAC, "abcd", "11.22.33.44", "1234", "", "", nil)
 	if err != nil {
 		t.Fatalf("new OSOperator error: %v", err)
 	}
@@ -291,7 +457,7 @@ func TestChangePACURL(t *testing.T) {
 
 	// test ChangePACURL after startup but with global mode
 	mapi = resetMockAPI()
-	op, err = NewOSOperator(config.ModeGlobal, "abcd", "11.22.33.44", "1234")
+	op, err = NewOSOperator(config.ModeGlobal, "abcd", "11.22.33.44", "1234", "", "", nil)
 	if err != nil {
 		t.Fatalf("new OSOperator error: %v", err)
 	}
@@ -310,7 +476,7 @@ func TestChangePACURL(t *testing.T) {
 
 	// test ChangePACURL after startup and with pac mode
 	mapi = resetMockAPI()
-	op, err = NewOSOperator(config.ModePAC, "abcd", "11.22.33.44", "1234")
+	op, err = NewOSOperator(config.ModePAC, "abcd", "11.22.33.44", "1234", "", "", nil)
 	if err != nil {
 		t.Fatalf("new OSOperator error: %v", err)
 	}
@@ -327,3 +493,64 @@ func TestChangePACURL(t *testing.T) {
 		}
 	}
 }
+
+func TestChangeBypass(t *testing.T) {
+	oldBypass := []string{"localhost", "10.0.0.0/8"}
+	expectBypass := []string{"*.local", "192.168.0.0/16"}
+	mapi := resetMockAPI()
+
+	op, err := NewOSOperator(config.ModeDirect, "abcd", "11.22.33.44", "1234", "", "", oldBypass)
+	if err != nil {
+		t.Fatalf("new OSOperator error: %v", err)
+	}
+
+	// bypass is set on startup in every mode
+	if err := op.Startup(); err != nil {
+		t.Fatalf("start OSOperator error: %v", err)
+	}
+	for name, s := range mapi.settings {
+		if !reflect.DeepEqual(s.bypass, oldBypass) {
+			t.Errorf("network %s: expect bypass %v but got %v", name, oldBypass, s.bypass)
+		}
+	}
+
+	if err := op.ChangeBypass(expectBypass); err != nil {
+		t.Fatalf("OSOperator.ChangeBypass error: %v", err)
+	}
+	for name, s := range mapi.settings {
+		if !reflect.DeepEqual(s.bypass, expectBypass) {
+			t.Errorf("network %s: expect bypass %v but got %v", name, expectBypass, s.bypass)
+		}
+	}
+}
+
+func TestShutdownRestoreBypass(t *testing.T) {
+	mapi := resetMockAPI()
+	osBypass := map[string][]string{
+		"WiFi": []string{"*.local", "169.254/16"},
+		"wlan": nil,
+	}
+	for name, bypass := range osBypass {
+		mapi.settings[name].bypass = bypass
+	}
+
+	op, err := NewOSOperator(config.ModePAC, "abcd", "11.22.33.44", "1234", "", "", []string{"localhost"})
+	if err != nil {
+		t.Fatalf("new OSOperator error: %v", err)
+	}
+	if err := op.Startup(); err != nil {
+		t.Fatalf("start OSOperator error: %v", err)
+	}
+	if err := op.ChangeBypass([]string{"10.0.0.0/8"}); err != nil {
+		t.Fatalf("OSOperator.ChangeBypass error: %v", err)
+	}
+	if err := op.Shutdown(); err != nil {
+		t.Fatalf("shutdown OSOperator error: %v", err)
+	}
+
+	for name, s := range mapi.settings {
+		if !reflect.DeepEqual(s.bypass, osBypass[name]) {
+			t.Errorf("network %s: expect bypass %v after shutdown but got %v", name, osBypass[name], s.bypass)
+		}
+	}
+}
@@ -0,0 +1,272 @@
+package core
+
+import (
+	"regexp"
+	"strings"
+)
+
+/*
+The AdBlock style rules are compiled to lookup tables instead of being
+matched one by one in the pac file:
+  - "||domain" and "||domain^" rules are indexed by the domain without
+    its last label, so a host is looked up label by label.
+  - plain rules (with optional '|' anchors) are indexed by keyword the same
+    way as Adblock Plus does, and matched by string comparison.
+  - the rest (regexp, wildcard, options...) are matched by regexp.
+The compiled rules make exactly the same decisions as adblockMatcher.
+*/
+
+var (
+	domainRuleRegexp   = regexp.MustCompile(`^[a-z0-9\-_.]+\^?$`)
+	urlAuthorityRegexp = regexp.MustCompile(`^[\w\-]+:/+([^/]*)`)
+)
+
+// rulePattern is a compiled rule, text is the rule it's compiled from.
+type rulePattern struct {
+	pattern string
+	text    string
+}
+
+type compiledRuleList struct {
+	// domains maps a domain without its last label (such as "www.google.")
+	// to the last labels (such as "com"). A last label ends with '^' if
+	// the domain must be followed by a separator.
+	domains map[string][]rulePattern
+	// keywords maps keyword to plain rules. A rule starts or ends with
+	// '|' if it's anchored at the beginning or end of url.
+	keywords map[string][]rulePattern
+	regexps  []*adblockFilter
+}
+
+// compiledRules is the compiled version of AdBlock style rules.
+// Allowed(whitelist) rules take precedence over blocked rules.
+type compiledRules struct {
+	block *compiledRuleList
+	allow *compiledRuleList
+}
+
+func compilePACRules(rules []string) *compiledRules {
+	c := &compiledRules{
+		block: newCompiledRuleList(),
+		allow: newCompiledRuleList(),
+	}
+
+	added := make(map[string]struct{}, len(rules))
+	for _, r := range rules {
+		if _, ok := added[r]; ok {
+			continue
+		}
+		f := parseAdblockFilter(r)
+		if f == nil {
+			continue
+		}
+		added[r] = struct{}{}
+
+		if f.whitelist {
+			c.allow.add(f)
+		} else {
+			c.block.add(f)
+		}
+	}
+	return c
+}
+
+// match returns the rule matches location, and whether the
+// location should be proxied. rule is empty if no rule matches.
+func (c *compiledRules) match(location, host string) (rule string, proxy bool) {
+	if rule := c.allow.match(location, host); len(rule) != 0 {
+		return rule, false
+	}
+	if rule := c.block.match(location, host); len(rule) != 0 {
+		return rule, true
+	}
+	return "", false
+}
+
+func newCompiledRuleList() *compiledRuleList {
+	return &compiledRuleList{
+		domains:  make(map[string][]rulePattern),
+		keywords: make(map[string][]rulePattern),
+	}
+}
+
+func (l *compiledRuleList) add(f *adblockFilter) {
+	text := strings.ToLower(strings.TrimPrefix(f.text, "@@"))
+	if strings.ContainsAny(text, "$*") || (len(text) >= 2 && text[0] == '/' && text[len(text)-1] == '/') {
+		l.regexps = append(l.regexps, f)
+		return
+	}
+
+	if strings.HasPrefix(text, "||") && domainRuleRegexp.MatchString(text[2:]) {
+		domain := text[2:]
+		dot := strings.LastIndex(domain, ".")
+		key, tail := domain[:dot+1], domain[dot+1:]
+		l.domains[key] = append(l.domains[key], rulePattern{pattern: tail, text: f.text})
+		return
+	}
+
+	body := strings.TrimPrefix(text, "|")
+	body = strings.TrimSuffix(body, "|")
+	if len(body) == 0 || strings.ContainsAny(body, "|^") {
+		l.regexps = append(l.regexps, f)
+		return
+	}
+	keyword := l.findKeyword(text)
+	l.keywords[keyword] = append(l.keywords[keyword], rulePattern{pattern: text, text: f.text})
+}
+
+// findKeyword chooses the keyword with the least rules, the same as adblockList.
+func (l *compiledRuleList) findKeyword(text string) string {
+	result := ""
+	resultCount := 0xFFFFFF
+	for _, candidate := range filterKeywordCandidates(text) {
+		count := len(l.keywords[candidate])
+		if count < resultCount || (count == resultCount && len(candidate) > len(result)) {
+			result = candidate
+			resultCount = count
+		}
+	}
+	return result
+}
+
+// match returns the text of the rule matches location,
+// or empty string if no rule matches.
+func (l *compiledRuleList) match(location, host string) string {
+	lower := strings.ToLower(location)
+
+	if m := urlAuthorityRegexp.FindStringSubmatch(lower); m != nil {
+		if rule := l.matchDomains(m[1]); len(rule) != 0 {
+			return rule
+		}
+	}
+
+	for _, keyword := range append(locationKeywords(lower), "") {
+		for _, p := range l.keywords[keyword] {
+			if matchRulePattern(lower, p.pattern) {
+				return p.text
+			}
+		}
+	}
+
+	for _, f := range l.regexps {
+		if f.matches(location, host) {
+			return f.text
+		}
+	}
+	return ""
+}
+
+// matchDomains looks up the domains of authority. A domain may start
+// at the beginning of authority or after any dot but the first char,
+// the same as the regexp of "||domain" rule.
+func (l *compiledRuleList) matchDomains(authority string) string {
+	start := 0
+	for {
+		end := start
+		for {
+			for _, p := range l.domains[authority[start:end]] {
+				if matchDomainTail(authority, end, p.pattern) {
+					return p.text
+				}
+			}
+			dot := strings.IndexByte(authority[end:], '.')
+			if dot < 0 {
+				break
+			}
+			end += dot + 1
+		}
+
+		from := start
+		if from == 0 {
+			from = 1
+		}
+		if from >= len(authority) {
+			return ""
+		}
+		dot := strings.IndexByte(authority[from:], '.')
+		if dot < 0 {
+			return ""
+		}
+		start = from + dot + 1
+	}
+}
+
+func matchDomainTail(authority string, end int, tail string) bool {
+	sep := strings.HasSuffix(tail, "^")
+	if sep {
+		tail = tail[:len(tail)-1]
+	}
+	if !strings.HasPrefix(authority[end:], tail) {
+		return false
+	}
+	next := end + len(tail)
+	return !sep || next == len(authority) || isAdblockSeparator(authority[next])
+}
+
+func matchRulePattern(location, pattern string) bool {
+	begin := strings.HasPrefix(pattern, "|")
+	if begin {
+		pattern = pattern[1:]
+	}
+	end := strings.HasSuffix(pattern, "|")
+	if end {
+		pattern = pattern[:len(pattern)-1]
+	}
+
+	switch {
+	case begin && end:
+		return location == pattern
+	case begin:
+		return strings.HasPrefix(location, pattern)
+	case end:
+		return strings.HasSuffix(location, pattern)
+	default:
+		return strings.Contains(location, pattern)
+	}
+}
+
+// isAdblockSeparator reports whether c matches '^' of AdBlock filters.
+func isAdblockSeparator(c byte) bool {
+	if c >= 0x80 {
+		return false
+	}
+	isWord := (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+	return !isWord && c != '_' && c != '%' && c != '.' && c != '-'
+}
+
+type jsRegexpRule struct {
+	Source  string          `json:"source"`
+	Flags   string          `json:"flags"`
+	Domains map[string]bool `json:"domains,omitempty"`
+}
+
+// jsObject returns the compiled rules in the form used by the pac file.
+func (l *compiledRuleList) jsObject() interface{} {
+	patterns := func(m map[string][]rulePattern) map[string][]string {
+		result := make(map[string][]string, len(m))
+		for k, ps := range m {
+			for _, p := range ps {
+				result[k] = append(result[k], p.pattern)
+			}
+		}
+		return result
+	}
+
+	regexps := []jsRegexpRule{}
+	for _, f := range l.regexps {
+		r := jsRegexpRule{
+			Source:  f.source,
+			Domains: f.domains,
+		}
+		if !f.matchCase {
+			r.Flags = "i"
+		}
+		regexps = append(regexps, r)
+	}
+
+	return map[string]interface{}{
+		"domains":  patterns(l.domains),
+		"keywords": patterns(l.keywords),
+		"regexps":  regexps,
+	}
+}
@@ -0,0 +1,129 @@
+package core
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCompiledRules(t *testing.T) {
+	c := compilePACRules(matcherTestRules)
+
+	if tails := c.block.domains["google."]; len(tails) != 1 || tails[0].pattern != "com" {
+		t.Errorf("expect '||google.com' compiled to domain 'google.' but got %v", tails)
+	}
+	if tails := c.allow.domains["ssl.gstatic."]; len(tails) != 1 || tails[0].pattern != "com" {
+		t.Errorf("expect '@@||ssl.gstatic.com' compiled to domain 'ssl.gstatic.' but got %v", tails)
+	}
+	if patterns := c.block.keywords["casinobellini"]; len(patterns) != 1 || patterns[0].pattern != ".casinobellini.com" {
+		t.Errorf("expect '.casinobellini.com' compiled to keyword 'casinobellini' but got %v", patterns)
+	}
+	if len(c.block.regexps) != 3 {
+		t.Errorf("expect 3 regexp rules but got %d", len(c.block.regexps))
+	}
+}
+
+// pacScriptCheckStep is the step of the urls made from gfwlist which
+// are checked by the pac file in TestCompiledRulesSameAsMatcher.
+var pacScriptCheckStep = 50
+
+func TestCompiledRulesSameAsMatcher(t *testing.T) {
+	rules := append([]string{
+		"||sep.example.com^",
+		"||nodot",
+		"|https://anchor.example.com|",
+		"suffix.example.com/end|",
+		"@@||allow.sep.example.com^",
+	}, matcherTestRules...)
+	gfwRules, err := loadPACRules("../gfwlist.js")
+	if err != nil {
+		t.Fatalf("load gfwlist.js error: %v", err)
+	}
+	rules = append(rules, gfwRules...)
+
+	m := newAdblockMatcher(rules)
+	c := compilePACRules(rules)
+
+	// the tables are emitted to JavaScript, so the rendered pac file is
+	// checked by the same urls too.
+	content := pacContent{
+		rules:     rules,
+		compiled:  c,
+		ipRules:   &ipRuleList{},
+		localAddr: "127.0.0.1",
+		localPort: "1080",
+	}
+	pacData, err := content.renderPAC(time.Now())
+	if err != nil {
+		t.Fatalf("render pac error: %v", err)
+	}
+	script, err := newPACScript(pacData.data)
+	if err != nil {
+		t.Fatalf("create pac script error: %v", err)
+	}
+
+	urls := []string{
+		"https://www.google.com/search",
+		"https://google.com.hk/",
+		"https://notgoogle.com/",
+		"http://85.17.73.31/abc",
+		"https://share.dmhy.org/",
+		"https://abc.blogspot.com/",
+		"https://ssl.gstatic.com/a.js",
+		"http://example.net/path/abc",
+		"http://example.net/pathabc",
+		"http://sep.example.com/",
+		"http://sep.example.com:8080/",
+		"http://sep.example.community/",
+		"http://a.allow.sep.example.com/",
+		"http://nodot.example.com/",
+		"http://x.nodotty.com/",
+		"https://anchor.example.com",
+		"https://anchor.example.com/",
+		"http://a.suffix.example.com/end",
+		"http://a.suffix.example.com/end/",
+		"http://www.baidu.com/?q=www.youtube.com",
+		"https://WWW.YouTube.COM/watch",
+		"ftp://127.0.0.1/",
+		"data:text/plain,google.com",
+	}
+	handWritten := len(urls)
+	for _, r := range gfwRules {
+		// make urls which are likely to be matched by the rule
+		text := strings.Trim(strings.TrimPrefix(r, "@@"), "|^")
+		if strings.ContainsAny(text, "/$*") {
+			continue
+		}
+		urls = append(urls, "https://"+text+"/", "http://www."+text+".hk/", "http://a"+text+"/")
+	}
+
+	for i, u := range urls {
+		host := ""
+		if matched := urlAuthorityRegexp.FindStringSubmatch(u); matched != nil {
+			host = matched[1]
+		}
+
+		expectProxy := false
+		if f := m.matchesAny(u, host); f != nil {
+			expectProxy = !f.whitelist
+		}
+		rule, proxy := c.match(u, host)
+		if proxy != expectProxy {
+			t.Errorf("url '%s': expect proxy %v but got %v by '%s'", u, expectProxy, proxy, rule)
+		}
+
+		// the interpreter is slow, so only a part of the urls made
+		// from gfwlist are checked by it.
+		if i >= handWritten && (i-handWritten)%pacScriptCheckStep != 0 {
+			continue
+		}
+		pac, err := script.findProxyForURL(u, host)
+		if err != nil {
+			t.Errorf("url '%s': FindProxyForURL error: %v", u, err)
+			continue
+		}
+		if jsProxy := !strings.HasPrefix(pac, "DIRECT"); jsProxy != expectProxy {
+			t.Errorf("url '%s': expect proxy %v but pac file returns '%s'", u, expectProxy, pac)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package core
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const pacContentType = "application/x-ns-proxy-autoconfig"
+
+// renderedPAC is a rendered pac file ready to be served.
+type renderedPAC struct {
+	data    []byte
+	gzData  []byte
+	etag    string
+	modTime time.Time
+}
+
+func newRenderedPAC(data []byte, modTime time.Time) (*renderedPAC, error) {
+	var buf bytes.Buffer
+	zw, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	sum := sha1.Sum(data)
+	return &renderedPAC{
+		data:    data,
+		gzData:  buf.Bytes(),
+		etag:    hex.EncodeToString(sum[:]),
+		modTime: modTime,
+	}, nil
+}
+
+// serve writes the pac file to w. Conditional requests, range requests
+// and HEAD are handled by http.ServeContent.
+func (rp *renderedPAC) serve(w http.ResponseWriter, req *http.Request) {
+	h := w.Header()
+	h.Set("Content-Type", pacContentType)
+	h.Set("Cache-Control", "no-cache")
+	h.Add("Vary", "Accept-Encoding")
+
+	data := rp.data
+	if acceptsGzip(req) {
+		data = rp.gzData
+		h.Set("Content-Encoding", "gzip")
+		// the gzipped file is a different representation
+		h.Set("ETag", `"`+rp.etag+`-gzip"`)
+	} else {
+		h.Set("ETag", `"`+rp.etag+`"`)
+	}
+
+	http.ServeContent(w, req, "", rp.modTime, bytes.NewReader(data))
+}
+
+// acceptsGzip reports whether the client accepts gzip encoding.
+func acceptsGzip(req *http.Request) bool {
+	for _, coding := range strings.Split(req.Header.Get("Accept-Encoding"), ",") {
+		params := strings.Split(coding, ";")
+		if strings.ToLower(strings.TrimSpace(params[0])) != "gzip" {
+			continue
+		}
+		for _, p := range params[1:] {
+			p = strings.TrimSpace(p)
+			if !strings.HasPrefix(p, "q=") {
+				continue
+			}
+			if q, err := strconv.ParseFloat(p[2:], 64); err == nil && q == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
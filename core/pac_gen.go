@@ -0,0 +1,217 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/fatcat22/ssctrl/config"
+)
+
+var pacTemplate = template.Must(template.New("pac").Parse(defaultPACTemplate))
+
+// pacContent contains everything needed to generate a pac file.
+type pacContent struct {
+	// tmpl is the template of pac file, pacTemplate is used if it's nil.
+	tmpl *template.Template
+
+	rules     []string
+	compiled  *compiledRules
+	userRules config.UserRules
+	ipRules   *ipRuleList
+	// whitelist tells rules are the whitelist, hosts
+	// not matched by any rule go proxy.
+	whitelist bool
+
+	localAddr string
+	localPort string
+	// httpPort is empty if http proxy is disabled.
+	httpPort string
+	bypass   []string
+}
+
+/*
+pacTemplateData is the data of pac templates, including the ones supplied
+by users. Fields of type string except the socks address and port are
+JavaScript literals which can be assigned to variables directly, such as
+'var rules = {{.Rules}};'.
+*/
+type pacTemplateData struct {
+	// Proxy is the value returned by FindProxyForURL to use socks proxy.
+	Proxy     string
+	SocksAddr string
+	SocksPort string
+	// HTTPPort is the port of http proxy listening on SocksAddr,
+	// it's empty if http proxy is disabled.
+	HTTPPort string
+
+	// Rules is the list of AdBlock style rules loaded from pac file,
+	// and BlockRules and AllowRules are the compiled ones.
+	Rules      string
+	BlockRules string
+	AllowRules string
+
+	// Bypass is the list of hosts and networks which never use proxy,
+	// BypassDomains and BypassNets are the ones used by the default pac
+	// file. Like the OS proxy settings, BypassNets match ip hosts only.
+	Bypass        string
+	BypassDomains string
+	BypassNets    string
+
+	UserProxyDomains  string
+	UserDirectDomains string
+	UserProxyNets     string
+	UserDirectNets    string
+
+	IPRanges     string
+	IPRulesProxy bool
+	IPRulesFirst bool
+
+	Whitelist bool
+}
+
+func (pc *pacContent) render() ([]byte, error) {
+	proxyDomains, proxyNets := splitUserRules(pc.userRules.Proxy)
+	directDomains, directNets := splitUserRules(pc.userRules.Direct)
+	bypassDomains, bypassNets := splitUserRules(bypassRules(pc.bypass))
+
+	data := pacTemplateData{
+		Proxy:     pc.proxy(),
+		SocksAddr: pc.localAddr,
+		SocksPort: pc.localPort,
+		HTTPPort:  pc.httpPort,
+
+		IPRulesProxy: pc.ipRules.route == config.IPRouteProxy,
+		IPRulesFirst: pc.ipRules.before,
+
+		Whitelist: pc.whitelist,
+	}
+	ipRanges, err := pc.ipRules.jsRanges()
+	if err != nil {
+		return nil, err
+	}
+	data.IPRanges = ipRanges
+
+	fields := []struct {
+		dst *string
+		v   interface{}
+	}{
+		{&data.Rules, pc.rules},
+		{&data.Bypass, pc.bypass},
+		{&data.BypassDomains, bypassDomains},
+		{&data.BypassNets, bypassNets},
+		{&data.BlockRules, pc.compiled.block.jsObject()},
+		{&data.AllowRules, pc.compiled.allow.jsObject()},
+		{&data.UserProxyDomains, proxyDomains},
+		{&data.UserDirectDomains, directDomains},
+		{&data.UserProxyNets, proxyNets},
+		{&data.UserDirectNets, directNets},
+	}
+	for _, f := range fields {
+		s, err := toJSList(f.v)
+		if err != nil {
+			return nil, err
+		}
+		*f.dst = s
+	}
+
+	tmpl := pc.tmpl
+	if tmpl == nil {
+		tmpl = pacTemplate
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// loadPACTemplate parses a pac template file, see pacTemplateData
+// for the data of it. It returns nil if file is empty.
+func loadPACTemplate(file string) (*template.Template, error) {
+	if len(file) == 0 {
+		return nil, nil
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := template.New(filepath.Base(file)).Parse(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid pac template: %v", err)
+	}
+	return tmpl, nil
+}
+
+// proxy returns the socks proxy, followed by the http proxy if it's enabled.
+func (pc *pacContent) proxy() string {
+	proxy := fmt.Sprintf("SOCKS5 %s:%s; SOCKS %s:%s; ", pc.localAddr, pc.localPort, pc.localAddr, pc.localPort)
+	if len(pc.httpPort) != 0 {
+		proxy += fmt.Sprintf("PROXY %s:%s; ", pc.localAddr, pc.httpPort)
+	}
+	return proxy + "DIRECT;"
+}
+
+// renderPAC renders pac file which was changed at modTime.
+func (pc *pacContent) renderPAC(modTime time.Time) (*renderedPAC, error) {
+	data, err := pc.render()
+	if err != nil {
+		return nil, err
+	}
+	return newRenderedPAC(data, modTime)
+}
+
+// splitUserRules splits user rules into domain list and
+// network list. Every network is a pair of ip and mask which
+// can be used by isInNet of pac directly.
+func splitUserRules(rules []string) ([]string, [][2]string) {
+	domains := []string{}
+	nets := [][2]string{}
+
+	for _, r := range rules {
+		if !strings.Contains(r, "/") {
+			domains = append(domains, strings.ToLower(r))
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(r)
+		if err != nil || ipNet.IP.To4() == nil {
+			continue
+		}
+		nets = append(nets, [2]string{ipNet.IP.String(), net.IP(ipNet.Mask).String()})
+	}
+
+	return domains, nets
+}
+
+// bypassRules converts bypass entries to user rules: "*." is trimmed
+// from domains, and ip addresses are converted to CIDRs.
+func bypassRules(bypass []string) []string {
+	rules := make([]string, 0, len(bypass))
+	for _, b := range bypass {
+		if ip := net.ParseIP(b); ip != nil && ip.To4() != nil {
+			rules = append(rules, ip.String()+"/32")
+			continue
+		}
+		rules = append(rules, strings.TrimPrefix(b, "*."))
+	}
+	return rules
+}
+
+func toJSList(v interface{}) (string, error) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if string(data) == "null" {
+		return "[]", nil
+	}
+	return string(data), nil
+}
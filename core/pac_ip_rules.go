@@ -0,0 +1,139 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/fatcat22/ssctrl/config"
+)
+
+// ipRuleList is a list of ip v4 networks loaded from IPRulesConfig.File.
+// Hosts resolved to these networks take route.
+type ipRuleList struct {
+	nets   []*net.IPNet
+	route  string
+	before bool
+
+	// ranges are the sorted and merged ranges of nets, every range
+	// is a pair of the first and the last ip as integers.
+	ranges [][2]uint32
+}
+
+// loadIPRules returns an empty list if ip rules are disabled.
+func loadIPRules(cfg config.IPRulesConfig) (*ipRuleList, error) {
+	l := &ipRuleList{
+		route:  cfg.GetRoute(),
+		before: cfg.IsBeforeDomainRules(),
+	}
+	if !cfg.IsEnabled() {
+		return l, nil
+	}
+
+	data, err := ioutil.ReadFile(cfg.File)
+	if err != nil {
+		return nil, err
+	}
+	nets, err := parseIPRules(data)
+	if err != nil {
+		return nil, fmt.Errorf("load ip rules from '%s' error: %v", cfg.File, err)
+	}
+
+	l.nets = nets
+	l.ranges = mergeIPRanges(nets)
+	return l, nil
+}
+
+// parseIPRules parses one CIDR or ip v4 address per line.
+// Empty lines and lines start with '#' are ignored.
+func parseIPRules(data []byte) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !strings.Contains(line, "/") {
+			line += "/32"
+		}
+
+		ip, n, err := net.ParseCIDR(line)
+		if err != nil || ip.To4() == nil {
+			return nil, fmt.Errorf("invalid ip v4 CIDR '%s'", line)
+		}
+		nets = append(nets, n)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return nets, nil
+}
+
+func mergeIPRanges(nets []*net.IPNet) [][2]uint32 {
+	ranges := make([][2]uint32, 0, len(nets))
+	for _, n := range nets {
+		first := binary.BigEndian.Uint32(n.IP.To4())
+		last := first | ^binary.BigEndian.Uint32(net.IP(n.Mask).To4())
+		ranges = append(ranges, [2]uint32{first, last})
+	}
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i][0] < ranges[j][0] })
+
+	var merged [][2]uint32
+	for _, r := range ranges {
+		if len(merged) != 0 {
+			prev := &merged[len(merged)-1]
+			if uint64(r[0]) <= uint64(prev[1])+1 {
+				if r[1] > prev[1] {
+					prev[1] = r[1]
+				}
+				continue
+			}
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// match returns the network contains ip, or empty string if no network matches.
+func (l *ipRuleList) match(ip string) string {
+	parsed := net.ParseIP(ip).To4()
+	if parsed == nil || len(l.ranges) == 0 {
+		return ""
+	}
+
+	n := binary.BigEndian.Uint32(parsed)
+	i := sort.Search(len(l.ranges), func(i int) bool { return l.ranges[i][1] >= n })
+	if i == len(l.ranges) || l.ranges[i][0] > n {
+		return ""
+	}
+
+	for _, ipNet := range l.nets {
+		if ipNet.Contains(parsed) {
+			return ipNet.String()
+		}
+	}
+	return ""
+}
+
+// jsRanges returns ranges as a flat JavaScript array of numbers.
+func (l *ipRuleList) jsRanges() (string, error) {
+	flat := make([]uint32, 0, 2*len(l.ranges))
+	for _, r := range l.ranges {
+		flat = append(flat, r[0], r[1])
+	}
+
+	// one number per line is too long for thousands of ranges
+	data, err := json.Marshal(flat)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
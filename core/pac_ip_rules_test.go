@@ -0,0 +1,135 @@
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/fatcat22/ssctrl/common"
+	"github.com/fatcat22/ssctrl/config"
+)
+
+const mockIPRules = `# chnroutes
+1.0.1.0/24
+1.0.2.0/23
+10.0.0.0/8
+10.1.0.0/16
+
+114.114.114.114
+`
+
+func createIPRulesFile(t *testing.T) string {
+	file, err := common.TempFile()
+	if err != nil {
+		t.Fatalf("create ip rules file error: %v", err)
+	}
+	if err := ioutil.WriteFile(file, []byte(mockIPRules), os.ModePerm); err != nil {
+		t.Fatalf("write ip rules file error: %v", err)
+	}
+	return file
+}
+
+func TestLoadIPRules(t *testing.T) {
+	file := createIPRulesFile(t)
+	defer os.Remove(file)
+
+	l, err := loadIPRules(config.IPRulesConfig{File: file})
+	if err != nil {
+		t.Fatalf("load ip rules error: %v", err)
+	}
+	if l.route != config.IPRouteDirect || !l.before {
+		t.Errorf("expect default route direct before domain rules but got %s, %v", l.route, l.before)
+	}
+
+	// 1.0.1.0/24 and 1.0.2.0/23 are merged, and 10.1.0.0/16 is in 10.0.0.0/8
+	expectRanges := `[16777472,16778239,167772160,184549375,1920103026,1920103026]`
+	if ranges, _ := l.jsRanges(); ranges != expectRanges {
+		t.Errorf("expect ranges %s but got %s", expectRanges, ranges)
+	}
+
+	cases := map[string]string{
+		"1.0.1.1":         "1.0.1.0/24",
+		"1.0.3.255":       "1.0.2.0/23",
+		"1.0.4.0":         "",
+		"10.1.2.3":        "10.0.0.0/8",
+		"114.114.114.114": "114.114.114.114/32",
+		"114.114.114.115": "",
+		"":                "",
+	}
+	for ip, expect := range cases {
+		if got := l.match(ip); got != expect {
+			t.Errorf("ip '%s': expect rule '%s' but got '%s'", ip, expect, got)
+		}
+	}
+
+	if _, err := parseIPRules([]byte("1.0.1.0/24\n2001:db8::/32\n")); err == nil {
+		t.Errorf("parse ip v6 rules should be failed")
+	}
+	if l, err := loadIPRules(config.IPRulesConfig{}); err != nil || len(l.ranges) != 0 {
+		t.Errorf("expect empty ip rules but got %v, %v", l, err)
+	}
+}
+
+func TestPACRouterIPRules(t *testing.T) {
+	file := createIPRulesFile(t)
+	defer os.Remove(file)
+
+	cases := []struct {
+		cfg         config.IPRulesConfig
+		url         string
+		expectRoute string
+		expectRule  string
+	}{
+		{config.IPRulesConfig{File: file}, "http://10.2.3.4/", RouteDirect, "10.0.0.0/8"},
+		{config.IPRulesConfig{File: file, Order: config.IPRulesAfter}, "http://10.2.3.4/", RouteProxy, "||10.2.3.4"},
+		{config.IPRulesConfig{File: file, Route: config.IPRouteProxy, Order: config.IPRulesAfter}, "http://1.0.1.1/", RouteProxy, "1.0.1.0/24"},
+		{config.IPRulesConfig{File: file, Route: config.IPRouteProxy}, "http://1.0.4.1/", RouteDirect, ""},
+	}
+	for _, c := range cases {
+		ipRules, err := loadIPRules(c.cfg)
+		if err != nil {
+			t.Fatalf("load ip rules error: %v", err)
+		}
+		rules := []string{"||10.2.3.4"}
+		r := newPACRouter(&pacContent{rules: rules, compiled: compilePACRules(rules), ipRules: ipRules})
+
+		result, err := r.route(c.url)
+		if err != nil {
+			t.Fatalf("route '%s' error: %v", c.url, err)
+		}
+		if result.Route != c.expectRoute || result.Rule != c.expectRule {
+			t.Errorf("url '%s' with %v: expect route '%s' by '%s' but got '%s' by '%s'", c.url, c.cfg, c.expectRoute, c.expectRule, result.Route, result.Rule)
+		}
+	}
+}
+
+func TestPACServerIPRules(t *testing.T) {
+	const port = "1042"
+
+	file := createIPRulesFile(t)
+	defer os.Remove(file)
+	tmpPAC := createMockPACFile("||hello.example.com", t)
+	defer os.Remove(tmpPAC)
+
+	srv, err := NewPACServer(port, "127.0.0.1", "1080", PACOptions{
+		PACFile: tmpPAC,
+		IPRules: config.IPRulesConfig{File: file, Route: config.IPRouteProxy, Order: config.IPRulesAfter},
+	})
+	if err != nil {
+		t.Fatalf("create pac server error: %v", err)
+	}
+	srv.Startup()
+	defer srv.Shutdown()
+
+	checkGetPAC(t, "var ipRanges = [16777472,16778239,", port)
+	checkGetPAC(t, "var ipRulesProxy = true;", port)
+	checkGetPAC(t, "var ipRulesFirst = false;", port)
+
+	if _, err := NewPACServer(port, "127.0.0.1", "1080", PACOptions{
+		PACFile: tmpPAC,
+		IPRules: config.IPRulesConfig{File: file + ".notexist"},
+	}); err == nil || !strings.Contains(err.Error(), "notexist") {
+		t.Errorf("create pac server with missing ip rules file should be failed: %v", err)
+	}
+}
@@ -0,0 +1,351 @@
+package core
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+)
+
+/*
+This file is a go version of the Adblock Plus matcher used by gfwlist.js
+(Filter, RegExpFilter, Matcher and CombinedMatcher). Only the parts used by
+FindProxyForURL are ported, so content type, third party and sitekey options
+are parsed but ignored, the same as gfwlist.js does. The served pac file
+uses the compiled rules(see pac_compile.go), which make the same decisions
+as adblockMatcher.
+*/
+
+// adblockSeparator is what '^' means in AdBlock filters.
+const adblockSeparator = `(?:[\x00-\x24\x26-\x2C\x2F\x3A-\x40\x5B-\x5E\x60\x7B-\x7F]|$)`
+
+var (
+	filterRegexpRegexp  = regexp.MustCompile(`^(@@)?\/.*\/(?:\$~?[\w\-]+(?:=[^,\s]+)?(?:,~?[\w\-]+(?:=[^,\s]+)?)*)?$`)
+	filterOptionsRegexp = regexp.MustCompile(`\$(~?[\w\-]+(?:=[^,\s]+)?(?:,~?[\w\-]+(?:=[^,\s]+)?)*)$`)
+	multiStarRegexp     = regexp.MustCompile(`\*+`)
+
+	filterTypeOptions = map[string]struct{}{
+		"OTHER": {}, "SCRIPT": {}, "IMAGE": {}, "STYLESHEET": {}, "OBJECT": {},
+		"SUBDOCUMENT": {}, "DOCUMENT": {}, "XBL": {}, "PING": {}, "XMLHTTPREQUEST": {},
+		"OBJECT_SUBREQUEST": {}, "DTD": {}, "MEDIA": {}, "FONT": {}, "BACKGROUND": {},
+		"POPUP": {}, "ELEMHIDE": {},
+	}
+)
+
+type adblockFilter struct {
+	text      string
+	whitelist bool
+	matchCase bool
+	// domains is nil if the filter is active on all domains.
+	domains map[string]bool
+
+	source  string
+	regexp  *regexp.Regexp
+	compile sync.Once
+}
+
+// parseAdblockFilter returns nil if text is a comment or an invalid filter.
+func parseAdblockFilter(text string) *adblockFilter {
+	if len(text) == 0 || text[0] == '!' {
+		return nil
+	}
+
+	f := &adblockFilter{
+		text: text,
+	}
+	if strings.HasPrefix(text, "@@") {
+		f.whitelist = true
+		text = text[2:]
+	}
+
+	if strings.Contains(text, "$") {
+		if loc := filterOptionsRegexp.FindStringSubmatchIndex(text); loc != nil {
+			options := strings.Split(strings.ToUpper(text[loc[2]:loc[3]]), ",")
+			text = text[:loc[0]]
+			if !f.parseOptions(options) {
+				return nil
+			}
+		}
+	}
+
+	if len(text) >= 2 && text[0] == '/' && text[len(text)-1] == '/' {
+		f.source = text[1 : len(text)-1]
+	} else {
+		f.source = adblockToRegexp(text)
+	}
+	return f
+}
+
+func (f *adblockFilter) parseOptions(options []string) bool {
+	for _, option := range options {
+		var value string
+		if idx := strings.Index(option, "="); idx >= 0 {
+			value = option[idx+1:]
+			option = option[:idx]
+		}
+		option = strings.Replace(option, "-", "_", 1)
+
+		switch {
+		case isFilterTypeOption(option):
+		case strings.HasPrefix(option, "~") && isFilterTypeOption(option[1:]):
+		case option == "MATCH_CASE":
+			f.matchCase = true
+		case option == "~MATCH_CASE":
+			f.matchCase = false
+		case option == "DOMAIN" && len(value) != 0:
+			f.domains = parseFilterDomains(value)
+		case option == "THIRD_PARTY", option == "~THIRD_PARTY",
+			option == "COLLAPSE", option == "~COLLAPSE",
+			option == "SITEKEY":
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func isFilterTypeOption(option string) bool {
+	_, ok := filterTypeOptions[option]
+	return ok
+}
+
+func parseFilterDomains(value string) map[string]bool {
+	domains := make(map[string]bool)
+	hasIncludes := false
+	for _, d := range strings.Split(value, "|") {
+		if len(d) == 0 {
+			continue
+		}
+		if d[0] == '~' {
+			domains[d[1:]] = false
+		} else {
+			domains[d] = true
+			hasIncludes = true
+		}
+	}
+	domains[""] = !hasIncludes
+	return domains
+}
+
+// adblockToRegexp converts a simple AdBlock filter to regular expression.
+func adblockToRegexp(text string) string {
+	text = multiStarRegexp.ReplaceAllString(text, "*")
+	if strings.HasSuffix(text, "^|") {
+		text = text[:len(text)-1]
+	}
+
+	var prefix, suffix string
+	if strings.HasPrefix(text, "||") {
+		prefix = `^[\w\-]+:\/+(?:[^\/]+\.)?`
+		text = text[2:]
+	} else if strings.HasPrefix(text, "|") {
+		prefix = "^"
+		text = text[1:]
+	}
+	if strings.HasSuffix(text, "|") {
+		suffix = "$"
+		text = text[:len(text)-1]
+	}
+
+	var body strings.Builder
+	for _, c := range text {
+		switch c {
+		case '*':
+			body.WriteString(".*")
+		case '^':
+			body.WriteString(adblockSeparator)
+		default:
+			body.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	source := prefix + body.String() + suffix
+	source = strings.TrimPrefix(source, ".*")
+	source = strings.TrimSuffix(source, ".*")
+	return source
+}
+
+func (f *adblockFilter) getRegexp() *regexp.Regexp {
+	f.compile.Do(func() {
+		source := f.source
+		if !f.matchCase {
+			source = "(?i)" + source
+		}
+		// an invalid regexp never matches, the same as InvalidFilter
+		f.regexp, _ = regexp.Compile(source)
+	})
+	return f.regexp
+}
+
+func (f *adblockFilter) matches(location, host string) bool {
+	re := f.getRegexp()
+	if re == nil || !re.MatchString(location) {
+		return false
+	}
+	return f.isActiveOnDomain(host)
+}
+
+func (f *adblockFilter) isActiveOnDomain(host string) bool {
+	if f.domains == nil {
+		return true
+	}
+	if len(host) == 0 {
+		return f.domains[""]
+	}
+
+	host = strings.ToUpper(strings.TrimRight(host, "."))
+	for {
+		if active, ok := f.domains[host]; ok {
+			return active
+		}
+		dot := strings.Index(host, ".")
+		if dot < 0 {
+			break
+		}
+		host = host[dot+1:]
+	}
+	return f.domains[""]
+}
+
+// adblockList is the Matcher of Adblock Plus, filters are
+// indexed by keyword to reduce the number of regexp matching.
+type adblockList struct {
+	filterByKeyword map[string][]*adblockFilter
+}
+
+func newAdblockList() *adblockList {
+	return &adblockList{
+		filterByKeyword: make(map[string][]*adblockFilter),
+	}
+}
+
+func (l *adblockList) add(f *adblockFilter) {
+	keyword := l.findKeyword(f)
+	l.filterByKeyword[keyword] = append(l.filterByKeyword[keyword], f)
+}
+
+func (l *adblockList) findKeyword(f *adblockFilter) string {
+	text := f.text
+	if filterRegexpRegexp.MatchString(text) {
+		return ""
+	}
+	if loc := filterOptionsRegexp.FindStringIndex(text); loc != nil {
+		text = text[:loc[0]]
+	}
+	text = strings.TrimPrefix(text, "@@")
+
+	result := ""
+	resultCount := 0xFFFFFF
+	for _, candidate := range filterKeywordCandidates(strings.ToLower(text)) {
+		count := len(l.filterByKeyword[candidate])
+		if count < resultCount || (count == resultCount && len(candidate) > len(result)) {
+			result = candidate
+			resultCount = count
+		}
+	}
+	return result
+}
+
+func (l *adblockList) checkEntryMatch(keyword, location, host string) *adblockFilter {
+	for _, f := range l.filterByKeyword[keyword] {
+		if f.matches(location, host) {
+			return f
+		}
+	}
+	return nil
+}
+
+// adblockMatcher is the CombinedMatcher of Adblock Plus.
+type adblockMatcher struct {
+	blacklist *adblockList
+	whitelist *adblockList
+}
+
+func newAdblockMatcher(rules []string) *adblockMatcher {
+	m := &adblockMatcher{
+		blacklist: newAdblockList(),
+		whitelist: newAdblockList(),
+	}
+
+	added := make(map[string]struct{}, len(rules))
+	for _, r := range rules {
+		if _, ok := added[r]; ok {
+			continue
+		}
+		f := parseAdblockFilter(r)
+		if f == nil {
+			continue
+		}
+		added[r] = struct{}{}
+
+		if f.whitelist {
+			m.whitelist.add(f)
+		} else {
+			m.blacklist.add(f)
+		}
+	}
+
+	return m
+}
+
+// matchesAny returns the filter matches location. Whitelist filters
+// take precedence over blacklist filters.
+func (m *adblockMatcher) matchesAny(location, host string) *adblockFilter {
+	candidates := append(locationKeywords(strings.ToLower(location)), "")
+
+	var blacklistHit *adblockFilter
+	for _, substr := range candidates {
+		if result := m.whitelist.checkEntryMatch(substr, location, host); result != nil {
+			return result
+		}
+		if blacklistHit == nil {
+			blacklistHit = m.blacklist.checkEntryMatch(substr, location, host)
+		}
+	}
+	return blacklistHit
+}
+
+func isKeywordChar(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '%'
+}
+
+// locationKeywords returns all runs of keyword characters
+// longer than 2 in s, the same as /[a-z0-9%]{3,}/g.
+func locationKeywords(s string) []string {
+	var result []string
+	for i := 0; i < len(s); {
+		if !isKeywordChar(s[i]) {
+			i++
+			continue
+		}
+		j := i
+		for j < len(s) && isKeywordChar(s[j]) {
+			j++
+		}
+		if j-i >= 3 {
+			result = append(result, s[i:j])
+		}
+		i = j
+	}
+	return result
+}
+
+// filterKeywordCandidates returns the keyword candidates of filter text,
+// the same as /[^a-z0-9%*][a-z0-9%]{3,}(?=[^a-z0-9%*])/g.
+func filterKeywordCandidates(s string) []string {
+	var result []string
+	for i := 1; i < len(s); {
+		if !isKeywordChar(s[i]) || isKeywordChar(s[i-1]) || s[i-1] == '*' {
+			i++
+			continue
+		}
+		j := i
+		for j < len(s) && isKeywordChar(s[j]) {
+			j++
+		}
+		if j-i >= 3 && j < len(s) && s[j] != '*' {
+			result = append(result, s[i:j])
+		}
+		i = j
+	}
+	return result
+}
@@ -0,0 +1,116 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/fatcat22/ssctrl/config"
+)
+
+var matcherTestRules = []string{
+	"||google.com",
+	"|http://85.17.73.31/",
+	".casinobellini.com",
+	"share.dmhy.org",
+	"@@|https://share.dmhy.org",
+	"/^https?:\\/\\/[^\\/]+blogspot\\.(.*)/",
+	"@@||ssl.gstatic.com",
+	"||gstatic.com",
+	"example.net/path^",
+	"||domainopt.com$domain=foo.com",
+}
+
+func TestAdblockMatcher(t *testing.T) {
+	m := newAdblockMatcher(matcherTestRules)
+
+	cases := []struct {
+		url    string
+		host   string
+		expect string
+	}{
+		{"https://www.google.com/search", "www.google.com", "||google.com"},
+		{"https://google.com/", "google.com", "||google.com"},
+		{"https://notgoogle.com/", "notgoogle.com", ""},
+		{"http://85.17.73.31/abc", "85.17.73.31", "|http://85.17.73.31/"},
+		{"https://85.17.73.31/abc", "85.17.73.31", ""},
+		{"http://www.casinobellini.com/", "www.casinobellini.com", ".casinobellini.com"},
+		{"http://share.dmhy.org/", "share.dmhy.org", "share.dmhy.org"},
+		{"https://share.dmhy.org/", "share.dmhy.org", "@@|https://share.dmhy.org"},
+		{"https://abc.blogspot.com/", "abc.blogspot.com", "/^https?:\\/\\/[^\\/]+blogspot\\.(.*)/"},
+		{"https://ssl.gstatic.com/a.js", "ssl.gstatic.com", "@@||ssl.gstatic.com"},
+		{"https://fonts.gstatic.com/a.js", "fonts.gstatic.com", "||gstatic.com"},
+		{"http://example.net/path/abc", "example.net", "example.net/path^"},
+		{"http://example.net/pathabc", "example.net", ""},
+		{"http://www.domainopt.com/", "www.domainopt.com", ""},
+		{"http://www.domainopt.com/", "www.foo.com", "||domainopt.com$domain=foo.com"},
+	}
+
+	for _, c := range cases {
+		f := m.matchesAny(c.url, c.host)
+		got := ""
+		if f != nil {
+			got = f.text
+		}
+		if got != c.expect {
+			t.Errorf("url '%s': expect rule '%s' but got '%s'", c.url, c.expect, got)
+		}
+	}
+}
+
+func TestAdblockToRegexp(t *testing.T) {
+	cases := map[string]string{
+		"||google.com":     `^[\w\-]+:\/+(?:[^\/]+\.)?google\.com`,
+		"|http://a.com/":   `^http://a\.com/`,
+		"*abc**def*":       `abc.*def`,
+		"a.com^|":          `a\.com` + adblockSeparator,
+		"|http://a.com|":   `^http://a\.com$`,
+		"a|b":              `a\|b`,
+		"||google.com/a.*": `^[\w\-]+:\/+(?:[^\/]+\.)?google\.com/a\.`,
+	}
+
+	for text, expect := range cases {
+		if got := adblockToRegexp(text); got != expect {
+			t.Errorf("filter '%s': expect regexp '%s' but got '%s'", text, expect, got)
+		}
+	}
+}
+
+func TestPACRouter(t *testing.T) {
+	content := pacContent{
+		rules:    matcherTestRules,
+		compiled: compilePACRules(matcherTestRules),
+		ipRules:  &ipRuleList{},
+		userRules: config.UserRules{
+			Proxy:  []string{"example.com", "10.0.0.0/8"},
+			Direct: []string{"maps.google.com", "10.1.0.0/16"},
+		},
+	}
+	r := newPACRouter(&content)
+
+	cases := []struct {
+		url         string
+		expectRoute string
+		expectRule  string
+	}{
+		{"https://www.google.com/", RouteProxy, "||google.com"},
+		{"https://maps.google.com/", RouteDirect, "maps.google.com"},
+		{"https://a.example.com/", RouteProxy, "example.com"},
+		{"http://10.2.3.4/", RouteProxy, "10.0.0.0/8"},
+		{"http://10.1.3.4/", RouteDirect, "10.1.0.0/16"},
+		{"https://ssl.gstatic.com/", RouteDirect, "@@||ssl.gstatic.com"},
+		{"http://127.0.0.1/", RouteDirect, ""},
+	}
+	for _, c := range cases {
+		result, err := r.route(c.url)
+		if err != nil {
+			t.Errorf("route '%s' error: %v", c.url, err)
+			continue
+		}
+		if result.Route != c.expectRoute || result.Rule != c.expectRule {
+			t.Errorf("url '%s': expect route '%s' by '%s' but got '%s' by '%s'", c.url, c.expectRoute, c.expectRule, result.Route, result.Rule)
+		}
+	}
+
+	if _, err := r.route("www.google.com"); err == nil {
+		t.Errorf("route url without scheme should be failed")
+	}
+}
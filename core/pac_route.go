@@ -0,0 +1,196 @@
+package core
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/fatcat22/ssctrl/config"
+)
+
+const (
+	RouteProxy  = "proxy"
+	RouteDirect = "direct"
+)
+
+// RouteResult tells which route a URL would take with the pac file.
+type RouteResult struct {
+	URL   string `json:"url"`
+	Host  string `json:"host"`
+	Route string `json:"route"`
+	// Rule is the rule which decides the route.
+	// It's empty if no rule matches the URL.
+	Rule string `json:"rule"`
+	// PAC is the value returned by FindProxyForURL of the serving
+	// pac file, such as "SOCKS5 127.0.0.1:1080; SOCKS 127.0.0.1:1080".
+	PAC string `json:"pac"`
+}
+
+// pacRouter makes the same decision as FindProxyForURL of the
+// generated pac file: bypass first, user direct rules, then user proxy
+// rules, and then the AdBlock style rules. IP rules are checked
+// before or after the AdBlock style rules. With whitelist, hosts
+// not matched by any rule go proxy.
+type pacRouter struct {
+	bypass    []string
+	userRules config.UserRules
+	rules     *compiledRules
+	ipRules   *ipRuleList
+	whitelist bool
+}
+
+func newPACRouter(content *pacContent) *pacRouter {
+	return &pacRouter{
+		bypass:    content.bypass,
+		userRules: content.userRules,
+		rules:     content.compiled,
+		ipRules:   content.ipRules,
+		whitelist: content.whitelist,
+	}
+}
+
+func (r *pacRouter) route(rawURL string) (RouteResult, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return RouteResult{}, err
+	}
+	host := u.Hostname()
+	if len(u.Scheme) == 0 || len(host) == 0 {
+		return RouteResult{}, fmt.Errorf("invalid url '%s'", rawURL)
+	}
+
+	result := RouteResult{
+		URL:   rawURL,
+		Host:  host,
+		Route: RouteDirect,
+	}
+
+	var ip string
+	resolved := false
+	resolve := func() string {
+		if !resolved {
+			ip = resolveIPv4(host)
+			resolved = true
+		}
+		return ip
+	}
+
+	if rule := matchBypass(host, r.bypass); len(rule) != 0 {
+		result.Rule = rule
+		return result, nil
+	}
+	if rule := matchUserRules(host, r.userRules.Direct, resolve); len(rule) != 0 {
+		result.Rule = rule
+		return result, nil
+	}
+	if rule := matchUserRules(host, r.userRules.Proxy, resolve); len(rule) != 0 {
+		result.Route = RouteProxy
+		result.Rule = rule
+		return result, nil
+	}
+
+	matchIPRules := func() bool {
+		// don't resolve host if there is no ip rule
+		if len(r.ipRules.ranges) == 0 {
+			return false
+		}
+		rule := r.ipRules.match(resolve())
+		if len(rule) == 0 {
+			return false
+		}
+		result.Rule = rule
+		if r.ipRules.route == config.IPRouteProxy {
+			result.Route = RouteProxy
+		}
+		return true
+	}
+
+	if r.ipRules.before && matchIPRules() {
+		return result, nil
+	}
+	if rule, proxy := r.rules.match(rawURL, host); len(rule) != 0 {
+		result.Rule = rule
+		if proxy {
+			result.Route = RouteProxy
+		}
+		return result, nil
+	}
+	if !r.ipRules.before && matchIPRules() {
+		return result, nil
+	}
+	if r.whitelist && !isLocalHost(host) {
+		result.Route = RouteProxy
+	}
+	return result, nil
+}
+
+// matchUserRules returns the first rule matches host, or empty string
+// if no rule matches. resolve is called only if there is CIDR rule.
+func matchUserRules(host string, rules []string, resolve func() string) string {
+	host = strings.ToLower(host)
+	for _, rule := range rules {
+		if strings.Contains(rule, "/") {
+			continue
+		}
+		d := strings.ToLower(rule)
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return rule
+		}
+	}
+
+	for _, rule := range rules {
+		if !strings.Contains(rule, "/") {
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(rule)
+		if err != nil {
+			continue
+		}
+		ip := net.ParseIP(resolve())
+		if ip != nil && ipNet.Contains(ip) {
+			return rule
+		}
+	}
+	return ""
+}
+
+// matchBypass returns the first bypass entry matches host, or empty
+// string if no one matches. Networks only match hosts of ip addresses,
+// host is never resolved.
+func matchBypass(host string, bypass []string) string {
+	host = strings.ToLower(host)
+	ip := net.ParseIP(host)
+	for _, b := range bypass {
+		if strings.Contains(b, "/") {
+			_, ipNet, err := net.ParseCIDR(b)
+			if err == nil && ip != nil && ipNet.Contains(ip) {
+				return b
+			}
+			continue
+		}
+		d := strings.ToLower(strings.TrimPrefix(b, "*."))
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return b
+		}
+	}
+	return ""
+}
+
+// resolveIPv4 works like dnsResolve of pac.
+func resolveIPv4(host string) string {
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String()
+	}
+
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return ""
+	}
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			return ip4.String()
+		}
+	}
+	return ""
+}
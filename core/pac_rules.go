@@ -0,0 +1,72 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+const (
+	jsRulesBegin = "var rules = ["
+	jsRulesEnd   = "];"
+)
+
+// loadPACRules reads the rule list from a local file.
+// See parsePACRules for the supported formats.
+func loadPACRules(file string) ([]string, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	return parsePACRules(data)
+}
+
+/*
+parsePACRules get the rule list from data.
+data may be a pac file generated by gfwlist2pac(which contains a
+'var rules = [...];' statement), or a plain AdBlock style rule list
+with one rule per line.
+*/
+func parsePACRules(data []byte) ([]string, error) {
+	if begin := bytes.Index(data, []byte(jsRulesBegin)); begin >= 0 {
+		return parseJSRules(data[begin+len(jsRulesBegin)-1:])
+	}
+
+	var rules []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || isRuleComment(line) {
+			continue
+		}
+		rules = append(rules, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return rules, nil
+}
+
+func parseJSRules(data []byte) ([]string, error) {
+	end := bytes.Index(data, []byte(jsRulesEnd))
+	if end < 0 {
+		return nil, fmt.Errorf("can not find the end of rules ('%s')", jsRulesEnd)
+	}
+
+	var rules []string
+	if err := json.Unmarshal(data[:end+1], &rules); err != nil {
+		return nil, fmt.Errorf("invalid rules in pac file: %v", err)
+	}
+	return rules, nil
+}
+
+// isRuleComment reports whether line is a comment or a header
+// (such as '[AutoProxy 0.2.9]') of AdBlock style rule list.
+func isRuleComment(line string) bool {
+	return strings.HasPrefix(line, "!") || strings.HasPrefix(line, "[")
+}
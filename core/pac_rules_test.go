@@ -0,0 +1,59 @@
+package core
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParsePACRulesFromJS(t *testing.T) {
+	const pacData = `
+var proxy = "SOCKS5 127.0.0.1:1080; SOCKS 127.0.0.1:1080; DIRECT;";
+
+var rules = [
+  "|http:\/\/85.17.73.31\/",
+  "||agnesb.fr",
+  "@@||qq.com"
+];
+
+function FindProxyForURL(url, host) {
+  return proxy;
+}
+`
+	expect := []string{"|http://85.17.73.31/", "||agnesb.fr", "@@||qq.com"}
+
+	rules, err := parsePACRules([]byte(pacData))
+	if err != nil {
+		t.Fatalf("parse pac rules error: %v", err)
+	}
+	if !reflect.DeepEqual(rules, expect) {
+		t.Errorf("expect rules %v but got %v", expect, rules)
+	}
+}
+
+func TestParsePACRulesFromList(t *testing.T) {
+	const listData = `[AutoProxy 0.2.9]
+! comment line
+||google.com
+
+|http://85.17.73.31/
+@@||qq.com
+`
+	expect := []string{"||google.com", "|http://85.17.73.31/", "@@||qq.com"}
+
+	rules, err := parsePACRules([]byte(listData))
+	if err != nil {
+		t.Fatalf("parse pac rules error: %v", err)
+	}
+	if !reflect.DeepEqual(rules, expect) {
+		t.Errorf("expect rules %v but got %v", expect, rules)
+	}
+}
+
+func TestParsePACRulesError(t *testing.T) {
+	const pacData = `var rules = [
+  "||google.com",
+`
+	if _, err := parsePACRules([]byte(pacData)); err == nil {
+		t.Errorf("parse invalid pac rules should be failed")
+	}
+}
@@ -0,0 +1,260 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/robertkrimen/otto"
+)
+
+const (
+	// pacCheckURL and pacCheckHost are used to check a pac file runs.
+	// host is an ip, so checking never waits for dns.
+	pacCheckURL  = "http://127.0.0.1/"
+	pacCheckHost = "127.0.0.1"
+)
+
+// pacScriptTimeout limits how long FindProxyForURL runs.
+var pacScriptTimeout = 5 * time.Second
+
+var (
+	// pacRouteCacheSize limits the routes cached by pacScript.route,
+	// the cache is cleared when it's full.
+	pacRouteCacheSize = 4096
+	// pacRouteCacheTTL is how long a cached route is used, because
+	// the route may depend on dns.
+	pacRouteCacheTTL = 10 * time.Minute
+)
+
+var errPACScriptTimeout = errors.New("FindProxyForURL timeout")
+
+// pacFunctions are the functions defined by the pac standard that
+// are written in JavaScript. dnsResolve, isInNet, isResolvable and
+// myIpAddress are implemented in go.
+const pacFunctions = `
+function isPlainHostName(host) {
+  return host.indexOf(".") < 0;
+}
+
+function dnsDomainIs(host, domain) {
+  return host.length >= domain.length &&
+    host.substring(host.length - domain.length) === domain;
+}
+
+function localHostOrDomainIs(host, hostdom) {
+  return host === hostdom || hostdom.lastIndexOf(host + ".", 0) === 0;
+}
+
+function dnsDomainLevels(host) {
+  return host.split(".").length - 1;
+}
+
+function shExpMatch(str, shexp) {
+  var re = shexp.replace(/[.+^${}()|[\]\\]/g, "\\$&")
+    .replace(/\*/g, ".*").replace(/\?/g, ".");
+  return new RegExp("^" + re + "$").test(str);
+}
+`
+
+/*
+pacScript runs a pac file in an embedded JavaScript interpreter, so the
+pac file can be checked before it's served and URLs can be evaluated by
+the exact pac file being served. The interpreter is not safe for
+concurrent use, calls are serialized by lock.
+*/
+type pacScript struct {
+	vm        *otto.Otto
+	findProxy otto.Value
+	lock      sync.Mutex
+	// resolved are the hosts resolved before calling FindProxyForURL,
+	// which are used by the dns functions instead of resolving again.
+	resolved map[string]string
+
+	routeLock sync.Mutex
+	routes    map[string]cachedRoute
+}
+
+// cachedRoute is a route got by pacScript.route.
+type cachedRoute struct {
+	route   string
+	expires time.Time
+}
+
+// newPACScript runs data and checks FindProxyForURL is defined and runs.
+func newPACScript(data []byte) (*pacScript, error) {
+	vm := otto.New()
+	vm.Interrupt = make(chan func(), 1)
+	s := &pacScript{
+		vm:     vm,
+		routes: make(map[string]cachedRoute),
+	}
+	if err := setPACFunctions(vm, s.resolve); err != nil {
+		return nil, err
+	}
+
+	script, err := vm.Compile("proxy.pac", data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pac file: %v", err)
+	}
+	if err := runWithTimeout(vm, func() error {
+		_, err := vm.Run(script)
+		return err
+	}); err != nil {
+		return nil, fmt.Errorf("invalid pac file: %v", err)
+	}
+
+	findProxy, err := vm.Get("FindProxyForURL")
+	if err != nil {
+		return nil, err
+	}
+	if !findProxy.IsFunction() {
+		return nil, errors.New("invalid pac file: FindProxyForURL is not defined")
+	}
+
+	s.findProxy = findProxy
+	if _, err := s.findProxyForURL(pacCheckURL, pacCheckHost); err != nil {
+		return nil, fmt.Errorf("invalid pac file: %v", err)
+	}
+	return s, nil
+}
+
+// findProxyForURL returns the result of FindProxyForURL(rawURL, host).
+func (s *pacScript) findProxyForURL(rawURL, host string) (string, error) {
+	return s.call(rawURL, host, nil)
+}
+
+// call runs FindProxyForURL(rawURL, host) with the hosts resolved already.
+func (s *pacScript) call(rawURL, host string, resolved map[string]string) (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.resolved = resolved
+	defer func() { s.resolved = nil }()
+
+	var result otto.Value
+	if err := runWithTimeout(s.vm, func() (err error) {
+		result, err = s.findProxy.Call(otto.NullValue(), rawURL, host)
+		return err
+	}); err != nil {
+		return "", err
+	}
+	if !result.IsString() {
+		return "", fmt.Errorf("FindProxyForURL returns %s instead of a string", result.Class())
+	}
+	return result.String(), nil
+}
+
+// route returns the route of rawURL by FindProxyForURL. Routes are cached,
+// and host is resolved before running the interpreter, so a slow dns
+// lookup doesn't block other calls.
+func (s *pacScript) route(rawURL, host string) (string, error) {
+	now := time.Now()
+	s.routeLock.Lock()
+	cached, ok := s.routes[rawURL]
+	s.routeLock.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.route, nil
+	}
+
+	result, err := s.call(rawURL, host, map[string]string{host: resolveIPv4(host)})
+	if err != nil {
+		return "", err
+	}
+	route := pacResultRoute(result)
+
+	s.routeLock.Lock()
+	if len(s.routes) >= pacRouteCacheSize {
+		s.routes = make(map[string]cachedRoute)
+	}
+	s.routes[rawURL] = cachedRoute{route: route, expires: now.Add(pacRouteCacheTTL)}
+	s.routeLock.Unlock()
+	return route, nil
+}
+
+// resolve returns the ipv4 address of host for the dns functions,
+// s.lock must be held.
+func (s *pacScript) resolve(host string) string {
+	if ip, ok := s.resolved[host]; ok {
+		return ip
+	}
+	return resolveIPv4(host)
+}
+
+// runWithTimeout interrupts vm if run takes longer than pacScriptTimeout.
+func runWithTimeout(vm *otto.Otto, run func() error) (err error) {
+	fired := make(chan struct{})
+	t := time.AfterFunc(pacScriptTimeout, func() {
+		vm.Interrupt <- func() {
+			panic(errPACScriptTimeout)
+		}
+		close(fired)
+	})
+	defer func() {
+		if !t.Stop() {
+			// drain the interrupt in case it's sent after run returns
+			<-fired
+			select {
+			case <-vm.Interrupt:
+			default:
+			}
+		}
+
+		if r := recover(); r != nil {
+			if r != errPACScriptTimeout {
+				panic(r)
+			}
+			err = errPACScriptTimeout
+		}
+	}()
+
+	return run()
+}
+
+// setPACFunctions defines the pac functions in vm, and the dns functions
+// resolve hosts by resolve.
+func setPACFunctions(vm *otto.Otto, resolve func(host string) string) error {
+	funcs := map[string]func(call otto.FunctionCall) otto.Value{
+		"dnsResolve": func(call otto.FunctionCall) otto.Value {
+			ip := resolve(call.Argument(0).String())
+			if len(ip) == 0 {
+				return otto.NullValue()
+			}
+			return toJSValue(vm, ip)
+		},
+		"isResolvable": func(call otto.FunctionCall) otto.Value {
+			return toJSValue(vm, len(resolve(call.Argument(0).String())) != 0)
+		},
+		"isInNet": func(call otto.FunctionCall) otto.Value {
+			ip := net.ParseIP(resolve(call.Argument(0).String()))
+			pattern := net.ParseIP(call.Argument(1).String()).To4()
+			mask := net.ParseIP(call.Argument(2).String()).To4()
+			if ip == nil || pattern == nil || mask == nil {
+				return toJSValue(vm, false)
+			}
+			ipNet := net.IPNet{IP: pattern.Mask(net.IPMask(mask)), Mask: net.IPMask(mask)}
+			return toJSValue(vm, ipNet.Contains(ip))
+		},
+		"myIpAddress": func(call otto.FunctionCall) otto.Value {
+			return toJSValue(vm, "127.0.0.1")
+		},
+	}
+	for name, f := range funcs {
+		if err := vm.Set(name, f); err != nil {
+			return err
+		}
+	}
+
+	_, err := vm.Run(pacFunctions)
+	return err
+}
+
+func toJSValue(vm *otto.Otto, v interface{}) otto.Value {
+	value, err := vm.ToValue(v)
+	if err != nil {
+		return otto.UndefinedValue()
+	}
+	return value
+}
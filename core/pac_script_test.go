@@ -0,0 +1,194 @@
+package core
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPACScript(t *testing.T) {
+	const pacData = `
+function FindProxyForURL(url, host) {
+  if (dnsDomainIs(host, ".example.com") || shExpMatch(url, "*://proxy.*")) {
+    return "SOCKS5 127.0.0.1:1080";
+  }
+  if (isInNet(host, "10.0.0.0", "255.0.0.0")) {
+    return "PROXY 10.0.0.1:8080";
+  }
+  return "DIRECT";
+}
+`
+	s, err := newPACScript([]byte(pacData))
+	if err != nil {
+		t.Fatalf("create pac script error: %v", err)
+	}
+
+	tests := []struct {
+		url    string
+		host   string
+		expect string
+	}{
+		{"https://www.example.com/", "www.example.com", "SOCKS5 127.0.0.1:1080"},
+		{"http://proxy.test/", "proxy.test", "SOCKS5 127.0.0.1:1080"},
+		{"http://10.1.2.3/", "10.1.2.3", "PROXY 10.0.0.1:8080"},
+		{"http://11.1.2.3/", "11.1.2.3", "DIRECT"},
+	}
+	for _, test := range tests {
+		result, err := s.findProxyForURL(test.url, test.host)
+		if err != nil {
+			t.Errorf("FindProxyForURL('%s') error: %v", test.url, err)
+			continue
+		}
+		if result != test.expect {
+			t.Errorf("FindProxyForURL('%s'): expect '%s' but got '%s'", test.url, test.expect, result)
+		}
+	}
+}
+
+func TestInvalidPACScript(t *testing.T) {
+	tests := []struct {
+		data   string
+		expect string
+	}{
+		{"function FindProxyForURL(url, host) { return 'DIRECT';", "invalid pac file"},
+		{"function findProxy(url, host) { return 'DIRECT'; }", "FindProxyForURL is not defined"},
+		{"var FindProxyForURL = 'DIRECT';", "FindProxyForURL is not defined"},
+		{"function FindProxyForURL(url, host) { return undefinedFunc(host); }", "undefinedFunc"},
+		{"function FindProxyForURL(url, host) { return 1; }", "instead of a string"},
+		{"throw new Error('broken');", "broken"},
+	}
+
+	for _, test := range tests {
+		_, err := newPACScript([]byte(test.data))
+		if err == nil {
+			t.Errorf("create pac script success with '%s'", test.data)
+			continue
+		}
+		if !strings.Contains(err.Error(), test.expect) {
+			t.Errorf("expect error contains '%s' but got '%v'", test.expect, err)
+		}
+	}
+}
+
+func TestPACScriptTimeout(t *testing.T) {
+	oldTimeout := pacScriptTimeout
+	pacScriptTimeout = 100 * time.Millisecond
+	defer func() { pacScriptTimeout = oldTimeout }()
+
+	const pacData = `
+function FindProxyForURL(url, host) {
+  while (host === "loop.example.com") {}
+  return "DIRECT";
+}
+`
+	s, err := newPACScript([]byte(pacData))
+	if err != nil {
+		t.Fatalf("create pac script error: %v", err)
+	}
+	if _, err := s.findProxyForURL("http://loop.example.com/", "loop.example.com"); err != errPACScriptTimeout {
+		t.Fatalf("expect timeout error but got %v", err)
+	}
+
+	// the script still works after being interrupted
+	if result, err := s.findProxyForURL("http://example.com/", "example.com"); err != nil || result != "DIRECT" {
+		t.Fatalf("expect 'DIRECT' after timeout but got '%s', %v", result, err)
+	}
+}
+
+func TestPACScriptSameAsRouter(t *testing.T) {
+	rules := append([]string{"||sep.example.com^", "@@||allow.sep.example.com^"}, matcherTestRules...)
+	content := pacContent{
+		rules:     rules,
+		compiled:  compilePACRules(rules),
+		ipRules:   &ipRuleList{},
+		localAddr: "127.0.0.1",
+		localPort: "1080",
+	}
+	content.userRules.Proxy = []string{"user.example.org"}
+	content.userRules.Direct = []string{"www.google.com"}
+
+	pacData, err := content.renderPAC(time.Now())
+	if err != nil {
+		t.Fatalf("render pac error: %v", err)
+	}
+	s, err := newPACScript(pacData.data)
+	if err != nil {
+		t.Fatalf("create pac script error: %v", err)
+	}
+	router := newPACRouter(&content)
+
+	urls := []string{
+		"https://www.google.com/search",
+		"https://mail.google.com/",
+		"https://user.example.org/",
+		"https://ssl.gstatic.com/a.js",
+		"http://sep.example.com/",
+		"http://a.allow.sep.example.com/",
+		"http://example.net/path/abc",
+		"http://85.17.73.31/abc",
+		"http://www.baidu.com/?q=www.youtube.com",
+	}
+	for _, u := range urls {
+		expect, err := router.route(u)
+		if err != nil {
+			t.Fatalf("route '%s' error: %v", u, err)
+		}
+		result, err := s.findProxyForURL(u, expect.Host)
+		if err != nil {
+			t.Fatalf("FindProxyForURL('%s') error: %v", u, err)
+		}
+
+		route := RouteDirect
+		if strings.HasPrefix(result, "SOCKS5") {
+			route = RouteProxy
+		}
+		if route != expect.Route {
+			t.Errorf("url '%s': expect route '%s' but pac returns '%s'", u, expect.Route, result)
+		}
+	}
+}
+
+func TestPACScriptRoute(t *testing.T) {
+	const pacData = `
+var calls = 0;
+function FindProxyForURL(url, host) {
+  calls++;
+  if (isInNet(host, "10.0.0.0", "255.0.0.0")) {
+    return "SOCKS5 127.0.0.1:1080";
+  }
+  return "DIRECT";
+}
+`
+	s, err := newPACScript([]byte(pacData))
+	if err != nil {
+		t.Fatalf("create pac script error: %v", err)
+	}
+	calls := func() int64 {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		v, _ := s.vm.Get("calls")
+		n, _ := v.ToInteger()
+		return n
+	}
+	startCalls := calls()
+
+	for i := 0; i < 2; i++ {
+		if route, err := s.route("http://10.1.2.3/", "10.1.2.3"); err != nil || route != RouteProxy {
+			t.Errorf("expect route '%s' but got '%s'(error: %v)", RouteProxy, route, err)
+		}
+		if route, err := s.route("http://11.1.2.3/", "11.1.2.3"); err != nil || route != RouteDirect {
+			t.Errorf("expect route '%s' but got '%s'(error: %v)", RouteDirect, route, err)
+		}
+	}
+	if n := calls() - startCalls; n != 2 {
+		t.Errorf("expect FindProxyForURL called 2 times with cached routes but got %d", n)
+	}
+
+	defer func(ttl time.Duration) { pacRouteCacheTTL = ttl }(pacRouteCacheTTL)
+	pacRouteCacheTTL = 0
+	s.route("http://10.4.5.6/", "10.4.5.6")
+	s.route("http://10.4.5.6/", "10.4.5.6")
+	if n := calls() - startCalls; n != 4 {
+		t.Errorf("expect expired routes found again but FindProxyForURL is called %d times", n)
+	}
+}
@@ -2,54 +2,176 @@ package core
 
 import (
 	"context"
-	"io/ioutil"
+	"errors"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
+	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/fatcat22/ssctrl/common"
+	"github.com/fatcat22/ssctrl/config"
 )
 
 const (
-	pacURLFile = "proxy.pac"
+	pacURLFile  = "proxy.pac"
+	wpadURLFile = "wpad.dat"
 )
 
 var (
 	DefaultPACLocalPath = filepath.Join(common.HomeDir(), ".ssctrl", "gfwlist.js")
+	// DefaultWhitelistLocalPath is the whitelist used by config.PACStrategyWhitelist.
+	DefaultWhitelistLocalPath = filepath.Join(common.HomeDir(), ".ssctrl", "whitelist.txt")
+
+	// pacWatchInterval is how often the pac file is checked for changes.
+	pacWatchInterval = 2 * time.Second
 )
 
+// PACOptions contains the options of pac file.
+type PACOptions struct {
+	// PACFile is the file which rules are loaded from. The whitelist
+	// or DefaultPACLocalPath is used if it's empty.
+	PACFile   string
+	UserRules config.UserRules
+
+	// Strategy is config.PACStrategyBlacklist(the default) or
+	// config.PACStrategyWhitelist. With whitelist, PACFile is a
+	// list of domains going direct, and other hosts go proxy.
+	Strategy string
+	// WhitelistFile is used if PACFile is empty with whitelist.
+	// DefaultWhitelistLocalPath is used if it's empty.
+	WhitelistFile string
+
+	// AllowedClients are ip addresses or CIDRs of the clients
+	// allowed to get pac file. Loopback is always allowed.
+	AllowedClients []string
+
+	// IPRules is loaded when the server is created.
+	IPRules config.IPRulesConfig
+
+	// Bypass are the hosts and networks which always go direct,
+	// see config.CheckBypassEntry for the format of them.
+	Bypass []string
+
+	// HTTPPort is the port of http proxy. If it's not empty, the http
+	// proxy is a fallback of the socks proxy in pac file.
+	HTTPPort string
+
+	// Template is a text/template file rendered as the pac file instead
+	// of the default one, see pacTemplateData for the data of it. It's
+	// loaded when the server is created.
+	Template string
+}
+
 type PACServer struct {
 	server *http.Server
 
-	pacPort string
-	pacData []byte
-
-	localAddr string
-	localPort string
-
-	isStartup  bool
-	shutdownCh chan struct{}
+	pacPort     string
+	listenAddr  string
+	allowedNets []*net.IPNet
+	whitelist   bool
+	// customTemplate tells the pac file is rendered from PACOptions.Template,
+	// so routes of URLs are told by the pac file instead of router.
+	customTemplate bool
+
+	content pacContent
+	pacData *renderedPAC
+	router  *pacRouter
+	lock    sync.RWMutex
+
+	// script runs pacData, which is checked by it before being served.
+	script *pacScript
+
+	// pacDataByAddr caches pac data rendered for the server
+	// addresses(other than content.localAddr) reached by clients.
+	pacDataByAddr map[string]*renderedPAC
+
+	// pacFile is the file being watched, and pacModTime and pacSize
+	// are the state of it when it was loaded last time.
+	pacFile    string
+	pacModTime time.Time
+	pacSize    int64
+
+	isStartup   bool
+	shutdownCh  chan struct{}
+	watchStopCh chan struct{}
+	watchDoneCh chan struct{}
 }
 
-func NewPACServer(port, localPACFile string, localAddr, localPort string) (*PACServer, error) {
+/*
+NewPACServer creates a pac server listening on localAddr:port. localAddr
+is also the address of local socks proxy. If localAddr is unspecified
+(0.0.0.0), the proxy in pac file is the address reached by each client.
+*/
+func NewPACServer(port, localAddr, localPort string, opts PACOptions) (*PACServer, error) {
+	localPACFile := opts.PACFile
 	if localPACFile == "" {
-		localPACFile = DefaultPACLocalPath
+		localPACFile = opts.defaultPACFile()
+	}
+	allowedNets, err := parseAllowedClients(opts.AllowedClients)
+	if err != nil {
+		return nil, err
 	}
 
-	pacData, err := ioutil.ReadFile(localPACFile)
+	fi, err := os.Stat(localPACFile)
+	if err != nil {
+		return nil, err
+	}
+	rules, err := loadRules(localPACFile, opts.isWhitelist())
+	if err != nil {
+		return nil, err
+	}
+	ipRules, err := loadIPRules(opts.IPRules)
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := loadPACTemplate(opts.Template)
+	if err != nil {
+		return nil, err
+	}
+	content := pacContent{
+		tmpl:      tmpl,
+		rules:     rules,
+		compiled:  compilePACRules(rules),
+		userRules: opts.UserRules.Copy(),
+		ipRules:   ipRules,
+		whitelist: opts.isWhitelist(),
+		localAddr: dialAddr(localAddr),
+		localPort: localPort,
+		httpPort:  opts.HTTPPort,
+		bypass:    append([]string(nil), opts.Bypass...),
+	}
+	pacData, err := content.renderPAC(time.Now())
+	if err != nil {
+		return nil, err
+	}
+	script, err := newPACScript(pacData.data)
 	if err != nil {
 		return nil, err
 	}
 
 	return &PACServer{
-		pacPort: port,
-		pacData: pacData,
+		pacPort:     port,
+		listenAddr:  localAddr,
+		allowedNets: allowedNets,
+		whitelist:   opts.isWhitelist(),
 
-		localAddr: localAddr,
-		localPort: localPort,
+		customTemplate: tmpl != nil,
+
+		content:       content,
+		pacData:       pacData,
+		script:        script,
+		router:        newPACRouter(&content),
+		pacDataByAddr: make(map[string]*renderedPAC),
+
+		pacFile:    localPACFile,
+		pacModTime: fi.ModTime(),
+		pacSize:    fi.Size(),
 
 		isStartup: false,
 	}, nil
@@ -81,6 +203,7 @@ func (ps *PACServer) Startup() error {
 	select {
 	case <-t.C:
 		ps.isStartup = true
+		ps.startWatch()
 		return nil
 	case <-ps.shutdownCh:
 		return resultErr
@@ -96,6 +219,7 @@ func (ps *PACServer) Shutdown() error {
 		return err
 	}
 
+	ps.stopWatch()
 	<-ps.shutdownCh
 	ps.server = nil
 	ps.isStartup = false
@@ -105,50 +229,320 @@ func (ps *PACServer) Shutdown() error {
 func (ps *PACServer) GetPACURL() string {
 	url := url.URL{
 		Scheme: "http",
-		Host:   ps.serverAddr(),
+		Host:   dialAddr(ps.listenAddr) + ":" + ps.pacPort,
 		Path:   pacURLFile,
 	}
 	return url.String()
 }
 
+// ReloadPAC loads rules from pacFile and watches pacFile from now on.
+// The serving pac is not changed if pacFile is invalid.
 func (ps *PACServer) ReloadPAC(pacFile string) error {
-	pacData, err := ioutil.ReadFile(pacFile)
+	return ps.loadPACFile(pacFile, func(*pacContent) {})
+}
+
+// ChangeRules works like ReloadPAC, and replaces user rules at the same time.
+func (ps *PACServer) ChangeRules(pacFile string, userRules config.UserRules) error {
+	userRules = userRules.Copy()
+	return ps.loadPACFile(pacFile, func(c *pacContent) {
+		c.userRules = userRules
+	})
+}
+
+// loadPACFile loads rules from pacFile, and changes other content by change.
+func (ps *PACServer) loadPACFile(pacFile string, change func(*pacContent)) error {
+	fi, err := os.Stat(pacFile)
+	if err != nil {
+		return err
+	}
+	rules, err := loadRules(pacFile, ps.whitelist)
 	if err != nil {
 		return err
 	}
+	if len(rules) == 0 {
+		return errors.New("no rule found in pac file")
+	}
 
-	ps.pacData = pacData
+	compiled := compilePACRules(rules)
+	if err := ps.updateContent(func(c *pacContent) {
+		c.rules = rules
+		c.compiled = compiled
+		change(c)
+	}); err != nil {
+		return err
+	}
+
+	ps.lock.Lock()
+	ps.pacFile = pacFile
+	ps.pacModTime = fi.ModTime()
+	ps.pacSize = fi.Size()
+	ps.lock.Unlock()
 	return nil
 }
 
-func (ps *PACServer) ChangeLocalPort(newPort string) (result error) {
-	if newPort == ps.localPort {
-		return nil
+func (ps *PACServer) ChangeLocalPort(newPort string) error {
+	return ps.updateContent(func(c *pacContent) {
+		c.localPort = newPort
+	})
+}
+
+func (ps *PACServer) ChangeBypass(bypass []string) error {
+	bypass = append([]string(nil), bypass...)
+	return ps.updateContent(func(c *pacContent) {
+		c.bypass = bypass
+	})
+}
+
+func (ps *PACServer) ChangeUserRules(rules config.UserRules) error {
+	return ps.updateContent(func(c *pacContent) {
+		c.userRules = rules.Copy()
+	})
+}
+
+// TestURL tells which route rawURL would take with the serving pac file.
+func (ps *PACServer) TestURL(rawURL string) (RouteResult, error) {
+	ps.lock.RLock()
+	router, script := ps.router, ps.script
+	ps.lock.RUnlock()
+
+	result, err := router.route(rawURL)
+	if err != nil {
+		return RouteResult{}, err
+	}
+	result.PAC, err = script.findProxyForURL(rawURL, result.Host)
+	if err != nil {
+		return RouteResult{}, err
+	}
+	if ps.customTemplate {
+		// rules may be not used by the template
+		result.Route = pacResultRoute(result.PAC)
+		result.Rule = ""
+	}
+	return result, nil
+}
+
+// FindProxyForURL runs FindProxyForURL of the serving pac file.
+func (ps *PACServer) FindProxyForURL(rawURL, host string) (string, error) {
+	ps.lock.RLock()
+	script := ps.script
+	ps.lock.RUnlock()
+
+	return script.findProxyForURL(rawURL, host)
+}
+
+// RouteTarget tells which route the connections to target(host:port)
+// take, like the URL https://host/ for port 443 and http://host:port/
+// for others. It returns RouteDirect if target is invalid.
+func (ps *PACServer) RouteTarget(target string) string {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return RouteDirect
 	}
-	defer func() {
-		if result == nil {
-			ps.localPort = newPort
+	u := url.URL{Scheme: "http", Host: target, Path: "/"}
+	if port == "443" {
+		u.Scheme = "https"
+		u.Host = host
+		if strings.Contains(host, ":") {
+			u.Host = "[" + host + "]"
 		}
-	}()
+	}
+	rawURL := u.String()
+
+	ps.lock.RLock()
+	router, script, custom := ps.router, ps.script, ps.customTemplate
+	ps.lock.RUnlock()
+
+	// the rules are compiled to router, but they may be not used by
+	// a custom template, whose routes are found by the script.
+	if custom {
+		route, err := script.route(rawURL, host)
+		if err != nil {
+			log.Printf("find proxy for '%s' error: %v\n", target, err)
+			return RouteDirect
+		}
+		return route
+	}
 
-	//TODO
-	return nil
+	result, err := router.route(rawURL)
+	if err != nil {
+		return RouteDirect
+	}
+	return result.Route
 }
 
 func (ps *PACServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	if req.Method != "GET" {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
 
 	reqPath := strings.TrimLeft(req.URL.Path, "/")
 
-	if reqPath != pacURLFile {
+	if reqPath != pacURLFile && reqPath != wpadURLFile {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
 
-	w.Write(ps.pacData)
+	serverIP := requestServerIP(req)
+	if !ps.isClientAllowed(req.RemoteAddr, serverIP) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	pacData, err := ps.getPACData(serverIP)
+	if err != nil {
+		log.Printf("generate pac for '%s' error: %v\n", serverIP, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	pacData.serve(w, req)
+}
+
+// getPACData returns pac data whose proxy address is serverIP.
+func (ps *PACServer) getPACData(serverIP string) (*renderedPAC, error) {
+	ps.lock.RLock()
+	if serverIP == "" || serverIP == ps.content.localAddr {
+		defer ps.lock.RUnlock()
+		return ps.pacData, nil
+	}
+	pacData, ok := ps.pacDataByAddr[serverIP]
+	ps.lock.RUnlock()
+	if ok {
+		return pacData, nil
+	}
+
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	if pacData, ok := ps.pacDataByAddr[serverIP]; ok {
+		return pacData, nil
+	}
+	content := ps.content
+	content.localAddr = serverIP
+	pacData, err := content.renderPAC(ps.pacData.modTime)
+	if err != nil {
+		return nil, err
+	}
+
+	ps.pacDataByAddr[serverIP] = pacData
+	return pacData, nil
+}
+
+// isClientAllowed reports whether the client can get pac file.
+func (ps *PACServer) isClientAllowed(remoteAddr, serverIP string) bool {
+	return isClientAllowed(remoteAddr, serverIP, ps.allowedNets)
+}
+
+// isClientAllowed reports whether the client at remoteAddr is in
+// allowedNets. Clients on the same host(loopback or the same ip as
+// server) are always allowed.
+func isClientAllowed(remoteAddr, serverIP string, allowedNets []*net.IPNet) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	if ip.IsLoopback() || ip.Equal(net.ParseIP(serverIP)) {
+		return true
+	}
+	for _, n := range allowedNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (ps *PACServer) startWatch() {
+	ps.watchStopCh = make(chan struct{})
+	ps.watchDoneCh = make(chan struct{})
+
+	go func() {
+		defer close(ps.watchDoneCh)
+
+		t := time.NewTicker(pacWatchInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				ps.checkPACFile()
+			case <-ps.watchStopCh:
+				return
+			}
+		}
+	}()
+}
+
+func (ps *PACServer) stopWatch() {
+	if ps.watchStopCh == nil {
+		return
+	}
+
+	close(ps.watchStopCh)
+	<-ps.watchDoneCh
+	ps.watchStopCh = nil
+}
+
+// checkPACFile reloads the pac file if it has been changed.
+func (ps *PACServer) checkPACFile() {
+	ps.lock.RLock()
+	pacFile, modTime, size := ps.pacFile, ps.pacModTime, ps.pacSize
+	ps.lock.RUnlock()
+
+	// the file may be missing for a while when it's being saved
+	fi, err := os.Stat(pacFile)
+	if err != nil {
+		return
+	}
+	if fi.ModTime().Equal(modTime) && fi.Size() == size {
+		return
+	}
+
+	if err := ps.ReloadPAC(pacFile); err != nil {
+		log.Printf("reload pac file '%s' error: %v. keep serving the old one\n", pacFile, err)
+
+		// don't try to reload the broken file until it's changed again
+		ps.lock.Lock()
+		if ps.pacFile == pacFile {
+			ps.pacModTime = fi.ModTime()
+			ps.pacSize = fi.Size()
+		}
+		ps.lock.Unlock()
+		return
+	}
+	log.Printf("pac file '%s' reloaded\n", pacFile)
+}
+
+// updateContent re-renders pac data with the content changed by
+// change, and replaces the serving pac data only if rendering success.
+func (ps *PACServer) updateContent(change func(*pacContent)) error {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	newContent := ps.content
+	change(&newContent)
+
+	pacData, err := newContent.renderPAC(time.Now())
+	if err != nil {
+		return err
+	}
+	script, err := newPACScript(pacData.data)
+	if err != nil {
+		return err
+	}
+
+	ps.content = newContent
+	ps.pacData = pacData
+	ps.script = script
+	ps.router = newPACRouter(&newContent)
+	ps.pacDataByAddr = make(map[string]*renderedPAC)
+	return nil
 }
 
 func (ps *PACServer) renewServer() {
@@ -163,5 +557,80 @@ func (ps *PACServer) renewServer() {
 }
 
 func (ps *PACServer) serverAddr() string {
-	return "127.0.0.1:" + ps.pacPort
+	return ps.listenAddr + ":" + ps.pacPort
+}
+
+// pacResultRoute returns the route of the first proxy returned by FindProxyForURL.
+func pacResultRoute(result string) string {
+	first := strings.TrimSpace(strings.SplitN(result, ";", 2)[0])
+	if len(first) == 0 || strings.EqualFold(first, "DIRECT") {
+		return RouteDirect
+	}
+	return RouteProxy
+}
+
+func (opts PACOptions) isWhitelist() bool {
+	return opts.Strategy == config.PACStrategyWhitelist
+}
+
+// defaultPACFile returns the rule file used if PACFile is empty.
+func (opts PACOptions) defaultPACFile() string {
+	if !opts.isWhitelist() {
+		return DefaultPACLocalPath
+	}
+	if len(opts.WhitelistFile) != 0 {
+		return opts.WhitelistFile
+	}
+	return DefaultWhitelistLocalPath
+}
+
+// loadRules loads whitelist if whitelist is true, or rules of pac file.
+func loadRules(file string, whitelist bool) ([]string, error) {
+	if whitelist {
+		return loadWhitelistRules(file)
+	}
+	return loadPACRules(file)
+}
+
+// requestServerIP returns the local ip v4 address of the connection
+// which req comes from, or empty string if it's unknown.
+func requestServerIP(req *http.Request) string {
+	addr, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if !ok {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return ""
+	}
+	ip := net.ParseIP(host).To4()
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
+
+// parseAllowedClients converts ip addresses and CIDRs to networks.
+func parseAllowedClients(clients []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, c := range clients {
+		if !strings.Contains(c, "/") {
+			c += "/32"
+		}
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowed client '%s'", c)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// dialAddr returns the address used to connect to a server
+// listening on listenAddr from local host.
+func dialAddr(listenAddr string) string {
+	if ip := net.ParseIP(listenAddr); ip == nil || ip.IsUnspecified() {
+		return "127.0.0.1"
+	}
+	return listenAddr
 }
@@ -1,12 +1,19 @@
 package core
 
 import (
+	"compress/gzip"
+	"context"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/fatcat22/ssctrl/common"
+	"github.com/fatcat22/ssctrl/config"
 )
 
 func TestGetPACURL(t *testing.T) {
@@ -38,7 +45,8 @@ func TestReloadPAC(t *testing.T) {
 	srv.Startup()
 	defer srv.Shutdown()
 
-	const newPACData = "!@#$%^&*(newpac"
+	const newPACData = "||newpac.example.com"
+	const expectData = `"newpac.example."`
 	newPACFile, err := common.TempFile()
 	if err != nil {
 		t.Fatalf("create new template pac file error: %v", err)
@@ -52,7 +60,22 @@ func TestReloadPAC(t *testing.T) {
 		t.Fatalf("reload pac file error: %v", err)
 	}
 
-	checkGetPAC(t, newPACData, port)
+	checkGetPAC(t, expectData, port)
+}
+
+func TestPACServerChangeLocalPort(t *testing.T) {
+	const port = "1035"
+	const expectProxy = "SOCKS5 127.0.0.1:5678"
+
+	srv, _ := createPACServer(t, port)
+	srv.Startup()
+	defer srv.Shutdown()
+
+	if err := srv.ChangeLocalPort("5678"); err != nil {
+		t.Fatalf("change local port error: %v", err)
+	}
+
+	checkGetPAC(t, expectProxy, port)
 }
 
 func TestPACServerStartupShutdownRepeatedly(t *testing.T) {
@@ -80,17 +103,18 @@ func createPACServer(t *testing.T, pacPort string) (*PACServer, string) {
 	}
 	defer os.Remove(tmpPAC)
 
-	const mockPAC = "hello, I am pac string"
+	const mockPAC = "||hello.example.com"
 	if err := ioutil.WriteFile(tmpPAC, []byte(mockPAC), os.ModePerm); err != nil {
 		t.Fatalf("write mock pac file error: %v", err)
 	}
 
-	srv, err := NewPACServer(pacPort, tmpPAC, "11.22.33.44", "4321")
+	srv, err := NewPACServer(pacPort, "127.0.0.1", "4321", PACOptions{PACFile: tmpPAC})
 	if err != nil {
 		t.Fatalf("create pac server error: %v", err)
 	}
 
-	return srv, mockPAC
+	// "||hello.example.com" is compiled to domain "hello.example." with tail "com"
+	return srv, `"hello.example."`
 }
 
 func checkGetPAC(t *testing.T, expectData string, pacPort string) {
@@ -104,11 +128,346 @@ func checkGetPAC(t *testing.T, expectData string, pacPort string) {
 		t.Fatalf("read proxy.pac body error: %v", err)
 	}
 
-	if string(data) != expectData {
-		t.Fatalf("http get pac data failed: expect '%s' but got '%s'", expectData, data)
+	if !strings.Contains(string(data), expectData) {
+		t.Fatalf("http get pac data failed: expect '%s' in pac but not found", expectData)
 	}
 }
 
 func getPACURL(port string) string {
 	return "http://127.0.0.1:" + port + "/" + pacURLFile
 }
+
+func TestPACServerChangeUserRules(t *testing.T) {
+	const port = "1036"
+
+	srv, _ := createPACServer(t, port)
+	srv.Startup()
+	defer srv.Shutdown()
+
+	rules := config.UserRules{
+		Proxy:  []string{"google.com", "8.8.8.0/24"},
+		Direct: []string{"baidu.com"},
+	}
+	if err := srv.ChangeUserRules(rules); err != nil {
+		t.Fatalf("change user rules error: %v", err)
+	}
+
+	checkGetPAC(t, `"google.com"`, port)
+	checkGetPAC(t, `"255.255.255.0"`, port)
+	checkGetPAC(t, `"baidu.com"`, port)
+}
+
+func TestPACServerTestURL(t *testing.T) {
+	srv, _ := createPACServer(t, "1038")
+
+	result, err := srv.TestURL("https://hello.example.com/")
+	if err != nil {
+		t.Fatalf("test url error: %v", err)
+	}
+	if result.Route != RouteProxy || result.Rule != "||hello.example.com" {
+		t.Errorf("expect route '%s' by '%s' but got '%s' by '%s'", RouteProxy, "||hello.example.com", result.Route, result.Rule)
+	}
+	if !strings.HasPrefix(result.PAC, "SOCKS5 127.0.0.1:") {
+		t.Errorf("expect pac result of proxy but got '%s'", result.PAC)
+	}
+
+	if err := srv.ChangeUserRules(config.UserRules{Direct: []string{"example.com"}}); err != nil {
+		t.Fatalf("change user rules error: %v", err)
+	}
+	result, err = srv.TestURL("https://hello.example.com/")
+	if err != nil {
+		t.Fatalf("test url error: %v", err)
+	}
+	if result.Route != RouteDirect || result.Rule != "example.com" {
+		t.Errorf("expect route '%s' by '%s' but got '%s' by '%s'", RouteDirect, "example.com", result.Route, result.Rule)
+	}
+	if result.PAC != "DIRECT;" {
+		t.Errorf("expect pac result 'DIRECT;' but got '%s'", result.PAC)
+	}
+}
+
+func TestPACServerBypass(t *testing.T) {
+	pacFile := createMockPACFile("||hello.example.com", t)
+	defer os.Remove(pacFile)
+
+	srv, err := NewPACServer("1051", "127.0.0.1", "4321", PACOptions{
+		PACFile:   pacFile,
+		UserRules: config.UserRules{Proxy: []string{"10.1.0.0/16"}},
+		Bypass:    []string{"10.0.0.0/8", "*.hello.example.com"},
+	})
+	if err != nil {
+		t.Fatalf("create pac server error: %v", err)
+	}
+
+	tests := []struct {
+		url   string
+		route string
+		rule  string
+	}{
+		{"https://www.hello.example.com/", RouteDirect, "*.hello.example.com"},
+		{"https://hello.example.com/", RouteDirect, "*.hello.example.com"},
+		{"http://10.1.2.3/", RouteDirect, "10.0.0.0/8"},
+		{"https://example.com/", RouteDirect, ""},
+	}
+	check := func() {
+		for _, test := range tests {
+			result, err := srv.TestURL(test.url)
+			if err != nil {
+				t.Fatalf("test url '%s' error: %v", test.url, err)
+			}
+			if result.Route != test.route || result.Rule != test.rule {
+				t.Errorf("url '%s': expect route '%s' by '%s' but got '%s' by '%s'", test.url, test.route, test.rule, result.Route, result.Rule)
+			}
+			if isProxy := strings.HasPrefix(result.PAC, "SOCKS5"); isProxy != (test.route == RouteProxy) {
+				t.Errorf("url '%s': expect route '%s' but pac returns '%s'", test.url, test.route, result.PAC)
+			}
+		}
+	}
+	check()
+
+	if err := srv.ChangeBypass(nil); err != nil {
+		t.Fatalf("change bypass error: %v", err)
+	}
+	tests = []struct {
+		url   string
+		route string
+		rule  string
+	}{
+		{"https://www.hello.example.com/", RouteProxy, "||hello.example.com"},
+		{"http://10.1.2.3/", RouteProxy, "10.1.0.0/16"},
+	}
+	check()
+}
+
+func TestPACServerWatchFile(t *testing.T) {
+	const port = "1039"
+	oldInterval := pacWatchInterval
+	pacWatchInterval = 100 * time.Millisecond
+	defer func() { pacWatchInterval = oldInterval }()
+
+	pacFile, err := common.TempFile()
+	if err != nil {
+		t.Fatalf("create template pac file error: %v", err)
+	}
+	defer os.Remove(pacFile)
+	if err := ioutil.WriteFile(pacFile, []byte("||old.example.com"), os.ModePerm); err != nil {
+		t.Fatalf("write pac file error: %v", err)
+	}
+
+	srv, err := NewPACServer(port, "127.0.0.1", "1080", PACOptions{PACFile: pacFile})
+	if err != nil {
+		t.Fatalf("create pac server error: %v", err)
+	}
+	if err := srv.Startup(); err != nil {
+		t.Fatalf("pac server startup error: %v", err)
+	}
+	defer srv.Shutdown()
+
+	// change pac file
+	if err := ioutil.WriteFile(pacFile, []byte("||new.example.com"), os.ModePerm); err != nil {
+		t.Fatalf("write pac file error: %v", err)
+	}
+	time.Sleep(5 * pacWatchInterval)
+	checkGetPAC(t, `"new.example."`, port)
+
+	// break pac file
+	if err := ioutil.WriteFile(pacFile, []byte("var rules = [\n  \"||broken.example.com\",\n"), os.ModePerm); err != nil {
+		t.Fatalf("write pac file error: %v", err)
+	}
+	time.Sleep(5 * pacWatchInterval)
+	checkGetPAC(t, `"new.example."`, port)
+}
+
+func TestPACServerLANClients(t *testing.T) {
+	pacFile, err := common.TempFile()
+	if err != nil {
+		t.Fatalf("create template pac file error: %v", err)
+	}
+	defer os.Remove(pacFile)
+	if err := ioutil.WriteFile(pacFile, []byte("||hello.example.com"), os.ModePerm); err != nil {
+		t.Fatalf("write pac file error: %v", err)
+	}
+
+	srv, err := NewPACServer("1040", "0.0.0.0", "1080", PACOptions{
+		PACFile:        pacFile,
+		AllowedClients: []string{"192.168.1.0/24", "10.0.0.8"},
+	})
+	if err != nil {
+		t.Fatalf("create pac server error: %v", err)
+	}
+	if srv.GetPACURL() != getPACURL("1040") {
+		t.Errorf("GetPACURL error: expect '%s' but got '%s'", getPACURL("1040"), srv.GetPACURL())
+	}
+
+	tests := []struct {
+		client   string
+		serverIP string
+		status   int
+		proxy    string
+	}{
+		{"127.0.0.1:5000", "127.0.0.1", http.StatusOK, "SOCKS5 127.0.0.1:1080"},
+		{"192.168.1.20:5000", "192.168.1.2", http.StatusOK, "SOCKS5 192.168.1.2:1080"},
+		{"10.0.0.8:5000", "10.0.0.2", http.StatusOK, "SOCKS5 10.0.0.2:1080"},
+		{"192.168.1.2:5000", "192.168.1.2", http.StatusOK, "SOCKS5 192.168.1.2:1080"},
+		{"10.0.0.9:5000", "10.0.0.2", http.StatusForbidden, ""},
+		{"172.16.0.3:5000", "172.16.0.2", http.StatusForbidden, ""},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/"+pacURLFile, nil)
+		req.RemoteAddr = test.client
+		localAddr := &net.TCPAddr{IP: net.ParseIP(test.serverIP), Port: 1040}
+		req = req.WithContext(context.WithValue(req.Context(), http.LocalAddrContextKey, localAddr))
+
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, req)
+		if w.Code != test.status {
+			t.Errorf("get pac from '%s' by '%s': expect status %d but got %d", test.serverIP, test.client, test.status, w.Code)
+			continue
+		}
+		if test.status == http.StatusOK && !strings.Contains(w.Body.String(), test.proxy) {
+			t.Errorf("get pac from '%s' by '%s': expect '%s' in pac but not found", test.serverIP, test.client, test.proxy)
+		}
+	}
+}
+
+func TestPACServerHTTP(t *testing.T) {
+	srv, expectData := createPACServer(t, "1041")
+
+	serve := func(method, path string, header map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.RemoteAddr = "127.0.0.1:5000"
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, req)
+		return w
+	}
+
+	// content type and validators
+	w := serve("GET", "/"+pacURLFile, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("get pac: expect status %d but got %d", http.StatusOK, w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != pacContentType {
+		t.Errorf("expect content type '%s' but got '%s'", pacContentType, ct)
+	}
+	etag := w.Header().Get("ETag")
+	lastModified := w.Header().Get("Last-Modified")
+	if etag == "" || lastModified == "" {
+		t.Fatalf("expect ETag and Last-Modified but got '%s' and '%s'", etag, lastModified)
+	}
+	pacData := w.Body.String()
+	if !strings.Contains(pacData, expectData) {
+		t.Fatalf("expect '%s' in pac but not found", expectData)
+	}
+
+	// conditional get
+	if w := serve("GET", "/"+pacURLFile, map[string]string{"If-None-Match": etag}); w.Code != http.StatusNotModified {
+		t.Errorf("get pac with If-None-Match: expect status %d but got %d", http.StatusNotModified, w.Code)
+	}
+	if w := serve("GET", "/"+pacURLFile, map[string]string{"If-Modified-Since": lastModified}); w.Code != http.StatusNotModified {
+		t.Errorf("get pac with If-Modified-Since: expect status %d but got %d", http.StatusNotModified, w.Code)
+	}
+	if err := srv.ChangeLocalPort("5678"); err != nil {
+		t.Fatalf("change local port error: %v", err)
+	}
+	if w := serve("GET", "/"+pacURLFile, map[string]string{"If-None-Match": etag}); w.Code != http.StatusOK {
+		t.Errorf("get changed pac with If-None-Match: expect status %d but got %d", http.StatusOK, w.Code)
+	}
+
+	// gzip
+	w = serve("GET", "/"+pacURLFile, map[string]string{"Accept-Encoding": "deflate, gzip"})
+	if w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("expect gzip encoding but got '%s'", w.Header().Get("Content-Encoding"))
+	}
+	zr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatalf("create gzip reader error: %v", err)
+	}
+	data, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("read gzipped pac error: %v", err)
+	}
+	if !strings.Contains(string(data), "SOCKS5 127.0.0.1:5678") {
+		t.Errorf("expect new local port in gzipped pac but not found")
+	}
+	if w := serve("GET", "/"+pacURLFile, map[string]string{"Accept-Encoding": "gzip;q=0"}); w.Header().Get("Content-Encoding") != "" {
+		t.Errorf("expect no encoding but got '%s'", w.Header().Get("Content-Encoding"))
+	}
+
+	// HEAD, wpad.dat and others
+	if w := serve("HEAD", "/"+pacURLFile, nil); w.Code != http.StatusOK || w.Body.Len() != 0 || w.Header().Get("Content-Length") == "" {
+		t.Errorf("head pac: unexpect status %d, body length %d, Content-Length '%s'", w.Code, w.Body.Len(), w.Header().Get("Content-Length"))
+	}
+	if w := serve("GET", "/"+wpadURLFile, nil); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), expectData) {
+		t.Errorf("get wpad.dat: unexpect status %d or content", w.Code)
+	}
+	if w := serve("POST", "/"+pacURLFile, nil); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("post pac: expect status %d but got %d", http.StatusMethodNotAllowed, w.Code)
+	}
+	if w := serve("GET", "/other.pac", nil); w.Code != http.StatusNotFound {
+		t.Errorf("get other.pac: expect status %d but got %d", http.StatusNotFound, w.Code)
+	}
+}
+
+func TestPACServerTemplate(t *testing.T) {
+	const port = "1044"
+	const tmplData = `var rules = {{.Rules}};
+var bypass = {{.Bypass}};
+function FindProxyForURL(url, host) {
+  for (var i = 0; i < rules.length; i++) {
+    if (dnsDomainIs(host, rules[i].substring(2))) {
+      return "PROXY {{.SocksAddr}}:8118; {{.Proxy}}";
+    }
+  }
+  return "DIRECT";
+}
+`
+	tmplFile := createMockPACFile(tmplData, t)
+	defer os.Remove(tmplFile)
+	pacFile := createMockPACFile("||hello.example.com", t)
+	defer os.Remove(pacFile)
+
+	srv, err := NewPACServer(port, "127.0.0.1", "4321", PACOptions{PACFile: pacFile, Template: tmplFile, Bypass: config.DefaultBypass})
+	if err != nil {
+		t.Fatalf("create pac server error: %v", err)
+	}
+	srv.Startup()
+	defer srv.Shutdown()
+
+	checkGetPAC(t, `"127.0.0.1"`, port)
+	checkGetPAC(t, "PROXY 127.0.0.1:8118; SOCKS5 127.0.0.1:4321", port)
+
+	result, err := srv.TestURL("https://hello.example.com/")
+	if err != nil {
+		t.Fatalf("test url error: %v", err)
+	}
+	if result.Route != RouteProxy || !strings.HasPrefix(result.PAC, "PROXY 127.0.0.1:8118") {
+		t.Errorf("expect route '%s' but got '%s' by pac result '%s'", RouteProxy, result.Route, result.PAC)
+	}
+
+	// the template is rendered again with the new port
+	if err := srv.ChangeLocalPort("5678"); err != nil {
+		t.Fatalf("change local port error: %v", err)
+	}
+	checkGetPAC(t, "SOCKS5 127.0.0.1:5678", port)
+}
+
+func TestInvalidPACTemplate(t *testing.T) {
+	pacFile := createMockPACFile("||hello.example.com", t)
+	defer os.Remove(pacFile)
+
+	for _, data := range []string{
+		"function FindProxyForURL(url, host) { return '{{.Proxy'; }",
+		"function FindProxyForURL(url, host) { return {{.Proxy}}; }",
+		"var proxy = '{{.Proxy}}';",
+	} {
+		tmplFile := createMockPACFile(data, t)
+		defer os.Remove(tmplFile)
+
+		if _, err := NewPACServer("1045", "127.0.0.1", "4321", PACOptions{PACFile: pacFile, Template: tmplFile}); err == nil {
+			t.Errorf("create pac server with invalid template '%s' success", data)
+		}
+	}
+}
@@ -0,0 +1,285 @@
+package core
+
+// defaultPACTemplate is the PAC script served by PACServer.
+// The AdBlock style rules are compiled by ssctrl (see pac_compile.go),
+// the matcher below looks them up instead of running every filter.
+const defaultPACTemplate = `// Generated by ssctrl
+
+var proxy = "{{.Proxy}}";
+
+var blockRules = {{.BlockRules}};
+var allowRules = {{.AllowRules}};
+
+// bypass hosts always go direct, and bypassNets match ip hosts only
+var bypassDomains = {{.BypassDomains}};
+var bypassNets = {{.BypassNets}};
+
+var userProxyDomains = {{.UserProxyDomains}};
+var userDirectDomains = {{.UserDirectDomains}};
+var userProxyNets = {{.UserProxyNets}};
+var userDirectNets = {{.UserDirectNets}};
+
+// ipRanges are sorted pairs of the first and the last ip as numbers
+var ipRanges = {{.IPRanges}};
+var ipRulesProxy = {{.IPRulesProxy}};
+var ipRulesFirst = {{.IPRulesFirst}};
+
+// with whitelist, hosts not matched by any rule go proxy
+var whitelist = {{.Whitelist}};
+
+var direct = 'DIRECT;';
+
+function hasOwn(obj, key) {
+  return Object.prototype.hasOwnProperty.call(obj, key);
+}
+
+// isSeparator reports whether the char at i of s matches '^' of AdBlock filters.
+function isSeparator(s, i) {
+  if (i >= s.length) {
+    return true;
+  }
+  return s.charCodeAt(i) < 0x80 && !/[\w%.\-]/.test(s.charAt(i));
+}
+
+function matchDomainTail(authority, end, tail) {
+  var sep = tail.charAt(tail.length - 1) === "^";
+  if (sep) {
+    tail = tail.substring(0, tail.length - 1);
+  }
+  if (authority.substring(end, end + tail.length) !== tail) {
+    return false;
+  }
+  return !sep || isSeparator(authority, end + tail.length);
+}
+
+// matchDomainRules looks up "||domain" rules. A domain may start at the
+// beginning of authority or after any dot but the first char.
+function matchDomainRules(domains, authority) {
+  var start = 0;
+  for (;;) {
+    var end = start;
+    for (;;) {
+      var key = authority.substring(start, end);
+      if (hasOwn(domains, key)) {
+        var tails = domains[key];
+        for (var i = 0; i < tails.length; i++) {
+          if (matchDomainTail(authority, end, tails[i])) {
+            return true;
+          }
+        }
+      }
+      end = authority.indexOf(".", end) + 1;
+      if (end === 0) {
+        break;
+      }
+    }
+    start = authority.indexOf(".", start || 1) + 1;
+    if (start === 0) {
+      return false;
+    }
+  }
+}
+
+function matchPattern(location, pattern) {
+  var begin = pattern.charAt(0) === "|";
+  if (begin) {
+    pattern = pattern.substring(1);
+  }
+  var end = pattern.charAt(pattern.length - 1) === "|";
+  if (end) {
+    pattern = pattern.substring(0, pattern.length - 1);
+  }
+
+  if (begin && end) {
+    return location === pattern;
+  }
+  if (begin) {
+    return location.substring(0, pattern.length) === pattern;
+  }
+  if (end) {
+    return location.length >= pattern.length &&
+      location.substring(location.length - pattern.length) === pattern;
+  }
+  return location.indexOf(pattern) >= 0;
+}
+
+function matchKeywordRules(keywords, location) {
+  var candidates = location.match(/[a-z0-9%]{3,}/g) || [];
+  candidates.push("");
+  for (var i = 0; i < candidates.length; i++) {
+    if (!hasOwn(keywords, candidates[i])) {
+      continue;
+    }
+    var patterns = keywords[candidates[i]];
+    for (var j = 0; j < patterns.length; j++) {
+      if (matchPattern(location, patterns[j])) {
+        return true;
+      }
+    }
+  }
+  return false;
+}
+
+function isActiveOnDomain(domains, host) {
+  if (!domains) {
+    return true;
+  }
+  if (!host) {
+    return domains[""];
+  }
+  host = host.replace(/\.+$/, "").toUpperCase();
+  for (;;) {
+    if (hasOwn(domains, host)) {
+      return domains[host];
+    }
+    var dot = host.indexOf(".");
+    if (dot < 0) {
+      break;
+    }
+    host = host.substring(dot + 1);
+  }
+  return domains[""];
+}
+
+function matchRegexpRules(regexps, location, host) {
+  for (var i = 0; i < regexps.length; i++) {
+    var r = regexps[i];
+    if (r.re === undefined) {
+      try {
+        r.re = new RegExp(r.source, r.flags);
+      } catch (e) {
+        // an invalid regexp never matches
+        r.re = null;
+      }
+    }
+    if (r.re && r.re.test(location) && isActiveOnDomain(r.domains, host)) {
+      return true;
+    }
+  }
+  return false;
+}
+
+function matchRules(rules, url, host) {
+  var location = url.toLowerCase();
+  var m = /^[\w\-]+:\/+([^\/]*)/.exec(location);
+  if (m && matchDomainRules(rules.domains, m[1])) {
+    return true;
+  }
+  if (matchKeywordRules(rules.keywords, location)) {
+    return true;
+  }
+  return matchRegexpRules(rules.regexps, url, host);
+}
+
+function matchDomains(host, domains) {
+  host = host.toLowerCase();
+  for (var i = 0; i < domains.length; i++) {
+    var d = domains[i];
+    if (host === d || (host.length > d.length &&
+        host.substring(host.length - d.length - 1) === "." + d)) {
+      return true;
+    }
+  }
+  return false;
+}
+
+function matchNets(ip, nets) {
+  if (!ip) {
+    return false;
+  }
+  for (var i = 0; i < nets.length; i++) {
+    if (isInNet(ip, nets[i][0], nets[i][1])) {
+      return true;
+    }
+  }
+  return false;
+}
+
+function matchUserRules(host, domains, nets) {
+  if (matchDomains(host, domains)) {
+    return true;
+  }
+  if (nets.length === 0) {
+    return false;
+  }
+  var ip = /^\d+\.\d+\.\d+\.\d+$/.test(host) ? host : dnsResolve(host);
+  return matchNets(ip, nets);
+}
+
+function isBypassed(host) {
+  if (matchDomains(host, bypassDomains)) {
+    return true;
+  }
+  return /^\d+\.\d+\.\d+\.\d+$/.test(host) && matchNets(host, bypassNets);
+}
+
+function ipToNumber(ip) {
+  var parts = ip.split(".");
+  return ((parseInt(parts[0], 10) * 256 + parseInt(parts[1], 10)) * 256 +
+    parseInt(parts[2], 10)) * 256 + parseInt(parts[3], 10);
+}
+
+function matchIPRules(host) {
+  if (ipRanges.length === 0) {
+    return false;
+  }
+  var ip = /^\d+\.\d+\.\d+\.\d+$/.test(host) ? host : dnsResolve(host);
+  if (!ip) {
+    return false;
+  }
+
+  var n = ipToNumber(ip);
+  var lo = 0, hi = ipRanges.length / 2 - 1;
+  while (lo <= hi) {
+    var mid = (lo + hi) >> 1;
+    if (n < ipRanges[2 * mid]) {
+      hi = mid - 1;
+    } else if (n > ipRanges[2 * mid + 1]) {
+      lo = mid + 1;
+    } else {
+      return true;
+    }
+  }
+  return false;
+}
+
+// isLocalHost reports whether host is a plain host name or a loopback,
+// private or link local ip, which goes direct with whitelist.
+function isLocalHost(host) {
+  if (host.indexOf(".") < 0) {
+    return true;
+  }
+  return /^(10|127)\.\d+\.\d+\.\d+$/.test(host) ||
+    /^172\.(1[6-9]|2\d|3[01])\.\d+\.\d+$/.test(host) ||
+    /^(192\.168|169\.254)\.\d+\.\d+$/.test(host);
+}
+
+function FindProxyForURL(url, host) {
+  if (isBypassed(host)) {
+    return direct;
+  }
+  if (matchUserRules(host, userDirectDomains, userDirectNets)) {
+    return direct;
+  }
+  if (matchUserRules(host, userProxyDomains, userProxyNets)) {
+    return proxy;
+  }
+  var ipRoute = ipRulesProxy ? proxy : direct;
+  if (ipRulesFirst && matchIPRules(host)) {
+    return ipRoute;
+  }
+  if (matchRules(allowRules, url, host)) {
+    return direct;
+  }
+  if (matchRules(blockRules, url, host)) {
+    return proxy;
+  }
+  if (!ipRulesFirst && matchIPRules(host)) {
+    return ipRoute;
+  }
+  if (whitelist && !isLocalHost(host)) {
+    return proxy;
+  }
+  return direct;
+}
+`
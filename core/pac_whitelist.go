@@ -0,0 +1,83 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"regexp"
+	"strings"
+)
+
+var whitelistDomainRegexp = regexp.MustCompile(`^[a-z0-9_\-]+(\.[a-z0-9_\-]+)*$`)
+
+// loadWhitelistRules reads the whitelist from a local file, and converts
+// every domain to an AdBlock style exception rule, so the whitelist is
+// compiled and matched the same as other rules.
+func loadWhitelistRules(file string) ([]string, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	domains, err := parseWhitelist(data)
+	if err != nil {
+		return nil, fmt.Errorf("load whitelist from '%s' error: %v", file, err)
+	}
+	rules := make([]string, 0, len(domains))
+	for _, d := range domains {
+		rules = append(rules, "@@||"+d+"^")
+	}
+	return rules, nil
+}
+
+/*
+parseWhitelist parses one domain per line. Lines of dnsmasq config such as
+'server=/example.cn/114.114.114.114' are accepted too, so lists like
+dnsmasq-china-list can be used directly. Empty lines and lines start
+with '#' are ignored.
+*/
+func parseWhitelist(data []byte) ([]string, error) {
+	var domains []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		domain := line
+		if strings.HasPrefix(line, "server=/") {
+			fields := strings.Split(line, "/")
+			if len(fields) < 3 {
+				return nil, fmt.Errorf("invalid dnsmasq config '%s'", line)
+			}
+			domain = fields[1]
+		}
+
+		domain = strings.Trim(strings.ToLower(domain), ".")
+		if !whitelistDomainRegexp.MatchString(domain) {
+			return nil, fmt.Errorf("invalid domain '%s'", line)
+		}
+		domains = append(domains, domain)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return domains, nil
+}
+
+// isLocalHost reports whether host is a plain host name or a loopback,
+// private or link local ip v4 address, which goes direct with whitelist.
+func isLocalHost(host string) bool {
+	if !strings.Contains(host, ".") {
+		return true
+	}
+	ip := net.ParseIP(host).To4()
+	if ip == nil {
+		return false
+	}
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast()
+}
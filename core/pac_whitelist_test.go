@@ -0,0 +1,73 @@
+package core
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/fatcat22/ssctrl/config"
+)
+
+func TestParseWhitelist(t *testing.T) {
+	const data = `
+# domestic domains
+baidu.com
+server=/qq.com/114.114.114.114
+  WWW.Example.CN.
+`
+	domains, err := parseWhitelist([]byte(data))
+	if err != nil {
+		t.Fatalf("parse whitelist error: %v", err)
+	}
+	expect := []string{"baidu.com", "qq.com", "www.example.cn"}
+	if !reflect.DeepEqual(domains, expect) {
+		t.Errorf("expect domains %v but got %v", expect, domains)
+	}
+
+	for _, invalid := range []string{"||baidu.com", "server=/", "exa mple.com"} {
+		if _, err := parseWhitelist([]byte(invalid)); err == nil {
+			t.Errorf("parse invalid whitelist '%s' success", invalid)
+		}
+	}
+}
+
+func TestWhitelistPACServer(t *testing.T) {
+	whitelistFile := createMockPACFile("baidu.com\nserver=/qq.com/114.114.114.114\n", t)
+	defer os.Remove(whitelistFile)
+
+	srv, err := NewPACServer("1043", "127.0.0.1", "4321", PACOptions{
+		UserRules:     config.UserRules{Proxy: []string{"news.qq.com"}},
+		Strategy:      config.PACStrategyWhitelist,
+		WhitelistFile: whitelistFile,
+	})
+	if err != nil {
+		t.Fatalf("create pac server error: %v", err)
+	}
+
+	tests := []struct {
+		url   string
+		route string
+		rule  string
+	}{
+		{"https://www.baidu.com/", RouteDirect, "@@||baidu.com^"},
+		{"https://im.qq.com/", RouteDirect, "@@||qq.com^"},
+		{"https://news.qq.com/", RouteProxy, "news.qq.com"},
+		{"https://www.google.com/", RouteProxy, ""},
+		{"https://notbaidu.com/", RouteProxy, ""},
+		{"http://192.168.1.1/", RouteDirect, ""},
+		{"http://localhost:8080/", RouteDirect, ""},
+	}
+	for _, test := range tests {
+		result, err := srv.TestURL(test.url)
+		if err != nil {
+			t.Fatalf("test url '%s' error: %v", test.url, err)
+		}
+		if result.Route != test.route || result.Rule != test.rule {
+			t.Errorf("url '%s': expect route '%s' by '%s' but got '%s' by '%s'", test.url, test.route, test.rule, result.Route, result.Rule)
+		}
+		if isProxy := strings.HasPrefix(result.PAC, "SOCKS5"); isProxy != (test.route == RouteProxy) {
+			t.Errorf("url '%s': expect route '%s' but pac returns '%s'", test.url, test.route, result.PAC)
+		}
+	}
+}
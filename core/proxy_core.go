@@ -1,18 +1,57 @@
 package core
 
 import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
 	"github.com/fatcat22/ssctrl/config"
 )
 
 var isOnTest = false
 
+// failOpenDialTimeout is the timeout of connecting the server in health checks.
+var failOpenDialTimeout = 5 * time.Second
+
 type ProxyCore struct {
-	pacSrv *PACServer
-	ss     *ShadowSocks
-	op     *OSOperator
+	pacSrv  *PACServer
+	ss      *ShadowSocks
+	op      *OSOperator
+	gfwList *GFWListUpdater
+	// httpProxy is nil if http proxy is disabled.
+	httpProxy *HTTPProxy
+	// ruleProxy runs in config.ModeRule only.
+	ruleProxy *RuleProxy
+	// failOpen is nil if fail-open policy is disabled.
+	failOpen *BackendMonitor
+
+	// opLock protects op and failOpenState, because OS proxy
+	// settings may be cleared and re-applied by failOpen in background.
+	opLock          sync.Mutex
+	failOpenState   FailOpenEvent
+	failOpenHandler func(FailOpenEvent)
+	// checkedRestarts is the restarts of ss process in the last
+	// health check, which is used by failOpen only.
+	checkedRestarts int
+
+	// pacLock protects pacSrv and pacOpts, because
+	// they may be changed by gfwList in background.
+	pacLock sync.Mutex
+
+	pacPort string
+	pacOpts PACOptions
+	// profilePACFile is the rule file of the active pac profile.
+	// The default one(see defaultPACFile) is used if it's empty.
+	profilePACFile string
+	gfwListCfg     config.GFWListConfig
+	// gfwListFile is the rule file updated by gfwList last time,
+	// which is used by the default pac profile.
+	gfwListFile string
 
-	pacPort   string
-	pacFile   string
 	localPort string
 	localAddr string
 	mode      string
@@ -21,36 +60,108 @@ type ProxyCore struct {
 	isStartup bool
 }
 
-func NewProxyCore(pacPort, pacFile, localPort, mode string, srv config.ServerConfig, ssPath string) (*ProxyCore, error) {
-	const localAddr = "127.0.0.1"
+// ProxyCoreConfig is the config of ProxyCore besides the options of
+// its pac server.
+type ProxyCoreConfig struct {
+	PACPort string
+	// LocalAddr is the address which the local socks proxy and the pac
+	// server listen on. It can be a LAN address or 0.0.0.0 to serve
+	// other devices.
+	LocalAddr string
+	LocalPort string
+	// HTTPPort is the port of http proxy, which is disabled if it's empty.
+	HTTPPort string
+	// RulePort is the port of the rule proxy running in config.ModeRule.
+	RulePort string
+	Mode     string
+
+	Server config.ServerConfig
+	// Tunnels are used if Server has no tunnels.
+	Tunnels config.TunnelConfig
+
+	GFWList config.GFWListConfig
+	// OS proxy settings are cleared when the backend is down if
+	// FailOpen is enabled.
+	FailOpen config.FailOpenConfig
+	// DrainTimeout is how long the connections through the old server
+	// are kept at most after changing server.
+	DrainTimeout time.Duration
+	// SSBackend and SSPath tell how to run the shadowsocks client,
+	// see NewShadowSocks.
+	SSBackend string
+	SSPath    string
+}
 
-	pacSrv, err := NewPACServer(pacPort, pacFile, localAddr, localPort)
+// NewProxyCore creates a ProxyCore by cfg, and its pac server by pacOpts.
+func NewProxyCore(cfg ProxyCoreConfig, pacOpts PACOptions) (*ProxyCore, error) {
+	pacOpts.UserRules = pacOpts.UserRules.Copy()
+	pacOpts.AllowedClients = append([]string(nil), pacOpts.AllowedClients...)
+	pacOpts.Bypass = append([]string(nil), pacOpts.Bypass...)
+	pacOpts.HTTPPort = cfg.HTTPPort
+
+	profilePACFile := pacOpts.PACFile
+	if len(profilePACFile) == 0 {
+		pacOpts.PACFile = defaultPACFile(pacOpts, cfg.GFWList)
+	}
+
+	pacSrv, err := NewPACServer(cfg.PACPort, cfg.LocalAddr, cfg.LocalPort, pacOpts)
 	if err != nil {
 		return nil, err
 	}
-	ss, err := NewShadowSocks(ssPath, localAddr, localPort, srv)
+	ss, err := NewShadowSocks(cfg.SSBackend, cfg.SSPath, DefaultSSLogPath, cfg.LocalAddr, cfg.LocalPort, cfg.Server, cfg.Tunnels, cfg.DrainTimeout)
 	if err != nil {
 		return nil, err
 	}
-	op, err := NewOSOperator(mode, pacSrv.GetPACURL(), localAddr, localPort)
+	op, err := NewOSOperator(cfg.Mode, pacSrv.GetPACURL(), dialAddr(cfg.LocalAddr), cfg.LocalPort, cfg.HTTPPort, cfg.RulePort, pacOpts.Bypass)
 	if err != nil {
 		return nil, err
 	}
+	var httpProxy *HTTPProxy
+	if len(cfg.HTTPPort) != 0 {
+		if httpProxy, err = NewHTTPProxy(cfg.LocalAddr, cfg.HTTPPort, cfg.LocalAddr, cfg.LocalPort, pacOpts.AllowedClients); err != nil {
+			return nil, err
+		}
+	}
 
-	return &ProxyCore{
+	pc := &ProxyCore{
 		pacSrv: pacSrv,
 		ss:     ss,
 		op:     op,
 
-		pacPort:   pacPort,
-		pacFile:   pacFile,
-		localPort: localPort,
-		localAddr: localAddr,
-		mode:      mode,
-		srvCfg:    srv,
+		httpProxy: httpProxy,
+
+		pacPort:        cfg.PACPort,
+		pacOpts:        pacOpts,
+		profilePACFile: profilePACFile,
+		gfwListCfg:     cfg.GFWList,
+
+		localPort: cfg.LocalPort,
+		localAddr: cfg.LocalAddr,
+		mode:      cfg.Mode,
+		srvCfg:    cfg.Server,
 
 		isStartup: false,
-	}, nil
+	}
+
+	ruleProxy, err := NewRuleProxy(cfg.LocalAddr, cfg.RulePort, cfg.LocalAddr, cfg.LocalPort, pacOpts.AllowedClients, pc.routeTarget)
+	if err != nil {
+		return nil, err
+	}
+	pc.ruleProxy = ruleProxy
+
+	gfwList, err := NewGFWListUpdater(cfg.GFWList, DefaultGFWListCachePath, dialAddr(cfg.LocalAddr), cfg.LocalPort, pc.reloadPAC)
+	if err != nil {
+		return nil, err
+	}
+	pc.gfwList = gfwList
+
+	if cfg.FailOpen.Enable {
+		if pc.failOpen, err = NewBackendMonitor(cfg.FailOpen, pc.checkBackend, pc.fallBackToDirect, pc.reapplyProxy); err != nil {
+			return nil, err
+		}
+	}
+
+	return pc, nil
 }
 
 func (pc *ProxyCore) Startup() error {
@@ -76,6 +187,37 @@ func (pc *ProxyCore) Startup() error {
 		}
 	}()
 
+	if pc.httpProxy != nil {
+		if err := pc.httpProxy.Startup(); err != nil {
+			return err
+		}
+		defer func() {
+			if !pc.isStartup {
+				pc.httpProxy.Shutdown()
+			}
+		}()
+	}
+
+	if err := pc.gfwList.Startup(); err != nil {
+		return err
+	}
+	defer func() {
+		if !pc.isStartup {
+			pc.gfwList.Shutdown()
+		}
+	}()
+
+	if pc.mode == config.ModeRule {
+		if err := pc.ruleProxy.Startup(); err != nil {
+			return err
+		}
+		defer func() {
+			if !pc.isStartup {
+				pc.ruleProxy.Shutdown()
+			}
+		}()
+	}
+
 	if err := pc.op.Startup(); err != nil {
 		return err
 	}
@@ -85,6 +227,13 @@ func (pc *ProxyCore) Startup() error {
 		}
 	}()
 
+	if pc.failOpen != nil {
+		pc.checkedRestarts = pc.ss.Status().Restarts
+		if err := pc.failOpen.Startup(); err != nil {
+			return err
+		}
+	}
+
 	pc.isStartup = true
 	return nil
 }
@@ -94,22 +243,51 @@ func (pc *ProxyCore) Shutdown() {
 		return
 	}
 
+	if pc.failOpen != nil {
+		pc.failOpen.Shutdown()
+	}
+	pc.opLock.Lock()
 	pc.op.Shutdown()
+	pc.failOpenState = FailOpenEvent{}
+	pc.opLock.Unlock()
+	pc.ruleProxy.Shutdown()
+	pc.gfwList.Shutdown()
+	if pc.httpProxy != nil {
+		pc.httpProxy.Shutdown()
+	}
 	pc.ss.Shutdown()
 	pc.pacSrv.Shutdown()
 
 	pc.isStartup = false
 }
 
-func (pc *ProxyCore) ChangeMode(newMode string) error {
+func (pc *ProxyCore) ChangeMode(newMode string) (result error) {
 	if newMode == pc.mode {
 		return nil
 	}
 
-	if err := pc.op.ChangeMode(newMode); err != nil {
+	// the rule proxy must be ready before OS proxy points to it
+	if newMode == config.ModeRule && pc.isStartup {
+		if err := pc.ruleProxy.Startup(); err != nil {
+			return err
+		}
+		defer func() {
+			if result != nil {
+				pc.ruleProxy.Shutdown()
+			}
+		}()
+	}
+
+	pc.opLock.Lock()
+	err := pc.op.ChangeMode(newMode)
+	pc.opLock.Unlock()
+	if err != nil {
 		return err
 	}
 
+	if pc.mode == config.ModeRule {
+		pc.ruleProxy.Shutdown()
+	}
 	pc.mode = newMode
 	return nil
 }
@@ -129,12 +307,17 @@ func (pc *ProxyCore) ChangeLocalPort(newPort string) (result error) {
 		}
 	}()
 
-	if err := pc.op.ChangeLocalPort(newPort); err != nil {
+	pc.opLock.Lock()
+	err := pc.op.ChangeLocalPort(newPort)
+	pc.opLock.Unlock()
+	if err != nil {
 		return err
 	}
 	defer func() {
 		if result != nil {
+			pc.opLock.Lock()
 			pc.op.ChangeLocalPort(oldPort)
+			pc.opLock.Unlock()
 		}
 	}()
 
@@ -147,6 +330,11 @@ func (pc *ProxyCore) ChangeLocalPort(newPort string) (result error) {
 		}
 	}()
 
+	pc.gfwList.ChangeLocalPort(newPort)
+	if pc.httpProxy != nil {
+		pc.httpProxy.ChangeSocksPort(newPort)
+	}
+	pc.ruleProxy.ChangeSocksPort(newPort)
 	pc.localPort = newPort
 	return nil
 }
@@ -156,7 +344,10 @@ func (pc *ProxyCore) ChangePACPort(newPort string) (result error) {
 		return nil
 	}
 
-	newPACSrv, err := NewPACServer(newPort, pc.pacFile, pc.localAddr, pc.localPort)
+	pc.pacLock.Lock()
+	defer pc.pacLock.Unlock()
+
+	newPACSrv, err := NewPACServer(newPort, pc.localAddr, pc.localPort, pc.pacOpts)
 	if err != nil {
 		return err
 	}
@@ -169,17 +360,21 @@ func (pc *ProxyCore) ChangePACPort(newPort string) (result error) {
 		}
 	}()
 
-	if err := pc.op.ChangePACURL(newPACSrv.GetPACURL()); err != nil {
+	pc.opLock.Lock()
+	err = pc.op.ChangePACURL(newPACSrv.GetPACURL())
+	pc.opLock.Unlock()
+	if err != nil {
 		return err
 	}
 
 	pc.pacSrv.Shutdown()
 	pc.pacSrv = newPACSrv
+	pc.pacPort = newPort
 	return nil
 }
 
 func (pc *ProxyCore) ChangeServerConfig(newSrvCfg config.ServerConfig) error {
-	if newSrvCfg == pc.srvCfg {
+	if reflect.DeepEqual(newSrvCfg, pc.srvCfg) {
 		return nil
 	}
 
@@ -190,3 +385,234 @@ func (pc *ProxyCore) ChangeServerConfig(newSrvCfg config.ServerConfig) error {
 	pc.srvCfg = newSrvCfg
 	return nil
 }
+
+// ChangeDefaultTunnels changes the tunnels used by the servers without
+// their own ones, the ss process is restarted if its tunnels are changed.
+func (pc *ProxyCore) ChangeDefaultTunnels(tunnels config.TunnelConfig) error {
+	return pc.ss.ChangeDefaultTunnels(tunnels)
+}
+
+// UpdateGFWList downloads gfwlist and reloads pac server immediately.
+func (pc *ProxyCore) UpdateGFWList() error {
+	return pc.gfwList.Update()
+}
+
+func (pc *ProxyCore) TestURL(rawURL string) (RouteResult, error) {
+	pc.pacLock.Lock()
+	defer pc.pacLock.Unlock()
+
+	return pc.pacSrv.TestURL(rawURL)
+}
+
+// SSStatus returns the state of the shadowsocks process.
+func (pc *ProxyCore) SSStatus() SSStatus {
+	return pc.ss.Status()
+}
+
+// SSLog returns the log of the shadowsocks process.
+func (pc *ProxyCore) SSLog() *SSLog {
+	return pc.ss.Log()
+}
+
+// FailOpenStatus returns the state of fail-open policy.
+func (pc *ProxyCore) FailOpenStatus() FailOpenEvent {
+	pc.opLock.Lock()
+	defer pc.opLock.Unlock()
+
+	return pc.failOpenState
+}
+
+// SetFailOpenHandler sets the function called with every event of
+// fail-open policy. It's called in background.
+func (pc *ProxyCore) SetFailOpenHandler(h func(FailOpenEvent)) {
+	pc.opLock.Lock()
+	defer pc.opLock.Unlock()
+
+	pc.failOpenHandler = h
+}
+
+// checkBackend is the health check of fail-open policy. The backend is
+// down if ss process is not running or restarted since the last check,
+// or the server can not be connected. The server is not dialed if it's
+// connected by a plugin, which may not use tcp at all.
+func (pc *ProxyCore) checkBackend() error {
+	status := pc.ss.Status()
+	restarts := status.Restarts - pc.checkedRestarts
+	pc.checkedRestarts = status.Restarts
+
+	switch {
+	case status.State == SSStateFailed:
+		// the supervisor has given up, so try again by ourselves
+		if err := pc.ss.Revive(); err != nil {
+			return fmt.Errorf("restart shadowsocks error: %v", err)
+		}
+		return fmt.Errorf("shadowsocks crashed too often(%s)", status.LastExit)
+	case status.State != SSStateRunning:
+		return fmt.Errorf("shadowsocks is %s(%s)", status.State, status.LastExit)
+	case restarts > 0:
+		return fmt.Errorf("shadowsocks restarted %d times(%s)", restarts, status.LastExit)
+	}
+
+	if pc.ss.UsesPlugin() {
+		return nil
+	}
+	conn, err := net.DialTimeout("tcp", pc.ss.ServerAddr(), failOpenDialTimeout)
+	if err != nil {
+		return fmt.Errorf("server is unreachable: %v", err)
+	}
+	conn.Close()
+	return nil
+}
+
+// fallBackToDirect clears OS proxy settings because the backend is down.
+func (pc *ProxyCore) fallBackToDirect(reason error) error {
+	pc.opLock.Lock()
+	if err := pc.op.Shutdown(); err != nil {
+		pc.opLock.Unlock()
+		log.Printf("clear OS proxy settings for fail-open error: %v\n", err)
+		return err
+	}
+	ev := FailOpenEvent{Active: true, Reason: reason.Error(), Time: time.Now()}
+	pc.failOpenState = ev
+	h := pc.failOpenHandler
+	pc.opLock.Unlock()
+
+	log.Printf("proxy backend is down(%v), connections go direct now\n", reason)
+	if h != nil {
+		h(ev)
+	}
+	return nil
+}
+
+// reapplyProxy restores OS proxy settings because the backend recovers.
+func (pc *ProxyCore) reapplyProxy() error {
+	pc.opLock.Lock()
+	if err := pc.op.Startup(); err != nil {
+		pc.opLock.Unlock()
+		log.Printf("re-apply OS proxy settings for fail-open error: %v\n", err)
+		return err
+	}
+	ev := FailOpenEvent{Active: false, Time: time.Now()}
+	pc.failOpenState = ev
+	h := pc.failOpenHandler
+	pc.opLock.Unlock()
+
+	log.Println("proxy backend recovers, OS proxy settings are re-applied")
+	if h != nil {
+		h(ev)
+	}
+	return nil
+}
+
+// routeTarget tells the route of connections to target by the pac server.
+func (pc *ProxyCore) routeTarget(target string) string {
+	pc.pacLock.Lock()
+	pacSrv := pc.pacSrv
+	pc.pacLock.Unlock()
+
+	return pacSrv.RouteTarget(target)
+}
+
+func (pc *ProxyCore) ChangeUserRules(rules config.UserRules) error {
+	pc.pacLock.Lock()
+	defer pc.pacLock.Unlock()
+
+	if err := pc.pacSrv.ChangeUserRules(rules); err != nil {
+		return err
+	}
+
+	pc.pacOpts.UserRules = rules.Copy()
+	return nil
+}
+
+// ChangeBypass changes the bypass list of both OS proxy settings and pac file.
+func (pc *ProxyCore) ChangeBypass(bypass []string) (result error) {
+	pc.pacLock.Lock()
+	defer pc.pacLock.Unlock()
+
+	oldBypass := pc.pacOpts.Bypass
+	pc.opLock.Lock()
+	err := pc.op.ChangeBypass(bypass)
+	pc.opLock.Unlock()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if result != nil {
+			pc.opLock.Lock()
+			pc.op.ChangeBypass(oldBypass)
+			pc.opLock.Unlock()
+		}
+	}()
+
+	if err := pc.pacSrv.ChangeBypass(bypass); err != nil {
+		return err
+	}
+
+	pc.pacOpts.Bypass = append([]string(nil), bypass...)
+	return nil
+}
+
+// ChangePACProfile replaces the rule file and user rules of the pac server.
+// The pac URL is not changed, so the OS proxy setting keeps valid.
+func (pc *ProxyCore) ChangePACProfile(profile config.PACProfile) error {
+	pc.pacLock.Lock()
+	defer pc.pacLock.Unlock()
+
+	pacFile := profile.File
+	if len(pacFile) == 0 {
+		pacFile = pc.defaultPACFile()
+	}
+	if err := pc.pacSrv.ChangeRules(pacFile, profile.Rules); err != nil {
+		return err
+	}
+
+	pc.pacOpts.PACFile = pacFile
+	pc.pacOpts.UserRules = profile.Rules.Copy()
+	pc.profilePACFile = profile.File
+	return nil
+}
+
+func (pc *ProxyCore) reloadPAC(pacFile string) error {
+	pc.pacLock.Lock()
+	defer pc.pacLock.Unlock()
+
+	// gfwlist is not used by the active pac profile or whitelist, and
+	// it's applied when switching to the default profile.
+	pc.gfwListFile = pacFile
+	if len(pc.profilePACFile) != 0 || pc.pacOpts.isWhitelist() {
+		log.Printf("gfwlist '%s' is updated but not applied, the active pac profile or strategy doesn't use it\n", pacFile)
+		return nil
+	}
+
+	if err := pc.pacSrv.ReloadPAC(pacFile); err != nil {
+		return err
+	}
+
+	pc.pacOpts.PACFile = pacFile
+	return nil
+}
+
+// defaultPACFile returns the rule file of the default pac profile, which
+// is the gfwlist updated last time if there is one.
+func (pc *ProxyCore) defaultPACFile() string {
+	if len(pc.gfwListFile) != 0 && !pc.pacOpts.isWhitelist() {
+		return pc.gfwListFile
+	}
+	return defaultPACFile(pc.pacOpts, pc.gfwListCfg)
+}
+
+// defaultPACFile returns the whitelist with config.PACStrategyWhitelist.
+// Otherwise it returns the rules downloaded from gfwlist last time, or
+// DefaultPACLocalPath if there is no one.
+func defaultPACFile(pacOpts PACOptions, gfwListCfg config.GFWListConfig) string {
+	if pacOpts.isWhitelist() {
+		return pacOpts.defaultPACFile()
+	}
+	if gfwListCfg.IsEnabled() {
+		if _, err := os.Stat(DefaultGFWListCachePath); err == nil {
+			return DefaultGFWListCachePath
+		}
+	}
+	return DefaultPACLocalPath
+}
@@ -2,10 +2,13 @@ package core
 
 import (
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/fatcat22/ssctrl/common"
 	"github.com/fatcat22/ssctrl/config"
@@ -14,6 +17,7 @@ import (
 func init() {
 	isOnTest = true
 	api = newOSAPI()
+	DefaultSSLogPath = ""
 }
 
 func TestProxyCoreStartup(t *testing.T) {
@@ -27,11 +31,18 @@ func TestProxyCoreStartup(t *testing.T) {
 		Crypt:    config.Crypt_AEAD_AES_128_GCM,
 		Password: "yourpwd",
 	}
-	const expectPACData = "hello, testing ProxyCore"
-	tmpPACFile := createMockPACFile(expectPACData, t)
+	const mockPACData = "||testing.example.com"
+	const expectPACData = `"testing.example."`
+	tmpPACFile := createMockPACFile(mockPACData, t)
 	defer os.Remove(tmpPACFile)
 
-	core, err := NewProxyCore(expectPACPort, tmpPACFile, expectLocalPort, expectMode, expectSrvCfg, "")
+	core, err := NewProxyCore(ProxyCoreConfig{
+		PACPort:   expectPACPort,
+		LocalAddr: "127.0.0.1",
+		LocalPort: expectLocalPort,
+		Mode:      expectMode,
+		Server:    expectSrvCfg,
+	}, PACOptions{PACFile: tmpPACFile})
 	if err != nil {
 		t.Fatalf("create ProxyCore error: %v", err)
 	}
@@ -62,8 +73,8 @@ func TestProxyCoreStartup(t *testing.T) {
 		if err != nil {
 			t.Errorf("read pac data error: %v", err)
 		} else {
-			if string(data) != expectPACData {
-				t.Errorf("http get pac data failed: expect '%s' but got '%s'", expectPACData, data)
+			if !strings.Contains(string(data), expectPACData) {
+				t.Errorf("http get pac data failed: expect '%s' in pac but not found", expectPACData)
 			}
 		}
 	}
@@ -84,8 +95,11 @@ func TestProxyCoreStartup(t *testing.T) {
 	if ssm.killed == true {
 		t.Errorf("shadowsocks2 process should be started")
 	}
-	if ssm.localPort != expectLocalPort {
-		t.Errorf("shadowsocks2 expect local port %s but got %s", expectLocalPort, ssm.localPort)
+	if core.ss.front.Port() != expectLocalPort {
+		t.Errorf("shadowsocks2 expect local port %s but got %s", expectLocalPort, core.ss.front.Port())
+	}
+	if ssm.localPort != core.ss.front.UpstreamPort() {
+		t.Errorf("shadowsocks2 expect listening on upstream port %s but got %s", core.ss.front.UpstreamPort(), ssm.localPort)
 	}
 	if ssm.srvCfg != expectSrvCfg {
 		t.Errorf("shadowsocks2 expect server config %v but got %v", expectSrvCfg, ssm.srvCfg)
@@ -101,11 +115,17 @@ func TestProxyCoreShutdown(t *testing.T) {
 		Crypt:    config.Crypt_AEAD_AES_128_GCM,
 		Password: "yourpwd",
 	}
-	const expectPACData = "hello, testing ProxyCore"
+	const expectPACData = "||testing.example.com"
 	tmpPACFile := createMockPACFile(expectPACData, t)
 	defer os.Remove(tmpPACFile)
 
-	core, err := NewProxyCore("1234", tmpPACFile, "2234", expectMode, expectSrvCfg, "")
+	core, err := NewProxyCore(ProxyCoreConfig{
+		PACPort:   "1234",
+		LocalAddr: "127.0.0.1",
+		LocalPort: "2234",
+		Mode:      expectMode,
+		Server:    expectSrvCfg,
+	}, PACOptions{PACFile: tmpPACFile})
 	if err != nil {
 		t.Fatalf("NewProxyCore error: %v", err)
 	}
@@ -146,6 +166,26 @@ func TestProxyCoreChangeModeToPAC(t *testing.T) {
 	testChangeMode(config.ModeGlobal, config.ModePAC, modePAC, t)
 }
 
+func TestProxyCoreChangeModeToDirect(t *testing.T) {
+	testChangeMode(config.ModePAC, config.ModeDirect, 0, t)
+}
+
+func TestProxyCoreChangeModeFromDirect(t *testing.T) {
+	testChangeMode(config.ModeDirect, config.ModeGlobal, modeGlobal, t)
+}
+
+func TestProxyCoreChangeModeToRule(t *testing.T) {
+	testChangeMode(config.ModePAC, config.ModeRule, modeGlobal|modeWeb|modeSecureWeb, t)
+}
+
+func TestProxyCoreChangeModeFromRule(t *testing.T) {
+	testChangeMode(config.ModeRule, config.ModeGlobal, modeGlobal, t)
+}
+
+func TestProxyCoreChangeLocalPortOnDirect(t *testing.T) {
+	testProxyCoreChangeLocalPort(config.ModeDirect, t)
+}
+
 func TestProxyCoreChangeLocalPortOnPAC(t *testing.T) {
 	testProxyCoreChangeLocalPort(config.ModePAC, t)
 }
@@ -175,11 +215,17 @@ func TestProxyCoreChangeServerConfig(t *testing.T) {
 		Crypt:    config.Crypt_AEAD_AES_128_GCM,
 		Password: "yourpwd",
 	}
-	const expectPACData = "hello, testing ProxyCore"
+	const expectPACData = "||testing.example.com"
 	tmpPACFile := createMockPACFile(expectPACData, t)
 	defer os.Remove(tmpPACFile)
 
-	core, err := NewProxyCore("1234", tmpPACFile, "9100", config.ModeGlobal, oldSrvCfg, "")
+	core, err := NewProxyCore(ProxyCoreConfig{
+		PACPort:   "1234",
+		LocalAddr: "127.0.0.1",
+		LocalPort: "9100",
+		Mode:      config.ModeGlobal,
+		Server:    oldSrvCfg,
+	}, PACOptions{PACFile: tmpPACFile})
 	if err != nil {
 		t.Fatalf("create ProxyCore error: %v", err)
 	}
@@ -197,6 +243,61 @@ func TestProxyCoreChangeServerConfig(t *testing.T) {
 	}
 }
 
+func TestProxyCoreChangeDefaultTunnels(t *testing.T) {
+	srvCfg := config.ServerConfig{
+		Address:  "11.22.33.44",
+		Port:     "3234",
+		Crypt:    config.Crypt_AEAD_AES_128_GCM,
+		Password: "yourpwd",
+	}
+	oldTunnels := config.TunnelConfig{UDPRelay: true}
+	expectTunnels := config.TunnelConfig{
+		UDPRelay:   true,
+		UDPTunnels: []string{":8053=8.8.8.8:53"},
+	}
+	tmpPACFile := createMockPACFile("||testing.example.com", t)
+	defer os.Remove(tmpPACFile)
+
+	core, err := NewProxyCore(ProxyCoreConfig{
+		PACPort:   "1234",
+		LocalAddr: "127.0.0.1",
+		LocalPort: "9105",
+		Mode:      config.ModeGlobal,
+		Server:    srvCfg,
+		Tunnels:   oldTunnels,
+	}, PACOptions{PACFile: tmpPACFile})
+	if err != nil {
+		t.Fatalf("create ProxyCore error: %v", err)
+	}
+	defer core.Shutdown()
+	if err := core.Startup(); err != nil {
+		t.Fatalf("ProxyCore.Startup error: %v", err)
+	}
+	if ssm := core.ss.proc.(*ssProcessMock); !reflect.DeepEqual(ssm.tunnels, oldTunnels) {
+		t.Errorf("expect ss tunnels %v but got %v", oldTunnels, ssm.tunnels)
+	}
+
+	if err := core.ChangeDefaultTunnels(expectTunnels); err != nil {
+		t.Fatalf("ProxyCore.ChangeDefaultTunnels error: %v", err)
+	}
+	if ssm := core.ss.proc.(*ssProcessMock); !reflect.DeepEqual(ssm.tunnels, expectTunnels) {
+		t.Errorf("expect ss tunnels %v but got %v", expectTunnels, ssm.tunnels)
+	}
+
+	// the tunnels of server are not changed by the default ones
+	srvTunnels := config.TunnelConfig{TCPTunnels: []string{":84=8.8.8.8:80"}}
+	srvCfg.Tunnels = &srvTunnels
+	if err := core.ChangeServerConfig(srvCfg); err != nil {
+		t.Fatalf("ProxyCore.ChangeServerConfig error: %v", err)
+	}
+	if err := core.ChangeDefaultTunnels(oldTunnels); err != nil {
+		t.Fatalf("ProxyCore.ChangeDefaultTunnels error: %v", err)
+	}
+	if ssm := core.ss.proc.(*ssProcessMock); !reflect.DeepEqual(ssm.tunnels, srvTunnels) {
+		t.Errorf("expect ss tunnels %v of server but got %v", srvTunnels, ssm.tunnels)
+	}
+}
+
 func createMockPACFile(data string, t *testing.T) string {
 	tmpFile, err := common.TempFile()
 	if err != nil {
@@ -213,17 +314,25 @@ func createMockPACFile(data string, t *testing.T) string {
 func testChangeMode(oldMode, toMode string, expectMode int, t *testing.T) {
 	const expectPACPort = "1234"
 	const expectLocalPort = "2234"
+	const expectRulePort = "1048"
 	expectSrvCfg := config.ServerConfig{
 		Address:  "11.22.33.44",
 		Port:     "3234",
 		Crypt:    config.Crypt_AEAD_AES_128_GCM,
 		Password: "yourpwd",
 	}
-	const expectPACData = "hello, testing ProxyCore"
+	const expectPACData = "||testing.example.com"
 	tmpPACFile := createMockPACFile(expectPACData, t)
 	defer os.Remove(tmpPACFile)
 
-	core, err := NewProxyCore(expectPACPort, tmpPACFile, expectLocalPort, oldMode, expectSrvCfg, "")
+	core, err := NewProxyCore(ProxyCoreConfig{
+		PACPort:   expectPACPort,
+		LocalAddr: "127.0.0.1",
+		LocalPort: expectLocalPort,
+		RulePort:  expectRulePort,
+		Mode:      oldMode,
+		Server:    expectSrvCfg,
+	}, PACOptions{PACFile: tmpPACFile})
 	if err != nil {
 		t.Fatalf("create ProxyCore error: %v", err)
 	}
@@ -250,10 +359,28 @@ func testChangeMode(oldMode, toMode string, expectMode int, t *testing.T) {
 			if s.pacURL != core.pacSrv.GetPACURL() {
 				t.Errorf("expect pac url %s but got %s", core.pacSrv.GetPACURL(), s.pacURL)
 			}
+		case config.ModeDirect:
+			if s.pacURL != "" || s.globalPort != "" {
+				t.Errorf("network %s: proxy mode is direct, but got pac url '%s' and local port '%s'", name, s.pacURL, s.globalPort)
+			}
+		case config.ModeRule:
+			if s.globalPort != expectRulePort {
+				t.Errorf("network %s: expect rule proxy port %s but got %s", name, expectRulePort, s.globalPort)
+			}
 		default:
 			t.Fatalf("unknown mode %s", toMode)
 		}
 	}
+
+	// the rule proxy runs in rule mode only
+	if core.ruleProxy.isStartup != (toMode == config.ModeRule) {
+		t.Errorf("mode is %s but rule proxy startup is %v", toMode, core.ruleProxy.isStartup)
+	}
+
+	// the local proxy keeps running in every mode
+	if ssm := core.ss.proc.(*ssProcessMock); ssm.killed {
+		t.Errorf("ss process is killed after changing mode to %s", toMode)
+	}
 }
 
 func testProxyCoreChangeLocalPort(mode string, t *testing.T) {
@@ -265,11 +392,17 @@ func testProxyCoreChangeLocalPort(mode string, t *testing.T) {
 		Crypt:    config.Crypt_AEAD_AES_128_GCM,
 		Password: "yourpwd",
 	}
-	const expectPACData = "hello, testing ProxyCore"
+	const expectPACData = "||testing.example.com"
 	tmpPACFile := createMockPACFile(expectPACData, t)
 	defer os.Remove(tmpPACFile)
 
-	core, err := NewProxyCore("1234", tmpPACFile, oldLocalPort, mode, expectSrvCfg, "")
+	core, err := NewProxyCore(ProxyCoreConfig{
+		PACPort:   "1234",
+		LocalAddr: "127.0.0.1",
+		LocalPort: oldLocalPort,
+		Mode:      mode,
+		Server:    expectSrvCfg,
+	}, PACOptions{PACFile: tmpPACFile})
 	if err != nil {
 		t.Fatalf("create ProxyCore error: %v", err)
 	}
@@ -302,6 +435,10 @@ func testProxyCoreChangeLocalPort(mode string, t *testing.T) {
 			if s.pacURL != "" {
 				t.Errorf("network %s: proxy mode is global, expect pac url is empty but got %s", name, s.pacURL)
 			}
+		case config.ModeDirect:
+			if s.mode != 0 {
+				t.Errorf("network %s: proxy mode is direct, but got mode %d", name, s.mode)
+			}
 		default:
 			t.Fatalf("unknown mode %s", mode)
 		}
@@ -309,16 +446,29 @@ func testProxyCoreChangeLocalPort(mode string, t *testing.T) {
 
 	// check ss
 	ssm := core.ss.proc.(*ssProcessMock)
-	if ssm.localPort != expectLocalPort {
-		t.Errorf("expect ss local port %s but got %s", expectLocalPort, ssm.localPort)
+	if core.ss.front.Port() != expectLocalPort {
+		t.Errorf("expect ss local port %s but got %s", expectLocalPort, core.ss.front.Port())
+	}
+	if ssm.localPort != core.ss.front.UpstreamPort() {
+		t.Errorf("expect ss listening on upstream port %s but got %s", core.ss.front.UpstreamPort(), ssm.localPort)
 	}
 
 	// check pac server
-	//TODO: should using http.GET to get pac data
-	//and analyze port from the response data.
-	if core.pacSrv.localPort != expectLocalPort {
+	if core.pacSrv.content.localPort != expectLocalPort {
 		t.Errorf("expect pac server local port %s but got %s", expectLocalPort, ssm.localPort)
 	}
+	resp, err := http.Get(core.pacSrv.GetPACURL())
+	if err != nil {
+		t.Fatalf("get pac data error: %v", err)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("read pac data error: %v", err)
+	}
+	expectProxy := "SOCKS5 127.0.0.1:" + expectLocalPort
+	if !strings.Contains(string(data), expectProxy) {
+		t.Errorf("expect '%s' in pac data but not found", expectProxy)
+	}
 }
 
 func testProxyCoreChangePACPort(mode string, t *testing.T) {
@@ -330,11 +480,17 @@ func testProxyCoreChangePACPort(mode string, t *testing.T) {
 		Crypt:    config.Crypt_AEAD_AES_128_GCM,
 		Password: "yourpwd",
 	}
-	const expectPACData = "hello, testing ProxyCore"
+	const expectPACData = "||testing.example.com"
 	tmpPACFile := createMockPACFile(expectPACData, t)
 	defer os.Remove(tmpPACFile)
 
-	core, err := NewProxyCore(oldPACPort, tmpPACFile, "9100", mode, expectSrvCfg, "")
+	core, err := NewProxyCore(ProxyCoreConfig{
+		PACPort:   oldPACPort,
+		LocalAddr: "127.0.0.1",
+		LocalPort: "9100",
+		Mode:      mode,
+		Server:    expectSrvCfg,
+	}, PACOptions{PACFile: tmpPACFile})
 	if err != nil {
 		t.Fatalf("create ProxyCore error: %v", err)
 	}
@@ -372,3 +528,286 @@ func testProxyCoreChangePACPort(mode string, t *testing.T) {
 		}
 	}
 }
+
+func TestProxyCoreChangePACProfile(t *testing.T) {
+	srvCfg := config.ServerConfig{
+		Address:  "11.22.33.44",
+		Port:     "3234",
+		Crypt:    config.Crypt_AEAD_AES_128_GCM,
+		Password: "yourpwd",
+	}
+	homePACFile := createMockPACFile("||home.example.com", t)
+	defer os.Remove(homePACFile)
+	officePACFile := createMockPACFile("||office.example.com", t)
+	defer os.Remove(officePACFile)
+
+	core, err := NewProxyCore(ProxyCoreConfig{
+		PACPort:   "1234",
+		LocalAddr: "127.0.0.1",
+		LocalPort: "9101",
+		Mode:      config.ModePAC,
+		Server:    srvCfg,
+	}, PACOptions{PACFile: homePACFile})
+	if err != nil {
+		t.Fatalf("create ProxyCore error: %v", err)
+	}
+	defer core.Shutdown()
+	if err := core.Startup(); err != nil {
+		t.Fatalf("ProxyCore.Startup error: %v", err)
+	}
+	pacURL := core.pacSrv.GetPACURL()
+
+	officeRules := config.UserRules{Direct: []string{"example.cn"}}
+	if err := core.ChangePACProfile(config.PACProfile{File: officePACFile, Rules: officeRules}); err != nil {
+		t.Fatalf("ProxyCore.ChangePACProfile error: %v", err)
+	}
+	if core.pacSrv.GetPACURL() != pacURL {
+		t.Errorf("expect pac url %s but got %s", pacURL, core.pacSrv.GetPACURL())
+	}
+	for _, expect := range []string{`"office.example."`, `"example.cn"`} {
+		checkGetPAC(t, expect, "1234")
+	}
+
+	// gfwlist is not used by the profile with its own rule file
+	if err := core.reloadPAC(homePACFile); err != nil {
+		t.Fatalf("reload pac error: %v", err)
+	}
+	checkGetPAC(t, `"office.example."`, "1234")
+
+	if err := core.ChangePACProfile(config.PACProfile{File: officePACFile + ".notexist"}); err == nil {
+		t.Errorf("change to profile with missing rule file should be failed")
+	}
+	if core.pacOpts.PACFile != officePACFile || !reflect.DeepEqual(core.pacOpts.UserRules, officeRules) {
+		t.Errorf("expect pac options unchanged but got %v", core.pacOpts)
+	}
+
+	// the default profile uses the gfwlist reloaded while it's inactive
+	if err := core.ChangePACProfile(config.PACProfile{}); err != nil {
+		t.Fatalf("change to default profile error: %v", err)
+	}
+	if core.pacOpts.PACFile != homePACFile {
+		t.Errorf("expect pac file %s of default profile but got %s", homePACFile, core.pacOpts.PACFile)
+	}
+	checkGetPAC(t, `"home.example."`, "1234")
+}
+
+func TestProxyCoreChangeBypass(t *testing.T) {
+	srvCfg := config.ServerConfig{
+		Address:  "11.22.33.44",
+		Port:     "3234",
+		Crypt:    config.Crypt_AEAD_AES_128_GCM,
+		Password: "yourpwd",
+	}
+	tmpPACFile := createMockPACFile("||intranet.example.com", t)
+	defer os.Remove(tmpPACFile)
+	mapi := resetMockAPI()
+
+	oldBypass := []string{"localhost"}
+	core, err := NewProxyCore(ProxyCoreConfig{
+		PACPort:   "1234",
+		LocalAddr: "127.0.0.1",
+		LocalPort: "9102",
+		Mode:      config.ModeGlobal,
+		Server:    srvCfg,
+	}, PACOptions{PACFile: tmpPACFile, Bypass: oldBypass})
+	if err != nil {
+		t.Fatalf("create ProxyCore error: %v", err)
+	}
+	defer core.Shutdown()
+	if err := core.Startup(); err != nil {
+		t.Fatalf("ProxyCore.Startup error: %v", err)
+	}
+	for name, s := range mapi.settings {
+		if !reflect.DeepEqual(s.bypass, oldBypass) {
+			t.Errorf("network %s: expect bypass %v but got %v", name, oldBypass, s.bypass)
+		}
+	}
+
+	expectBypass := []string{"localhost", "*.example.com"}
+	if err := core.ChangeBypass(expectBypass); err != nil {
+		t.Fatalf("ProxyCore.ChangeBypass error: %v", err)
+	}
+	for name, s := range mapi.settings {
+		if !reflect.DeepEqual(s.bypass, expectBypass) {
+			t.Errorf("network %s: expect bypass %v but got %v", name, expectBypass, s.bypass)
+		}
+	}
+	checkGetPAC(t, `"example.com"`, "1234")
+
+	result, err := core.TestURL("https://intranet.example.com/")
+	if err != nil {
+		t.Fatalf("test url error: %v", err)
+	}
+	if result.Route != RouteDirect || result.Rule != "*.example.com" || result.PAC != "DIRECT;" {
+		t.Errorf("expect intranet.example.com bypassed but got %v", result)
+	}
+}
+
+func TestProxyCoreGlobalWithHTTPProxy(t *testing.T) {
+	const httpPort = "1052"
+	srvCfg := config.ServerConfig{
+		Address:  "11.22.33.44",
+		Port:     "3234",
+		Crypt:    config.Crypt_AEAD_AES_128_GCM,
+		Password: "yourpwd",
+	}
+	tmpPACFile := createMockPACFile("||testing.example.com", t)
+	defer os.Remove(tmpPACFile)
+	mapi := resetMockAPI()
+
+	core, err := NewProxyCore(ProxyCoreConfig{
+		PACPort:   "1234",
+		LocalAddr: "127.0.0.1",
+		LocalPort: "9103",
+		HTTPPort:  httpPort,
+		Mode:      config.ModeGlobal,
+		Server:    srvCfg,
+	}, PACOptions{PACFile: tmpPACFile})
+	if err != nil {
+		t.Fatalf("create ProxyCore error: %v", err)
+	}
+	defer core.Shutdown()
+	if err := core.Startup(); err != nil {
+		t.Fatalf("ProxyCore.Startup error: %v", err)
+	}
+
+	for name, s := range mapi.settings {
+		if s.mode != modeGlobal|modeWeb|modeSecureWeb {
+			t.Errorf("network %s: expect socks, web and secure web proxies but got mode %d", name, s.mode)
+		}
+		if s.globalPort != "9103" || s.webPort != httpPort || s.secureWebPort != httpPort {
+			t.Errorf("network %s: expect socks port 9103 and web port %s but got %s, %s and %s", name, httpPort, s.globalPort, s.webPort, s.secureWebPort)
+		}
+	}
+
+	core.Shutdown()
+	for name, s := range mapi.settings {
+		if s.mode != 0 {
+			t.Errorf("network %s: expect proxies cleared after shutdown but got mode %d", name, s.mode)
+		}
+	}
+}
+
+func TestProxyCoreFailOpen(t *testing.T) {
+	srvListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen mock server error: %v", err)
+	}
+	srvAddr := srvListener.Addr().String()
+	host, port, _ := net.SplitHostPort(srvAddr)
+	srvCfg := config.ServerConfig{
+		Address:  host,
+		Port:     port,
+		Crypt:    config.Crypt_AEAD_AES_128_GCM,
+		Password: "yourpwd",
+	}
+	tmpPACFile := createMockPACFile("||testing.example.com", t)
+	defer os.Remove(tmpPACFile)
+	mapi := resetMockAPI()
+
+	failOpenCfg := config.FailOpenConfig{Enable: true, MaxFailures: 2, CheckInterval: "20ms"}
+	core, err := NewProxyCore(ProxyCoreConfig{
+		PACPort:   "1234",
+		LocalAddr: "127.0.0.1",
+		LocalPort: "9104",
+		Mode:      config.ModePAC,
+		Server:    srvCfg,
+		FailOpen:  failOpenCfg,
+	}, PACOptions{PACFile: tmpPACFile})
+	if err != nil {
+		t.Fatalf("create ProxyCore error: %v", err)
+	}
+	events := make(chan FailOpenEvent, 4)
+	core.SetFailOpenHandler(func(ev FailOpenEvent) { events <- ev })
+	defer core.Shutdown()
+	if err := core.Startup(); err != nil {
+		t.Fatalf("ProxyCore.Startup error: %v", err)
+	}
+
+	waitEvent := func(active bool) {
+		select {
+		case ev := <-events:
+			if ev.Active != active {
+				t.Fatalf("expect fail-open event active %v but got %v", active, ev.Active)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("wait fail-open event active %v timeout", active)
+		}
+	}
+
+	// server is down
+	srvListener.Close()
+	waitEvent(true)
+	for name, s := range mapi.settings {
+		if s.mode != 0 {
+			t.Errorf("network %s: expect proxies cleared when backend is down but got mode %d", name, s.mode)
+		}
+	}
+	if status := core.FailOpenStatus(); !status.Active || !strings.Contains(status.Reason, "unreachable") {
+		t.Errorf("unexpect fail-open status when backend is down: %+v", status)
+	}
+
+	// server recovers
+	srvListener, err = net.Listen("tcp", srvAddr)
+	if err != nil {
+		t.Fatalf("listen mock server again error: %v", err)
+	}
+	defer srvListener.Close()
+	waitEvent(false)
+	for name, s := range mapi.settings {
+		if s.mode != modePAC {
+			t.Errorf("network %s: expect pac proxy re-applied when backend recovers but got mode %d", name, s.mode)
+		}
+	}
+	if status := core.FailOpenStatus(); status.Active {
+		t.Errorf("unexpect fail-open status when backend recovers: %+v", status)
+	}
+}
+
+func TestProxyCoreCheckBackendWithPlugin(t *testing.T) {
+	// nothing listens on the server port
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	l.Close()
+	srvCfg := config.ServerConfig{
+		Address:  host,
+		Port:     port,
+		Crypt:    config.Crypt_AEAD_AES_128_GCM,
+		Password: "yourpwd",
+		Plugin:   "kcptun",
+	}
+	tmpPACFile := createMockPACFile("||testing.example.com", t)
+	defer os.Remove(tmpPACFile)
+	resetMockAPI()
+
+	core, err := NewProxyCore(ProxyCoreConfig{
+		PACPort:   "1234",
+		LocalAddr: "127.0.0.1",
+		LocalPort: "9104",
+		Mode:      config.ModePAC,
+		Server:    srvCfg,
+	}, PACOptions{PACFile: tmpPACFile})
+	if err != nil {
+		t.Fatalf("create ProxyCore error: %v", err)
+	}
+	defer core.Shutdown()
+	if err := core.Startup(); err != nil {
+		t.Fatalf("ProxyCore.Startup error: %v", err)
+	}
+
+	// the plugin may connect the server by udp only
+	if err := core.checkBackend(); err != nil {
+		t.Errorf("expect backend up with a plugin but got error: %v", err)
+	}
+
+	srvCfg.Plugin = ""
+	if err := core.ChangeServerConfig(srvCfg); err != nil {
+		t.Fatalf("ProxyCore.ChangeServerConfig error: %v", err)
+	}
+	if err := core.checkBackend(); err == nil || !strings.Contains(err.Error(), "unreachable") {
+		t.Errorf("expect server unreachable without a plugin but got error: %v", err)
+	}
+}
@@ -0,0 +1,236 @@
+package core
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+/*
+RuleProxy is the proxy OS global proxy points to in config.ModeRule.
+It serves both socks5 and http(including CONNECT) on one port, and
+decides each connection goes direct or through the local socks5 proxy
+by the same rules as the pac file.
+*/
+type RuleProxy struct {
+	listener net.Listener
+
+	listenAddr string
+	port       string
+
+	// handler serves http requests and dials for socks5 requests.
+	handler    *HTTPProxy
+	httpServer *http.Server
+
+	isStartup  bool
+	shutdownCh chan struct{}
+}
+
+// NewRuleProxy creates a rule proxy listening on listenAddr:port. route
+// tells the route of the connections to target(host:port), and the ones
+// of RouteProxy go through the socks5 proxy at socksAddr:socksPort. Like
+// HTTPProxy, only the clients on the same host or in allowedClients are served.
+func NewRuleProxy(listenAddr, port, socksAddr, socksPort string, allowedClients []string, route func(target string) string) (*RuleProxy, error) {
+	handler, err := NewHTTPProxy(listenAddr, port, socksAddr, socksPort, allowedClients)
+	if err != nil {
+		return nil, err
+	}
+	handler.route = route
+
+	return &RuleProxy{
+		listenAddr: listenAddr,
+		port:       port,
+
+		handler: handler,
+
+		isStartup: false,
+	}, nil
+}
+
+func (rp *RuleProxy) Startup() error {
+	if rp.isStartup {
+		return nil
+	}
+
+	tl, err := net.Listen("tcp", rp.listenAddr+":"+rp.port)
+	if err != nil {
+		return err
+	}
+	l := &allowedListener{Listener: tl, allowedNets: rp.handler.allowedNets}
+	// http connections are told from socks5 ones by serve
+	httpConns := newConnListener(l.Addr())
+	httpServer := &http.Server{Handler: rp.handler}
+	shutdownCh := make(chan struct{})
+	rp.listener = l
+	rp.httpServer = httpServer
+	rp.shutdownCh = shutdownCh
+
+	go func() {
+		if err := httpServer.Serve(httpConns); err != http.ErrServerClosed {
+			log.Printf("rule proxy serves http error: %v\n", err)
+		}
+	}()
+	go func() {
+		defer close(shutdownCh)
+		rp.serve(l, httpConns)
+	}()
+
+	rp.isStartup = true
+	return nil
+}
+
+func (rp *RuleProxy) Shutdown() error {
+	if !rp.isStartup {
+		return nil
+	}
+
+	rp.listener.Close()
+	<-rp.shutdownCh
+
+	if err := rp.httpServer.Shutdown(context.Background()); err != nil {
+		return err
+	}
+	rp.handler.closeTunnels()
+	rp.handler.transport.CloseIdleConnections()
+
+	rp.listener = nil
+	rp.httpServer = nil
+	rp.isStartup = false
+	return nil
+}
+
+// ChangeSocksPort makes new connections going proxy dial through the new socks port.
+func (rp *RuleProxy) ChangeSocksPort(newPort string) {
+	rp.handler.ChangeSocksPort(newPort)
+}
+
+func (rp *RuleProxy) serve(l net.Listener, httpConns *connListener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go rp.serveConn(conn, httpConns)
+	}
+}
+
+// serveConn tells socks5 from http by the first byte of conn.
+func (rp *RuleProxy) serveConn(conn net.Conn, httpConns *connListener) {
+	r := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(socks5HandshakeTimeout))
+	first, err := r.Peek(1)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	pc := &peekedConn{Conn: conn, r: r}
+	if first[0] == socks5Version {
+		rp.serveSOCKS5(pc)
+		return
+	}
+	if err := httpConns.put(pc); err != nil {
+		conn.Close()
+	}
+}
+
+func (rp *RuleProxy) serveSOCKS5(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(socks5HandshakeTimeout))
+	cmd, target, err := socks5Accept(conn)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	if cmd != socks.CmdConnect {
+		socks5Reply(conn, socks.ErrCommandNotSupported, nil)
+		conn.Close()
+		return
+	}
+
+	remote, err := rp.handler.dial(context.Background(), target.String())
+	if err != nil {
+		socks5Reply(conn, socks.ErrHostUnreachable, nil)
+		conn.Close()
+		return
+	}
+	if err := socks5Reply(conn, nil, nil); err != nil {
+		conn.Close()
+		remote.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	rp.handler.addTunnel(conn, remote)
+	defer rp.handler.removeTunnel(conn)
+	relay(conn, remote)
+}
+
+// peekedConn is a net.Conn whose first bytes have been read into r.
+type peekedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *peekedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+var errConnListenerClosed = errors.New("listener is closed")
+
+// connListener is a net.Listener accepting the connections put to it.
+type connListener struct {
+	addr      net.Addr
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newConnListener(addr net.Addr) *connListener {
+	return &connListener{
+		addr:   addr,
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+func (l *connListener) put(conn net.Conn) error {
+	select {
+	case l.conns <- conn:
+		return nil
+	case <-l.closed:
+		return errConnListenerClosed
+	}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, errConnListenerClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.addr
+}
@@ -0,0 +1,145 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+func TestRuleProxy(t *testing.T) {
+	const port = "1049"
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(w, "hello %s", req.URL.Path)
+	}))
+	defer backend.Close()
+	_, backendPort, _ := net.SplitHostPort(backend.Listener.Addr().String())
+
+	socksPort, targets, stop := startMockSOCKS5(t)
+	defer stop()
+
+	// ip addresses go direct, and domains go proxy
+	route := func(target string) string {
+		host, _, _ := net.SplitHostPort(target)
+		if net.ParseIP(host) != nil {
+			return RouteDirect
+		}
+		return RouteProxy
+	}
+	rp, err := NewRuleProxy("127.0.0.1", port, "127.0.0.1", socksPort, nil, route)
+	if err != nil {
+		t.Fatalf("create rule proxy error: %v", err)
+	}
+	if err := rp.Startup(); err != nil {
+		t.Fatalf("start rule proxy error: %v", err)
+	}
+	defer rp.Shutdown()
+
+	checkTarget := func(expect string) {
+		select {
+		case target := <-targets:
+			if target != expect {
+				t.Errorf("expect socks target '%s' but got '%s'", expect, target)
+			}
+		default:
+			if len(expect) != 0 {
+				t.Errorf("expect socks target '%s' but it goes direct", expect)
+			}
+		}
+	}
+
+	// http
+	proxyURL, _ := url.Parse("http://127.0.0.1:" + port)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	for _, test := range []struct {
+		url    string
+		target string
+	}{
+		{"http://proxy.test:" + backendPort + "/http-proxy", "proxy.test:" + backendPort},
+		{"http://127.0.0.1:" + backendPort + "/http-direct", ""},
+	} {
+		resp, err := client.Get(test.url)
+		if err != nil {
+			t.Fatalf("get '%s' through rule proxy error: %v", test.url, err)
+		}
+		data, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if expect := "hello " + resp.Request.URL.Path; string(data) != expect {
+			t.Errorf("expect '%s' but got '%s'", expect, data)
+		}
+		checkTarget(test.target)
+	}
+
+	// socks5
+	for _, test := range []struct {
+		target      string
+		socksTarget string
+	}{
+		{"proxy.test:" + backendPort, "proxy.test:" + backendPort},
+		{"127.0.0.1:" + backendPort, ""},
+	} {
+		conn, err := dialSOCKS5(context.Background(), "127.0.0.1:"+port, test.target)
+		if err != nil {
+			t.Fatalf("dial '%s' through rule proxy error: %v", test.target, err)
+		}
+		fmt.Fprintf(conn, "GET /socks HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n\r\n", test.target)
+		data, _ := ioutil.ReadAll(conn)
+		conn.Close()
+		if !strings.Contains(string(data), "hello /socks") {
+			t.Errorf("target '%s': expect 'hello /socks' in response but got '%s'", test.target, data)
+		}
+		checkTarget(test.socksTarget)
+	}
+
+	// udp associate is not supported
+	conn, err := net.Dial("tcp", "127.0.0.1:"+port)
+	if err != nil {
+		t.Fatalf("dial rule proxy error: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	conn.Write([]byte{socks5Version, 1, socks5NoAuth})
+	conn.Write(append([]byte{socks5Version, socks.CmdUDPAssociate, 0}, socks.ParseAddr("0.0.0.0:0")...))
+	reply := make([]byte, 2+3)
+	if _, err := io.ReadFull(conn, reply); err != nil || reply[3] != byte(socks.ErrCommandNotSupported) {
+		t.Errorf("expect udp associate rejected but got reply %v(error: %v)", reply, err)
+	}
+}
+
+func TestPACServerRouteTarget(t *testing.T) {
+	pacFile := createMockPACFile("||hello.example.com\n|http://plain.example.com", t)
+	defer os.Remove(pacFile)
+
+	srv, err := NewPACServer("1050", "127.0.0.1", "4321", PACOptions{PACFile: pacFile})
+	if err != nil {
+		t.Fatalf("create pac server error: %v", err)
+	}
+
+	tests := []struct {
+		target string
+		route  string
+	}{
+		{"hello.example.com:443", RouteProxy},
+		{"www.hello.example.com:80", RouteProxy},
+		{"plain.example.com:80", RouteProxy},
+		{"plain.example.com:443", RouteDirect},
+		{"www.example.com:443", RouteDirect},
+		{"invalid", RouteDirect},
+	}
+	for _, test := range tests {
+		if route := srv.RouteTarget(test.target); route != test.route {
+			t.Errorf("target '%s': expect route '%s' but got '%s'", test.target, test.route, route)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+// The addresses and commands of socks5 are the ones of socks package,
+// and these are the parts of RFC 1928 it doesn't define.
+const (
+	socks5Version = 0x05
+	socks5NoAuth  = 0x00
+
+	socks5NoAcceptable = 0xff
+
+	socks5RepSucceeded = 0x00
+)
+
+// socks5HandshakeTimeout limits how long the handshake with socks server takes.
+var socks5HandshakeTimeout = 10 * time.Second
+
+// dialSOCKS5 connects to target(host:port) through the socks5 server at
+// proxyAddr. Only CONNECT without authentication is supported, which is
+// enough for the local socks port of go-shadowsocks2.
+func dialSOCKS5(ctx context.Context, proxyAddr, target string) (net.Conn, error) {
+	addr := socks.ParseAddr(target)
+	if addr == nil {
+		return nil, fmt.Errorf("invalid target '%s'", target)
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(socks5HandshakeTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+	if err := socks5Connect(conn, addr); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("socks5 connect to '%s' error: %v", target, err)
+	}
+	conn.SetDeadline(time.Time{})
+
+	return conn, nil
+}
+
+func socks5Connect(conn net.Conn, addr socks.Addr) error {
+	// the bound address is useless for CONNECT
+	_, err := socks5Request(conn, socks.CmdConnect, addr)
+	return err
+}
+
+// socks5Request sends the request of cmd with addr to the socks5 server
+// on conn, and returns the bound address replied. The error is a
+// socks.Error if the server replies an error.
+func socks5Request(conn net.Conn, cmd byte, addr socks.Addr) (socks.Addr, error) {
+	if _, err := conn.Write([]byte{socks5Version, 1, socks5NoAuth}); err != nil {
+		return nil, err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return nil, err
+	}
+	if reply[0] != socks5Version || reply[1] != socks5NoAuth {
+		return nil, errors.New("socks5 server requires authentication")
+	}
+
+	req := append([]byte{socks5Version, cmd, 0}, addr...)
+	if _, err := conn.Write(req); err != nil {
+		return nil, err
+	}
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+	if header[1] != socks5RepSucceeded {
+		return nil, socks.Error(header[1])
+	}
+
+	return socks.ReadAddr(conn)
+}
+
+// socks5Accept does the handshake with a socks5 client, and returns the
+// command(socks.CmdConnect or socks.CmdUDPAssociate) and the address of
+// its request. Other commands are replied with socks.ErrCommandNotSupported.
+// The reply of the request is not sent, see socks5Reply.
+func socks5Accept(conn net.Conn) (byte, socks.Addr, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return 0, nil, err
+	}
+	if header[0] != socks5Version {
+		return 0, nil, fmt.Errorf("unknown socks version 0x%02x", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return 0, nil, err
+	}
+	noAuth := false
+	for _, m := range methods {
+		if m == socks5NoAuth {
+			noAuth = true
+			break
+		}
+	}
+	if !noAuth {
+		conn.Write([]byte{socks5Version, socks5NoAcceptable})
+		return 0, nil, errors.New("socks5 client requires authentication")
+	}
+	if _, err := conn.Write([]byte{socks5Version, socks5NoAuth}); err != nil {
+		return 0, nil, err
+	}
+
+	req := make([]byte, 3)
+	if _, err := io.ReadFull(conn, req); err != nil {
+		return 0, nil, err
+	}
+	addr, err := socks.ReadAddr(conn)
+	if err != nil {
+		if err == socks.ErrAddressNotSupported {
+			socks5Reply(conn, socks.ErrAddressNotSupported, nil)
+		}
+		return 0, nil, err
+	}
+	if req[1] != socks.CmdConnect && req[1] != socks.CmdUDPAssociate {
+		socks5Reply(conn, socks.ErrCommandNotSupported, nil)
+		return 0, nil, fmt.Errorf("unsupported socks5 command 0x%02x", req[1])
+	}
+	return req[1], addr, nil
+}
+
+// socks5Reply replies the request of a socks5 client with rep, which is
+// nil if it succeeds. The bound address is 0.0.0.0:0 if bound is nil.
+func socks5Reply(conn net.Conn, rep error, bound socks.Addr) error {
+	code := byte(socks5RepSucceeded)
+	if rep != nil {
+		code = byte(socks.ErrGeneralFailure)
+		if e, ok := rep.(socks.Error); ok {
+			code = byte(e)
+		}
+	}
+	if bound == nil {
+		bound = socks.Addr{socks.AtypIPv4, 0, 0, 0, 0, 0, 0}
+	}
+
+	_, err := conn.Write(append([]byte{socks5Version, code, 0}, bound...))
+	return err
+}
@@ -2,9 +2,15 @@ package core
 
 import (
 	"fmt"
+	"log"
+	"net"
 	"os"
 	"path/filepath"
+	"reflect"
 	"runtime"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/fatcat22/ssctrl/common"
 	"github.com/fatcat22/ssctrl/config"
@@ -12,25 +18,100 @@ import (
 
 var ssProcessIsMock = false
 
+var (
+	// ssRestartDelay is the delay before restarting a crashed ss process
+	// for the first time, and it doubles on each crash up to ssMaxRestartDelay.
+	ssRestartDelay    = time.Second
+	ssMaxRestartDelay = 30 * time.Second
+
+	// ss process is not restarted any more if it crashes more than
+	// ssCrashLoopLimit times within ssCrashLoopWindow.
+	ssCrashLoopLimit  = 5
+	ssCrashLoopWindow = 2 * time.Minute
+
+	// ssStartRetries is the times starting the external ss process is
+	// tried, each time with another port if it fails to listen on one.
+	ssStartRetries = 3
+)
+
+// states of ss process in SSStatus
+const (
+	SSStateStopped    = "stopped"
+	SSStateRunning    = "running"
+	SSStateRestarting = "restarting"
+	SSStateFailed     = "failed"
+)
+
+// SSStatus tells the state of the ss process.
+type SSStatus struct {
+	State string `json:"state"`
+	// Restarts is the times the ss process is restarted after crashing.
+	Restarts int `json:"restarts"`
+	// LastExit is the exit status of the last crashed ss process.
+	LastExit     string    `json:"lastExit,omitempty"`
+	LastExitTime time.Time `json:"lastExitTime,omitempty"`
+}
+
 type ShadowSocks struct {
 	localAddr string
 	localPort string
 	srvCfg    config.ServerConfig
 
-	ssPath string
-	proc   ssProcess
+	// backend is config.SSBackendBuiltin or config.SSBackendExternal,
+	// and ssPath is the go-shadowsocks2 executable of the external one.
+	backend string
+	ssPath  string
+	// defaultTunnels are used if srvCfg has no tunnels.
+	defaultTunnels config.TunnelConfig
+	// ssLog saves the output of every ss process.
+	ssLog *SSLog
+	// front listens on the local port and relays to the current ss process.
+	front *ssFront
+	// drainTimeout is how long the connections through the replaced ss
+	// process are kept.
+	drainTimeout time.Duration
+
+	// lock protects proc and status, which are changed by the supervisor too.
+	lock    sync.Mutex
+	proc    ssProcess
+	status  SSStatus
+	crashes []time.Time
+	stopCh  chan struct{}
+	// draining are the replaced ss processes serving their old connections.
+	draining map[ssProcess]*ssDraining
 
 	isStartup bool
 }
 
-func NewShadowSocks(ssPath, localAddr, localPort string, srvCfg config.ServerConfig) (*ShadowSocks, error) {
+// ssDraining is a replaced ss process which is killed after its
+// connections are finished.
+type ssDraining struct {
+	upstream *ssUpstream
+	tunnels  config.TunnelConfig
+}
+
+// NewShadowSocks creates a ShadowSocks whose process output is saved
+// to the rotated log file logPath, which is disabled if it's empty.
+// defaultTunnels are used by the servers without their own tunnels.
+// The shadowsocks client runs in ssctrl process if backend is
+// config.SSBackendBuiltin, or it's the go-shadowsocks2 at ssPath.
+// The connections through the old server are kept at most drainTimeout
+// after changing server.
+func NewShadowSocks(backend, ssPath, logPath, localAddr, localPort string, srvCfg config.ServerConfig, defaultTunnels config.TunnelConfig, drainTimeout time.Duration) (*ShadowSocks, error) {
 	return &ShadowSocks{
 		localAddr: localAddr,
 		localPort: localPort,
 		srvCfg:    srvCfg,
 
-		ssPath: ssPath,
-		proc:   nil,
+		backend:        backend,
+		ssPath:         ssPath,
+		defaultTunnels: defaultTunnels.Copy(),
+		ssLog:          NewSSLog(logPath),
+		front:          newSSFront(localAddr),
+		drainTimeout:   drainTimeout,
+		proc:           nil,
+		status:         SSStatus{State: SSStateStopped},
+		draining:       make(map[ssProcess]*ssDraining),
 
 		isStartup: false,
 	}, nil
@@ -41,36 +122,237 @@ func (ss *ShadowSocks) Startup() error {
 		return nil
 	}
 
-	proc, err := startSSProcess(ss.ssPath, ss.localAddr, ss.localPort, ss.srvCfg)
+	if err := ss.front.Listen(ss.localPort); err != nil {
+		return err
+	}
+	proc, port, err := ss.startProc(ss.srvCfg, ss.tunnels(ss.srvCfg))
 	if err != nil {
+		ss.front.Close()
 		return err
 	}
 
+	stopCh := make(chan struct{})
+	ss.lock.Lock()
 	ss.proc = proc
+	ss.front.SetUpstream(port)
+	ss.status.State = SSStateRunning
+	ss.crashes = nil
+	ss.stopCh = stopCh
+	ss.lock.Unlock()
+	go ss.supervise(proc, stopCh)
+
 	ss.isStartup = true
 	return nil
 }
 
 func (ss *ShadowSocks) Shutdown() error {
-	if !ss.isStartup || ss.proc == nil {
+	if !ss.isStartup {
+		return nil
+	}
+
+	ss.lock.Lock()
+	proc := ss.proc
+	ss.proc = nil
+	upstream := ss.front.SetUpstream("")
+	draining := ss.draining
+	ss.draining = make(map[ssProcess]*ssDraining)
+	close(ss.stopCh)
+	ss.status.State = SSStateStopped
+	ss.lock.Unlock()
+
+	ss.isStartup = false
+	ss.front.Close()
+	for p, d := range draining {
+		d.upstream.CloseConns()
+		p.Kill()
+	}
+	if upstream != nil {
+		upstream.CloseConns()
+	}
+	if proc != nil {
+		if err := proc.Kill(); err != nil {
+			return err
+		}
+	}
+	return ss.ssLog.Close()
+}
+
+// Log returns the log of ss process.
+func (ss *ShadowSocks) Log() *SSLog {
+	return ss.ssLog
+}
+
+// Status returns the current state of the ss process.
+func (ss *ShadowSocks) Status() SSStatus {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	return ss.status
+}
+
+// ServerAddr returns the address(host:port) of the shadowsocks server.
+func (ss *ShadowSocks) ServerAddr() string {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	return net.JoinHostPort(ss.srvCfg.Address, ss.srvCfg.Port)
+}
+
+// UsesPlugin tells whether the server is connected by a SIP003 plugin.
+func (ss *ShadowSocks) UsesPlugin() bool {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	return len(ss.srvCfg.Plugin) != 0
+}
+
+// Revive starts the ss process again if the supervisor has stopped
+// restarting it because of crashing too often.
+func (ss *ShadowSocks) Revive() error {
+	ss.lock.Lock()
+	if ss.status.State != SSStateFailed {
+		ss.lock.Unlock()
 		return nil
 	}
+	// the process is started without the lock, which may take a while
+	oldProc := ss.proc
+	srvCfg, tunnels := ss.srvCfg, ss.tunnels(ss.srvCfg)
+	ss.status.State = SSStateRestarting
+	ss.lock.Unlock()
 
-	if err := ss.proc.Kill(); err != nil {
+	proc, port, err := ss.startProc(srvCfg, tunnels)
+
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+
+	// the process may be replaced or stopped in the meantime
+	changed := ss.proc != oldProc || ss.status.State != SSStateRestarting
+	if err != nil {
+		if !changed {
+			ss.status.State = SSStateFailed
+		}
 		return err
 	}
+	if changed {
+		proc.Kill()
+		return nil
+	}
 
-	ss.isStartup = false
+	ss.proc = proc
+	if old := ss.front.SetUpstream(port); old != nil {
+		old.CloseConns()
+	}
+	ss.status.State = SSStateRunning
+	ss.crashes = nil
+	go ss.supervise(proc, ss.stopCh)
 	return nil
 }
 
+// supervise waits on proc, and restarts the ss process if it exits
+// unexpectedly until stopCh is closed. A process is killed on purpose
+// if ss.proc is not it any more when it exits.
+func (ss *ShadowSocks) supervise(proc ssProcess, stopCh chan struct{}) {
+	for {
+		select {
+		case <-proc.Exited():
+		case <-stopCh:
+			return
+		}
+
+		ss.lock.Lock()
+		if ss.proc != proc {
+			ss.lock.Unlock()
+			return
+		}
+		delay, ok := ss.onCrash(proc.ExitStatus())
+		ss.lock.Unlock()
+		if !ok {
+			log.Printf("shadowsocks crashed too often(%s), stop restarting it\n", proc.ExitStatus())
+			ss.ssLog.WriteLine(fmt.Sprintf("ssctrl: shadowsocks crashed too often(%s), stop restarting it", proc.ExitStatus()))
+			return
+		}
+		log.Printf("shadowsocks exited unexpectedly(%s), restart it in %v\n", proc.ExitStatus(), delay)
+		ss.ssLog.WriteLine(fmt.Sprintf("ssctrl: shadowsocks exited unexpectedly(%s), restart it in %v", proc.ExitStatus(), delay))
+
+		select {
+		case <-time.After(delay):
+		case <-stopCh:
+			return
+		}
+
+		ss.lock.Lock()
+		if ss.proc != proc {
+			ss.lock.Unlock()
+			return
+		}
+		srvCfg, tunnels := ss.srvCfg, ss.tunnels(ss.srvCfg)
+		ss.lock.Unlock()
+
+		// the process is started without the lock, which may take a while
+		newProc, port, err := ss.startProc(srvCfg, tunnels)
+
+		ss.lock.Lock()
+		if ss.proc != proc {
+			// replaced or stopped in the meantime
+			ss.lock.Unlock()
+			if err == nil {
+				newProc.Kill()
+			}
+			return
+		}
+		if err != nil {
+			// proc has exited, so this is taken as another crash in the next loop.
+			log.Printf("restart shadowsocks error: %v\n", err)
+		} else {
+			ss.proc = newProc
+			if old := ss.front.SetUpstream(port); old != nil {
+				old.CloseConns()
+			}
+			ss.status.State = SSStateRunning
+			ss.status.Restarts++
+			proc = newProc
+		}
+		ss.lock.Unlock()
+	}
+}
+
+// onCrash records a crash of ss process and returns the delay before
+// restarting it. It returns false if ss process crashes too often and
+// should not be restarted. ss.lock must be held.
+func (ss *ShadowSocks) onCrash(exitStatus string) (time.Duration, bool) {
+	now := time.Now()
+	ss.status.LastExit = exitStatus
+	ss.status.LastExitTime = now
+
+	crashes := ss.crashes[:0]
+	for _, t := range ss.crashes {
+		if now.Sub(t) < ssCrashLoopWindow {
+			crashes = append(crashes, t)
+		}
+	}
+	ss.crashes = append(crashes, now)
+	if len(ss.crashes) > ssCrashLoopLimit {
+		ss.status.State = SSStateFailed
+		return 0, false
+	}
+
+	ss.status.State = SSStateRestarting
+	delay := ssRestartDelay
+	for i := 1; i < len(ss.crashes) && delay < ssMaxRestartDelay; i++ {
+		delay *= 2
+	}
+	if delay > ssMaxRestartDelay {
+		delay = ssMaxRestartDelay
+	}
+	return delay, true
+}
+
 func (ss *ShadowSocks) ChangeLocalPort(newPort string) (result error) {
 	if newPort == ss.localPort {
 		return nil
 	}
 	defer func() {
 		if result == nil {
+			ss.lock.Lock()
 			ss.localPort = newPort
+			ss.lock.Unlock()
 		}
 	}()
 
@@ -78,23 +360,20 @@ func (ss *ShadowSocks) ChangeLocalPort(newPort string) (result error) {
 		return nil
 	}
 
-	newProc, err := startSSProcess(ss.ssPath, ss.localAddr, newPort, ss.srvCfg)
-	if err != nil {
-		return err
-	}
-
-	ss.proc.Kill()
-	ss.proc = newProc
-	return nil
+	// local port is listened by the front, so ss process keeps running
+	// and the connections accepted by the old port are not closed.
+	return ss.front.Listen(newPort)
 }
 
 func (ss *ShadowSocks) ChangeServerConfig(newSrvCfg config.ServerConfig) (result error) {
-	if newSrvCfg == ss.srvCfg {
+	if reflect.DeepEqual(newSrvCfg, ss.srvCfg) {
 		return nil
 	}
 	defer func() {
 		if result == nil {
+			ss.lock.Lock()
 			ss.srvCfg = newSrvCfg
+			ss.lock.Unlock()
 		}
 	}()
 
@@ -102,29 +381,268 @@ func (ss *ShadowSocks) ChangeServerConfig(newSrvCfg config.ServerConfig) (result
 		return nil
 	}
 
-	// Because local port is not changed,
-	// we must kill old ss process first, or the new
-	// ss process will listen local port failed.
-	if err := ss.proc.Kill(); err != nil {
+	return ss.restart(newSrvCfg, ss.tunnels(newSrvCfg))
+}
+
+// ChangeDefaultTunnels changes the tunnels used by the servers without
+// their own ones.
+func (ss *ShadowSocks) ChangeDefaultTunnels(newTunnels config.TunnelConfig) (result error) {
+	if reflect.DeepEqual(newTunnels, ss.defaultTunnels) {
+		return nil
+	}
+	defer func() {
+		if result == nil {
+			ss.lock.Lock()
+			ss.defaultTunnels = newTunnels.Copy()
+			ss.lock.Unlock()
+		}
+	}()
+
+	if !ss.isStartup || ss.srvCfg.Tunnels != nil {
+		return nil
+	}
+
+	return ss.restart(ss.srvCfg, newTunnels)
+}
+
+// tunnels returns the tunnels used by srvCfg.
+func (ss *ShadowSocks) tunnels(srvCfg config.ServerConfig) config.TunnelConfig {
+	if srvCfg.Tunnels != nil {
+		return *srvCfg.Tunnels
+	}
+	return ss.defaultTunnels
+}
+
+// restart replaces the ss process by the one with srvCfg and tunnels.
+// New connections go to the new process at once, and the old one is
+// killed after its connections are finished, or ss.drainTimeout passes.
+func (ss *ShadowSocks) restart(srvCfg config.ServerConfig, tunnels config.TunnelConfig) error {
+	ss.stopConflictDraining(tunnels)
+
+	oldTunnels := ss.tunnels(ss.srvCfg)
+	if tunnelsConflict(oldTunnels, tunnels) {
+		return ss.restartAfterKill(srvCfg, tunnels)
+	}
+
+	newProc, port, err := ss.startProc(srvCfg, tunnels)
+	if err != nil {
 		return err
 	}
+	oldProc, oldUpstream := ss.replaceProc(newProc, port)
+	if oldProc != nil {
+		ss.drain(oldProc, oldUpstream, oldTunnels)
+	}
+	return nil
+}
+
+// restartAfterKill is restart used if the old ss process can not run
+// with the new one, it kills the old one first and starts it again if
+// the new one fails.
+func (ss *ShadowSocks) restartAfterKill(srvCfg config.ServerConfig, tunnels config.TunnelConfig) (result error) {
+	oldProc, oldUpstream := ss.replaceProc(nil, "")
+	if oldProc != nil {
+		oldUpstream.CloseConns()
+		if err := oldProc.Kill(); err != nil {
+			ss.replaceProc(oldProc, oldUpstream.port)
+			return err
+		}
+	}
 	defer func() {
 		if result != nil {
-			ss.proc, _ = startSSProcess(ss.ssPath, ss.localAddr, ss.localPort, ss.srvCfg)
+			if proc, port, err := ss.startProc(ss.srvCfg, ss.tunnels(ss.srvCfg)); err == nil {
+				ss.replaceProc(proc, port)
+			}
 		}
 	}()
 
-	newProc, err := startSSProcess(ss.ssPath, ss.localAddr, ss.localPort, newSrvCfg)
+	newProc, port, err := ss.startProc(srvCfg, tunnels)
 	if err != nil {
 		return err
 	}
-	ss.proc = newProc
+	ss.replaceProc(newProc, port)
 	return nil
 }
 
-func startSSProcess(ssPath, localAddr, localPort string, srvCfg config.ServerConfig) (ssProcess, error) {
+// tunnelsConflict tells whether the ss processes with tunnels a and b
+// can not run at the same time, because tunnels are listened by ss
+// processes themselves.
+func tunnelsConflict(a, b config.TunnelConfig) bool {
+	return tunnelPortsOverlap(a.TCPTunnels, b.TCPTunnels) ||
+		tunnelPortsOverlap(a.UDPTunnels, b.UDPTunnels)
+}
+
+// tunnelPortsOverlap tells whether a tunnel of a listens on the same
+// local port as one of b.
+func tunnelPortsOverlap(a, b []string) bool {
+	ports := make(map[string]struct{}, len(a))
+	for _, t := range a {
+		ports[tunnelLocalPort(t)] = struct{}{}
+	}
+	for _, t := range b {
+		if _, ok := ports[tunnelLocalPort(t)]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// tunnelLocalPort returns the local port of tunnel, or "" if it's invalid.
+func tunnelLocalPort(tunnel string) string {
+	local, _, _ := config.ParseTunnel(tunnel)
+	_, port, _ := net.SplitHostPort(local)
+	return port
+}
+
+// drain kills proc replaced by a new ss process once the connections
+// through upstream are finished, or ss.drainTimeout passes.
+func (ss *ShadowSocks) drain(proc ssProcess, upstream *ssUpstream, tunnels config.TunnelConfig) {
+	select {
+	case <-upstream.Idle():
+		proc.Kill()
+		return
+	default:
+	}
+	if ss.drainTimeout <= 0 {
+		upstream.CloseConns()
+		proc.Kill()
+		return
+	}
+
+	ss.lock.Lock()
+	ss.draining[proc] = &ssDraining{upstream: upstream, tunnels: tunnels}
+	stopCh := ss.stopCh
+	ss.lock.Unlock()
+
+	go func() {
+		timer := time.NewTimer(ss.drainTimeout)
+		defer timer.Stop()
+
+		select {
+		case <-upstream.Idle():
+		case <-timer.C:
+		case <-stopCh:
+		}
+		ss.stopDraining(proc)
+	}()
+}
+
+// stopDraining closes the connections of the draining proc and kills it.
+func (ss *ShadowSocks) stopDraining(proc ssProcess) {
+	ss.lock.Lock()
+	d, ok := ss.draining[proc]
+	delete(ss.draining, proc)
+	ss.lock.Unlock()
+
+	if ok {
+		d.upstream.CloseConns()
+		proc.Kill()
+	}
+}
+
+// stopConflictDraining stops the draining processes which can not run
+// with the one with tunnels.
+func (ss *ShadowSocks) stopConflictDraining(tunnels config.TunnelConfig) {
+	var procs []ssProcess
+	ss.lock.Lock()
+	for proc, d := range ss.draining {
+		if tunnelsConflict(d.tunnels, tunnels) {
+			procs = append(procs, proc)
+		}
+	}
+	ss.lock.Unlock()
+
+	for _, proc := range procs {
+		ss.stopDraining(proc)
+	}
+}
+
+// startProc starts a ss process with srvCfg and tunnels, whose socks
+// port is a free one picked for the front to relay to.
+func (ss *ShadowSocks) startProc(srvCfg config.ServerConfig, tunnels config.TunnelConfig) (ssProcess, string, error) {
+	if ss.backend == config.SSBackendBuiltin && !isOnTest {
+		// the port is listened here and taken by the process, so it
+		// can't be taken by others in the meantime.
+		l, err := net.Listen("tcp", ssUpstreamAddr+":0")
+		if err != nil {
+			return nil, "", err
+		}
+		_, port, _ := net.SplitHostPort(l.Addr().String())
+		proc, err := startBuiltinSS(l, srvCfg, tunnels, ss.ssLog)
+		if err != nil {
+			l.Close()
+			return nil, "", err
+		}
+		return proc, port, nil
+	}
+
+	// the external process listens on the port by itself, which may be
+	// taken by others after freePort returns it. go-shadowsocks2 keeps
+	// running if it fails to listen, so it's retried with another port
+	// if the port is not listened.
+	for i := 1; ; i++ {
+		port, err := freePort(ssUpstreamAddr)
+		if err != nil {
+			return nil, "", err
+		}
+		proc, err := startSSProcess(ss.backend, ss.ssPath, ssUpstreamAddr, port, srvCfg, tunnels, ss.ssLog)
+		if err != nil {
+			return nil, "", err
+		}
+		if isOnTest || ssListening(proc, net.JoinHostPort(ssUpstreamAddr, port)) {
+			return proc, port, nil
+		}
+
+		proc.Kill()
+		if i >= ssStartRetries {
+			return nil, "", fmt.Errorf("shadowsocks does not listen on port %s", port)
+		}
+		ss.ssLog.WriteLine(fmt.Sprintf("ssctrl: shadowsocks does not listen on port %s, retry with another port", port))
+	}
+}
+
+// ssListening tells whether proc listens on addr in ssUpstreamDialTimeout.
+// It's true if proc exits, which is taken as a crash by the supervisor.
+func ssListening(proc ssProcess, addr string) bool {
+	deadline := time.Now().Add(ssUpstreamDialTimeout)
+	for {
+		conn, err := net.DialTimeout("tcp", addr, ssUpstreamDialTimeout)
+		if err == nil {
+			conn.Close()
+			return true
+		}
+		select {
+		case <-proc.Exited():
+			return true
+		default:
+		}
+		if time.Now().Add(ssUpstreamDialRetry).After(deadline) {
+			return false
+		}
+		time.Sleep(ssUpstreamDialRetry)
+	}
+}
+
+// replaceProc makes proc listening on port the current ss process and
+// supervises it, and returns the old one with the upstream relaying to
+// it. Replaced process is not restarted by the supervisor any more.
+func (ss *ShadowSocks) replaceProc(proc ssProcess, port string) (ssProcess, *ssUpstream) {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+
+	oldProc := ss.proc
+	ss.proc = proc
+	oldUpstream := ss.front.SetUpstream(port)
+	if proc != nil {
+		ss.status.State = SSStateRunning
+		ss.crashes = nil
+		go ss.supervise(proc, ss.stopCh)
+	}
+	return oldProc, oldUpstream
+}
+
+func startSSProcess(backend, ssPath, localAddr, localPort string, srvCfg config.ServerConfig, tunnels config.TunnelConfig, ssLog *SSLog) (ssProcess, error) {
 	if isOnTest {
-		return newSSProcessMock(localAddr, localPort, srvCfg)
+		return newSSProcessMock(localAddr, localPort, srvCfg, tunnels)
 	}
 
 	if len(ssPath) == 0 {
@@ -135,39 +653,56 @@ func startSSProcess(ssPath, localAddr, localPort string, srvCfg config.ServerCon
 		}
 	}
 
-	argv := []string{
-		ssPath,
-		"-c",
-		fmt.Sprintf("ss://%s:%s@%s:%s", srvCfg.Crypt, srvCfg.Password, srvCfg.Address, srvCfg.Port),
-		"-socks",
-		localAddr + ":" + localPort,
-		"-u",
-		"-udptun",
-		":8053=8.8.8.8:53,:8054=8.8.4.4:53",
-		"-tcptun",
-		":8053=8.8.8.8:53,:84=8.8.4.4:53",
-	}
+	argv := ssArgs(ssPath, localAddr, localPort, srvCfg, tunnels)
 
-	file, err := os.Create(filepath.Join(common.HomeDir(), ".ssctrl", "ss2.log"))
+	r, w, err := os.Pipe()
 	if err != nil {
 		return nil, err
 	}
 	attr := &os.ProcAttr{
 		Files: []*os.File{
 			os.Stdin,
-			file,
-			file,
+			w,
+			w,
 		},
 	}
 
 	proc, err := os.StartProcess(ssPath, argv, attr)
+	// the child has its own copy of w, and r gets EOF after it exits
+	w.Close()
 	if err != nil {
+		r.Close()
 		return nil, err
 	}
 
-	return &ssProcessImpl{
-		proc: proc,
-	}, nil
+	return newSSProcessImpl(proc, r, ssLog), nil
+}
+
+// ssArgs returns the command line of the ss process.
+func ssArgs(ssPath, localAddr, localPort string, srvCfg config.ServerConfig, tunnels config.TunnelConfig) []string {
+	argv := []string{
+		ssPath,
+		"-c",
+		fmt.Sprintf("ss://%s:%s@%s:%s", srvCfg.Crypt, srvCfg.Password, srvCfg.Address, srvCfg.Port),
+		"-socks",
+		localAddr + ":" + localPort,
+	}
+	if len(srvCfg.Plugin) != 0 {
+		argv = append(argv, "-plugin", srvCfg.PluginCommand())
+		if len(srvCfg.PluginOpts) != 0 {
+			argv = append(argv, "-plugin-opts", srvCfg.PluginOpts)
+		}
+	}
+	if tunnels.UDPRelay {
+		argv = append(argv, "-u")
+	}
+	if len(tunnels.UDPTunnels) != 0 {
+		argv = append(argv, "-udptun", strings.Join(tunnels.UDPTunnels, ","))
+	}
+	if len(tunnels.TCPTunnels) != 0 {
+		argv = append(argv, "-tcptun", strings.Join(tunnels.TCPTunnels, ","))
+	}
+	return argv
 }
 
 func getSSPath() (string, error) {
@@ -0,0 +1,429 @@
+package core
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+
+	sscore "github.com/shadowsocks/go-shadowsocks2/core"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+
+	"github.com/fatcat22/ssctrl/config"
+)
+
+var (
+	// ssBuiltinDialTimeout limits how long connecting to the server takes.
+	ssBuiltinDialTimeout = 10 * time.Second
+	// ssBuiltinUDPTimeout is how long an udp session without packets is kept.
+	ssBuiltinUDPTimeout = 5 * time.Minute
+)
+
+const ssBuiltinUDPBufSize = 64 * 1024
+
+/*
+ssBuiltinProcess is the shadowsocks client running in ssctrl process,
+which serves the same socks5 proxy and tunnels as go-shadowsocks2 by
+the ciphers and socks of its packages. It "exits" if one of its
+listeners fails, so it's restarted by ShadowSocks like a crashed process.
+*/
+type ssBuiltinProcess struct {
+	server string
+	cipher sscore.Cipher
+	ssLog  *SSLog
+	// udpRelay tells whether udp associate of socks5 is replied.
+	udpRelay bool
+
+	lock sync.Mutex
+	// closers are the listeners and the connections being relayed,
+	// which are all closed when the process exits.
+	closers map[io.Closer]struct{}
+	exiting bool
+
+	wg         sync.WaitGroup
+	exited     chan struct{}
+	exitStatus string
+}
+
+// startBuiltinSS starts a builtin process serving the socks5 proxy on l,
+// which is closed when the process exits.
+func startBuiltinSS(l net.Listener, srvCfg config.ServerConfig, tunnels config.TunnelConfig, ssLog *SSLog) (ssProcess, error) {
+	if len(srvCfg.Plugin) != 0 {
+		return nil, fmt.Errorf("plugin '%s' is not supported by the builtin ss backend", srvCfg.Plugin)
+	}
+	cipher, err := sscore.PickCipher(srvCfg.Crypt, nil, srvCfg.Password)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &ssBuiltinProcess{
+		server:   net.JoinHostPort(srvCfg.Address, srvCfg.Port),
+		cipher:   cipher,
+		ssLog:    ssLog,
+		udpRelay: tunnels.UDPRelay,
+		closers:  make(map[io.Closer]struct{}),
+		exited:   make(chan struct{}),
+	}
+	var serves []func() error
+
+	socksAddr := l.Addr().String()
+	p.track(l)
+	serves = append(serves, func() error {
+		return p.serveTCP(l, p.handshake)
+	})
+	p.logf("SOCKS proxy %s <-> %s", socksAddr, p.server)
+
+	if tunnels.UDPRelay {
+		c, err := p.listenPacket(socksAddr)
+		if err != nil {
+			p.close()
+			return nil, err
+		}
+		serves = append(serves, func() error { return p.serveUDP(c, nil) })
+	}
+
+	for _, t := range tunnels.TCPTunnels {
+		local, remote, err := config.ParseTunnel(t)
+		if err != nil {
+			p.close()
+			return nil, err
+		}
+		l, err := p.listen(local)
+		if err != nil {
+			p.close()
+			return nil, err
+		}
+		tgt := socks.ParseAddr(remote)
+		serves = append(serves, func() error {
+			return p.serveTCP(l, func(net.Conn) (socks.Addr, error) { return tgt, nil })
+		})
+		p.logf("TCP tunnel %s <-> %s <-> %s", local, p.server, remote)
+	}
+
+	for _, t := range tunnels.UDPTunnels {
+		local, remote, err := config.ParseTunnel(t)
+		if err != nil {
+			p.close()
+			return nil, err
+		}
+		c, err := p.listenPacket(local)
+		if err != nil {
+			p.close()
+			return nil, err
+		}
+		tgt := socks.ParseAddr(remote)
+		serves = append(serves, func() error { return p.serveUDP(c, tgt) })
+		p.logf("UDP tunnel %s <-> %s <-> %s", local, p.server, remote)
+	}
+
+	for _, serve := range serves {
+		p.wg.Add(1)
+		go func(serve func() error) {
+			defer p.wg.Done()
+			if err := serve(); err != nil {
+				p.exit(err.Error())
+			}
+		}(serve)
+	}
+	go func() {
+		p.wg.Wait()
+		close(p.exited)
+	}()
+
+	return p, nil
+}
+
+func (p *ssBuiltinProcess) Kill() error {
+	p.exit("killed")
+	return nil
+}
+
+func (p *ssBuiltinProcess) Exited() <-chan struct{} {
+	return p.exited
+}
+
+func (p *ssBuiltinProcess) ExitStatus() string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.exitStatus
+}
+
+// exit closes all listeners and connections of p, status is
+// ignored if p is exiting already.
+func (p *ssBuiltinProcess) exit(status string) {
+	p.lock.Lock()
+	if p.exiting {
+		p.lock.Unlock()
+		return
+	}
+	p.exiting = true
+	p.exitStatus = status
+	p.lock.Unlock()
+
+	if status != "killed" {
+		p.logf("exit: %s", status)
+	}
+	p.close()
+}
+
+// close closes all listeners and connections of p.
+func (p *ssBuiltinProcess) close() {
+	p.lock.Lock()
+	closers := p.closers
+	p.closers = make(map[io.Closer]struct{})
+	p.lock.Unlock()
+
+	for c := range closers {
+		c.Close()
+	}
+}
+
+// track adds c to the closers of p, or closes c if p is exiting.
+func (p *ssBuiltinProcess) track(c io.Closer) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.exiting {
+		c.Close()
+		return false
+	}
+	p.closers[c] = struct{}{}
+	return true
+}
+
+func (p *ssBuiltinProcess) untrack(c io.Closer) {
+	p.lock.Lock()
+	delete(p.closers, c)
+	p.lock.Unlock()
+}
+
+func (p *ssBuiltinProcess) listen(addr string) (net.Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	p.track(l)
+	return l, nil
+}
+
+func (p *ssBuiltinProcess) listenPacket(addr string) (net.PacketConn, error) {
+	c, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	p.track(c)
+	return c, nil
+}
+
+func (p *ssBuiltinProcess) logf(format string, v ...interface{}) {
+	p.ssLog.WriteLine("builtin ss: " + fmt.Sprintf(format, v...))
+}
+
+// handshake does the socks5 handshake with conn and returns the target
+// of CONNECT. UDP associate is replied only if the udp relay of p is
+// enabled, and socks.InfoUDPAssociate is returned then.
+func (p *ssBuiltinProcess) handshake(conn net.Conn) (socks.Addr, error) {
+	cmd, addr, err := socks5Accept(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	if cmd == socks.CmdUDPAssociate {
+		if !p.udpRelay {
+			socks5Reply(conn, socks.ErrCommandNotSupported, nil)
+			return nil, socks.ErrCommandNotSupported
+		}
+		// the udp relay listens on the same address as the socks port
+		if err := socks5Reply(conn, nil, socks.ParseAddr(conn.LocalAddr().String())); err != nil {
+			return nil, err
+		}
+		return nil, socks.InfoUDPAssociate
+	}
+
+	if err := socks5Reply(conn, nil, nil); err != nil {
+		return nil, err
+	}
+	return addr, nil
+}
+
+// serveTCP relays the connections accepted by l to the targets got by getTarget.
+func (p *ssBuiltinProcess) serveTCP(l net.Listener, getTarget func(net.Conn) (socks.Addr, error)) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return p.serveError(err)
+		}
+		if !p.track(conn) {
+			return nil
+		}
+		go p.serveTCPConn(conn, getTarget)
+	}
+}
+
+func (p *ssBuiltinProcess) serveTCPConn(conn net.Conn, getTarget func(net.Conn) (socks.Addr, error)) {
+	defer p.untrack(conn)
+
+	conn.SetDeadline(time.Now().Add(socks5HandshakeTimeout))
+	tgt, err := getTarget(conn)
+	conn.SetDeadline(time.Time{})
+	if err == socks.InfoUDPAssociate {
+		// the udp association ends when the tcp connection is closed
+		io.Copy(ioutil.Discard, conn)
+		conn.Close()
+		return
+	}
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	rc, err := net.DialTimeout("tcp", p.server, ssBuiltinDialTimeout)
+	if err != nil {
+		p.logf("failed to connect to server %s: %v", p.server, err)
+		conn.Close()
+		return
+	}
+	if !p.track(rc) {
+		conn.Close()
+		return
+	}
+	defer p.untrack(rc)
+
+	sc := &shadowConn{Conn: p.cipher.StreamConn(rc), raw: rc}
+	if _, err := sc.Write(tgt); err != nil {
+		p.logf("failed to send target address %s: %v", tgt, err)
+		conn.Close()
+		rc.Close()
+		return
+	}
+	relay(conn, sc)
+}
+
+// serveUDP relays the packets received by c to tgt, or to the target
+// in the header of every packet from socks5 clients if tgt is nil.
+func (p *ssBuiltinProcess) serveUDP(c net.PacketConn, tgt socks.Addr) error {
+	var sessionLock sync.Mutex
+	sessions := make(map[string]*udpSession)
+
+	buf := make([]byte, ssBuiltinUDPBufSize)
+	copy(buf, tgt)
+	for {
+		n, peer, err := c.ReadFrom(buf[len(tgt):])
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return p.serveError(err)
+		}
+
+		packet := buf[:len(tgt)+n]
+		if tgt == nil {
+			// skip RSV and FRAG of socks5 udp request
+			if n < 3 {
+				continue
+			}
+			packet = buf[3:n]
+		}
+
+		sessionLock.Lock()
+		s := sessions[peer.String()]
+		sessionLock.Unlock()
+		if s == nil {
+			srvAddr, err := net.ResolveUDPAddr("udp", p.server)
+			if err != nil {
+				p.logf("failed to resolve server %s: %v", p.server, err)
+				continue
+			}
+			raw, err := net.ListenPacket("udp", "")
+			if err != nil {
+				p.logf("failed to listen udp: %v", err)
+				continue
+			}
+			if !p.track(raw) {
+				return nil
+			}
+			s = &udpSession{PacketConn: p.cipher.PacketConn(raw), srvAddr: srvAddr}
+
+			sessionLock.Lock()
+			sessions[peer.String()] = s
+			sessionLock.Unlock()
+			go func(peer net.Addr, s *udpSession, raw net.PacketConn) {
+				p.copyUDPBack(c, peer, s, tgt == nil)
+				sessionLock.Lock()
+				delete(sessions, peer.String())
+				sessionLock.Unlock()
+				p.untrack(raw)
+				raw.Close()
+			}(peer, s, raw)
+		}
+
+		if _, err := s.WriteTo(packet, s.srvAddr); err != nil {
+			p.logf("failed to send udp packet to server %s: %v", p.server, err)
+		}
+	}
+}
+
+// copyUDPBack sends the packets from server back to peer until no packet
+// is received in ssBuiltinUDPTimeout. The packets to socks5 clients keep
+// the target address with RSV and FRAG before it, and others drop it.
+func (p *ssBuiltinProcess) copyUDPBack(c net.PacketConn, peer net.Addr, pc net.PacketConn, toSocks bool) {
+	buf := make([]byte, ssBuiltinUDPBufSize)
+	for {
+		pc.SetReadDeadline(time.Now().Add(ssBuiltinUDPTimeout))
+		n, _, err := pc.ReadFrom(buf[3:])
+		if err != nil {
+			return
+		}
+
+		packet := buf[:3+n]
+		if toSocks {
+			packet[0], packet[1], packet[2] = 0, 0, 0
+		} else {
+			addr := socks.SplitAddr(buf[3 : 3+n])
+			if addr == nil {
+				continue
+			}
+			packet = buf[3+len(addr) : 3+n]
+		}
+		if _, err := c.WriteTo(packet, peer); err != nil {
+			return
+		}
+	}
+}
+
+// serveError returns nil if err is caused by closing the listener on exit.
+func (p *ssBuiltinProcess) serveError(err error) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.exiting {
+		return nil
+	}
+	return err
+}
+
+// shadowConn is a connection to the server whose writing side
+// can be shut down, see relay.
+type shadowConn struct {
+	net.Conn
+	raw net.Conn
+}
+
+func (c *shadowConn) CloseWrite() error {
+	if cw, ok := c.raw.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// udpSession is the packet connection to the server for an udp peer.
+type udpSession struct {
+	net.PacketConn
+	srvAddr net.Addr
+}
@@ -0,0 +1,581 @@
+package core
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	sscore "github.com/shadowsocks/go-shadowsocks2/core"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+
+	"github.com/fatcat22/ssctrl/config"
+)
+
+func init() {
+	// the mock server and the builtin client share the salt filter of
+	// go-shadowsocks2 in tests, so salts of the client would be taken
+	// as repeated by the server.
+	os.Setenv("SHADOWSOCKS_SF_CAPACITY", "-1")
+}
+
+// startMockSSServer starts a shadowsocks server relaying tcp to the
+// targets, and echoing every udp packet. It returns the port of server
+// and a function stopping it.
+func startMockSSServer(t *testing.T, srvCfg config.ServerConfig) (string, func()) {
+	cipher, err := sscore.PickCipher(srvCfg.Crypt, nil, srvCfg.Password)
+	if err != nil {
+		t.Fatalf("pick cipher error: %v", err)
+	}
+
+	l, err := sscore.Listen("tcp", "127.0.0.1:0", cipher)
+	if err != nil {
+		t.Fatalf("listen tcp error: %v", err)
+	}
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	pc, err := sscore.ListenPacket("udp", "127.0.0.1:"+port, cipher)
+	if err != nil {
+		l.Close()
+		t.Fatalf("listen udp error: %v", err)
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				tgt, err := socks.ReadAddr(conn)
+				if err != nil {
+					conn.Close()
+					return
+				}
+				remote, err := net.Dial("tcp", tgt.String())
+				if err != nil {
+					conn.Close()
+					return
+				}
+				relay(conn, remote)
+			}()
+		}
+	}()
+	go func() {
+		buf := make([]byte, ssBuiltinUDPBufSize)
+		for {
+			n, peer, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(buf[:n], peer)
+		}
+	}()
+
+	return port, func() {
+		l.Close()
+		pc.Close()
+	}
+}
+
+// startEchoServer starts a tcp server echoing everything it receives.
+func startEchoServer(t *testing.T) (string, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen echo server error: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return l.Addr().String(), func() { l.Close() }
+}
+
+func checkEcho(t *testing.T, conn net.Conn, name string) {
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Errorf("write to %s error: %v", name, err)
+		return
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Errorf("read from %s error: %v", name, err)
+		return
+	}
+	if string(buf) != "hello" {
+		t.Errorf("expect 'hello' from %s but got '%s'", name, buf)
+	}
+}
+
+func TestSSBuiltinProcess(t *testing.T) {
+	srvCfg := config.ServerConfig{
+		Address:  "127.0.0.1",
+		Crypt:    config.Crypt_AEAD_CHACHA20_POLY1305,
+		Password: "yourpwd",
+	}
+	srvPort, stopServer := startMockSSServer(t, srvCfg)
+	defer stopServer()
+	srvCfg.Port = srvPort
+	echoAddr, stopEcho := startEchoServer(t)
+	defer stopEcho()
+
+	tunnels := config.TunnelConfig{
+		UDPRelay:   true,
+		TCPTunnels: []string{"127.0.0.1:9116=" + echoAddr},
+		UDPTunnels: []string{"127.0.0.1:9117=8.8.8.8:53"},
+	}
+	sl := NewSSLog("")
+	l, err := net.Listen("tcp", "127.0.0.1:9115")
+	if err != nil {
+		t.Fatalf("listen socks port error: %v", err)
+	}
+	proc, err := startBuiltinSS(l, srvCfg, tunnels, sl)
+	if err != nil {
+		t.Fatalf("start builtin ss error: %v", err)
+	}
+	defer proc.Kill()
+
+	// socks5 proxy
+	conn, err := dialSOCKS5(context.Background(), "127.0.0.1:9115", echoAddr)
+	if err != nil {
+		t.Fatalf("dial through socks5 proxy error: %v", err)
+	}
+	checkEcho(t, conn, "socks5 proxy")
+
+	// tcp tunnel
+	conn, err = net.Dial("tcp", "127.0.0.1:9116")
+	if err != nil {
+		t.Fatalf("dial tcp tunnel error: %v", err)
+	}
+	checkEcho(t, conn, "tcp tunnel")
+
+	// udp tunnel
+	uc, err := net.Dial("udp", "127.0.0.1:9117")
+	if err != nil {
+		t.Fatalf("dial udp tunnel error: %v", err)
+	}
+	defer uc.Close()
+	uc.SetDeadline(time.Now().Add(3 * time.Second))
+	if _, err := uc.Write([]byte("ping")); err != nil {
+		t.Fatalf("write to udp tunnel error: %v", err)
+	}
+	buf := make([]byte, 16)
+	if n, err := uc.Read(buf); err != nil || string(buf[:n]) != "ping" {
+		t.Errorf("expect 'ping' from udp tunnel but got '%s'(error: %v)", buf[:n], err)
+	}
+
+	// udp relay of socks5 proxy
+	ctrlConn, err := net.Dial("tcp", "127.0.0.1:9115")
+	if err != nil {
+		t.Fatalf("dial socks5 proxy error: %v", err)
+	}
+	defer ctrlConn.Close()
+	ctrlConn.SetDeadline(time.Now().Add(3 * time.Second))
+	ctrlConn.Write([]byte{socks5Version, 1, socks5NoAuth})
+	reply := make([]byte, 2+10)
+	ctrlConn.Write([]byte{socks5Version, 3, 0, socks.AtypIPv4, 0, 0, 0, 0, 0, 0})
+	if _, err := io.ReadFull(ctrlConn, reply); err != nil || reply[3] != socks5RepSucceeded {
+		t.Fatalf("udp associate error: %v, reply %v", err, reply)
+	}
+	relayConn, err := net.Dial("udp", "127.0.0.1:9115")
+	if err != nil {
+		t.Fatalf("dial udp relay error: %v", err)
+	}
+	defer relayConn.Close()
+	relayConn.SetDeadline(time.Now().Add(3 * time.Second))
+	packet := append(append([]byte{0, 0, 0}, socks.ParseAddr("8.8.8.8:53")...), "ping"...)
+	if _, err := relayConn.Write(packet); err != nil {
+		t.Fatalf("write to udp relay error: %v", err)
+	}
+	buf = make([]byte, 64)
+	if n, err := relayConn.Read(buf); err != nil || string(buf[:n]) != string(packet) {
+		t.Errorf("expect %v from udp relay but got %v(error: %v)", packet, buf[:n], err)
+	}
+
+	if err := proc.Kill(); err != nil {
+		t.Fatalf("kill builtin ss error: %v", err)
+	}
+	select {
+	case <-proc.Exited():
+	case <-time.After(3 * time.Second):
+		t.Fatalf("wait builtin ss exiting timeout")
+	}
+	if proc.ExitStatus() != "killed" {
+		t.Errorf("expect exit status 'killed' but got '%s'", proc.ExitStatus())
+	}
+
+	// ports are released after exiting
+	if l, err = net.Listen("tcp", "127.0.0.1:9115"); err != nil {
+		t.Fatalf("listen socks port again error: %v", err)
+	}
+	newProc, err := startBuiltinSS(l, srvCfg, tunnels, sl)
+	if err != nil {
+		t.Fatalf("start builtin ss again error: %v", err)
+	}
+	newProc.Kill()
+}
+
+func TestSSBuiltinProcessUDPRelayDisabled(t *testing.T) {
+	srvCfg := config.ServerConfig{
+		Address:  "127.0.0.1",
+		Port:     "8388",
+		Crypt:    config.Crypt_AEAD_CHACHA20_POLY1305,
+		Password: "yourpwd",
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:9120")
+	if err != nil {
+		t.Fatalf("listen socks port error: %v", err)
+	}
+	proc, err := startBuiltinSS(l, srvCfg, config.TunnelConfig{}, NewSSLog(""))
+	if err != nil {
+		t.Fatalf("start builtin ss error: %v", err)
+	}
+	defer proc.Kill()
+
+	conn, err := net.Dial("tcp", "127.0.0.1:9120")
+	if err != nil {
+		t.Fatalf("dial socks5 proxy error: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	conn.Write([]byte{socks5Version, 1, socks5NoAuth})
+	conn.Write([]byte{socks5Version, socks.CmdUDPAssociate, 0, socks.AtypIPv4, 0, 0, 0, 0, 0, 0})
+	reply := make([]byte, 2+10)
+	if _, err := io.ReadFull(conn, reply); err != nil || reply[3] != byte(socks.ErrCommandNotSupported) {
+		t.Errorf("expect udp associate rejected but got reply %v(error: %v)", reply, err)
+	}
+}
+
+func TestSSBuiltinProcessRejectsPlugin(t *testing.T) {
+	srvCfg := config.ServerConfig{
+		Address:  "127.0.0.1",
+		Port:     "8388",
+		Crypt:    config.Crypt_AEAD_CHACHA20_POLY1305,
+		Password: "yourpwd",
+		Plugin:   "v2ray-plugin",
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen socks port error: %v", err)
+	}
+	defer l.Close()
+	if _, err := startBuiltinSS(l, srvCfg, config.TunnelConfig{}, NewSSLog("")); err == nil {
+		t.Errorf("start builtin ss with plugin success")
+	}
+}
+
+func TestShadowSocksBuiltinBackend(t *testing.T) {
+	oldIsOnTest := isOnTest
+	isOnTest = false
+	defer func() { isOnTest = oldIsOnTest }()
+
+	srvCfg := config.ServerConfig{
+		Address:  "127.0.0.1",
+		Crypt:    config.Crypt_AEAD_AES_256_GCM,
+		Password: "yourpwd",
+	}
+	srvPort, stopServer := startMockSSServer(t, srvCfg)
+	defer stopServer()
+	srvCfg.Port = srvPort
+	newSrvCfg := srvCfg
+	newSrvCfg.Crypt = config.Crypt_AEAD_AES_128_GCM
+	newSrvPort, stopNewServer := startMockSSServer(t, newSrvCfg)
+	defer stopNewServer()
+	newSrvCfg.Port = newSrvPort
+	echoAddr, stopEcho := startEchoServer(t)
+	defer stopEcho()
+
+	checkSocks := func(port string) {
+		conn, err := dialSOCKS5(context.Background(), "127.0.0.1:"+port, echoAddr)
+		if err != nil {
+			t.Fatalf("dial through socks5 proxy at %s error: %v", port, err)
+		}
+		checkEcho(t, conn, "socks5 proxy at "+port)
+	}
+
+	ss, err := NewShadowSocks(config.SSBackendBuiltin, "", "", "127.0.0.1", "9118", srvCfg, config.TunnelConfig{}, 0)
+	if err != nil {
+		t.Fatalf("NewShadowSocks error: %v", err)
+	}
+	if err := ss.Startup(); err != nil {
+		t.Fatalf("ShadowSocks.Startup error: %v", err)
+	}
+	defer ss.Shutdown()
+	checkSocks("9118")
+
+	if err := ss.ChangeLocalPort("9119"); err != nil {
+		t.Fatalf("ShadowSocks.ChangeLocalPort error: %v", err)
+	}
+	checkSocks("9119")
+	if _, err := net.Dial("tcp", "127.0.0.1:9118"); err == nil {
+		t.Errorf("old local port is still listened after changing local port")
+	}
+
+	if err := ss.ChangeServerConfig(newSrvCfg); err != nil {
+		t.Fatalf("ShadowSocks.ChangeServerConfig error: %v", err)
+	}
+	// connections go through the new server only
+	stopServer()
+	checkSocks("9119")
+	if status := ss.Status(); status.State != SSStateRunning || status.Restarts != 0 {
+		t.Errorf("expect ss running without restarts but got %v", status)
+	}
+}
+
+func TestShadowSocksUDPAssociateFromLAN(t *testing.T) {
+	var lanIP net.IP
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() != nil && !ipNet.IP.IsLoopback() {
+				lanIP = ipNet.IP.To4()
+				break
+			}
+		}
+	}
+	if lanIP == nil {
+		t.Skip("no LAN address to test with")
+	}
+
+	oldIsOnTest := isOnTest
+	isOnTest = false
+	defer func() { isOnTest = oldIsOnTest }()
+
+	srvCfg := config.ServerConfig{
+		Address:  "127.0.0.1",
+		Crypt:    config.Crypt_AEAD_CHACHA20_POLY1305,
+		Password: "yourpwd",
+	}
+	srvPort, stopServer := startMockSSServer(t, srvCfg)
+	defer stopServer()
+	srvCfg.Port = srvPort
+
+	ss, err := NewShadowSocks(config.SSBackendBuiltin, "", "", "0.0.0.0", "9121", srvCfg, config.TunnelConfig{UDPRelay: true}, 0)
+	if err != nil {
+		t.Fatalf("NewShadowSocks error: %v", err)
+	}
+	if err := ss.Startup(); err != nil {
+		t.Fatalf("ShadowSocks.Startup error: %v", err)
+	}
+	defer ss.Shutdown()
+
+	ctrlConn, err := net.Dial("tcp", net.JoinHostPort(lanIP.String(), "9121"))
+	if err != nil {
+		t.Fatalf("dial socks5 proxy error: %v", err)
+	}
+	defer ctrlConn.Close()
+	ctrlConn.SetDeadline(time.Now().Add(3 * time.Second))
+	bound, err := socks5Request(ctrlConn, socks.CmdUDPAssociate, socks.ParseAddr("0.0.0.0:0"))
+	if err != nil {
+		t.Fatalf("udp associate error: %v", err)
+	}
+	boundAddr, err := net.ResolveUDPAddr("udp", bound.String())
+	if err != nil || !boundAddr.IP.Equal(lanIP) {
+		t.Fatalf("expect udp relay at %s but got %s(error: %v)", lanIP, bound, err)
+	}
+
+	// the client sends from its LAN address too
+	relayConn, err := net.DialUDP("udp", &net.UDPAddr{IP: lanIP}, boundAddr)
+	if err != nil {
+		t.Fatalf("dial udp relay error: %v", err)
+	}
+	defer relayConn.Close()
+	relayConn.SetDeadline(time.Now().Add(3 * time.Second))
+	packet := append(append([]byte{0, 0, 0}, socks.ParseAddr("8.8.8.8:53")...), "ping"...)
+	if _, err := relayConn.Write(packet); err != nil {
+		t.Fatalf("write to udp relay error: %v", err)
+	}
+	buf := make([]byte, 64)
+	if n, err := relayConn.Read(buf); err != nil || string(buf[:n]) != string(packet) {
+		t.Errorf("expect %v from udp relay but got %v(error: %v)", packet, buf[:n], err)
+	}
+}
+
+func TestShadowSocksSwitchDrain(t *testing.T) {
+	oldIsOnTest := isOnTest
+	isOnTest = false
+	defer func() { isOnTest = oldIsOnTest }()
+
+	var srvCfgs []config.ServerConfig
+	for i := 0; i < 3; i++ {
+		srvCfg := config.ServerConfig{
+			Address:  "127.0.0.1",
+			Crypt:    config.Crypt_AEAD_CHACHA20_POLY1305,
+			Password: "yourpwd",
+		}
+		srvPort, stopServer := startMockSSServer(t, srvCfg)
+		defer stopServer()
+		srvCfg.Port = srvPort
+		srvCfgs = append(srvCfgs, srvCfg)
+	}
+	echoAddr, stopEcho := startEchoServer(t)
+	defer stopEcho()
+
+	currentProc := func(ss *ShadowSocks) ssProcess {
+		ss.lock.Lock()
+		defer ss.lock.Unlock()
+		return ss.proc
+	}
+	echo := func(conn net.Conn, name string) {
+		conn.SetDeadline(time.Now().Add(3 * time.Second))
+		buf := make([]byte, 5)
+		if _, err := conn.Write([]byte("hello")); err != nil {
+			t.Fatalf("write to %s error: %v", name, err)
+		}
+		if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+			t.Fatalf("expect 'hello' from %s but got '%s'(error: %v)", name, buf, err)
+		}
+	}
+	waitExited := func(proc ssProcess, name string) {
+		select {
+		case <-proc.Exited():
+		case <-time.After(3 * time.Second):
+			t.Fatalf("%s is not killed after draining", name)
+		}
+	}
+
+	ss, err := NewShadowSocks(config.SSBackendBuiltin, "", "", "127.0.0.1", "9113", srvCfgs[0], config.TunnelConfig{}, time.Minute)
+	if err != nil {
+		t.Fatalf("NewShadowSocks error: %v", err)
+	}
+	if err := ss.Startup(); err != nil {
+		t.Fatalf("ShadowSocks.Startup error: %v", err)
+	}
+	defer ss.Shutdown()
+
+	oldConn, err := dialSOCKS5(context.Background(), "127.0.0.1:9113", echoAddr)
+	if err != nil {
+		t.Fatalf("dial through socks5 proxy error: %v", err)
+	}
+	defer oldConn.Close()
+	echo(oldConn, "old connection")
+
+	oldProc := currentProc(ss)
+	if err := ss.ChangeServerConfig(srvCfgs[1]); err != nil {
+		t.Fatalf("ShadowSocks.ChangeServerConfig error: %v", err)
+	}
+	// the old connection keeps working through the old server, and new
+	// connections go through the new one
+	echo(oldConn, "old connection after switching")
+	conn, err := dialSOCKS5(context.Background(), "127.0.0.1:9113", echoAddr)
+	if err != nil {
+		t.Fatalf("dial through socks5 proxy after switching error: %v", err)
+	}
+	checkEcho(t, conn, "new connection")
+	select {
+	case <-oldProc.Exited():
+		t.Fatalf("old ss process is killed before its connection is finished")
+	default:
+	}
+
+	// the old process is killed once its connections are finished
+	oldConn.Close()
+	waitExited(oldProc, "old ss process")
+
+	// connections are closed if they're not finished in drain timeout
+	ss.drainTimeout = 100 * time.Millisecond
+	oldConn, err = dialSOCKS5(context.Background(), "127.0.0.1:9113", echoAddr)
+	if err != nil {
+		t.Fatalf("dial through socks5 proxy error: %v", err)
+	}
+	defer oldConn.Close()
+	echo(oldConn, "old connection")
+
+	oldProc = currentProc(ss)
+	if err := ss.ChangeServerConfig(srvCfgs[2]); err != nil {
+		t.Fatalf("ShadowSocks.ChangeServerConfig error: %v", err)
+	}
+	waitExited(oldProc, "ss process with unfinished connections")
+	oldConn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err := oldConn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expect old connection closed after drain timeout but got error %v", err)
+	}
+
+	if status := ss.Status(); status.State != SSStateRunning || status.Restarts != 0 {
+		t.Errorf("expect ss running without restarts but got %v", status)
+	}
+}
+
+func TestShadowSocksSwitchTunnelPorts(t *testing.T) {
+	oldIsOnTest := isOnTest
+	isOnTest = false
+	defer func() { isOnTest = oldIsOnTest }()
+
+	srvCfg := config.ServerConfig{
+		Address:  "127.0.0.1",
+		Crypt:    config.Crypt_AEAD_CHACHA20_POLY1305,
+		Password: "yourpwd",
+	}
+	srvPort, stopServer := startMockSSServer(t, srvCfg)
+	defer stopServer()
+	srvCfg.Port = srvPort
+	echoAddr, stopEcho := startEchoServer(t)
+	defer stopEcho()
+
+	currentProc := func(ss *ShadowSocks) ssProcess {
+		ss.lock.Lock()
+		defer ss.lock.Unlock()
+		return ss.proc
+	}
+	checkTunnel := func(addr, name string) {
+		conn, err := net.DialTimeout("tcp", addr, 3*time.Second)
+		if err != nil {
+			t.Fatalf("dial %s error: %v", name, err)
+		}
+		checkEcho(t, conn, name)
+	}
+	tunnels := func(port string) config.TunnelConfig {
+		return config.TunnelConfig{TCPTunnels: []string{"127.0.0.1:" + port + "=" + echoAddr}}
+	}
+
+	ss, err := NewShadowSocks(config.SSBackendBuiltin, "", "", "127.0.0.1", "9122", srvCfg, tunnels("9123"), time.Minute)
+	if err != nil {
+		t.Fatalf("NewShadowSocks error: %v", err)
+	}
+	if err := ss.Startup(); err != nil {
+		t.Fatalf("ShadowSocks.Startup error: %v", err)
+	}
+	defer ss.Shutdown()
+	checkTunnel("127.0.0.1:9123", "tunnel")
+
+	oldConn, err := dialSOCKS5(context.Background(), "127.0.0.1:9122", echoAddr)
+	if err != nil {
+		t.Fatalf("dial through socks5 proxy error: %v", err)
+	}
+	defer oldConn.Close()
+
+	// the tunnel ports don't overlap, so the old process is kept for
+	// its connection
+	oldProc := currentProc(ss)
+	if err := ss.ChangeDefaultTunnels(tunnels("9124")); err != nil {
+		t.Fatalf("ShadowSocks.ChangeDefaultTunnels error: %v", err)
+	}
+	checkTunnel("127.0.0.1:9124", "tunnel after switching")
+	select {
+	case <-oldProc.Exited():
+		t.Fatalf("old ss process is killed but its tunnel ports are not used by the new one")
+	default:
+	}
+
+	// the old process listens on the tunnel port of the new one, so it's
+	// killed first
+	if err := ss.ChangeDefaultTunnels(tunnels("9123")); err != nil {
+		t.Fatalf("ShadowSocks.ChangeDefaultTunnels error: %v", err)
+	}
+	select {
+	case <-oldProc.Exited():
+	case <-time.After(3 * time.Second):
+		t.Fatalf("old ss process is not killed but its tunnel port is used by the new one")
+	}
+	checkTunnel("127.0.0.1:9123", "tunnel after switching back")
+}
@@ -0,0 +1,348 @@
+package core
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+// ssUpstreamAddr is the address which the socks ports of ss processes
+// listen on. They're only reached through the front, so they're not
+// exposed even if the front listens on a LAN address. So is the udp
+// relay of them, see ssFront.serveUDPAssociate.
+const ssUpstreamAddr = "127.0.0.1"
+
+const ssFrontUDPBufSize = 64 * 1024
+
+var (
+	// ssUpstreamDialTimeout is how long connecting to the socks port of
+	// ss process is retried, which may be starting.
+	ssUpstreamDialTimeout = 5 * time.Second
+	ssUpstreamDialRetry   = 50 * time.Millisecond
+)
+
+/*
+ssFront is the local socks port owned by ssctrl. It relays every
+connection to the socks port of the current ss process(the upstream),
+so the ss process can be replaced without closing the local port, and
+the connections through the old one are kept until they're finished.
+The socks5 requests are passed to the upstream by the front, which
+relays the udp of an udp association too, because the upstream only
+listens on loopback.
+*/
+type ssFront struct {
+	listenAddr string
+
+	lock     sync.Mutex
+	listener net.Listener
+	port     string
+	upstream *ssUpstream
+}
+
+// ssUpstream is the socks port of a ss process and the connections relayed to it.
+type ssUpstream struct {
+	port string
+
+	lock    sync.Mutex
+	conns   map[net.Conn]struct{}
+	retired bool
+	idleCh  chan struct{}
+}
+
+func newSSFront(listenAddr string) *ssFront {
+	return &ssFront{listenAddr: listenAddr}
+}
+
+// Listen makes f listen on port instead of the old one. The connections
+// accepted by the old port are not closed.
+func (f *ssFront) Listen(port string) error {
+	l, err := net.Listen("tcp", f.listenAddr+":"+port)
+	if err != nil {
+		return err
+	}
+
+	f.lock.Lock()
+	oldListener := f.listener
+	f.listener = l
+	f.port = port
+	f.lock.Unlock()
+
+	if oldListener != nil {
+		oldListener.Close()
+	}
+	go f.serve(l)
+	return nil
+}
+
+// Close stops listening, the connections being relayed are not closed.
+func (f *ssFront) Close() {
+	f.lock.Lock()
+	l := f.listener
+	f.listener = nil
+	f.lock.Unlock()
+
+	if l != nil {
+		l.Close()
+	}
+}
+
+// Port returns the port f listens on.
+func (f *ssFront) Port() string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.port
+}
+
+// SetUpstream relays new connections to the ss process listening on
+// port, and returns the old upstream, which gets no connection any more.
+// New connections are closed if port is empty.
+func (f *ssFront) SetUpstream(port string) *ssUpstream {
+	var u *ssUpstream
+	if len(port) != 0 {
+		u = &ssUpstream{
+			port:   port,
+			conns:  make(map[net.Conn]struct{}),
+			idleCh: make(chan struct{}),
+		}
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	old := f.upstream
+	f.upstream = u
+	if old != nil {
+		old.retire()
+	}
+	return old
+}
+
+// UpstreamPort returns the port of the current upstream.
+func (f *ssFront) UpstreamPort() string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.upstream == nil {
+		return ""
+	}
+	return f.upstream.port
+}
+
+func (f *ssFront) serve(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return
+		}
+
+		f.lock.Lock()
+		u := f.upstream
+		if u != nil {
+			u.add(conn)
+		}
+		f.lock.Unlock()
+
+		if u == nil {
+			conn.Close()
+			continue
+		}
+		go f.serveConn(conn, u)
+	}
+}
+
+func (f *ssFront) serveConn(conn net.Conn, u *ssUpstream) {
+	defer u.remove(conn)
+
+	remote, err := dialUpstream(net.JoinHostPort(ssUpstreamAddr, u.port))
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	deadline := time.Now().Add(socks5HandshakeTimeout)
+	conn.SetDeadline(deadline)
+	remote.SetDeadline(deadline)
+	cmd, addr, err := socks5Accept(conn)
+	if err != nil {
+		conn.Close()
+		remote.Close()
+		return
+	}
+	bound, err := socks5Request(remote, cmd, addr)
+	if err != nil {
+		socks5Reply(conn, err, nil)
+		conn.Close()
+		remote.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	remote.SetDeadline(time.Time{})
+
+	if cmd == socks.CmdUDPAssociate {
+		f.serveUDPAssociate(conn, remote, bound)
+		return
+	}
+	if err := socks5Reply(conn, nil, bound); err != nil {
+		conn.Close()
+		remote.Close()
+		return
+	}
+	relay(conn, remote)
+}
+
+// serveUDPAssociate relays the udp association of conn to the udp relay
+// of the upstream at bound. The upstream replies a loopback address
+// which can't be reached by the clients in LAN, so the front listens on
+// the address conn reaches, replies it instead, and relays the packets
+// between it and bound until conn is closed.
+func (f *ssFront) serveUDPAssociate(conn, remote net.Conn, bound socks.Addr) {
+	defer remote.Close()
+	defer conn.Close()
+
+	relayAddr, err := net.ResolveUDPAddr("udp", bound.String())
+	if err != nil {
+		socks5Reply(conn, socks.ErrGeneralFailure, nil)
+		return
+	}
+	if relayAddr.IP.IsUnspecified() {
+		relayAddr.IP = net.ParseIP(ssUpstreamAddr)
+	}
+	host, _, err := net.SplitHostPort(conn.LocalAddr().String())
+	if err != nil {
+		socks5Reply(conn, socks.ErrGeneralFailure, nil)
+		return
+	}
+	pc, err := net.ListenPacket("udp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		socks5Reply(conn, socks.ErrGeneralFailure, nil)
+		return
+	}
+	defer pc.Close()
+	if err := socks5Reply(conn, nil, socks.ParseAddr(pc.LocalAddr().String())); err != nil {
+		return
+	}
+
+	clientIP := conn.RemoteAddr().(*net.TCPAddr).IP
+	go relayUDP(pc, relayAddr, clientIP)
+
+	// the udp association ends when the tcp connection is closed
+	io.Copy(ioutil.Discard, conn)
+}
+
+// relayUDP sends the packets from clientIP to relayAddr, and the ones
+// from relayAddr back to the client, until pc is closed. Packets from
+// other addresses are dropped.
+func relayUDP(pc net.PacketConn, relayAddr *net.UDPAddr, clientIP net.IP) {
+	var client net.Addr
+	buf := make([]byte, ssFrontUDPBufSize)
+	for {
+		n, from, err := pc.ReadFrom(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+
+		if from.String() == relayAddr.String() {
+			if client != nil {
+				pc.WriteTo(buf[:n], client)
+			}
+			continue
+		}
+		if ua, ok := from.(*net.UDPAddr); !ok || !ua.IP.Equal(clientIP) {
+			continue
+		}
+		client = from
+		pc.WriteTo(buf[:n], relayAddr)
+	}
+}
+
+// dialUpstream connects to addr, and retries in ssUpstreamDialTimeout
+// because the ss process may be starting.
+func dialUpstream(addr string) (net.Conn, error) {
+	deadline := time.Now().Add(ssUpstreamDialTimeout)
+	for {
+		conn, err := net.DialTimeout("tcp", addr, ssUpstreamDialTimeout)
+		if err == nil || time.Now().Add(ssUpstreamDialRetry).After(deadline) {
+			return conn, err
+		}
+		time.Sleep(ssUpstreamDialRetry)
+	}
+}
+
+func (u *ssUpstream) add(conn net.Conn) {
+	u.lock.Lock()
+	u.conns[conn] = struct{}{}
+	u.lock.Unlock()
+}
+
+func (u *ssUpstream) remove(conn net.Conn) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	delete(u.conns, conn)
+	if u.retired && len(u.conns) == 0 {
+		u.closeIdle()
+	}
+}
+
+// retire marks u gets no new connection, and Idle is closed once the
+// connections of u are finished.
+func (u *ssUpstream) retire() {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	u.retired = true
+	if len(u.conns) == 0 {
+		u.closeIdle()
+	}
+}
+
+// closeIdle closes idleCh once, u.lock must be held.
+func (u *ssUpstream) closeIdle() {
+	select {
+	case <-u.idleCh:
+	default:
+		close(u.idleCh)
+	}
+}
+
+// Idle is closed when u is retired and has no connection.
+func (u *ssUpstream) Idle() <-chan struct{} {
+	return u.idleCh
+}
+
+// CloseConns closes the connections relayed to u.
+func (u *ssUpstream) CloseConns() {
+	u.lock.Lock()
+	conns := make([]net.Conn, 0, len(u.conns))
+	for conn := range u.conns {
+		conns = append(conns, conn)
+	}
+	u.lock.Unlock()
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+// freePort returns a tcp port of addr which is not in use now.
+func freePort(addr string) (string, error) {
+	l, err := net.Listen("tcp", addr+":0")
+	if err != nil {
+		return "", err
+	}
+	defer l.Close()
+
+	_, port, err := net.SplitHostPort(l.Addr().String())
+	return port, err
+}
@@ -0,0 +1,236 @@
+package core
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fatcat22/ssctrl/common"
+)
+
+var (
+	DefaultSSLogPath = filepath.Join(common.HomeDir(), ".ssctrl", "ss2.log")
+)
+
+var (
+	// The log file is rotated if it's larger than ssLogMaxSize, or it
+	// has been written longer than ssLogMaxAge(counted from the
+	// modification time of an existing file, so restarting ssctrl does not
+	// reset it). ssLogMaxBackups old files are kept as ss2.log.1, ss2.log.2
+	// and so on.
+	ssLogMaxSize    int64 = 10 * 1024 * 1024
+	ssLogMaxAge           = 24 * time.Hour
+	ssLogMaxBackups       = 3
+
+	// ssLogMemLines is the number of the latest lines kept in memory.
+	ssLogMemLines = 500
+	// ssLogFollowBuffer is the number of lines buffered for a follower,
+	// lines are dropped if a follower can not keep up.
+	ssLogFollowBuffer = 256
+)
+
+/*
+SSLog saves the output of ss process to a rotated log file, keeps the
+latest lines in memory and sends new lines to followers. The log file is
+opened on writing and is disabled if path is empty.
+*/
+type SSLog struct {
+	path string
+
+	lock     sync.Mutex
+	file     *os.File
+	size     int64
+	openTime time.Time
+	// openErr is the last error of opening the log file,
+	// which is logged once until the file is opened.
+	openErr string
+
+	lines     []string
+	followers map[chan string]struct{}
+}
+
+func NewSSLog(path string) *SSLog {
+	return &SSLog{
+		path:      path,
+		followers: make(map[chan string]struct{}),
+	}
+}
+
+// WriteLine saves line(without line break) to the log.
+func (sl *SSLog) WriteLine(line string) {
+	sl.lock.Lock()
+	defer sl.lock.Unlock()
+
+	sl.writeFile(line + "\n")
+
+	if len(sl.lines) < ssLogMemLines {
+		sl.lines = append(sl.lines, line)
+	} else if ssLogMemLines > 0 {
+		copy(sl.lines, sl.lines[1:])
+		sl.lines[len(sl.lines)-1] = line
+	}
+
+	for ch := range sl.followers {
+		select {
+		case ch <- line:
+		default:
+		}
+	}
+}
+
+// readLines writes every line read from r to the log until EOF.
+func (sl *SSLog) readLines(r io.Reader) {
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadString('\n')
+		if len(line) != 0 {
+			sl.WriteLine(trimLineBreak(line))
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Lines returns the latest n lines in memory, or all of them if n <= 0.
+func (sl *SSLog) Lines(n int) []string {
+	sl.lock.Lock()
+	defer sl.lock.Unlock()
+
+	return sl.latestLines(n)
+}
+
+// Follow returns the latest n lines like Lines, and a channel receiving
+// the lines written after them. cancel must be called to stop following.
+func (sl *SSLog) Follow(n int) (lines []string, ch <-chan string, cancel func()) {
+	sl.lock.Lock()
+	defer sl.lock.Unlock()
+
+	c := make(chan string, ssLogFollowBuffer)
+	sl.followers[c] = struct{}{}
+	var once sync.Once
+	cancel = func() {
+		once.Do(func() {
+			sl.lock.Lock()
+			delete(sl.followers, c)
+			sl.lock.Unlock()
+		})
+	}
+
+	return sl.latestLines(n), c, cancel
+}
+
+// Close closes the log file, which is opened again on next writing.
+func (sl *SSLog) Close() error {
+	sl.lock.Lock()
+	defer sl.lock.Unlock()
+
+	return sl.closeFile()
+}
+
+func (sl *SSLog) latestLines(n int) []string {
+	if n <= 0 || n > len(sl.lines) {
+		n = len(sl.lines)
+	}
+	return append([]string(nil), sl.lines[len(sl.lines)-n:]...)
+}
+
+func (sl *SSLog) writeFile(data string) {
+	if len(sl.path) == 0 {
+		return
+	}
+
+	if sl.file != nil && sl.size > 0 &&
+		(sl.size+int64(len(data)) > ssLogMaxSize || time.Since(sl.openTime) > ssLogMaxAge) {
+		sl.rotate()
+	}
+	if sl.file == nil {
+		if err := sl.openFile(); err != nil {
+			if err.Error() != sl.openErr {
+				sl.openErr = err.Error()
+				log.Printf("open shadowsocks log file error: %v\n", err)
+			}
+			return
+		}
+		sl.openErr = ""
+	}
+
+	n, err := sl.file.WriteString(data)
+	sl.size += int64(n)
+	if err != nil {
+		log.Printf("write shadowsocks log file error: %v\n", err)
+		sl.closeFile()
+	}
+}
+
+func (sl *SSLog) openFile() error {
+	// an existing file may be too old already
+	if fi, err := os.Stat(sl.path); err == nil && fi.Size() > 0 && time.Since(fi.ModTime()) > ssLogMaxAge {
+		sl.rotate()
+	}
+
+	file, err := os.OpenFile(sl.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	sl.file = file
+	sl.size = fi.Size()
+	sl.openTime = time.Now()
+	if sl.size > 0 && fi.ModTime().Before(sl.openTime) {
+		sl.openTime = fi.ModTime()
+	}
+	return nil
+}
+
+func (sl *SSLog) closeFile() error {
+	if sl.file == nil {
+		return nil
+	}
+
+	err := sl.file.Close()
+	sl.file = nil
+	sl.size = 0
+	return err
+}
+
+// rotate renames the log file to path.1 after renaming path.1 to path.2
+// and so on, the oldest backup path.<ssLogMaxBackups> is overwritten.
+func (sl *SSLog) rotate() {
+	sl.closeFile()
+
+	if ssLogMaxBackups <= 0 {
+		os.Remove(sl.path)
+		return
+	}
+	for i := ssLogMaxBackups - 1; i > 0; i-- {
+		os.Rename(sl.backupPath(i), sl.backupPath(i+1))
+	}
+	if err := os.Rename(sl.path, sl.backupPath(1)); err != nil {
+		log.Printf("rotate shadowsocks log file error: %v\n", err)
+	}
+}
+
+func (sl *SSLog) backupPath(i int) string {
+	return fmt.Sprintf("%s.%d", sl.path, i)
+}
+
+func trimLineBreak(line string) string {
+	if n := len(line); n > 0 && line[n-1] == '\n' {
+		line = line[:n-1]
+		if n := len(line); n > 0 && line[n-1] == '\r' {
+			line = line[:n-1]
+		}
+	}
+	return line
+}
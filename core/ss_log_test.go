@@ -0,0 +1,144 @@
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSSLogLines(t *testing.T) {
+	oldMemLines := ssLogMemLines
+	ssLogMemLines = 3
+	defer func() { ssLogMemLines = oldMemLines }()
+
+	sl := NewSSLog("")
+	sl.readLines(strings.NewReader("line1\nline2\r\nline3\nline4\nline5"))
+
+	if lines := sl.Lines(0); !reflect.DeepEqual(lines, []string{"line3", "line4", "line5"}) {
+		t.Errorf("expect the latest 3 lines but got %v", lines)
+	}
+	if lines := sl.Lines(2); !reflect.DeepEqual(lines, []string{"line4", "line5"}) {
+		t.Errorf("expect the latest 2 lines but got %v", lines)
+	}
+
+	lines, ch, cancel := sl.Follow(1)
+	if !reflect.DeepEqual(lines, []string{"line5"}) {
+		t.Errorf("expect the latest line when following but got %v", lines)
+	}
+	sl.WriteLine("line6")
+	if line := <-ch; line != "line6" {
+		t.Errorf("expect followed line 'line6' but got '%s'", line)
+	}
+	cancel()
+	sl.WriteLine("line7")
+	select {
+	case line := <-ch:
+		t.Errorf("receive line '%s' after canceling following", line)
+	default:
+	}
+}
+
+func TestSSLogRotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssctrl_sslog")
+	if err != nil {
+		t.Fatalf("create temp dir error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldMaxSize, oldMaxAge, oldMaxBackups := ssLogMaxSize, ssLogMaxAge, ssLogMaxBackups
+	ssLogMaxSize, ssLogMaxAge, ssLogMaxBackups = 12, time.Hour, 2
+	defer func() {
+		ssLogMaxSize, ssLogMaxAge, ssLogMaxBackups = oldMaxSize, oldMaxAge, oldMaxBackups
+	}()
+
+	path := filepath.Join(dir, "ss2.log")
+	sl := NewSSLog(path)
+	defer sl.Close()
+
+	checkFile := func(path, expect string) {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Errorf("read log file '%s' error: %v", path, err)
+			return
+		}
+		if string(data) != expect {
+			t.Errorf("expect '%s' in log file '%s' but got '%s'", expect, path, data)
+		}
+	}
+
+	// rotated by size
+	for _, line := range []string{"line1", "line2", "line3", "line4", "line5", "line6", "line7"} {
+		sl.WriteLine(line)
+	}
+	checkFile(path, "line7\n")
+	checkFile(path+".1", "line5\nline6\n")
+	checkFile(path+".2", "line3\nline4\n")
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("expect at most 2 backups but '%s' exists", path+".3")
+	}
+
+	// appended after reopening
+	sl.Close()
+	ssLogMaxSize = 1024
+	sl.WriteLine("line8")
+	checkFile(path, "line7\nline8\n")
+
+	// rotated by age
+	ssLogMaxAge = time.Millisecond
+	time.Sleep(10 * time.Millisecond)
+	sl.WriteLine("line9")
+	checkFile(path, "line9\n")
+	checkFile(path+".1", "line7\nline8\n")
+
+	// the age of an existing file is counted from its modification time
+	sl.Close()
+	ssLogMaxAge = time.Hour
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatalf("change times of log file error: %v", err)
+	}
+	sl.WriteLine("line10")
+	checkFile(path, "line10\n")
+	checkFile(path+".1", "line9\n")
+}
+
+func TestSSProcessOutput(t *testing.T) {
+	shPath := "/bin/sh"
+	if _, err := os.Stat(shPath); err != nil {
+		t.Skipf("'%s' is not found", shPath)
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("create pipe error: %v", err)
+	}
+	attr := &os.ProcAttr{Files: []*os.File{os.Stdin, w, w}}
+	proc, err := os.StartProcess(shPath, []string{shPath, "-c", "echo hello; echo crash >&2; exit 3"}, attr)
+	w.Close()
+	if err != nil {
+		r.Close()
+		t.Fatalf("start process error: %v", err)
+	}
+
+	sl := NewSSLog("")
+	ssp := newSSProcessImpl(proc, r, sl)
+	select {
+	case <-ssp.Exited():
+	case <-time.After(3 * time.Second):
+		t.Fatalf("wait process exiting timeout")
+	}
+
+	if ssp.ExitStatus() != "exit status 3" {
+		t.Errorf("expect exit status 'exit status 3' but got '%s'", ssp.ExitStatus())
+	}
+	if lines := sl.Lines(0); !reflect.DeepEqual(lines, []string{"hello", "crash"}) {
+		t.Errorf("expect the output of process in log but got %v", lines)
+	}
+	if err := ssp.Kill(); err != nil {
+		t.Errorf("kill exited process error: %v", err)
+	}
+}
@@ -2,51 +2,128 @@ package core
 
 import (
 	"os"
+	"sync"
 
 	"github.com/fatcat22/ssctrl/config"
 )
 
 type ssProcess interface {
 	Kill() error
+	// Exited is closed when the process exits, including being killed.
+	Exited() <-chan struct{}
+	// ExitStatus tells how the process exited, it's valid after Exited is closed.
+	ExitStatus() string
 }
 
 type ssProcessImpl struct {
 	proc *os.Process
+
+	exited     chan struct{}
+	exitStatus string
+}
+
+// newSSProcessImpl supervises proc whose stdout and stderr are written
+// to output. Lines read from output are saved to ssLog, and the process
+// is taken as exited after all its output is saved.
+func newSSProcessImpl(proc *os.Process, output *os.File, ssLog *SSLog) *ssProcessImpl {
+	ssp := &ssProcessImpl{
+		proc:   proc,
+		exited: make(chan struct{}),
+	}
+
+	logDone := make(chan struct{})
+	go func() {
+		defer close(logDone)
+		ssLog.readLines(output)
+		output.Close()
+	}()
+
+	go func() {
+		state, err := proc.Wait()
+		<-logDone
+		if err != nil {
+			ssp.exitStatus = err.Error()
+		} else {
+			ssp.exitStatus = state.String()
+		}
+		close(ssp.exited)
+	}()
+
+	return ssp
 }
 
 func (ssp *ssProcessImpl) Kill() error {
-	if ssp.proc == nil {
+	select {
+	case <-ssp.exited:
 		return nil
+	default:
 	}
 
 	if err := ssp.proc.Kill(); err != nil {
-		return err
+		// the process may exit by itself in the meantime
+		select {
+		case <-ssp.exited:
+			return nil
+		default:
+			return err
+		}
 	}
-	ssp.proc.Wait() // don't care aboult return value of wait
-
-	ssp.proc = nil
+	<-ssp.exited
 	return nil
 }
 
+func (ssp *ssProcessImpl) Exited() <-chan struct{} {
+	return ssp.exited
+}
+
+func (ssp *ssProcessImpl) ExitStatus() string {
+	return ssp.exitStatus
+}
+
 type ssProcessMock struct {
 	localAddr string
 	localPort string
 	srvCfg    config.ServerConfig
+	tunnels   config.TunnelConfig
 
 	killed bool
+
+	exited     chan struct{}
+	exitStatus string
+	exitOnce   sync.Once
 }
 
-func newSSProcessMock(localAddr, localPort string, srvCfg config.ServerConfig) (ssProcess, error) {
+func newSSProcessMock(localAddr, localPort string, srvCfg config.ServerConfig, tunnels config.TunnelConfig) (ssProcess, error) {
 	return &ssProcessMock{
 		localAddr: localAddr,
 		localPort: localPort,
 		srvCfg:    srvCfg,
+		tunnels:   tunnels,
 
 		killed: false,
+
+		exited: make(chan struct{}),
 	}, nil
 }
 
 func (ssm *ssProcessMock) Kill() error {
 	ssm.killed = true
+	ssm.exit("signal: killed")
 	return nil
 }
+
+func (ssm *ssProcessMock) Exited() <-chan struct{} {
+	return ssm.exited
+}
+
+func (ssm *ssProcessMock) ExitStatus() string {
+	return ssm.exitStatus
+}
+
+// exit makes the mock process exit with status as if it crashed.
+func (ssm *ssProcessMock) exit(status string) {
+	ssm.exitOnce.Do(func() {
+		ssm.exitStatus = status
+		close(ssm.exited)
+	})
+}
@@ -0,0 +1,275 @@
+package core
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/fatcat22/ssctrl/config"
+)
+
+// setSSRestartOptions changes the restart options of ss process and
+// returns a function restoring them.
+func setSSRestartOptions(delay time.Duration, limit int) func() {
+	oldDelay, oldMaxDelay := ssRestartDelay, ssMaxRestartDelay
+	oldLimit, oldWindow := ssCrashLoopLimit, ssCrashLoopWindow
+	ssRestartDelay, ssMaxRestartDelay = delay, 4*delay
+	ssCrashLoopLimit, ssCrashLoopWindow = limit, time.Minute
+	return func() {
+		ssRestartDelay, ssMaxRestartDelay = oldDelay, oldMaxDelay
+		ssCrashLoopLimit, ssCrashLoopWindow = oldLimit, oldWindow
+	}
+}
+
+func currentSSProcMock(ss *ShadowSocks) *ssProcessMock {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+
+	if ss.proc == nil {
+		return nil
+	}
+	return ss.proc.(*ssProcessMock)
+}
+
+// waitSSRestarted waits until oldProc is replaced by a new ss process.
+func waitSSRestarted(t *testing.T, ss *ShadowSocks, oldProc *ssProcessMock) {
+	deadline := time.Now().Add(2 * time.Second)
+	for currentSSProcMock(ss) == oldProc {
+		if time.Now().After(deadline) {
+			t.Fatal("ss process is not restarted after crash")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// waitSSStatus waits until the state of ss is state and returns the status.
+func waitSSStatus(t *testing.T, ss *ShadowSocks, state string) SSStatus {
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		status := ss.Status()
+		if status.State == state {
+			return status
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expect ss state '%s' but got '%s'", state, status.State)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestShadowSocksRestartOnCrash(t *testing.T) {
+	defer setSSRestartOptions(10*time.Millisecond, 5)()
+
+	srvCfg := config.ServerConfig{Address: "11.22.33.44", Port: "8899", Crypt: config.Crypt_AEAD_AES_128_GCM, Password: "pwd"}
+	ss, err := NewShadowSocks("", "", "", "127.0.0.1", "9110", srvCfg, config.TunnelConfig{}, 0)
+	if err != nil {
+		t.Fatalf("NewShadowSocks error: %v", err)
+	}
+	if status := ss.Status(); status.State != SSStateStopped {
+		t.Errorf("expect state '%s' before startup but got '%s'", SSStateStopped, status.State)
+	}
+	if err := ss.Startup(); err != nil {
+		t.Fatalf("ShadowSocks.Startup error: %v", err)
+	}
+	defer ss.Shutdown()
+
+	for i := 1; i <= 3; i++ {
+		oldProc := currentSSProcMock(ss)
+		oldProc.exit("exit status 2")
+		waitSSRestarted(t, ss, oldProc)
+
+		status := waitSSStatus(t, ss, SSStateRunning)
+		if status.Restarts != i {
+			t.Errorf("expect %d restarts but got %d", i, status.Restarts)
+		}
+		if status.LastExit != "exit status 2" {
+			t.Errorf("expect last exit 'exit status 2' but got '%s'", status.LastExit)
+		}
+		if newProc := currentSSProcMock(ss); newProc.localPort != ss.front.UpstreamPort() || newProc.srvCfg != srvCfg {
+			t.Errorf("restarted ss process has wrong config: %s %v", newProc.localPort, newProc.srvCfg)
+		}
+	}
+
+	// killed on purpose is not a crash
+	if err := ss.ChangeLocalPort("9111"); err != nil {
+		t.Fatalf("ShadowSocks.ChangeLocalPort error: %v", err)
+	}
+	proc := currentSSProcMock(ss)
+	if err := ss.Shutdown(); err != nil {
+		t.Fatalf("ShadowSocks.Shutdown error: %v", err)
+	}
+	if !proc.killed {
+		t.Error("ss process is not killed after shutdown")
+	}
+	time.Sleep(50 * time.Millisecond)
+	status := ss.Status()
+	if status.State != SSStateStopped {
+		t.Errorf("expect state '%s' after shutdown but got '%s'", SSStateStopped, status.State)
+	}
+	if status.Restarts != 3 {
+		t.Errorf("expect 3 restarts after shutdown but got %d", status.Restarts)
+	}
+}
+
+func TestShadowSocksCrashLoop(t *testing.T) {
+	const limit = 2
+	defer setSSRestartOptions(5*time.Millisecond, limit)()
+
+	ss, err := NewShadowSocks("", "", "", "127.0.0.1", "9112", config.ServerConfig{}, config.TunnelConfig{}, 0)
+	if err != nil {
+		t.Fatalf("NewShadowSocks error: %v", err)
+	}
+	if err := ss.Startup(); err != nil {
+		t.Fatalf("ShadowSocks.Startup error: %v", err)
+	}
+	defer ss.Shutdown()
+
+	for i := 0; i <= limit; i++ {
+		proc := currentSSProcMock(ss)
+		proc.exit("signal: segmentation fault")
+		if i < limit {
+			waitSSRestarted(t, ss, proc)
+		}
+	}
+
+	status := waitSSStatus(t, ss, SSStateFailed)
+	if status.Restarts != limit {
+		t.Errorf("expect %d restarts but got %d", limit, status.Restarts)
+	}
+	if status.LastExit != "signal: segmentation fault" {
+		t.Errorf("expect last exit 'signal: segmentation fault' but got '%s'", status.LastExit)
+	}
+
+	// starting a new process makes it supervised again
+	if err := ss.ChangeServerConfig(config.ServerConfig{Address: "11.22.33.44"}); err != nil {
+		t.Fatalf("ShadowSocks.ChangeServerConfig error: %v", err)
+	}
+	waitSSStatus(t, ss, SSStateRunning)
+}
+
+func TestSSArgs(t *testing.T) {
+	srvCfg := config.ServerConfig{
+		Address:    "11.22.33.44",
+		Port:       "443",
+		Crypt:      config.Crypt_AEAD_AES_128_GCM,
+		Password:   "yourpwd",
+		Plugin:     "v2ray-plugin",
+		PluginOpts: "tls;host=www.example.com",
+	}
+	tunnels := config.TunnelConfig{
+		UDPRelay:   true,
+		TCPTunnels: []string{":84=8.8.8.8:80", ":8053=8.8.8.8:53"},
+	}
+
+	expect := []string{
+		"ss", "-c", "ss://AEAD_AES_128_GCM:yourpwd@11.22.33.44:443", "-socks", "127.0.0.1:1080",
+		"-plugin", "v2ray-plugin", "-plugin-opts", "tls;host=www.example.com",
+		"-u", "-tcptun", ":84=8.8.8.8:80,:8053=8.8.8.8:53",
+	}
+	if argv := ssArgs("ss", "127.0.0.1", "1080", srvCfg, tunnels); !reflect.DeepEqual(argv, expect) {
+		t.Errorf("expect ss args %v but got %v", expect, argv)
+	}
+
+	srvCfg.PluginPath = "/usr/local/bin/obfs-local"
+	srvCfg.PluginOpts = ""
+	expect = []string{
+		"ss", "-c", "ss://AEAD_AES_128_GCM:yourpwd@11.22.33.44:443", "-socks", "127.0.0.1:1080",
+		"-plugin", "/usr/local/bin/obfs-local",
+	}
+	if argv := ssArgs("ss", "127.0.0.1", "1080", srvCfg, config.TunnelConfig{}); !reflect.DeepEqual(argv, expect) {
+		t.Errorf("expect ss args %v but got %v", expect, argv)
+	}
+}
+
+func TestShadowSocksChangePlugin(t *testing.T) {
+	isOnTest = true
+	srvCfg := config.ServerConfig{
+		Address:  "11.22.33.44",
+		Port:     "443",
+		Crypt:    config.Crypt_AEAD_AES_128_GCM,
+		Password: "yourpwd",
+	}
+	ss, err := NewShadowSocks("", "", "", "127.0.0.1", "9114", srvCfg, config.TunnelConfig{}, 0)
+	if err != nil {
+		t.Fatalf("NewShadowSocks error: %v", err)
+	}
+	if err := ss.Startup(); err != nil {
+		t.Fatalf("ShadowSocks.Startup error: %v", err)
+	}
+	defer ss.Shutdown()
+
+	oldProc := currentSSProcMock(ss)
+	srvCfg.Plugin = "obfs-local"
+	srvCfg.PluginOpts = "obfs=http"
+	if err := ss.ChangeServerConfig(srvCfg); err != nil {
+		t.Fatalf("ShadowSocks.ChangeServerConfig error: %v", err)
+	}
+	newProc := currentSSProcMock(ss)
+	if newProc == oldProc || !oldProc.killed {
+		t.Errorf("expect ss process restarted after changing plugin")
+	}
+	if newProc.srvCfg != srvCfg {
+		t.Errorf("expect ss server %v but got %v", srvCfg, newProc.srvCfg)
+	}
+}
+
+func TestTunnelsConflict(t *testing.T) {
+	tcp := config.TunnelConfig{TCPTunnels: []string{"127.0.0.1:5353=8.8.8.8:53"}}
+	udp := config.TunnelConfig{UDPTunnels: []string{"127.0.0.1:5353=8.8.8.8:53"}}
+	relay := config.TunnelConfig{UDPRelay: true}
+	otherTCP := config.TunnelConfig{TCPTunnels: []string{"127.0.0.1:5354=8.8.8.8:53", ":84=8.8.8.8:80"}}
+	otherUDP := config.TunnelConfig{UDPTunnels: []string{":5354=8.8.8.8:53"}}
+	bothTCP := config.TunnelConfig{TCPTunnels: []string{":5354=8.8.4.4:53", ":5353=8.8.4.4:53"}}
+
+	tests := []struct {
+		a, b     config.TunnelConfig
+		conflict bool
+	}{
+		{config.TunnelConfig{}, config.TunnelConfig{}, false},
+		{tcp, tcp, true},
+		{udp, udp, true},
+		{tcp, udp, false},
+		{relay, config.TunnelConfig{}, false},
+		{relay, relay, false},
+		{tcp, otherTCP, false},
+		{udp, otherUDP, false},
+		{tcp, bothTCP, true},
+		{otherTCP, bothTCP, true},
+		{udp, bothTCP, false},
+	}
+	for _, test := range tests {
+		if conflict := tunnelsConflict(test.a, test.b); conflict != test.conflict {
+			t.Errorf("expect tunnels %v and %v conflict %v but got %v", test.a, test.b, test.conflict, conflict)
+		}
+	}
+}
+
+func TestSSListening(t *testing.T) {
+	oldTimeout, oldRetry := ssUpstreamDialTimeout, ssUpstreamDialRetry
+	ssUpstreamDialTimeout, ssUpstreamDialRetry = 200*time.Millisecond, 20*time.Millisecond
+	defer func() { ssUpstreamDialTimeout, ssUpstreamDialRetry = oldTimeout, oldRetry }()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	addr := l.Addr().String()
+
+	proc, _ := newSSProcessMock("127.0.0.1", "", config.ServerConfig{}, config.TunnelConfig{})
+	if !ssListening(proc, addr) {
+		t.Errorf("expect %s listened", addr)
+	}
+
+	// the port taken by others is not listened by proc
+	l.Close()
+	if ssListening(proc, addr) {
+		t.Errorf("expect %s not listened", addr)
+	}
+
+	// an exited process is left to the supervisor
+	proc.Kill()
+	if !ssListening(proc, addr) {
+		t.Errorf("expect an exited process taken as listening")
+	}
+}
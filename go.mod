@@ -5,4 +5,7 @@ go 1.13
 require (
 	github.com/kardianos/service v1.0.0
 	github.com/pelletier/go-toml v1.6.0
+	github.com/robertkrimen/otto v0.2.1
+	github.com/shadowsocks/go-shadowsocks2 v0.1.5
+	golang.org/x/crypto v0.0.0-20211117183948-ae814b36b871 // indirect
 )
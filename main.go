@@ -19,7 +19,30 @@ func main() {
 	}
 
 	_, srvCfg := cfg.GetCurrentServerConfig()
-	core, err := core.NewProxyCore(cfg.GetPACPort(), "", cfg.GetLocalPort(), cfg.GetMode(), srvCfg, "")
+	_, pacProfile := cfg.GetCurrentPACProfile()
+	core, err := core.NewProxyCore(core.ProxyCoreConfig{
+		PACPort:      cfg.GetPACPort(),
+		LocalAddr:    cfg.GetLocalAddress(),
+		LocalPort:    cfg.GetLocalPort(),
+		HTTPPort:     cfg.GetHTTPPort(),
+		RulePort:     cfg.GetRulePort(),
+		Mode:         cfg.GetMode(),
+		Server:       srvCfg,
+		Tunnels:      cfg.GetTunnels(),
+		GFWList:      cfg.GetGFWListConfig(),
+		FailOpen:     cfg.GetFailOpenConfig(),
+		DrainTimeout: cfg.GetDrainTimeout(),
+		SSBackend:    cfg.GetSSBackend(),
+	}, core.PACOptions{
+		PACFile:        pacProfile.File,
+		UserRules:      pacProfile.Rules,
+		AllowedClients: cfg.GetAllowedClients(),
+		Bypass:         cfg.GetBypass(),
+		IPRules:        cfg.GetIPRulesConfig(),
+		Strategy:       cfg.GetPACStrategy(),
+		WhitelistFile:  cfg.GetWhitelistFile(),
+		Template:       cfg.GetPACTemplate(),
+	})
 	if err != nil {
 		fmt.Printf("%v\n", err)
 		os.Exit(1)
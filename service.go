@@ -28,7 +28,7 @@ func NewSSService() (*SSService, error) {
 		return nil, err
 	}
 
-	exitCh := make(chan os.Signal)
+	exitCh := make(chan os.Signal, 1)
 	signal.Notify(exitCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGKILL)
 
 	return &SSService{